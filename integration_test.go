@@ -0,0 +1,124 @@
+//go:build integration
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/roicp/aws-sg-updater/sgupdater"
+)
+
+// TestLocalStackSync syncs a group created in LocalStack, reached through
+// --endpoint-url, twice: once to authorize a first address and once after it
+// changed. Run it with LocalStack listening on LOCALSTACK_ENDPOINT, by default
+// http://localhost:4566:
+//
+//	go test -tags integration -run LocalStack .
+func TestLocalStackSync(t *testing.T) {
+	endpoint := cmp.Or(os.Getenv("LOCALSTACK_ENDPOINT"), "http://localhost:4566")
+
+	// LocalStack accepts any credentials, but the SDK needs some to sign with.
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	cfg, err := loadAWSConfig(ctx, "", "us-east-1", endpointOptions{URL: endpoint}, apiCallOptions{MaxRetries: 2, RetryMode: "standard"}, assumeRoleOptions{})
+	if err != nil {
+		t.Fatalf("loadAWSConfig() error = %v", err)
+	}
+
+	client := ec2.NewFromConfig(cfg)
+
+	vpc, err := client.CreateVpc(ctx, &ec2.CreateVpcInput{CidrBlock: aws.String("10.42.0.0/16")})
+	if err != nil {
+		t.Fatalf("CreateVpc() error = %v (is LocalStack running on %s?)", err, endpoint)
+	}
+
+	t.Cleanup(func() {
+		_, _ = client.DeleteVpc(context.Background(), &ec2.DeleteVpcInput{VpcId: vpc.Vpc.VpcId})
+	})
+
+	group, err := client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String("sg-updater-integration"),
+		Description: aws.String("aws-sg-updater integration test"),
+		VpcId:       vpc.Vpc.VpcId,
+	})
+	if err != nil {
+		t.Fatalf("CreateSecurityGroup() error = %v", err)
+	}
+
+	sgID := aws.ToString(group.GroupId)
+
+	t.Cleanup(func() {
+		_, _ = client.DeleteSecurityGroup(context.Background(), &ec2.DeleteSecurityGroupInput{GroupId: aws.String(sgID)})
+	})
+
+	const description = "integration-test"
+
+	sync := func(cidr string) {
+		t.Helper()
+
+		result, err := sgupdater.Sync(ctx, cfg, sgupdater.Options{
+			Target: sgupdater.Target{
+				Description: description,
+				Rule:        sgupdater.RuleSpec{Protocol: "tcp", FromPort: aws.Int32(22), ToPort: aws.Int32(22)},
+				SgIDs:       []string{sgID},
+			},
+			TargetCidrs: []string{cidr},
+		})
+		if err != nil {
+			t.Fatalf("Sync(%s) error = %v", cidr, err)
+		}
+
+		if len(result.Errors) > 0 {
+			t.Fatalf("Sync(%s) failed: %v", cidr, result.Errors)
+		}
+	}
+
+	// rules lists the group's ingress rules as "cidr description".
+	rules := func() []string {
+		t.Helper()
+
+		out, err := client.DescribeSecurityGroupRules(ctx, &ec2.DescribeSecurityGroupRulesInput{
+			Filters: []types.Filter{{Name: aws.String("group-id"), Values: []string{sgID}}},
+		})
+		if err != nil {
+			t.Fatalf("DescribeSecurityGroupRules() error = %v", err)
+		}
+
+		var rules []string
+
+		for _, rule := range out.SecurityGroupRules {
+			if !aws.ToBool(rule.IsEgress) {
+				rules = append(rules, aws.ToString(rule.CidrIpv4)+" "+aws.ToString(rule.Description))
+			}
+		}
+
+		return rules
+	}
+
+	sync("203.0.113.10/32")
+
+	if got, want := rules(), []string{"203.0.113.10/32 " + description}; !slices.Equal(got, want) {
+		t.Fatalf("rules after the first sync = %q, want %q", got, want)
+	}
+
+	sync("203.0.113.20/32")
+
+	if got, want := rules(), []string{"203.0.113.20/32 " + description}; !slices.Equal(got, want) {
+		t.Fatalf("rules after the IP changed = %q, want %q (the old rule must be gone)", got, want)
+	}
+}
@@ -1,439 +1,7550 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	"github.com/aws/smithy-go"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/roicp/aws-sg-updater/sgupdater"
+	"gopkg.in/yaml.v3"
 )
 
+// Process exit codes.
 const (
-	ipServiceURL = "https://checkip.amazonaws.com/"
+	exitOK = 0
+	// exitFatal means the run could not start: invalid options, no public IP,
+	// credentials or Security Group resolution failed.
+	exitFatal          = 1
+	exitPartialFailure = 2
+	exitAllFailed      = 3
+	// exitChangesNeeded is used by --check when a rule is out of date.
+	exitChangesNeeded = 4
+	// exitConnectFailed means every group synced but a --test-connect target could
+	// not be reached.
+	exitConnectFailed = 5
 )
 
-func getPublicIP() (string, error) {
-	resp, err := http.Get(ipServiceURL)
+const (
+	ipServiceTimeout = 5 * time.Second
+	notifyTimeout    = 10 * time.Second
+	pingTimeout      = 5 * time.Second
+	// metricsTimeout bounds publishing every CloudWatch metric of a run, so an
+	// unreachable endpoint barely delays it.
+	metricsTimeout  = 2 * time.Second
+	watchRetryDelay = 15 * time.Second
+	// serverShutdownTimeout bounds waiting for in-flight /update requests on shutdown.
+	serverShutdownTimeout = 30 * time.Second
+)
+
+// setupLogging installs the default slog logger writing to stderr at level, as text
+// or JSON.
+func setupLogging(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid --log-level '%s': use debug, info, warn or error", level)
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, handlerOptions)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(logOutput, handlerOptions)))
+	default:
+		return fmt.Errorf("invalid --log-format '%s': use text or json", format)
+	}
+
+	return nil
+}
+
+// statusLine is the stderr the logs are written to. On a terminal it can keep a
+// status line, e.g. the sync progress, under the logs: each log record clears it
+// and draws it again after itself.
+type statusLine struct {
+	mu     sync.Mutex
+	out    io.Writer
+	status string
+}
+
+var logOutput = &statusLine{out: os.Stderr}
+
+func (s *statusLine) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status == "" {
+		return s.out.Write(p)
+	}
+
+	fmt.Fprint(s.out, "\r\x1b[K")
+	n, err := s.out.Write(p)
+	fmt.Fprint(s.out, s.status)
+
+	return n, err
+}
+
+// setStatus replaces the status line; an empty one clears it.
+func (s *statusLine) setStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status == "" && status == "" {
+		return
+	}
+
+	s.status = status
+	fmt.Fprint(s.out, "\r\x1b[K"+status)
+}
+
+// fatal logs msg at error level and exits with exitFatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitFatal)
+}
+
+var (
+	ipv4ServiceURLs = []string{"https://checkip.amazonaws.com/", "https://icanhazip.com/", "https://api.ipify.org/"}
+	ipv6ServiceURLs = []string{"https://api6.ipify.org/", "https://icanhazip.com/"}
+)
+
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// rawListFlag is a repeatable flag whose values may themselves contain commas, so
+// its environment variable is taken as a single value rather than split.
+type rawListFlag []string
+
+func (s *rawListFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *rawListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// colorMode is the --color setting the text summary, plan and check output are
+// rendered with; main sets it once the options are parsed.
+var colorMode = colorAuto
+
+// palette colors text with ANSI escape codes; the zero value leaves it plain.
+type palette struct {
+	enabled bool
+}
+
+// paletteFor returns the palette for output written to w: colored with --color
+// always, and with auto only when w is a terminal and NO_COLOR is not set.
+func paletteFor(w io.Writer) palette {
+	switch colorMode {
+	case colorAlways:
+		return palette{enabled: true}
+	case colorNever:
+		return palette{}
+	}
+
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return palette{}
+	}
+
+	f, ok := w.(*os.File)
+
+	return palette{enabled: ok && isTerminal(f)}
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or a file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// The codes all have two digits, so colored table cells stay aligned with those
+// painted in the default color.
+func (p palette) paint(code, text string) string {
+	if !p.enabled {
+		return text
+	}
+
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+func (p palette) green(text string) string  { return p.paint("32", text) }
+func (p palette) red(text string) string    { return p.paint("31", text) }
+func (p palette) yellow(text string) string { return p.paint("33", text) }
+func (p palette) plain(text string) string  { return p.paint("39", text) }
+
+// action colors an action: additions green, revocations and failures red, updates
+// and skipped groups yellow.
+func (p palette) action(action sgupdater.Action) string {
+	switch action {
+	case sgupdater.ActionAdded, sgupdater.ActionRolledBack:
+		return p.green(string(action))
+	case sgupdater.ActionRemoved, sgupdater.ActionPruned, sgupdater.ActionFailed, sgupdater.ActionInterrupted, sgupdater.ActionTimedOut:
+		return p.red(string(action))
+	case sgupdater.ActionUpdated, sgupdater.ActionNotAttempted, sgupdater.ActionSkippedDeleted:
+		return p.yellow(string(action))
+	default:
+		return p.plain(string(action))
+	}
+}
+
+// change colors a diff line by its operation.
+func (p palette) change(change sgupdater.RuleChange) string {
+	switch change.Op {
+	case '+':
+		return p.green(change.String())
+	case '-':
+		return p.red(change.String())
+	default:
+		return change.String()
+	}
+}
+
+const (
+	familyIPv4 = "v4"
+	familyIPv6 = "v6"
+	familyDual = "dual"
+)
+
+// getPublicIP asks each service in turn and returns the first valid address of the
+// requested family. An empty services list falls back to the built-in defaults.
+func getPublicIP(family string, services []string) (string, error) {
+	if len(services) == 0 {
+		services = ipv4ServiceURLs
+		if family == familyIPv6 {
+			services = ipv6ServiceURLs
+		}
+	}
+
+	var failures []string
+
+	for _, serviceURL := range services {
+		ip, err := fetchPublicIP(serviceURL, family)
+		if err != nil {
+			slog.Warn("IP service failed", "service", serviceURL, "error", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", serviceURL, err))
+			continue
+		}
+
+		slog.Info("Discovered public IP", "ip", ip, "service", serviceURL)
+		return ip, nil
+	}
+
+	return "", fmt.Errorf("all IP services failed: %s", strings.Join(failures, "; "))
+}
+
+func fetchPublicIP(serviceURL, family string) (string, error) {
+	network := "tcp4"
+	if family == familyIPv6 {
+		network = "tcp6"
+	}
+
+	// Pin the connection to the requested address family so a dual-stack host
+	// reports the address that matches the rule being written.
+	dialer := &net.Dialer{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	httpClient := &http.Client{Transport: transport, Timeout: ipServiceTimeout}
+
+	resp, err := httpClient.Get(serviceURL)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("returned status %s", resp.Status)
+	}
+
+	ipBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	ip := strings.TrimSpace(string(ipBytes))
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return "", fmt.Errorf("invalid IP address received: %s", ip)
+	}
+
+	if family == familyIPv6 && parsedIP.To4() != nil {
+		return "", fmt.Errorf("expected an IPv6 address but received %s", ip)
+	}
+
+	if family == familyIPv4 && parsedIP.To4() == nil {
+		return "", fmt.Errorf("expected an IPv4 address but received %s", ip)
+	}
+
+	return ip, nil
+}
+
+func addressFamilies(raw string) ([]string, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case familyIPv4:
+		return []string{familyIPv4}, nil
+	case familyIPv6:
+		return []string{familyIPv6}, nil
+	case familyDual:
+		return []string{familyIPv4, familyIPv6}, nil
+	default:
+		return nil, fmt.Errorf("invalid address family '%s': use v4, v6 or dual", raw)
+	}
+}
+
+// parseIPOverride validates the --ip value, returning the CIDR to authorize. A bare
+// address becomes a host CIDR; a CIDR is normalized to its network address.
+func parseIPOverride(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+
+	if strings.Contains(raw, "/") {
+		_, ipNet, err := net.ParseCIDR(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid CIDR '%s': %w", raw, err)
+		}
+
+		if ipNet.String() != raw {
+			slog.Info("Normalized --ip CIDR", "from", raw, "to", ipNet.String())
+		}
+
+		return ipNet.String(), nil
+	}
+
+	if net.ParseIP(raw) == nil {
+		return "", fmt.Errorf("invalid IP address '%s'", raw)
+	}
+
+	return sgupdater.HostCIDR(raw), nil
+}
+
+// parseHostAddress validates an IP sent by a client rather than set by the operator,
+// returning its host CIDR. Only a single address is accepted, bare or as a /32 or
+// /128 CIDR, so that a request cannot open the groups to a whole network.
+func parseHostAddress(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+
+	if !strings.Contains(raw, "/") {
+		return parseIPOverride(raw)
+	}
+
+	ip, ipNet, err := net.ParseCIDR(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR '%s': %w", raw, err)
+	}
+
+	if ones, bits := ipNet.Mask.Size(); ones != bits {
+		return "", fmt.Errorf("'%s' is a network: only a single address, /32 or /128, is accepted", raw)
+	}
+
+	return sgupdater.HostCIDR(ip.String()), nil
+}
+
+// assumeRoleOptions describes an IAM role to assume on top of the base credentials.
+type assumeRoleOptions struct {
+	RoleARN     string
+	SessionName string
+	ExternalID  string
+}
+
+// endpointOptions replaces the AWS endpoints, for AWS-compatible clouds and local
+// testing.
+type endpointOptions struct {
+	URL string
+	// Insecure skips TLS certificate verification, for endpoints with self-signed
+	// certificates.
+	Insecure bool
+}
+
+// apiCallOptions configures how every AWS client makes its calls.
+type apiCallOptions struct {
+	// MaxRetries is how often a failed call is retried, so it is attempted at most
+	// MaxRetries+1 times.
+	MaxRetries int
+	// RetryMode is "standard" or "adaptive".
+	RetryMode string
+	// Timeout, when set, bounds each call, retries included.
+	Timeout time.Duration
+}
+
+// apiTimeout cancels an AWS operation, retries included, once timeout has passed,
+// so that a hung call fails instead of stalling the run.
+func apiTimeout(timeout time.Duration) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("APITimeout", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+	}
+}
+
+// profileLabel describes where credentials are loaded from, for log and error messages.
+func profileLabel(profileName string) string {
+	if profileName == "" {
+		return "the default credential chain"
+	}
+
+	return fmt.Sprintf("profile '%s'", profileName)
+}
+
+func loadAWSConfig(ctx context.Context, profileName, region string, endpoint endpointOptions, calls apiCallOptions, role assumeRoleOptions) (aws.Config, error) {
+	// Adaptive mode rate-limits the client itself once EC2 starts throttling, which
+	// matters when many groups are synced in parallel.
+	loadOptions := []func(*config.LoadOptions) error{
+		config.WithRetryMode(aws.RetryMode(calls.RetryMode)),
+		config.WithRetryMaxAttempts(calls.MaxRetries + 1),
+	}
+
+	if calls.Timeout > 0 {
+		loadOptions = append(loadOptions, config.WithAPIOptions([]func(*middleware.Stack) error{apiTimeout(calls.Timeout)}))
+	}
+
+	// Without an explicit profile the SDK's default chain decides (env vars, AWS_PROFILE, SSO, instance roles).
+	if profileName != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(profileName))
+	}
+
+	if region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(region))
+	}
+
+	// An endpoint override applies to every service, e.g. to run against LocalStack.
+	if endpoint.URL != "" {
+		loadOptions = append(loadOptions, config.WithBaseEndpoint(endpoint.URL))
+	}
+
+	if endpoint.Insecure {
+		loadOptions = append(loadOptions, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		})))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS configuration for %s: %w", profileLabel(profileName), err)
+	}
+
+	slog.Info("Loaded AWS configuration", "source", profileLabel(profileName))
+
+	if endpoint.URL != "" {
+		slog.Info("Using custom AWS endpoint", "endpoint", endpoint.URL)
+	}
+
+	if endpoint.Insecure {
+		slog.Warn("TLS certificate verification is disabled for AWS requests (--insecure)")
+	}
+
+	if cfg.Region == "" {
+		return aws.Config{}, fmt.Errorf("no AWS region configured for %s: set --region, AWS_REGION or a region in the profile", profileLabel(profileName))
+	}
+
+	if cfg.Credentials == nil {
+		return aws.Config{}, fmt.Errorf("no AWS credentials found for %s", profileLabel(profileName))
+	}
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to retrieve AWS credentials for %s: %w", profileLabel(profileName), err)
+	}
+
+	slog.Info("Using credentials", "source", creds.Source)
+
+	if region != "" {
+		slog.Info("Using AWS region (overriding the profile)", "region", cfg.Region)
+	} else {
+		slog.Info("Using AWS region", "region", cfg.Region)
+	}
+
+	if role.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = role.SessionName
+
+			if role.ExternalID != "" {
+				o.ExternalID = aws.String(role.ExternalID)
+			}
+		})
+
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+
+		// Retrieve now so access denied or a wrong external ID is reported before any SG work.
+		if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+			return aws.Config{}, fmt.Errorf("failed to assume role '%s': %w", role.RoleARN, err)
+		}
+
+		slog.Info("Assumed role", "role_arn", role.RoleARN, "session_name", role.SessionName)
+	}
+
+	return cfg, nil
+}
+
+// options is the fully resolved configuration for a run, whether it came from
+// flags, a config file or both.
+type options struct {
+	Profiles   []string
+	AssumeRole assumeRoleOptions
+	Regions    []string
+	AllRegions bool
+	// Endpoint, when its URL is set, replaces the AWS endpoint of every service.
+	Endpoint endpointOptions
+	APICalls apiCallOptions
+	// RunTimeout, when set, bounds a run; in watch mode, every sync.
+	RunTimeout time.Duration
+	Targets    []syncTarget
+	Families   []string
+	IPOverride string
+	// IPParameter is the SSM parameter holding the IP to allow, instead of
+	// discovering it.
+	IPParameter string
+	IPServices  []string
+	DryRun      bool
+	Remove      bool
+	Watch       bool
+	// StableChecks is how many checks in a row a changed IP must be seen in watch
+	// mode before it is synced.
+	StableChecks int
+	// MinUpdateInterval is the least time between two syncs in watch mode.
+	MinUpdateInterval time.Duration
+	// Ephemeral revokes the rules when watch or --listen mode shuts down, within
+	// EphemeralTimeout.
+	Ephemeral        bool
+	EphemeralTimeout time.Duration
+	// Lambda runs the tool as an AWS Lambda handler, one sync per invocation.
+	Lambda bool
+	// Listen is the address of the HTTP server that syncs pushed IPs, if any.
+	Listen string
+	// ListenToken is the bearer token every /update request must carry.
+	ListenToken  string
+	Interval     time.Duration
+	OutputFormat string
+	// Color is the --color mode of the text output: auto, always or never.
+	Color   string
+	Plan    bool
+	Apply   bool
+	Confirm bool
+	Yes     bool
+	// Select lists candidate groups and asks which ones to sync before the run.
+	Select bool
+	// Check evaluates every group without changing anything and exits with
+	// exitChangesNeeded when one is out of date.
+	Check bool
+	// PrunePrefix, when set, also revokes rules whose description starts with it but
+	// is not the current one.
+	PrunePrefix string
+	// Roster is the --roster file; its members' addresses are synced instead of
+	// this host's, one rule each.
+	Roster string
+	// CIDRSourceURL, when set, serves the allowlist of CIDRs synced as one set under
+	// the description instead of this host's address.
+	CIDRSourceURL string
+	// Directions are the --direction rules are synced in.
+	Directions []sgupdater.Direction
+	// List prints the rules with our description instead of syncing; it is set by
+	// the list subcommand.
+	List bool
+	// Doctor checks the IP service, credentials and EC2 permissions instead of
+	// syncing; it is set by the doctor subcommand.
+	Doctor bool
+	// IAMPolicy prints the IAM policy the run needs instead of syncing; it is set by
+	// the iam-policy subcommand.
+	IAMPolicy bool
+	// CleanExpired revokes expired rules whose description starts with CleanPrefix
+	// instead of syncing; it is set by the clean (or clean-expired) subcommand.
+	CleanExpired bool
+	CleanPrefix  string
+	// Rollback restores the rules recorded in BackupFile instead of syncing; it is set
+	// by the rollback subcommand.
+	Rollback   bool
+	BackupFile string
+	// Completion names the shell to print a completion script for instead of
+	// running; it is set by the completion subcommand, and nothing else is parsed.
+	Completion string
+	// BackupDir, when set, receives a snapshot of the rules in every group before a
+	// sync changes any.
+	BackupDir string
+	// TTL, when set, appends an expiry marker to the descriptions of new rules.
+	TTL time.Duration
+	// GracePeriod, when set, keeps the rules for a previous address this long.
+	GracePeriod time.Duration
+	// TagGroups records the last sync time and CIDR as tags on each changed group.
+	TagGroups bool
+	// FailOnOpen fails groups that already allow the whole internet on the rule's
+	// ports, which are otherwise only warned about.
+	FailOnOpen bool
+	// FailFast stops the run at the first group that fails, leaving the rest alone.
+	FailFast bool
+	// SkipIfCovered leaves groups alone where a broader rule already allows the
+	// address.
+	SkipIfCovered bool
+	// RulesQuota is the rules-per-group quota when raised above EC2's default, and
+	// CheckQuota warns about groups within that many rules of it.
+	RulesQuota int
+	CheckQuota int
+	// VerifyTimeout, when set, is how long --verify waits for each rule put in place
+	// to show up in describe calls.
+	VerifyTimeout time.Duration
+	// PrefixListID, when set, keeps the entry for our description in this managed
+	// prefix list instead of syncing Security Groups.
+	PrefixListID string
+	// WAFIPSet, when set, keeps our addresses in this WAFv2 IPSet instead of syncing
+	// Security Groups.
+	WAFIPSet *sgupdater.WAFIPSet
+	// LightsailInstance, when set, keeps our addresses in the firewall of this
+	// Lightsail instance instead of syncing Security Groups.
+	LightsailInstance string
+	// Route53ZoneID and Route53Record, when set, name a record pointed at the public
+	// IP after the Security Groups are synced: A for IPv4 and AAAA for IPv6.
+	Route53ZoneID string
+	Route53Record string
+	// StateFile, when set, records the CIDRs last synced successfully so an unchanged
+	// IP skips the run; Force syncs anyway.
+	StateFile string
+	Force     bool
+	// SummaryFile, when set, receives the --output=json summary of every sync.
+	SummaryFile string
+	// HistoryFile, when set, gets a line per run with the CIDRs allowed and the
+	// groups changed. History prints its last HistoryLast lines instead of syncing;
+	// it is set by the history subcommand.
+	HistoryFile string
+	History     bool
+	HistoryLast int
+	// Retry, loaded from a --retry-from summary file, restricts the run to the
+	// groups that failed or were not attempted in it.
+	Retry retrySet
+	// SlackWebhookURL, when set, receives a message after a run that changed or
+	// failed to change a rule, or after every run with NotifyAlways.
+	SlackWebhookURL string
+	NotifyAlways    bool
+	// PingURL, when set, is pinged after every run, healthchecks.io style.
+	PingURL string
+	// SNSTopicARN, when set, receives the JSON summary of every run.
+	SNSTopicARN string
+	// WebhookURL, when set, receives a JSON description of the run, depending on
+	// WebhookOn: change, failure or always.
+	WebhookURL     string
+	WebhookHeaders http.Header
+	WebhookTimeout time.Duration
+	WebhookOn      string
+	// MetricsNamespace, when set, is the CloudWatch namespace the run's metrics are
+	// published to.
+	MetricsNamespace string
+	// MetricsAddr, when set, is where watch and --listen mode serve Prometheus
+	// metrics on /metrics.
+	MetricsAddr string
+	Guardrails  sgupdater.Guardrails
+	// StrictTags fails the run when a requested tag value matches no group, while
+	// still syncing the groups that did resolve.
+	StrictTags bool
+	// ExpectedAccounts, when set, must contain the account the credentials belong to.
+	ExpectedAccounts []string
+	// OwnerID is the account the selected groups must belong to, or "self" for the
+	// account of the credentials.
+	OwnerID string
+	// MaxConcurrency caps the security groups synced at once in each region.
+	MaxConcurrency int
+	// TestConnect lists the targets dialled after the sync to prove the new rules let
+	// us in.
+	TestConnect connectTestOptions
+}
+
+// connectTestOptions are the --test-connect targets, host:port each, and how long
+// every dial may take.
+type connectTestOptions struct {
+	Targets []string
+	Timeout time.Duration
+}
+
+// fileConfig is the layout of the --config YAML file. Top-level target values apply
+// to every entry and each entry may override them; without entries the top level
+// is the only target.
+type fileConfig struct {
+	Profile         string `yaml:"profile"`
+	Region          string `yaml:"region"`
+	RoleARN         string `yaml:"role-arn"`
+	RoleSessionName string `yaml:"role-session-name"`
+	ExternalID      string `yaml:"external-id"`
+	fileTarget      `yaml:",inline"`
+	Entries         []fileEntry `yaml:"entries"`
+}
+
+type fileTarget struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Protocol    string   `yaml:"protocol"`
+	Port        string   `yaml:"port"`
+	SgIDs       []string `yaml:"sg-ids"`
+	SgTagNames  []string `yaml:"sg-tag-names"`
+	SgTags      []string `yaml:"sg-tags"`
+	SgNames     []string `yaml:"sg-names"`
+	VpcID       string   `yaml:"vpc-id"`
+	ExcludeIDs  []string `yaml:"exclude-sg-ids"`
+	InstanceIDs []string `yaml:"instance-ids"`
+	// LoadBalancers are names or ARNs.
+	LoadBalancers []string `yaml:"load-balancers"`
+}
+
+// fileEntry is one named target. Profile binds it to a single AWS profile; without
+// it the entry is synced under every selected profile.
+type fileEntry struct {
+	fileTarget `yaml:",inline"`
+	Profile    string `yaml:"profile"`
+}
+
+func loadConfigFile(path string) (fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("failed to read config file '%s': %w", path, err)
+	}
+
+	var fc fileConfig
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return fileConfig{}, fmt.Errorf("failed to parse config file '%s': %w", path, err)
+	}
+
+	return fc, nil
+}
+
+// rosterFile is the layout of the --roster JSON file.
+type rosterFile struct {
+	// Prefix starts every member's rule description, and is what --prune-roster
+	// looks for in the rules of former members.
+	Prefix  string         `json:"prefix"`
+	Members []rosterMember `json:"members"`
+}
+
+// rosterMember is one person on the roster, with their address given directly or
+// fetched from a URL that returns it as plain text.
+type rosterMember struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	URL  string `json:"url"`
+}
+
+func loadRoster(path string) (rosterFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rosterFile{}, fmt.Errorf("failed to read roster file '%s': %w", path, err)
+	}
+
+	var roster rosterFile
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&roster); err != nil {
+		return rosterFile{}, fmt.Errorf("failed to parse roster file '%s': %w", path, err)
+	}
+
+	if len(roster.Members) == 0 {
+		return rosterFile{}, fmt.Errorf("roster file '%s' has no members", path)
+	}
+
+	seen := make(map[string]bool)
+
+	for i, member := range roster.Members {
+		key := fmt.Sprintf("members[%d]", i)
+		member.Name = strings.TrimSpace(member.Name)
+		member.URL = strings.TrimSpace(member.URL)
+
+		switch {
+		case member.Name == "":
+			return rosterFile{}, fmt.Errorf("%s.name: every member needs a name", key)
+		case seen[member.Name]:
+			return rosterFile{}, fmt.Errorf("%s.name: duplicate member name '%s'", key, member.Name)
+		case (member.IP == "") == (member.URL == ""):
+			return rosterFile{}, fmt.Errorf("%s: set exactly one of ip and url", key)
+		}
+
+		if member.IP != "" {
+			if member.IP, err = parseIPOverride(member.IP); err != nil {
+				return rosterFile{}, fmt.Errorf("%s.ip: %w", key, err)
+			}
+		}
+
+		seen[member.Name] = true
+		roster.Members[i] = member
+	}
+
+	return roster, nil
+}
+
+// setting is a configuration value together with where it came from (a flag or a
+// config file key), so validation errors can point at the offending input.
+type setting struct {
+	Value  string
+	Source string
+}
+
+func (s *setting) set(value, source string) {
+	if value != "" {
+		s.Value = value
+		s.Source = source
+	}
+}
+
+type listSetting struct {
+	Values []string
+	Source string
+}
+
+func (s *listSetting) set(values []string, source string) {
+	if len(values) > 0 {
+		s.Values = values
+		s.Source = source
+	}
+}
+
+// targetSettings holds the unvalidated values for one syncTarget.
+type targetSettings struct {
+	Name        string
+	Profile     string
+	Description setting
+	Protocol    setting
+	Port        setting
+	SgIDs       listSetting
+	SgTagNames  listSetting
+	SgTags      listSetting
+	SgNames     listSetting
+	VpcID       setting
+	ExcludeIDs  listSetting
+	InstanceIDs listSetting
+	// LoadBalancers holds both --load-balancer-name and --load-balancer-arn values.
+	LoadBalancers listSetting
+}
+
+func (t *targetSettings) applyFile(ft fileTarget, keyPrefix string) {
+	t.Description.set(ft.Description, keyPrefix+"description")
+	t.Protocol.set(ft.Protocol, keyPrefix+"protocol")
+	t.Port.set(ft.Port, keyPrefix+"port")
+	t.SgIDs.set(ft.SgIDs, keyPrefix+"sg-ids")
+	t.SgTagNames.set(ft.SgTagNames, keyPrefix+"sg-tag-names")
+	t.SgTags.set(ft.SgTags, keyPrefix+"sg-tags")
+	t.SgNames.set(ft.SgNames, keyPrefix+"sg-names")
+	t.VpcID.set(ft.VpcID, keyPrefix+"vpc-id")
+	t.ExcludeIDs.set(ft.ExcludeIDs, keyPrefix+"exclude-sg-ids")
+	t.InstanceIDs.set(ft.InstanceIDs, keyPrefix+"instance-ids")
+	t.LoadBalancers.set(ft.LoadBalancers, keyPrefix+"load-balancers")
+}
+
+func (t *targetSettings) applyOverrides(overrides targetSettings) {
+	t.Description.set(overrides.Description.Value, overrides.Description.Source)
+	t.Protocol.set(overrides.Protocol.Value, overrides.Protocol.Source)
+	t.Port.set(overrides.Port.Value, overrides.Port.Source)
+	t.SgIDs.set(overrides.SgIDs.Values, overrides.SgIDs.Source)
+	t.SgTagNames.set(overrides.SgTagNames.Values, overrides.SgTagNames.Source)
+	t.SgTags.set(overrides.SgTags.Values, overrides.SgTags.Source)
+	t.SgNames.set(overrides.SgNames.Values, overrides.SgNames.Source)
+	t.VpcID.set(overrides.VpcID.Value, overrides.VpcID.Source)
+	t.ExcludeIDs.set(overrides.ExcludeIDs.Values, overrides.ExcludeIDs.Source)
+	t.InstanceIDs.set(overrides.InstanceIDs.Values, overrides.InstanceIDs.Source)
+	t.LoadBalancers.set(overrides.LoadBalancers.Values, overrides.LoadBalancers.Source)
+}
+
+// hostnameSource marks a description derived from the hostname.
+const hostnameSource = "hostname"
+
+// EC2 accepts rule descriptions of up to ec2DescriptionLimit characters from
+// letters, digits, spaces and descriptionSpecials. The --ttl and --grace-period
+// markers take up to their length on top of the description.
+const (
+	ec2DescriptionLimit = 255
+	descriptionSpecials = "._-:/()#,@[]+=&;{}!$*"
+	expiryMarkerLength  = len(" [expires=2006-01-02T15:04Z]")
+	revokeMarkerLength  = len(" [revoke-after=2006-01-02T15:04Z]")
+)
+
+// hostnameDescriptionLimit keeps a description derived from the hostname valid
+// whichever markers are appended.
+const hostnameDescriptionLimit = ec2DescriptionLimit - expiryMarkerLength - revokeMarkerLength
+
+// descriptionLimit is the longest description that stays within EC2's limit once
+// the markers the run appends are added.
+func descriptionLimit(ttl, gracePeriod bool) int {
+	limit := ec2DescriptionLimit
+
+	if ttl {
+		limit -= expiryMarkerLength
+	}
+
+	if gracePeriod {
+		limit -= revokeMarkerLength
+	}
+
+	return limit
+}
+
+func descriptionRuneAllowed(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == ' ' || strings.ContainsRune(descriptionSpecials, r)
+}
+
+// checkDescription reports the first reason EC2 would reject description, before
+// any rule is changed for it.
+func checkDescription(description string, limit int) error {
+	for i, r := range []rune(description) {
+		if !descriptionRuneAllowed(r) {
+			return fmt.Errorf("rule description %q has %q at position %d, EC2 only accepts letters, digits, spaces and %s (or use --sanitize-description)", description, r, i+1, descriptionSpecials)
+		}
+	}
+
+	if len(description) > limit {
+		if limit < ec2DescriptionLimit {
+			return fmt.Errorf("rule description is %d characters long, at most %d leave room for the --ttl and --grace-period markers within EC2's %d (or use --sanitize-description)", len(description), limit, ec2DescriptionLimit)
+		}
+
+		return fmt.Errorf("rule description is %d characters long, EC2 allows %d (or use --sanitize-description)", len(description), limit)
+	}
+
+	return nil
+}
+
+// dropDescriptionRunes drops every character EC2 rejects in a description.
+func dropDescriptionRunes(description string) string {
+	var b strings.Builder
+
+	for _, r := range description {
+		if descriptionRuneAllowed(r) {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// sanitizeDescription drops every character EC2 rejects in a description, then
+// truncates it to limit and trims the spaces left at either end.
+func sanitizeDescription(description string, limit int) string {
+	sanitized := strings.TrimSpace(dropDescriptionRunes(description))
+	if len(sanitized) > limit {
+		sanitized = strings.TrimSpace(sanitized[:limit])
+	}
+
+	return sanitized
+}
+
+// hostnameDescription turns a hostname into a rule description: lowercased and
+// sanitized, without the brackets the markers use.
+func hostnameDescription(hostname string) string {
+	return sanitizeDescription(strings.NewReplacer("[", "", "]", "").Replace(strings.ToLower(hostname)), hostnameDescriptionLimit)
+}
+
+// descriptionData holds the variables of --description-template.
+type descriptionData struct {
+	Name     string // --my-name, or the entry's description
+	Hostname string
+	User     string
+	Date     string // today in UTC, as 2006-01-02
+	IP       string // the address being allowed, without its prefix length
+}
+
+// sampleIP stands in for the caller's address when --description-template is checked.
+const sampleIP = "203.0.113.10"
+
+// templatedDescription returns the function rendering tmpl into the description of
+// the rule allowing a CIDR, and the prefix every rendering starts with. Rules are
+// matched by that prefix: matchPrefix when set, otherwise what tmpl renders before
+// the first {{.Date}} or {{.IP}}, which change from run to run.
+func templatedDescription(tmpl *template.Template, matchPrefix, name string, limit int, sanitize bool) (func(string) string, string, error) {
+	data := descriptionData{Name: name}
+	data.Hostname, _ = os.Hostname()
+
+	if current, err := user.Current(); err == nil {
+		data.User = current.Username
+	}
+
+	render := func(date, ip string) (string, error) {
+		data := data
+		data.Date = date
+		data.IP = ip
+
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", err
+		}
+
+		return b.String(), nil
+	}
+
+	// NUL never appears in a description, so it marks where the date or IP begins.
+	const marker = "\x00"
+
+	stable, err := render(marker, marker)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if matchPrefix == "" {
+		matchPrefix, _, _ = strings.Cut(stable, marker)
+		if strings.TrimSpace(matchPrefix) == "" {
+			return nil, "", fmt.Errorf("the template starts with {{.Date}} or {{.IP}}, leaving nothing stable to match the rules by; set --match-prefix")
+		}
+	}
+
+	sample, err := render(time.Now().UTC().Format(time.DateOnly), sampleIP)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if sanitize {
+		sample = sanitizeDescription(sample, limit)
+		matchPrefix = dropDescriptionRunes(matchPrefix)
+	} else if err := checkDescription(sample, limit); err != nil {
+		return nil, "", err
+	}
+
+	if !strings.HasPrefix(sample, matchPrefix) {
+		return nil, "", fmt.Errorf("rendered description %q does not start with match prefix %q", sample, matchPrefix)
+	}
+
+	describe := func(targetCidr string) string {
+		ip, _, _ := strings.Cut(targetCidr, "/")
+
+		description, err := render(time.Now().UTC().Format(time.DateOnly), ip)
+		if err != nil {
+			// The template rendered for the sample, so this is not expected; the
+			// prefix still matches the rule on the next run.
+			slog.Warn("Could not render --description-template, using the match prefix", "error", err)
+			return strings.TrimSpace(matchPrefix)
+		}
+
+		if sanitize {
+			return sanitizeDescription(description, limit)
+		}
+
+		return description
+	}
+
+	return describe, matchPrefix, nil
+}
+
+func cleanList(values []string) []string {
+	cleaned := []string{}
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			cleaned = append(cleaned, value)
+		}
+	}
+
+	return cleaned
+}
+
+// dedupeList drops repeated values, logging each one, and keeps the first
+// occurrence of every value in order.
+func dedupeList(values []string, source string) []string {
+	seen := make(map[string]bool, len(values))
+	deduped := values[:0:0]
+
+	for _, value := range values {
+		if seen[value] {
+			slog.Info("Ignoring repeated value", "source", source, "value", value)
+			continue
+		}
+
+		seen[value] = true
+		deduped = append(deduped, value)
+	}
+
+	return deduped
+}
+
+// Security Group and instance IDs are a prefix and 8 or 17 hexadecimal characters.
+// Checking their shape before any API call makes a typo fail at once instead of
+// with a Malformed error mid-run.
+var (
+	sgIDPattern       = regexp.MustCompile(`^sg-[0-9a-f]{8,17}$`)
+	instanceIDPattern = regexp.MustCompile(`^i-[0-9a-f]{8,17}$`)
+)
+
+// normalizeSgIDs lowercases the IDs, as EC2 only issues them in lower case, drops
+// repeated ones and rejects any that is not shaped like an ID.
+func normalizeSgIDs(values []string, source string) ([]string, error) {
+	return normalizeIDs(values, source, sgIDPattern, "a Security Group", "sg-")
+}
+
+func normalizeIDs(values []string, source string, pattern *regexp.Regexp, kind, prefix string) ([]string, error) {
+	ids := make([]string, 0, len(values))
+
+	for _, value := range cleanList(values) {
+		id := strings.ToLower(value)
+		if !pattern.MatchString(id) {
+			return nil, fmt.Errorf("%s: '%s' is not %s ID: use %s followed by 8 to 17 hexadecimal characters", source, value, kind, prefix)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return dedupeList(ids, source), nil
+}
+
+// mergeListFile combines a comma-separated flag value with the lines of a list
+// file, flag values first. The source names whichever of the two was given.
+func mergeListFile(flagSet bool, flagValue, flagName, path, fileFlag string, check func(string) error) ([]string, string, error) {
+	var values, sources []string
+
+	if flagSet {
+		values = strings.Split(flagValue, ",")
+		sources = append(sources, flagName)
+	}
+
+	if path != "" {
+		lines, err := readListFile(path, check)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", fileFlag, err)
+		}
+
+		slog.Info("Loaded list file", "source", fileFlag, "path", path, "entries", len(lines))
+
+		values = append(values, lines...)
+		sources = append(sources, fileFlag)
+	}
+
+	return values, strings.Join(sources, " and "), nil
+}
+
+// readListFile reads one value per line from path, or stdin for "-", skipping blank
+// lines and # comments. Every line is passed to check, and a failure is reported
+// with its line number.
+func readListFile(path string, check func(string) error) ([]string, error) {
+	var r io.Reader = os.Stdin
+
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read list file: %w", err)
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	var values []string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		value := strings.TrimSpace(stripComment(scanner.Text()))
+		if value == "" {
+			continue
+		}
+
+		if err := check(value); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", listFileName(path), line, err)
+		}
+
+		values = append(values, value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", listFileName(path), err)
+	}
+
+	return values, nil
+}
+
+// stripComment drops a # comment that starts the line or follows whitespace, so a
+// # inside a value such as a tag is kept.
+func stripComment(line string) string {
+	for i, r := range line {
+		if r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func listFileName(path string) string {
+	if path == "-" {
+		return "stdin"
+	}
+
+	return fmt.Sprintf("'%s'", path)
+}
+
+func checkSgIDLine(value string) error {
+	if !sgIDPattern.MatchString(strings.ToLower(value)) {
+		return fmt.Errorf("'%s' is not a Security Group ID: use sg- followed by 8 to 17 hexadecimal characters", value)
+	}
+
+	return nil
+}
+
+// checkTagValueLine rejects values EC2 could never have stored as a tag value.
+func checkTagValueLine(value string) error {
+	if utf8.RuneCountInString(value) > 256 {
+		return fmt.Errorf("tag value is longer than 256 characters")
+	}
+
+	return nil
+}
+
+func sourceOr(source, fallback string) string {
+	if source == "" {
+		return fallback
+	}
+
+	return source
+}
+
+// buildTarget validates t into a syncTarget. The description may only be omitted
+// when requireDescription is false, as clean-expired does not use it, and the group
+// selectors when requireSelectors is false, as --prefix-list-id has none.
+func buildTarget(t targetSettings, requireDescription, requireSelectors bool) (syncTarget, error) {
+	target := syncTarget{
+		Target: sgupdater.Target{
+			Name:        t.Name,
+			Description: strings.TrimSpace(t.Description.Value),
+		},
+		Profile: t.Profile,
+	}
+
+	if target.Description == "" && requireDescription {
+		return target, fmt.Errorf("a rule description is required: set --my-name or 'description' in the config file")
+	}
+
+	// Validate the protocol on its own first so each error names the right input.
+	if _, err := sgupdater.BuildRuleSpec(t.Protocol.Value, "0-65535", false); err != nil {
+		return target, fmt.Errorf("%s: %w", sourceOr(t.Protocol.Source, "--protocol"), err)
+	}
+
+	rule, err := sgupdater.BuildRuleSpec(t.Protocol.Value, t.Port.Value, t.Port.Source != "")
+	if err != nil {
+		return target, fmt.Errorf("%s: %w", sourceOr(t.Port.Source, "--port"), err)
+	}
+
+	target.Rule = rule
+	target.SgTagNames = dedupeList(cleanList(t.SgTagNames.Values), t.SgTagNames.Source)
+	target.SgNames = dedupeList(cleanList(t.SgNames.Values), t.SgNames.Source)
+	target.VpcID = strings.TrimSpace(t.VpcID.Value)
+
+	if target.SgIDs, err = normalizeSgIDs(t.SgIDs.Values, sourceOr(t.SgIDs.Source, "--sg-id")); err != nil {
+		return target, err
+	}
+
+	if target.ExcludeIDs, err = normalizeSgIDs(t.ExcludeIDs.Values, sourceOr(t.ExcludeIDs.Source, "--exclude-sg-id")); err != nil {
+		return target, err
+	}
+
+	if target.InstanceIDs, err = normalizeIDs(t.InstanceIDs.Values, sourceOr(t.InstanceIDs.Source, "--instance-id"), instanceIDPattern, "an instance", "i-"); err != nil {
+		return target, err
+	}
+
+	target.LoadBalancers = dedupeList(cleanList(t.LoadBalancers.Values), t.LoadBalancers.Source)
+
+	if t.SgIDs.Source != "" && len(target.SgIDs) == 0 {
+		return target, fmt.Errorf("%s: contained no valid IDs after parsing", t.SgIDs.Source)
+	}
+
+	if t.SgTagNames.Source != "" && len(target.SgTagNames) == 0 {
+		return target, fmt.Errorf("%s: contained no valid tag names after parsing", t.SgTagNames.Source)
+	}
+
+	if t.SgNames.Source != "" && len(target.SgNames) == 0 {
+		return target, fmt.Errorf("%s: contained no valid group names after parsing", t.SgNames.Source)
+	}
+
+	for _, raw := range t.SgTags.Values {
+		filter, err := sgupdater.ParseTagFilter(raw)
+		if err != nil {
+			return target, fmt.Errorf("%s: %w", t.SgTags.Source, err)
+		}
+
+		if slices.Contains(target.SgTags, filter) {
+			slog.Info("Ignoring repeated value", "source", t.SgTags.Source, "value", filter.String())
+			continue
+		}
+
+		target.SgTags = append(target.SgTags, filter)
+	}
+
+	if requireSelectors && len(target.SgIDs) == 0 && len(target.SgTagNames) == 0 && len(target.SgTags) == 0 && len(target.SgNames) == 0 && len(target.InstanceIDs) == 0 && len(target.LoadBalancers) == 0 {
+		return target, fmt.Errorf("you must provide at least one Security Group identifier via --sg-id, --sg-tag-name, --sg-tag, --sg-name, --instance-id, --load-balancer-name or --load-balancer-arn (or 'sg-ids'/'sg-tag-names'/'sg-tags'/'sg-names'/'instance-ids'/'load-balancers' in the config file)")
+	}
+
+	return target, nil
+}
+
+// envPrefix is prepended to a flag's upper-cased name, with dashes turned into
+// underscores, to form its environment variable: --my-name reads SG_UPDATER_MY_NAME.
+const envPrefix = "SG_UPDATER_"
+
+func envVarName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvironment sets every flag that was not given on the command line from its
+// environment variable, if present, and returns the flags it set mapped to the
+// variable names. Repeatable flags accept a comma-separated list.
+func applyEnvironment(fs *flag.FlagSet, setFlags map[string]bool) (map[string]string, error) {
+	fromEnv := make(map[string]string)
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || setFlags[f.Name] {
+			return
+		}
+
+		envName := envVarName(f.Name)
+
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			return
+		}
+
+		values := []string{value}
+		if _, isList := f.Value.(*stringListFlag); isList {
+			values = cleanList(strings.Split(value, ","))
+		}
+
+		for _, v := range values {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %w", envName, setErr)
+				return
+			}
+		}
+
+		fromEnv[f.Name] = envName
+	})
+
+	return fromEnv, err
+}
+
+// parseOptions reads the flags, their environment variables and the optional config
+// file into options. Precedence is flag, then environment, then config file, then default.
+func parseOptions() (options, error) {
+	sanitize := flag.Bool("sanitize-description", false, "Drop the characters EC2 rejects from the rule description and shorten it to fit, instead of failing")
+	descriptionTemplateValue := flag.String("description-template", "", "Go template for the rule description, with {{.Name}}, {{.Hostname}}, {{.User}}, {{.Date}} and {{.IP}}, e.g. '{{.Name}} ({{.User}}) {{.Date}}'")
+	ruleText := flag.String("description", "", "Text written on the rule, followed by a "+sgupdater.ManagedMarker+"<--my-name> marker the rule is matched by, so the text can change freely")
+	legacyMatch := flag.Bool("legacy-match", false, "With --description, also match rules described as the bare --my-name, as written by earlier versions, and give them the marker")
+	matchPrefix := flag.String("match-prefix", "", "Match the rules to update by this description prefix (default: what --description-template renders before {{.Date}} or {{.IP}})")
+	myName := flag.String("my-name", "", "Name of the host to resolve (default: the sanitized hostname)")
+	profileName := flag.String("profile", "", "Comma-separated AWS profile name(s) from credentials; each is synced separately (default: the SDK's default credential chain)")
+	regionNames := flag.String("region", "", "Comma-separated AWS region(s) to use, overriding the profile and environment")
+	endpointURL := flag.String("endpoint-url", "", "Send every AWS request to this endpoint instead, e.g. http://localhost:4566 for LocalStack")
+	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification for --endpoint-url")
+	maxAPIRetries := flag.Int("max-api-retries", 9, "How often the AWS SDK retries a failed call")
+	apiCallTimeout := flag.Duration("api-timeout", time.Minute, "Give up on an AWS call, retries included, after this long (0 waits indefinitely)")
+	runTimeout := flag.Duration("run-timeout", 0, "Give up on the run after this long, e.g. 2m; in watch mode it bounds every sync (0 disables it)")
+	apiRetryMode := flag.String("api-retry-mode", "adaptive", "AWS SDK retry mode: 'standard' or 'adaptive' (also rate-limits the client while AWS throttles)")
+	allRegions := flag.Bool("all-regions", false, "Sync in every region enabled for the account")
+	roleARN := flag.String("role-arn", "", "ARN of an IAM role to assume before managing Security Groups")
+	roleSessionName := flag.String("role-session-name", "aws-sg-updater", "Session name used when assuming --role-arn")
+	externalID := flag.String("external-id", "", "External ID required by the role's trust policy, if any")
+	sgIDsRaw := flag.String("sg-id", "", "Comma-separated list of target Security Group IDs")
+	sgTagNamesRaw := flag.String("sg-tag-name", "", "Comma-separated list of target Security Group Tag 'Name' values")
+	sgIDFile := flag.String("sg-id-file", "", "File listing target Security Group IDs one per line, merged with --sg-id; - reads stdin")
+	sgTagFile := flag.String("sg-tag-file", "", "File listing target Security Group Tag 'Name' values one per line, merged with --sg-tag-name; - reads stdin")
+	vpcID := flag.String("vpc-id", "", "Only select Security Groups in this VPC; explicit --sg-id values must belong to it")
+	ownerID := flag.String("owner-id", ownerSelf, "Account the Security Groups must belong to: self or an account ID; groups shared from other accounts are skipped")
+	sgNamesRaw := flag.String("sg-name", "", "Comma-separated list of target Security Group names (group-name, not the Name tag)")
+	portRaw := flag.String("port", "0-65535", "Port or port range to allow, e.g. 22, 443 or 8000-8100 (tcp and udp only)")
+	protocolRaw := flag.String("protocol", "tcp", "Protocol to allow: tcp, udp, icmp, -1 (all) or a protocol number")
+	addressFamilyRaw := flag.String("address-family", familyIPv4, "Address family to sync: v4, v6 or dual")
+	configPath := flag.String("config", "", "Path to a YAML config file; flags set on the command line override its values")
+
+	ipOverride := flag.String("ip", "", "IP address or CIDR to authorize instead of discovering the public IP")
+	ipParameter := flag.String("ip-parameter", "", "Name of an SSM parameter holding the IP address or CIDR to authorize, e.g. one a DDNS client updates")
+
+	dryRun := flag.Bool("dry-run", false, "Show the planned changes without revoking or authorizing any rule")
+	planMode := flag.Bool("plan", false, "Print a per-group diff of the rules before and after the run, without changing anything")
+	applyPlan := flag.Bool("apply", false, "With --plan, make the planned changes after printing the diff")
+	confirm := flag.Bool("confirm", false, "Show the planned changes and ask for confirmation once before making them")
+	selectMode := flag.Bool("select", false, "List the Security Groups of the region, narrowed by --vpc-id, --sg-tag-name or --sg-tag, and pick the ones to sync interactively")
+	assumeYes := flag.Bool("yes", false, "Approve the --confirm prompt automatically, for scripts")
+	checkMode := flag.Bool("check", false, "Change nothing; exit 4 and list the groups whose rule is out of date, or exit 0 silently")
+	outputFormat := flag.String("output", outputText, "Summary format: text or json (logs always go to stderr)")
+	colorValue := flag.String("color", colorAuto, "Color the text summary, plan and check output: auto (only on a terminal without NO_COLOR), always or never")
+	ttl := flag.Duration("ttl", 0, "Append an expiry marker (now + ttl) to the description of rules this run authorizes or updates, e.g. 72h")
+	gracePeriod := flag.Duration("grace-period", 0, "Keep the rule for the previous IP this long after it changes instead of revoking it at once, e.g. 15m")
+	route53ZoneID := flag.String("route53-zone-id", "", "Route53 hosted zone of --route53-record")
+	route53Record := flag.String("route53-record", "", "DNS name to point at the public IP with an A (and for IPv6 an AAAA) record, after syncing the Security Groups")
+	pingURL := flag.String("ping-url", "", "Healthchecks.io-style URL to GET after a successful run; failures are POSTed to <url>/fail")
+	slackWebhookURL := flag.String("slack-webhook-url", "", "Slack incoming webhook to notify when a rule is added or updated, or a sync fails")
+	webhookURL := flag.String("webhook-url", "", "URL to POST a JSON description of the run to")
+	webhookTimeout := flag.Duration("webhook-timeout", notifyTimeout, "Timeout of each --webhook-url request")
+	webhookOn := flag.String("webhook-on", webhookOnChange, "When to call --webhook-url: change (a rule changed or a group failed), failure or always")
+	cloudWatchMetrics := flag.Bool("cloudwatch-metrics", false, "Publish SyncSuccess, SyncFailure, RulesUpdated and IPChanged metrics to CloudWatch after each run")
+	metricsNamespace := flag.String("cloudwatch-namespace", "SGUpdater", "CloudWatch namespace for --cloudwatch-metrics")
+	metricsAddr := flag.String("metrics-addr", "", "In --watch or --listen mode, serve Prometheus metrics on this address, e.g. :9090, under /metrics")
+	snsTopicARN := flag.String("sns-topic-arn", "", "SNS topic to publish the JSON summary of the run to, with the credentials of the first profile")
+	notifyAlways := flag.Bool("notify-always", false, "Also notify after runs that changed nothing")
+	prefixListID := flag.String("prefix-list-id", "", "Keep the entry described with --my-name current in this customer-managed prefix list instead of editing Security Groups")
+	wafIPSetValue := flag.String("wafv2-ipset", "", `Keep the addresses for --my-name current in this WAFv2 IPSet, given as "name|id|scope" with scope REGIONAL or CLOUDFRONT, instead of editing Security Groups`)
+	lightsailInstance := flag.String("lightsail-instance", "", "Keep the public IP allowed for --port and --protocol in the firewall of this Lightsail instance instead of editing Security Groups")
+	verify := flag.Bool("verify", false, "After putting a rule in place, wait until describe calls return it, and fail the group if they do not")
+	verifyTimeout := flag.Duration("verify-timeout", 30*time.Second, "How long --verify waits for a rule to become visible")
+	checkQuota := flag.Int("check-quota", 0, "Warn about groups within this many rules of the rules-per-group quota")
+	rulesQuota := flag.Int("rules-quota", sgupdater.DefaultRulesQuota, "The account's quota of inbound or outbound rules per Security Group, when raised from the default")
+	skipIfCovered := flag.Bool("skip-if-covered", false, "Do not authorize the address in a group where a broader range, under any description, already allows it on the rule's ports")
+	failOnOpen := flag.Bool("fail-on-open", false, "Fail a group that already allows 0.0.0.0/0 or ::/0 on the rule's protocol and ports, instead of warning")
+	failFast := flag.Bool("fail-fast", false, "Stop at the first group that fails: groups not started yet are left alone and those in progress make no further change")
+	tagGroups := flag.Bool("tag-groups", false, "Tag each group whose rule was put in place with "+sgupdater.LastSyncTagKey+" and the CIDR last authorized for --my-name")
+	stateFile := flag.String("state-file", "", "JSON file recording the last successfully synced IP; the run is skipped while it is unchanged, e.g. ~/.cache/aws-sg-updater/state.json")
+	summaryFile := flag.String("summary-file", "", "Also write the JSON summary of the run to this file, for --retry-from")
+	historyFile := flag.String("history-file", "", "JSON Lines file every run appends its IP, whether it changed, the groups it changed and its errors to, e.g. ~/.local/share/aws-sg-updater/history.jsonl")
+	historyLast := flag.Int("last", 20, "With history, how many of the latest runs to print")
+	retryFrom := flag.String("retry-from", "", "Summary file written by --summary-file: only sync the groups that failed or were not attempted in that run")
+	force := flag.Bool("force", false, "Sync even when --state-file says the IP is unchanged")
+	backupDir := flag.String("backup-dir", "", "Directory to write a timestamped JSON snapshot of the rules to before changing them, for rollback")
+	backupFile := flag.String("backup", "", "With rollback, the --backup-dir snapshot to restore")
+	cleanPrefix := flag.String("prefix", "", "With clean-expired, only revoke expired rules whose description starts with this prefix")
+	direction := flag.String("direction", "ingress", "Rules to sync: ingress (traffic from the address), egress (traffic to it) or both")
+	cidrSourceURL := flag.String("cidr-source-url", "", "URL serving an allowlist of CIDRs, one per line; the groups get exactly those ranges under the description, instead of this host's address")
+	rosterPath := flag.String("roster", "", "JSON file listing the people to allow, each with a name and an ip or a url returning it; every member gets a rule of their own instead of this host's address")
+	pruneRoster := flag.Bool("prune-roster", false, "With --roster, also revoke the rules of former members: those starting with the roster's prefix but not named after a member")
+	prunePrefix := flag.String("prune-prefix", "", "Also revoke rules whose description starts with this prefix but is not --my-name, e.g. old names of this host")
+	removeMode := flag.Bool("remove", false, "Revoke every rule whose description equals --my-name instead of syncing")
+	watchMode := flag.Bool("watch", false, "Keep running and re-sync whenever the public IP changes")
+	listen := flag.String("listen", "", "Run an HTTP server on this address, e.g. :8080, that syncs the IP pushed to /update?ip=...&name=...")
+	listenToken := flag.String("listen-token", "", "Token every /update request must send as 'Authorization: Bearer <token>'")
+	lambdaMode := flag.Bool("lambda", false, "Run as an AWS Lambda handler: every invocation syncs once, with the IP from the event if it has one")
+	interval := flag.Duration("interval", 5*time.Minute, "How often to check the public IP in --watch mode")
+	stableChecks := flag.Int("stable-checks", 1, "In --watch mode, only sync a changed IP once it was seen in this many checks in a row")
+	ephemeral := flag.Bool("ephemeral", false, "In --watch or --listen mode, revoke the rules on shutdown, so they only exist while the tool runs")
+	ephemeralTimeout := flag.Duration("ephemeral-timeout", 30*time.Second, "How long --ephemeral may take to revoke the rules on shutdown")
+	minUpdateInterval := flag.Duration("min-update-interval", 0, "In --watch mode, wait at least this long between two syncs, e.g. 10m")
+	maxConcurrency := flag.Int("max-concurrency", 5, "Maximum number of Security Groups synced at once in each region")
+	expectedAccount := flag.String("expected-account", "", "Comma-separated AWS account ID(s) the credentials must belong to; the run aborts otherwise")
+	requireTag := flag.String("require-tag", "", "Tag Key=Value a Security Group must carry to be modified; groups without it are skipped")
+	strict := flag.Bool("strict", false, "Fail the run when a selected group is skipped for lacking --require-tag or is deleted during the run")
+	strictTags := flag.Bool("strict-tags", false, "Fail the run when a --sg-tag-name or --sg-tag value matches no Security Group; the groups that matched are still synced")
+	ignoreOptOut := flag.Bool("ignore-opt-out", false, "Break glass: also modify groups tagged "+sgupdater.OptOutTagKey+"="+sgupdater.OptOutTagValue)
+	debug := flag.Bool("debug", false, "Shorthand for --log-level=debug")
+	logLevel := flag.String("log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log format on stderr: text or json")
+	quiet := flag.Bool("quiet", false, "Only log errors; the summary on stdout is still printed")
+
+	var instanceIDs stringListFlag
+	flag.Var(&instanceIDs, "instance-id", "Comma-separated EC2 instance IDs whose attached Security Groups are targeted; may be repeated")
+
+	var loadBalancerNames stringListFlag
+	flag.Var(&loadBalancerNames, "load-balancer-name", "Comma-separated ALB or NLB names whose Security Groups are targeted; may be repeated")
+
+	var loadBalancerARNs stringListFlag
+	flag.Var(&loadBalancerARNs, "load-balancer-arn", "Comma-separated ALB or NLB ARNs whose Security Groups are targeted; may be repeated")
+
+	var excludeSgIDs stringListFlag
+	flag.Var(&excludeSgIDs, "exclude-sg-id", "Comma-separated Security Group IDs never to touch, even when selected; may be repeated")
+
+	var sgTags rawListFlag
+	flag.Var(&sgTags, "sg-tag", "Tag filter Key=Value a target Security Group must carry; repeat to require several")
+
+	var ruleValues stringListFlag
+	flag.Var(&ruleValues, "rule", "Protocol[:port] to allow, e.g. tcp:443 or udp:51820, each as its own rule under the description; may be repeated, instead of --protocol and --port")
+
+	var serviceValues stringListFlag
+	flag.Var(&serviceValues, "service", "Comma-separated well-known services to allow, e.g. ssh or https,wireguard, alongside any --rule; may be repeated")
+	perServiceDescription := flag.Bool("per-service-description", false, "Describe each --service's rules as the description followed by -<service>, e.g. laptop-ssh")
+
+	var extraCidrs rawListFlag
+	flag.Var(&extraCidrs, "extra-cidr", "Static CIDR=description to keep allowed alongside the discovered address, e.g. 10.1.2.0/24=office-vpn; may be repeated")
+
+	var webhookHeaders rawListFlag
+	flag.Var(&webhookHeaders, "webhook-header", "Header 'Name: value' to send to --webhook-url; may be repeated")
+
+	var ipServices stringListFlag
+	var testConnect stringListFlag
+	flag.Var(&testConnect, "test-connect", "host:port to open a TCP connection to after the sync, to check the rules let you in; may be repeated")
+	testConnectTimeout := flag.Duration("test-connect-timeout", 5*time.Second, "How long each --test-connect dial may take")
+	flag.Var(&ipServices, "ip-service", "URL of a public IP service to query; repeat to set the fallback order (default: built-in list)")
+
+	flag.Usage = printUsage
+
+	// The subcommands come before the flags; without one the groups are synced.
+	args := os.Args[1:]
+	subcommand := "sync"
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, ok := lookupSubcommand(args[0])
+		if !ok {
+			return options{}, fmt.Errorf("unknown subcommand '%s': use one of %s", args[0], strings.Join(subcommandNames(), ", "))
+		}
+
+		subcommand = name
+		args = args[1:]
+	}
+
+	if subcommand == "completion" {
+		if len(args) != 1 || !slices.Contains(completionShells, args[0]) {
+			return options{}, fmt.Errorf("completion needs one shell: %s", strings.Join(completionShells, ", "))
+		}
+
+		return options{Completion: args[0]}, nil
+	}
+
+	// flag.CommandLine exits on a parse error, so there is no error to handle.
+	_ = flag.CommandLine.Parse(args)
+
+	if flag.NArg() > 0 {
+		return options{}, fmt.Errorf("unexpected argument '%s': subcommands come before the flags", flag.Arg(0))
+	}
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	fromEnv, err := applyEnvironment(flag.CommandLine, setFlags)
+	if err != nil {
+		return options{}, err
+	}
+
+	if _, levelFromEnv := fromEnv["log-level"]; !setFlags["log-level"] && !levelFromEnv {
+		if *debug {
+			*logLevel = "debug"
+		} else if *checkMode {
+			// A check that finds nothing to change should print nothing at all.
+			*logLevel = "warn"
+		}
+	}
+
+	// Progress goes to stderr and the summary to stdout, so quiet only needs to
+	// raise the log level.
+	if *quiet {
+		*logLevel = "error"
+	}
+
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		return options{}, err
+	}
+
+	if len(fromEnv) > 0 {
+		envNames := make([]string, 0, len(fromEnv))
+
+		for name, envName := range fromEnv {
+			envNames = append(envNames, envName)
+			setFlags[name] = true
+		}
+
+		slices.Sort(envNames)
+		slog.Info("Using values from the environment", "variables", strings.Join(envNames, ", "))
+	}
+
+	flags := optionFlags{set: setFlags, fromEnv: fromEnv}
+	flagSource := flags.source
+
+	opts := options{
+		Profiles:   cleanList(strings.Split(*profileName, ",")),
+		Regions:    cleanList(strings.Split(*regionNames, ",")),
+		AllRegions: *allRegions,
+		Endpoint: endpointOptions{
+			URL:      strings.TrimSpace(*endpointURL),
+			Insecure: *insecure,
+		},
+		APICalls: apiCallOptions{
+			MaxRetries: *maxAPIRetries,
+			RetryMode:  strings.ToLower(strings.TrimSpace(*apiRetryMode)),
+			Timeout:    *apiCallTimeout,
+		},
+		RunTimeout: *runTimeout,
+		AssumeRole: assumeRoleOptions{
+			RoleARN:     *roleARN,
+			SessionName: *roleSessionName,
+			ExternalID:  *externalID,
+		},
+		IPOverride:        *ipOverride,
+		IPParameter:       strings.TrimSpace(*ipParameter),
+		IPServices:        ipServices,
+		TestConnect:       connectTestOptions{Targets: cleanList(testConnect), Timeout: *testConnectTimeout},
+		DryRun:            *dryRun,
+		Plan:              *planMode,
+		Apply:             *applyPlan,
+		Confirm:           *confirm,
+		Select:            *selectMode,
+		Yes:               *assumeYes,
+		Check:             *checkMode,
+		PrunePrefix:       *prunePrefix,
+		Roster:            strings.TrimSpace(*rosterPath),
+		CIDRSourceURL:     strings.TrimSpace(*cidrSourceURL),
+		List:              subcommand == "list",
+		Doctor:            subcommand == "doctor",
+		IAMPolicy:         subcommand == "iam-policy",
+		CleanExpired:      subcommand == "clean-expired",
+		Rollback:          subcommand == "rollback",
+		BackupFile:        strings.TrimSpace(*backupFile),
+		BackupDir:         strings.TrimSpace(*backupDir),
+		CleanPrefix:       strings.TrimSpace(*cleanPrefix),
+		TTL:               *ttl,
+		GracePeriod:       *gracePeriod,
+		TagGroups:         *tagGroups,
+		FailOnOpen:        *failOnOpen,
+		FailFast:          *failFast,
+		SkipIfCovered:     *skipIfCovered,
+		RulesQuota:        *rulesQuota,
+		CheckQuota:        *checkQuota,
+		PrefixListID:      strings.TrimSpace(*prefixListID),
+		LightsailInstance: strings.TrimSpace(*lightsailInstance),
+		StateFile:         *stateFile,
+		HistoryFile:       strings.TrimSpace(*historyFile),
+		History:           subcommand == "history",
+		HistoryLast:       *historyLast,
+		SummaryFile:       strings.TrimSpace(*summaryFile),
+		SlackWebhookURL:   strings.TrimSpace(*slackWebhookURL),
+		PingURL:           strings.TrimSpace(*pingURL),
+		Route53ZoneID:     strings.TrimSpace(*route53ZoneID),
+		Route53Record:     strings.TrimSpace(*route53Record),
+		NotifyAlways:      *notifyAlways,
+		SNSTopicARN:       strings.TrimSpace(*snsTopicARN),
+		WebhookURL:        strings.TrimSpace(*webhookURL),
+		WebhookHeaders:    make(http.Header),
+		WebhookTimeout:    *webhookTimeout,
+		WebhookOn:         *webhookOn,
+		Force:             *force,
+		Remove:            *removeMode || subcommand == "remove",
+		Watch:             *watchMode,
+		Lambda:            *lambdaMode,
+		Listen:            strings.TrimSpace(*listen),
+		ListenToken:       *listenToken,
+		Interval:          *interval,
+		StableChecks:      *stableChecks,
+		MinUpdateInterval: *minUpdateInterval,
+		Ephemeral:         *ephemeral,
+		EphemeralTimeout:  *ephemeralTimeout,
+		OutputFormat:      *outputFormat,
+		Color:             strings.ToLower(strings.TrimSpace(*colorValue)),
+		MaxConcurrency:    *maxConcurrency,
+		Guardrails:        sgupdater.Guardrails{IgnoreOptOut: *ignoreOptOut, Strict: *strict},
+		StrictTags:        *strictTags,
+		ExpectedAccounts:  cleanList(strings.Split(*expectedAccount, ",")),
+		OwnerID:           strings.TrimSpace(*ownerID),
+	}
+
+	if *requireTag != "" {
+		filter, err := sgupdater.ParseTagFilter(*requireTag)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", flagSource("require-tag"), err)
+		}
+
+		opts.Guardrails.RequireTag = &filter
+	}
+
+	if opts.HistoryFile, err = expandHome(opts.HistoryFile); err != nil {
+		return opts, fmt.Errorf("%s: %w", flagSource("history-file"), err)
+	}
+
+	if err := validateOutput(opts, flags); err != nil {
+		return opts, err
+	}
+
+	// history only reads the history file.
+	if err := validateHistory(opts, flags); err != nil || opts.History {
+		return opts, err
+	}
+
+	if opts.Directions, err = parseDirections(*direction); err != nil {
+		return opts, fmt.Errorf("%s: %w", flagSource("direction"), err)
+	}
+
+	if *wafIPSetValue != "" {
+		opts.WAFIPSet, err = sgupdater.ParseWAFIPSet(*wafIPSetValue)
+		if err != nil {
+			return opts, fmt.Errorf("--wafv2-ipset: %w", err)
+		}
+	}
+
+	for _, header := range webhookHeaders {
+		name, value, found := strings.Cut(header, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return opts, fmt.Errorf("%s: invalid header '%s', use 'Name: value'", flagSource("webhook-header"), header)
+		}
+
+		opts.WebhookHeaders.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	if *cloudWatchMetrics {
+		opts.MetricsNamespace = strings.TrimSpace(*metricsNamespace)
+	}
+
+	if *verify {
+		opts.VerifyTimeout = *verifyTimeout
+	}
+
+	opts.MetricsAddr = strings.TrimSpace(*metricsAddr)
+
+	for _, validate := range []func(options, optionFlags) error{
+		validateModes,
+		validateSubcommands,
+		validateRuleLifetime,
+		validateIPSources,
+		validateRuleFlags,
+		validateDestinations,
+		validateGroupSelection,
+		validateEndpoint,
+		validateNotifications,
+		validateDaemon,
+		validateTestConnect,
+		validateLimits,
+	} {
+		if err := validate(opts, flags); err != nil {
+			return opts, err
+		}
+	}
+
+	if opts.StateFile, err = expandHome(opts.StateFile); err != nil {
+		return opts, fmt.Errorf("%s: %w", flagSource("state-file"), err)
+	}
+
+	if *retryFrom != "" {
+		retry, err := loadRetrySet(*retryFrom)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", flagSource("retry-from"), err)
+		}
+
+		opts.Retry = retry
+	}
+
+	// A rollback finds its groups, profiles and regions in the backup.
+	if opts.Rollback {
+		if len(opts.Profiles) == 0 {
+			opts.Profiles = []string{""}
+		}
+
+		return opts, nil
+	}
+
+	families, err := addressFamilies(*addressFamilyRaw)
+	if err != nil {
+		return opts, fmt.Errorf("%s: %w", flagSource("address-family"), err)
+	}
+
+	opts.Families = families
+
+	defaults := targetSettings{
+		Protocol: setting{Value: "tcp"},
+		Port:     setting{Value: "0-65535"},
+	}
+
+	// A Lambda function's hostname changes with every sandbox, so it never names the
+	// rule there.
+	if hostname, err := os.Hostname(); err == nil && !opts.Lambda {
+		defaults.Description.set(hostnameDescription(hostname), hostnameSource)
+	}
+
+	var overrides targetSettings
+
+	if setFlags["my-name"] {
+		overrides.Description.set(*myName, flagSource("my-name"))
+	}
+
+	if setFlags["protocol"] {
+		overrides.Protocol.set(*protocolRaw, flagSource("protocol"))
+	}
+
+	if setFlags["port"] {
+		overrides.Port.set(*portRaw, flagSource("port"))
+	}
+
+	if *sgIDFile == "-" && *sgTagFile == "-" {
+		return opts, fmt.Errorf("%s and %s cannot both read stdin", flagSource("sg-id-file"), flagSource("sg-tag-file"))
+	}
+
+	if setFlags["sg-id"] || setFlags["sg-id-file"] {
+		ids, source, err := mergeListFile(setFlags["sg-id"], *sgIDsRaw, flagSource("sg-id"), *sgIDFile, flagSource("sg-id-file"), checkSgIDLine)
+		if err != nil {
+			return opts, err
+		}
+
+		overrides.SgIDs.set(ids, source)
+	}
+
+	if setFlags["sg-tag-name"] || setFlags["sg-tag-file"] {
+		names, source, err := mergeListFile(setFlags["sg-tag-name"], *sgTagNamesRaw, flagSource("sg-tag-name"), *sgTagFile, flagSource("sg-tag-file"), checkTagValueLine)
+		if err != nil {
+			return opts, err
+		}
+
+		overrides.SgTagNames.set(names, source)
+	}
+
+	if setFlags["exclude-sg-id"] {
+		var ids []string
+
+		for _, value := range excludeSgIDs {
+			ids = append(ids, strings.Split(value, ",")...)
+		}
+
+		overrides.ExcludeIDs.set(ids, flagSource("exclude-sg-id"))
+	}
+
+	if setFlags["instance-id"] {
+		var ids []string
+
+		for _, value := range instanceIDs {
+			ids = append(ids, strings.Split(value, ",")...)
+		}
+
+		overrides.InstanceIDs.set(ids, flagSource("instance-id"))
+	}
+
+	if setFlags["load-balancer-name"] || setFlags["load-balancer-arn"] {
+		var loadBalancers, sources []string
+
+		for _, value := range loadBalancerNames {
+			for _, name := range cleanList(strings.Split(value, ",")) {
+				if strings.HasPrefix(name, "arn:") {
+					return opts, fmt.Errorf("%s: '%s' is an ARN, use --load-balancer-arn", flagSource("load-balancer-name"), name)
+				}
+
+				loadBalancers = append(loadBalancers, name)
+			}
+		}
+
+		for _, value := range loadBalancerARNs {
+			for _, arn := range cleanList(strings.Split(value, ",")) {
+				if !strings.HasPrefix(arn, "arn:") || !strings.Contains(arn, ":loadbalancer/") {
+					return opts, fmt.Errorf("%s: '%s' is not a load balancer ARN", flagSource("load-balancer-arn"), arn)
+				}
+
+				loadBalancers = append(loadBalancers, arn)
+			}
+		}
+
+		for _, name := range []string{"load-balancer-name", "load-balancer-arn"} {
+			if setFlags[name] {
+				sources = append(sources, flagSource(name))
+			}
+		}
+
+		overrides.LoadBalancers.set(loadBalancers, strings.Join(sources, " and "))
+	}
+
+	if setFlags["vpc-id"] {
+		overrides.VpcID.set(*vpcID, flagSource("vpc-id"))
+	}
+
+	if setFlags["sg-name"] {
+		overrides.SgNames.set(strings.Split(*sgNamesRaw, ","), flagSource("sg-name"))
+	}
+
+	if setFlags["sg-tag"] {
+		overrides.SgTags.set(sgTags, flagSource("sg-tag"))
+	}
+
+	targets := []targetSettings{defaults}
+
+	if *configPath != "" {
+		fc, err := loadConfigFile(*configPath)
+		if err != nil {
+			return opts, err
+		}
+
+		if !setFlags["profile"] && fc.Profile != "" {
+			opts.Profiles = cleanList(strings.Split(fc.Profile, ","))
+		}
+
+		if !setFlags["role-arn"] && fc.RoleARN != "" {
+			opts.AssumeRole.RoleARN = fc.RoleARN
+		}
+
+		if !setFlags["role-session-name"] && fc.RoleSessionName != "" {
+			opts.AssumeRole.SessionName = fc.RoleSessionName
+		}
+
+		if !setFlags["external-id"] && fc.ExternalID != "" {
+			opts.AssumeRole.ExternalID = fc.ExternalID
+		}
+
+		if !setFlags["region"] && fc.Region != "" {
+			opts.Regions = cleanList(strings.Split(fc.Region, ","))
+		}
+
+		base := defaults
+		base.applyFile(fc.fileTarget, "")
+		targets = []targetSettings{base}
+
+		if len(fc.Entries) > 0 {
+			targets = nil
+			seenNames := make(map[string]bool)
+
+			for i, entry := range fc.Entries {
+				key := fmt.Sprintf("entries[%d]", i)
+
+				if entry.Name == "" {
+					return opts, fmt.Errorf("%s.name: every entry needs a name", key)
+				}
+
+				if seenNames[entry.Name] {
+					return opts, fmt.Errorf("%s.name: duplicate entry name '%s'", key, entry.Name)
+				}
+
+				seenNames[entry.Name] = true
+
+				t := base
+				t.Name = entry.Name
+				t.Profile = strings.TrimSpace(entry.Profile)
+				t.applyFile(entry.fileTarget, key+".")
+				targets = append(targets, t)
+
+				// Profiles named only by entries are added to the run, unless --profile
+				// picked the profiles explicitly.
+				if t.Profile != "" && !setFlags["profile"] && !slices.Contains(opts.Profiles, t.Profile) {
+					opts.Profiles = append(opts.Profiles, t.Profile)
+				}
+			}
+		}
+
+		slog.Info("Loaded config file", "path", *configPath, "targets", len(targets))
+	}
+
+	if opts.AssumeRole.RoleARN == "" && opts.AssumeRole.ExternalID != "" {
+		return opts, fmt.Errorf("--external-id requires --role-arn")
+	}
+
+	if len(opts.Profiles) == 0 {
+		opts.Profiles = []string{""}
+	}
+
+	var descriptionTemplate *template.Template
+
+	if *descriptionTemplateValue != "" {
+		descriptionTemplate, err = template.New("description").Option("missingkey=error").Parse(*descriptionTemplateValue)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", flagSource("description-template"), err)
+		}
+
+		if *ruleText != "" {
+			return opts, fmt.Errorf("%s cannot be combined with %s", flagSource("description-template"), flagSource("description"))
+		}
+	} else if *matchPrefix != "" {
+		return opts, fmt.Errorf("%s requires --description-template", flagSource("match-prefix"))
+	}
+
+	if *legacyMatch && *ruleText == "" {
+		return opts, fmt.Errorf("%s requires --description", flagSource("legacy-match"))
+	}
+
+	ruleSpecs, err := parseRuleSpecs(ruleValues)
+	if err != nil {
+		return opts, fmt.Errorf("%s: %w", flagSource("rule"), err)
+	}
+
+	services, err := parseServices(serviceValues)
+	if err != nil {
+		return opts, fmt.Errorf("%s: %w", flagSource("service"), err)
+	}
+
+	if *perServiceDescription && len(services) == 0 {
+		return opts, fmt.Errorf("%s requires --service", flagSource("per-service-description"))
+	}
+
+	// Every spec is checked against the others, as two rules for the same port and
+	// address cannot coexist even under different descriptions.
+	allSpecs := slices.Clone(ruleSpecs)
+
+	for _, service := range services {
+		allSpecs = append(allSpecs, service.Rules...)
+	}
+
+	for i, spec := range allSpecs {
+		if slices.ContainsFunc(allSpecs[:i], func(other sgupdater.RuleSpec) bool { return other.String() == spec.String() }) {
+			return opts, fmt.Errorf("%s is given more than once by --rule or --service", spec)
+		}
+	}
+
+	if len(allSpecs) > 1 && opts.CIDRSourceURL != "" {
+		return opts, fmt.Errorf("--cidr-source-url takes a single --rule or --service")
+	}
+
+	if !*perServiceDescription {
+		ruleSpecs = allSpecs
+	}
+
+	for _, t := range targets {
+		if t.Profile != "" && !slices.Contains(opts.Profiles, t.Profile) {
+			slog.Info("Skipping entry, its profile is not selected", "entry", t.Name, "profile", t.Profile, "selected_by", flagSource("profile"))
+			continue
+		}
+
+		t.applyOverrides(overrides)
+
+		if t.Description.Source == hostnameSource && !opts.CleanExpired {
+			slog.Warn("No --my-name given, the rules are described with the hostname", "description", t.Description.Value)
+		}
+
+		target, err := buildTarget(t, !opts.CleanExpired, opts.PrefixListID == "" && *wafIPSetValue == "" && opts.LightsailInstance == "" && !opts.Select && opts.Retry == nil)
+		if err != nil {
+			if t.Name != "" {
+				return opts, fmt.Errorf("entry '%s': %w", t.Name, err)
+			}
+
+			return opts, err
+		}
+
+		if len(allSpecs) > 0 {
+			if source := cmp.Or(t.Protocol.Source, t.Port.Source); source != "" {
+				return opts, fmt.Errorf("--rule and --service cannot be combined with %s", source)
+			}
+		}
+
+		if len(ruleSpecs) > 0 {
+			target.Rule = ruleSpecs[0]
+			target.ExtraRules = ruleSpecs[1:]
+		}
+
+		limit := descriptionLimit(opts.TTL > 0, opts.GracePeriod > 0)
+
+		if descriptionTemplate != nil && target.Description != "" && !opts.CleanExpired {
+			describe, prefix, err := templatedDescription(descriptionTemplate, *matchPrefix, target.Description, limit, *sanitize)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %w", flagSource("description-template"), err)
+			}
+
+			slog.Info("Rule descriptions come from the template", "entry", t.Name, "match_prefix", prefix)
+			target.Description = prefix
+			target.RuleDescription = describe
+			target.Match = sgupdater.MatchPrefix
+		} else if target.Description != "" {
+			if err := checkDescription(target.Description, limit); err != nil {
+				if !*sanitize {
+					return opts, fmt.Errorf("%s: %w", sourceOr(t.Description.Source, "--my-name"), err)
+				}
+
+				sanitized := sanitizeDescription(target.Description, limit)
+				if sanitized == "" {
+					return opts, fmt.Errorf("%s: nothing is left of rule description %q once sanitized", sourceOr(t.Description.Source, "--my-name"), target.Description)
+				}
+
+				slog.Warn("Sanitized the rule description for EC2", "from", target.Description, "to", sanitized)
+				target.Description = sanitized
+			}
+
+			// The rule carries the text followed by the marker, and is matched by the
+			// marker alone.
+			if *ruleText != "" && !opts.CleanExpired {
+				marker := sgupdater.MarkerFor(target.Description)
+				text := strings.TrimSpace(*ruleText)
+				textLimit := max(limit-len(marker)-1, 0)
+
+				if err := checkDescription(text, textLimit); err != nil {
+					if !*sanitize {
+						return opts, fmt.Errorf("%s: %w", flagSource("description"), err)
+					}
+
+					sanitized := sanitizeDescription(text, textLimit)
+					slog.Warn("Sanitized the rule description for EC2", "from", text, "to", sanitized)
+					text = sanitized
+				}
+
+				description := strings.TrimSpace(text + " " + marker)
+				target.Description = marker
+				target.RuleDescription = func(string) string { return description }
+				target.Match = sgupdater.MatchMarker
+
+				if *legacyMatch {
+					target.Match = sgupdater.MatchLegacy
+				}
+			}
+		}
+
+		opts.Targets = append(opts.Targets, target)
+	}
+
+	if *perServiceDescription {
+		opts.Targets, err = expandServices(opts.Targets, services, len(ruleSpecs) > 0, descriptionLimit(opts.TTL > 0, opts.GracePeriod > 0))
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", flagSource("per-service-description"), err)
+		}
+	}
+
+	if len(extraCidrs) > 0 {
+		extras, err := parseExtraCidrs(extraCidrs, opts.Targets, descriptionLimit(opts.TTL > 0, opts.GracePeriod > 0))
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", flagSource("extra-cidr"), err)
+		}
+
+		opts.Targets = append(opts.Targets, extras...)
+	}
+
+	if opts.Roster != "" {
+		roster, err := loadRoster(opts.Roster)
+		if err != nil {
+			return opts, err
+		}
+
+		if *pruneRoster && strings.TrimSpace(roster.Prefix) == "" {
+			return opts, fmt.Errorf("%s: the roster has no prefix, pruning would match every rule", flagSource("prune-roster"))
+		}
+
+		opts.Targets, err = expandRoster(opts.Targets, roster, *pruneRoster, descriptionLimit(opts.TTL > 0, opts.GracePeriod > 0))
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", flagSource("roster"), err)
+		}
+
+		slog.Info("Loaded roster file", "path", opts.Roster, "members", len(roster.Members))
+	}
+
+	for _, profile := range opts.Profiles {
+		if len(targetsForProfile(opts.Targets, profile)) == 0 {
+			return opts, fmt.Errorf("profile '%s' has no entries to sync", profile)
+		}
+	}
+
+	return opts, nil
+}
+
+// optionFlags tells the validation helpers which flags were set, on the command
+// line or through the environment, and where each value came from.
+type optionFlags struct {
+	set     map[string]bool
+	fromEnv map[string]string
+}
+
+// source names where a flag's value came from, for validation errors.
+func (f optionFlags) source(name string) string {
+	if envName, ok := f.fromEnv[name]; ok {
+		return envName
+	}
+
+	return "--" + name
+}
+
+// value returns the flag's value, for flags that do not end up in options as
+// given.
+func (f optionFlags) value(name string) string {
+	return flag.CommandLine.Lookup(name).Value.String()
+}
+
+// enabled reports whether a boolean flag is on.
+func (f optionFlags) enabled(name string) bool {
+	return f.value(name) == "true"
+}
+
+// parseDirections turns a --direction value into the directions rules are synced
+// in.
+func parseDirections(value string) ([]sgupdater.Direction, error) {
+	switch value {
+	case "ingress":
+		return []sgupdater.Direction{sgupdater.Ingress}, nil
+	case "egress":
+		return []sgupdater.Direction{sgupdater.Egress}, nil
+	case "both":
+		return []sgupdater.Direction{sgupdater.Ingress, sgupdater.Egress}, nil
+	default:
+		return nil, fmt.Errorf("must be ingress, egress or both, got '%s'", value)
+	}
+}
+
+// validateOutput checks --output and --color.
+func validateOutput(opts options, flags optionFlags) error {
+	if opts.OutputFormat != outputText && opts.OutputFormat != outputJSON {
+		return fmt.Errorf("invalid --output value '%s': use text or json", opts.OutputFormat)
+	}
+
+	if opts.Color != colorAuto && opts.Color != colorAlways && opts.Color != colorNever {
+		return fmt.Errorf("invalid %s value '%s': use auto, always or never", flags.source("color"), flags.value("color"))
+	}
+
+	return nil
+}
+
+// validateHistory checks the options of the history subcommand, and that --last is
+// not given without it.
+func validateHistory(opts options, flags optionFlags) error {
+	if !opts.History {
+		if flags.set["last"] {
+			return fmt.Errorf("--last is only used by history")
+		}
+
+		return nil
+	}
+
+	if opts.HistoryFile == "" {
+		return fmt.Errorf("history requires --history-file")
+	}
+
+	if opts.HistoryLast < 1 {
+		return fmt.Errorf("%s must be at least 1", flags.source("last"))
+	}
+
+	return nil
+}
+
+// validateModes checks how --remove, --confirm, --plan, --check, --lambda,
+// --state-file and --retry-from combine.
+func validateModes(opts options, flags optionFlags) error {
+	if opts.Remove && (opts.Watch || opts.IPOverride != "") {
+		return fmt.Errorf("--remove cannot be combined with --watch or --ip")
+	}
+
+	if opts.Confirm && opts.Watch {
+		return fmt.Errorf("--confirm cannot be combined with --watch")
+	}
+
+	if opts.Apply && !opts.Plan {
+		return fmt.Errorf("--apply requires --plan")
+	}
+
+	if opts.Plan && (opts.Watch || (opts.Apply && opts.DryRun)) {
+		return fmt.Errorf("--plan cannot be combined with --watch, and --plan --apply cannot be combined with --dry-run")
+	}
+
+	if opts.Check && (opts.Remove || opts.Watch || opts.Plan || opts.Confirm) {
+		return fmt.Errorf("--check cannot be combined with --remove, --watch, --plan or --confirm")
+	}
+
+	if opts.Lambda && (opts.Watch || opts.List || opts.Plan || opts.Confirm || opts.Check) {
+		return fmt.Errorf("--lambda cannot be combined with --watch, list, --plan, --confirm or --check")
+	}
+
+	if opts.StateFile != "" && (opts.Watch || opts.Remove || opts.List || opts.CleanExpired || opts.Check || opts.Plan) {
+		return fmt.Errorf("--state-file cannot be combined with --watch, --remove, --check, --plan, list or clean-expired")
+	}
+
+	if flags.value("retry-from") != "" && (opts.Watch || opts.Listen != "" || opts.Lambda || opts.Select || opts.List || opts.Doctor || opts.Rollback || opts.IAMPolicy || opts.PrefixListID != "" || opts.WAFIPSet != nil || opts.LightsailInstance != "") {
+		return fmt.Errorf("%s cannot be combined with --watch, --listen, --lambda, --select, --prefix-list-id, --wafv2-ipset, --lightsail-instance, list, doctor, rollback or iam-policy", flags.source("retry-from"))
+	}
+
+	return nil
+}
+
+// validateSubcommands checks the options of clean-expired, rollback, doctor and
+// list, and of --backup-dir, the snapshot rollback restores.
+func validateSubcommands(opts options, flags optionFlags) error {
+	if opts.CleanExpired && opts.CleanPrefix == "" {
+		return fmt.Errorf("clean-expired requires a non-empty --prefix, so teams only clean up their own rules")
+	}
+
+	if !opts.CleanExpired && flags.set["prefix"] {
+		return fmt.Errorf("--prefix is only used by clean-expired")
+	}
+
+	if opts.CleanExpired && (opts.Remove || opts.Watch || opts.Check || opts.IPOverride != "" || opts.PrunePrefix != "" || opts.TTL != 0) {
+		return fmt.Errorf("clean-expired cannot be combined with --remove, --watch, --check, --ip, --prune-prefix or --ttl")
+	}
+
+	if opts.Rollback && opts.BackupFile == "" {
+		return fmt.Errorf("rollback requires --backup, the snapshot to restore")
+	}
+
+	if !opts.Rollback && flags.set["backup"] {
+		return fmt.Errorf("--backup is only used by rollback")
+	}
+
+	if opts.Rollback && (opts.Watch || opts.Listen != "" || opts.Lambda || opts.Remove || opts.Plan || opts.Confirm || opts.Check || opts.BackupDir != "") {
+		return fmt.Errorf("rollback cannot be combined with --watch, --listen, --lambda, --remove, --plan, --confirm, --check or --backup-dir")
+	}
+
+	if opts.BackupDir != "" && (opts.List || opts.Listen != "" || opts.Lambda || opts.Check) {
+		return fmt.Errorf("--backup-dir cannot be combined with list, --listen, --lambda or --check")
+	}
+
+	if opts.Doctor && (opts.Remove || opts.Watch || opts.Listen != "" || opts.Lambda || opts.Plan || opts.Confirm || opts.Check || opts.BackupDir != "") {
+		return fmt.Errorf("doctor cannot be combined with --remove, --watch, --listen, --lambda, --plan, --confirm, --check or --backup-dir")
+	}
+
+	if opts.List && (opts.Remove || opts.Watch || opts.Plan || opts.Confirm || opts.Check || opts.IPOverride != "") {
+		return fmt.Errorf("list cannot be combined with --remove, --watch, --plan, --confirm, --check or --ip")
+	}
+
+	return nil
+}
+
+// validateRuleLifetime checks --ttl, --grace-period and --prune-prefix, which
+// decide when rules are revoked.
+func validateRuleLifetime(opts options, flags optionFlags) error {
+	if opts.TTL < 0 || (opts.TTL > 0 && (opts.Remove || opts.List)) {
+		return fmt.Errorf("--ttl must be positive and cannot be combined with --remove or list")
+	}
+
+	if opts.GracePeriod < 0 || (opts.GracePeriod > 0 && (opts.Remove || opts.List || opts.CleanExpired)) {
+		return fmt.Errorf("--grace-period must be positive and cannot be combined with --remove, list or clean-expired")
+	}
+
+	if flags.set["prune-prefix"] && strings.TrimSpace(opts.PrunePrefix) == "" {
+		return fmt.Errorf("%s must not be empty, it would match every rule", flags.source("prune-prefix"))
+	}
+
+	if opts.PrunePrefix != "" && (opts.Remove || opts.List) {
+		return fmt.Errorf("--prune-prefix cannot be combined with --remove or list")
+	}
+
+	return nil
+}
+
+// validateIPSources checks that the addresses to allow come from one place: --ip,
+// --ip-parameter, --roster, --cidr-source-url or discovery, with any --extra-cidr.
+func validateIPSources(opts options, flags optionFlags) error {
+	if opts.Roster != "" && (opts.Watch || opts.Listen != "" || opts.Lambda || opts.CleanExpired || opts.IPOverride != "" || opts.IPParameter != "" || opts.StateFile != "") {
+		return fmt.Errorf("--roster cannot be combined with --watch, --listen, --lambda, clean-expired, --ip, --ip-parameter or --state-file")
+	}
+
+	if opts.CIDRSourceURL != "" && (opts.Watch || opts.Listen != "" || opts.Lambda || opts.CleanExpired || opts.IPOverride != "" || opts.IPParameter != "" || opts.Roster != "") {
+		return fmt.Errorf("--cidr-source-url cannot be combined with --watch, --listen, --lambda, clean-expired, --ip, --ip-parameter or --roster")
+	}
+
+	if opts.CIDRSourceURL != "" && (opts.GracePeriod > 0 || opts.VerifyTimeout > 0 || opts.TagGroups) {
+		return fmt.Errorf("--cidr-source-url cannot be combined with --grace-period, --verify or --tag-groups, which follow a single address")
+	}
+
+	if opts.Watch && opts.IPOverride != "" {
+		return fmt.Errorf("--watch cannot be combined with --ip, the address would never change")
+	}
+
+	if opts.IPParameter != "" && (opts.IPOverride != "" || opts.Watch || opts.Remove || opts.CleanExpired) {
+		return fmt.Errorf("--ip-parameter cannot be combined with --ip, --watch, --remove or clean-expired")
+	}
+
+	if flags.value("extra-cidr") != "" && (opts.Roster != "" || opts.CIDRSourceURL != "" || opts.CleanExpired) {
+		return fmt.Errorf("--extra-cidr cannot be combined with --roster, --cidr-source-url or clean-expired")
+	}
+
+	return nil
+}
+
+// validateRuleFlags checks how --direction, --per-service-description,
+// --prune-roster and the description flags combine.
+func validateRuleFlags(opts options, flags optionFlags) error {
+	describedByFlags := flags.value("description-template") != "" || flags.value("description") != ""
+
+	// Pruning, clean-expired, allowlists and backups only know ingress rules.
+	if !slices.Equal(opts.Directions, []sgupdater.Direction{sgupdater.Ingress}) && (opts.PrunePrefix != "" || flags.enabled("prune-roster") || opts.CleanExpired || opts.CIDRSourceURL != "" || opts.BackupDir != "" || opts.Rollback) {
+		return fmt.Errorf("%s cannot be combined with --prune-prefix, --prune-roster, clean-expired, --cidr-source-url, --backup-dir or rollback", flags.source("direction"))
+	}
+
+	if flags.enabled("per-service-description") && (describedByFlags || opts.Roster != "" || flags.value("extra-cidr") != "" || opts.CleanExpired) {
+		return fmt.Errorf("--per-service-description cannot be combined with --description-template, --description, --roster, --extra-cidr or clean-expired")
+	}
+
+	if opts.Roster != "" && describedByFlags {
+		return fmt.Errorf("--roster cannot be combined with --description-template or --description, the members' names describe their rules")
+	}
+
+	if flags.enabled("prune-roster") && (opts.Roster == "" || opts.PrunePrefix != "" || opts.Remove || opts.List) {
+		return fmt.Errorf("%s requires --roster and cannot be combined with --prune-prefix, --remove or list", flags.source("prune-roster"))
+	}
+
+	return nil
+}
+
+// validateDestinations checks that at most one of --prefix-list-id, --wafv2-ipset
+// and --lightsail-instance replaces the Security Groups, and that none is combined
+// with flags that only apply to them. It also checks --route53-record.
+func validateDestinations(opts options, flags optionFlags) error {
+	if (opts.Route53ZoneID == "") != (opts.Route53Record == "") {
+		return fmt.Errorf("--route53-zone-id and --route53-record must be set together")
+	}
+
+	if opts.Route53Record != "" && (opts.Remove || opts.List || opts.CleanExpired || opts.Check) {
+		return fmt.Errorf("--route53-record cannot be combined with --remove, --check, list or clean-expired")
+	}
+
+	var listFlags []string
+
+	if opts.PrefixListID != "" {
+		listFlags = append(listFlags, "--prefix-list-id")
+	}
+
+	if opts.WAFIPSet != nil {
+		listFlags = append(listFlags, "--wafv2-ipset")
+	}
+
+	if opts.LightsailInstance != "" {
+		listFlags = append(listFlags, "--lightsail-instance")
+	}
+
+	switch {
+	case len(listFlags) > 1:
+		return fmt.Errorf("only one of %s can be used", strings.Join(listFlags, ", "))
+	case len(listFlags) == 0:
+		return nil
+	}
+
+	listFlag := listFlags[0]
+
+	for _, name := range []string{"sg-id", "sg-tag-name", "sg-id-file", "sg-tag-file", "sg-tag", "sg-name", "instance-id", "load-balancer-name", "load-balancer-arn", "vpc-id", "owner-id", "exclude-sg-id", "config", "all-regions", "prune-prefix", "ttl", "grace-period", "tag-groups", "verify", "backup-dir", "require-tag", "strict-tags", "description-template", "match-prefix", "description", "legacy-match", "roster", "prune-roster", "cidr-source-url", "extra-cidr", "rule", "service", "per-service-description", "direction", "fail-on-open", "skip-if-covered", "check-quota", "rules-quota", "select"} {
+		if flags.set[name] {
+			return fmt.Errorf("%s cannot be combined with %s", listFlag, flags.source(name))
+		}
+	}
+
+	if opts.Remove || opts.List || opts.CleanExpired || len(opts.Regions) > 1 {
+		return fmt.Errorf("%s cannot be combined with --remove, list, clean-expired or several regions", listFlag)
+	}
+
+	if opts.Ephemeral || opts.Doctor {
+		return fmt.Errorf("%s cannot be combined with --ephemeral or doctor", listFlag)
+	}
+
+	return nil
+}
+
+// validateGroupSelection checks --owner-id, --all-regions and --select, which
+// decide the groups and regions synced.
+func validateGroupSelection(opts options, flags optionFlags) error {
+	if opts.OwnerID != ownerSelf && !isAccountID(opts.OwnerID) {
+		return fmt.Errorf("invalid %s '%s': use self or a 12-digit account ID", flags.source("owner-id"), opts.OwnerID)
+	}
+
+	if opts.AllRegions && len(opts.Regions) > 0 && flags.set["region"] {
+		return fmt.Errorf("--all-regions cannot be combined with --region")
+	}
+
+	if !opts.Select {
+		return nil
+	}
+
+	for _, name := range []string{"sg-id", "sg-id-file", "sg-name", "instance-id", "load-balancer-name", "load-balancer-arn", "config", "all-regions", "roster", "extra-cidr"} {
+		if flags.set[name] {
+			return fmt.Errorf("--select cannot be combined with %s", flags.source(name))
+		}
+	}
+
+	if opts.Watch || opts.Listen != "" || opts.Lambda || opts.List || opts.Doctor || opts.Rollback || opts.IAMPolicy || opts.CleanExpired || len(opts.Profiles) > 1 || len(opts.Regions) > 1 {
+		return fmt.Errorf("--select cannot be combined with --watch, --listen, --lambda, a subcommand, several profiles or several regions")
+	}
+
+	if flags.value("sg-tag-file") == "-" {
+		return fmt.Errorf("--select reads the selection from stdin, so %s cannot read it too", flags.source("sg-tag-file"))
+	}
+
+	return nil
+}
+
+// validateEndpoint checks --endpoint-url and the settings of every AWS API call.
+func validateEndpoint(opts options, flags optionFlags) error {
+	if opts.Endpoint.URL != "" && !strings.HasPrefix(opts.Endpoint.URL, "https://") && !strings.HasPrefix(opts.Endpoint.URL, "http://") {
+		return fmt.Errorf("%s must be an http(s) URL", flags.source("endpoint-url"))
+	}
+
+	if opts.Endpoint.Insecure && opts.Endpoint.URL == "" {
+		return fmt.Errorf("--insecure requires --endpoint-url")
+	}
+
+	if opts.APICalls.MaxRetries < 0 {
+		return fmt.Errorf("%s cannot be negative", flags.source("max-api-retries"))
+	}
+
+	if opts.APICalls.RetryMode != string(aws.RetryModeStandard) && opts.APICalls.RetryMode != string(aws.RetryModeAdaptive) {
+		return fmt.Errorf("%s must be 'standard' or 'adaptive'", flags.source("api-retry-mode"))
+	}
+
+	if opts.APICalls.Timeout < 0 {
+		return fmt.Errorf("%s cannot be negative", flags.source("api-timeout"))
+	}
+
+	if opts.RunTimeout < 0 {
+		return fmt.Errorf("%s cannot be negative", flags.source("run-timeout"))
+	}
+
+	return nil
+}
+
+// validateNotifications checks where runs are reported: Slack, --ping-url, the
+// webhook, CloudWatch and SNS.
+func validateNotifications(opts options, flags optionFlags) error {
+	if opts.SlackWebhookURL != "" && !strings.HasPrefix(opts.SlackWebhookURL, "https://") && !strings.HasPrefix(opts.SlackWebhookURL, "http://") {
+		return fmt.Errorf("%s must be an http(s) URL", flags.source("slack-webhook-url"))
+	}
+
+	if opts.PingURL != "" && !strings.HasPrefix(opts.PingURL, "https://") && !strings.HasPrefix(opts.PingURL, "http://") {
+		return fmt.Errorf("%s must be an http(s) URL", flags.source("ping-url"))
+	}
+
+	if opts.WebhookURL != "" && !strings.HasPrefix(opts.WebhookURL, "https://") && !strings.HasPrefix(opts.WebhookURL, "http://") {
+		return fmt.Errorf("%s must be an http(s) URL", flags.source("webhook-url"))
+	}
+
+	if !slices.Contains([]string{webhookOnChange, webhookOnFailure, webhookOnAlways}, opts.WebhookOn) {
+		return fmt.Errorf("invalid %s value '%s': use change, failure or always", flags.source("webhook-on"), opts.WebhookOn)
+	}
+
+	if opts.WebhookTimeout <= 0 {
+		return fmt.Errorf("%s must be greater than zero", flags.source("webhook-timeout"))
+	}
+
+	if flags.enabled("cloudwatch-metrics") && opts.MetricsNamespace == "" {
+		return fmt.Errorf("%s must not be empty", flags.source("cloudwatch-namespace"))
+	}
+
+	if opts.SNSTopicARN != "" {
+		if parsed, err := arn.Parse(opts.SNSTopicARN); err != nil || parsed.Service != "sns" {
+			return fmt.Errorf("%s: '%s' is not an SNS topic ARN", flags.source("sns-topic-arn"), opts.SNSTopicARN)
+		}
+	}
+
+	return nil
+}
+
+// validateDaemon checks the options of the long-running modes: --watch, --listen
+// and --ephemeral, and the --metrics-addr they serve.
+func validateDaemon(opts options, flags optionFlags) error {
+	if opts.MetricsAddr != "" && !opts.Watch && opts.Listen == "" {
+		return fmt.Errorf("%s requires --watch or --listen", flags.source("metrics-addr"))
+	}
+
+	if opts.Listen != "" && (opts.Watch || opts.Lambda || opts.List || opts.Plan || opts.Confirm || opts.Check || opts.Remove || opts.CleanExpired) {
+		return fmt.Errorf("--listen cannot be combined with --watch, --lambda, list, --plan, --confirm, --check, --remove or clean-expired")
+	}
+
+	if opts.Listen != "" && (opts.IPOverride != "" || opts.IPParameter != "" || opts.StateFile != "") {
+		return fmt.Errorf("--listen cannot be combined with --ip, --ip-parameter or --state-file, the IP comes with every push")
+	}
+
+	if opts.Listen != "" && opts.ListenToken == "" {
+		return fmt.Errorf("--listen requires --listen-token, so that only your clients can push an IP")
+	}
+
+	if opts.Watch && opts.Interval <= 0 {
+		return fmt.Errorf("--interval must be greater than zero")
+	}
+
+	if opts.Ephemeral && !opts.Watch && opts.Listen == "" {
+		return fmt.Errorf("--ephemeral requires --watch or --listen")
+	}
+
+	if opts.EphemeralTimeout <= 0 {
+		return fmt.Errorf("%s must be greater than zero", flags.source("ephemeral-timeout"))
+	}
+
+	if (flags.set["stable-checks"] || flags.set["min-update-interval"]) && !opts.Watch {
+		return fmt.Errorf("--stable-checks and --min-update-interval require --watch")
+	}
+
+	if opts.StableChecks < 1 {
+		return fmt.Errorf("%s must be at least 1", flags.source("stable-checks"))
+	}
+
+	if opts.MinUpdateInterval < 0 {
+		return fmt.Errorf("%s cannot be negative", flags.source("min-update-interval"))
+	}
+
+	return nil
+}
+
+// validateTestConnect checks the --test-connect targets and their timeout.
+func validateTestConnect(opts options, flags optionFlags) error {
+	if len(opts.TestConnect.Targets) > 0 && (opts.Listen != "" || opts.Lambda || opts.List || opts.Check || opts.Remove || opts.CleanExpired) {
+		return fmt.Errorf("--test-connect cannot be combined with --listen, --lambda, list, --check, --remove or clean-expired")
+	}
+
+	for _, target := range opts.TestConnect.Targets {
+		if _, port, err := net.SplitHostPort(target); err != nil || port == "" {
+			return fmt.Errorf("invalid %s %q, expected host:port", flags.source("test-connect"), target)
+		}
+	}
+
+	if opts.TestConnect.Timeout <= 0 {
+		return fmt.Errorf("%s must be greater than zero", flags.source("test-connect-timeout"))
+	}
+
+	return nil
+}
+
+// validateLimits checks the rules quota, --max-concurrency and --verify-timeout.
+func validateLimits(opts options, flags optionFlags) error {
+	if opts.RulesQuota < 1 {
+		return fmt.Errorf("%s must be at least 1", flags.source("rules-quota"))
+	}
+
+	if opts.CheckQuota < 0 || opts.CheckQuota >= opts.RulesQuota {
+		return fmt.Errorf("%s must be between 0 and the rules quota", flags.source("check-quota"))
+	}
+
+	if opts.MaxConcurrency < 1 {
+		return fmt.Errorf("%s must be at least 1", flags.source("max-concurrency"))
+	}
+
+	if flags.enabled("verify") && opts.VerifyTimeout <= 0 {
+		return fmt.Errorf("%s must be greater than zero", flags.source("verify-timeout"))
+	}
+
+	return nil
+}
+
+// targetsForProfile returns the targets synced under profile: those bound to it and
+// those not bound to any profile.
+func targetsForProfile(targets []syncTarget, profile string) []syncTarget {
+	var selected []syncTarget
+
+	for _, target := range targets {
+		if target.Profile == "" || target.Profile == profile {
+			selected = append(selected, target)
+		}
+	}
+
+	return selected
+}
+
+// syncTarget is one entry of the run: the groups and rule to sync, and the profile
+// it is limited to, if any.
+type syncTarget struct {
+	sgupdater.Target
+	Profile string
+
+	// RuleDescription renders --description-template or --description; Description
+	// then holds what the rules are matched by, as Match says.
+	RuleDescription func(targetCidr string) string
+	Match           sgupdater.Match
+
+	// Member ties the target to one member of the --roster file, whose address it
+	// allows instead of this host's.
+	Member *memberTarget
+	// FixedCidrs, set for an --extra-cidr entry, are allowed instead of this host's
+	// address.
+	FixedCidrs []string
+}
+
+// parseRuleSpecs turns every --rule protocol[:port] into a rule spec; tcp and udp
+// without a port allow every port, as --port defaults to.
+func parseRuleSpecs(values []string) ([]sgupdater.RuleSpec, error) {
+	var specs []sgupdater.RuleSpec
+
+	for _, value := range values {
+		protocol, port, portSet := strings.Cut(value, ":")
+		if !portSet {
+			port = "0-65535"
+		}
+
+		spec, err := sgupdater.BuildRuleSpec(protocol, port, portSet)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", value, err)
+		}
+
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+// serviceRules is one --service preset: its name and the rules it allows.
+type serviceRules struct {
+	Name  string
+	Rules []sgupdater.RuleSpec
+}
+
+// parseServices looks up every comma-separated --service name among the presets.
+func parseServices(values []string) ([]serviceRules, error) {
+	var services []serviceRules
+
+	for _, value := range values {
+		for _, name := range cleanList(strings.Split(value, ",")) {
+			rules, err := sgupdater.ServiceRules(name)
+			if err != nil {
+				return nil, err
+			}
+
+			name = strings.ToLower(name)
+
+			if slices.ContainsFunc(services, func(service serviceRules) bool { return service.Name == name }) {
+				return nil, fmt.Errorf("service '%s' is given more than once", name)
+			}
+
+			services = append(services, serviceRules{Name: name, Rules: rules})
+		}
+	}
+
+	return services, nil
+}
+
+// expandServices gives every service a target of its own per target, described as
+// the target's description followed by the service name, e.g. laptop-ssh. The
+// targets themselves are only kept when keepTargets says they have --rule specs.
+func expandServices(targets []syncTarget, services []serviceRules, keepTargets bool, limit int) ([]syncTarget, error) {
+	var expanded []syncTarget
+
+	for _, target := range targets {
+		if keepTargets {
+			expanded = append(expanded, target)
+		}
+
+		for _, service := range services {
+			serviceTarget := target
+			serviceTarget.Description = target.Description + "-" + service.Name
+			serviceTarget.Name = serviceTarget.Description
+			serviceTarget.Rule = service.Rules[0]
+			serviceTarget.ExtraRules = service.Rules[1:]
+
+			if target.Name != "" {
+				serviceTarget.Name = target.Name + "/" + service.Name
+			}
+
+			if err := checkDescription(serviceTarget.Description, limit); err != nil {
+				return nil, err
+			}
+
+			expanded = append(expanded, serviceTarget)
+		}
+	}
+
+	return expanded, nil
+}
+
+// extraCidrSource is the IP source reported for --extra-cidr entries.
+const extraCidrSource = "from --extra-cidr"
+
+// parseExtraCidrs turns every --extra-cidr CIDR=description into one more target
+// per target, with the same groups and rule, under its own description.
+func parseExtraCidrs(values []string, targets []syncTarget, limit int) ([]syncTarget, error) {
+	var extras []syncTarget
+
+	seen := make(map[string]bool)
+
+	for _, target := range targets {
+		seen[target.Description] = true
+	}
+
+	for _, value := range values {
+		rawCidr, description, ok := strings.Cut(value, "=")
+		description = strings.TrimSpace(description)
+
+		if !ok || description == "" {
+			return nil, fmt.Errorf("'%s' is not CIDR=description", value)
+		}
+
+		cidr, err := parseIPOverride(rawCidr)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkDescription(description, limit); err != nil {
+			return nil, err
+		}
+
+		if seen[description] {
+			return nil, fmt.Errorf("description '%s' is already used, every extra CIDR needs its own", description)
+		}
+
+		seen[description] = true
+
+		for _, target := range targets {
+			extra := target
+			extra.Name = description
+			extra.Description = description
+			extra.RuleDescription = nil
+			extra.Match = sgupdater.MatchExact
+			extra.FixedCidrs = []string{cidr}
+
+			if target.Name != "" {
+				extra.Name = target.Name + "/" + description
+			}
+
+			extras = append(extras, extra)
+		}
+	}
+
+	return extras, nil
+}
+
+// noteExtraOverlap logs when an --extra-cidr range already covers an address the
+// run discovered, so its own rule is redundant while it does.
+func noteExtraOverlap(targets []syncTarget, targetCidrs []string) {
+	for _, target := range targets {
+		for _, extraCidr := range target.FixedCidrs {
+			_, extraNet, err := net.ParseCIDR(extraCidr)
+			if err != nil {
+				continue
+			}
+
+			for _, targetCidr := range targetCidrs {
+				if ip, _, err := net.ParseCIDR(targetCidr); err == nil && extraNet.Contains(ip) {
+					slog.Info("The discovered address is already covered by an --extra-cidr", "cidr", targetCidr, "extra_cidr", extraCidr, "description", target.Description)
+				}
+			}
+		}
+	}
+}
+
+// owns matches the rules synced for the target.
+func (t syncTarget) owns() func(string) bool {
+	return t.Match.Owns(t.Description)
+}
+
+// memberTarget is the roster side of a target expanded from a --roster file.
+type memberTarget struct {
+	rosterMember
+	// Entry numbers the target the member was expanded from; with --prune-roster,
+	// Prune is set on one member per entry, whose sync revokes the rules of former
+	// members: those starting with Prefix that Keep does not match.
+	Entry  int
+	Prefix string
+	Keep   func(string) bool
+	Prune  bool
+	// Cidrs and Err are the member's address as resolved before the run.
+	Cidrs []string
+	Err   error
+}
+
+// expandRoster turns every target into one target per roster member, described as
+// the roster's prefix followed by the member's name.
+func expandRoster(targets []syncTarget, roster rosterFile, prune bool, limit int) ([]syncTarget, error) {
+	var keep []func(string) bool
+
+	for _, member := range roster.Members {
+		description := roster.Prefix + member.Name
+		if err := checkDescription(description, limit); err != nil {
+			return nil, fmt.Errorf("member '%s': %w", member.Name, err)
+		}
+
+		keep = append(keep, sgupdater.OwnDescription(description))
+	}
+
+	isMember := func(ruleDescription string) bool {
+		return slices.ContainsFunc(keep, func(match func(string) bool) bool { return match(ruleDescription) })
+	}
+
+	var expanded []syncTarget
+
+	for i, target := range targets {
+		for _, member := range roster.Members {
+			expandedTarget := target
+			expandedTarget.Name = member.Name
+			expandedTarget.Description = roster.Prefix + member.Name
+			expandedTarget.Member = &memberTarget{rosterMember: member, Entry: i}
+
+			if target.Name != "" {
+				expandedTarget.Name = target.Name + "/" + member.Name
+			}
+
+			if prune {
+				expandedTarget.Member.Prefix = roster.Prefix
+				expandedTarget.Member.Keep = isMember
+			}
+
+			expanded = append(expanded, expandedTarget)
+		}
+	}
+
+	return expanded, nil
+}
+
+// resolveRoster looks up the address of every roster member before a run. The
+// targets of a member whose address cannot be fetched are left out of the run, and
+// reported as failed, without their rules being pruned; the first member resolved
+// for each entry prunes with --prune-roster.
+func resolveRoster(targets []syncTarget) []sgupdater.Result {
+	resolved := make(map[string]*memberTarget)
+	pruning := make(map[int]bool)
+
+	var failures []sgupdater.Result
+
+	for _, target := range targets {
+		member := target.Member
+		if member == nil {
+			continue
+		}
+
+		if earlier := resolved[member.Name]; earlier != nil {
+			member.Cidrs, member.Err = earlier.Cidrs, earlier.Err
+		} else {
+			resolved[member.Name] = member
+
+			if member.IP != "" {
+				member.Cidrs = []string{member.IP}
+			} else if ip, err := fetchMemberIP(member.URL); err != nil {
+				member.Err = fmt.Errorf("roster member '%s': %w", member.Name, err)
+				failures = append(failures, sgupdater.Result{Name: member.Name, IPSource: rosterIPSource, Errors: []error{member.Err}})
+			} else {
+				member.Cidrs = []string{ip}
+				slog.Info("Fetched the address of a roster member", "member", member.Name, "cidr", ip)
+			}
+		}
+
+		if member.Err == nil && member.Prefix != "" && !pruning[member.Entry] {
+			pruning[member.Entry] = true
+			member.Prune = true
+		}
+	}
+
+	return failures
+}
+
+// fetchCIDRList downloads the --cidr-source-url allowlist: one CIDR per line, with
+// blank lines and # comments ignored. Every CIDR is normalized to its network
+// address; an empty list is an error, as it would revoke every rule.
+func fetchCIDRList(url string) ([]string, error) {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %s", url, resp.Status)
+	}
+
+	var cidrs []string
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid CIDR '%s'", line, entry)
+		}
+
+		if !slices.Contains(cidrs, ipNet.String()) {
+			cidrs = append(cidrs, ipNet.String())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the allowlist: %w", err)
+	}
+
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("%s lists no CIDRs", url)
+	}
+
+	return cidrs, nil
+}
+
+// rosterIPSource is the IP source reported for roster members.
+const rosterIPSource = "from the roster"
+
+// fetchMemberIP reads a roster member's address from url, which returns an address
+// or CIDR as plain text.
+func fetchMemberIP(url string) (string, error) {
+	httpClient := &http.Client{Timeout: ipServiceTimeout}
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned status %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return parseIPOverride(string(body))
+}
+
+// subcommand is a verb given before the flags. Every subcommand shares the same
+// flags; the ones that do not apply to it are rejected when the options are parsed.
+type subcommand struct {
+	Name    string
+	Aliases []string
+	Summary string
+}
+
+var subcommands = []subcommand{
+	{Name: "sync", Summary: "Sync the rules to the current public IP (the default without a subcommand)"},
+	{Name: "list", Summary: "Print the rules with your description in the selected groups"},
+	{Name: "remove", Summary: "Revoke the rules with your description, like --remove"},
+	{Name: "clean-expired", Aliases: []string{"clean"}, Summary: "Revoke the expired rules whose description starts with --prefix"},
+	{Name: "doctor", Summary: "Check the IP service, credentials and EC2 permissions without changing anything"},
+	{Name: "rollback", Summary: "Restore the rules recorded in a --backup-dir file"},
+	{Name: "iam-policy", Summary: "Print the IAM policy the run needs"},
+	{Name: "history", Summary: "Print the latest runs recorded in --history-file"},
+	{Name: "completion", Summary: "Print a completion script for bash, zsh or fish"},
+}
+
+// lookupSubcommand returns the name of the subcommand called name or one of its
+// aliases.
+func lookupSubcommand(name string) (string, bool) {
+	for _, sub := range subcommands {
+		if sub.Name == name || slices.Contains(sub.Aliases, name) {
+			return sub.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// subcommandNames lists every subcommand and alias, in the order they are documented.
+func subcommandNames() []string {
+	var names []string
+
+	for _, sub := range subcommands {
+		names = append(names, sub.Name)
+		names = append(names, sub.Aliases...)
+	}
+
+	return names
+}
+
+func printUsage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [subcommand] [flags]\n\nSubcommands:\n", filepath.Base(os.Args[0]))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, sub := range subcommands {
+		name := sub.Name
+		if len(sub.Aliases) > 0 {
+			name += " (" + strings.Join(sub.Aliases, ", ") + ")"
+		}
+
+		fmt.Fprintf(tw, "  %s\t%s\n", name, sub.Summary)
+	}
+	tw.Flush()
+
+	fmt.Fprint(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// printCompletion writes a completion script for shell, completing the subcommands
+// as the first word and the flags after it. The completed command is the name the
+// program was run as.
+func printCompletion(w io.Writer, shell string) {
+	command := filepath.Base(os.Args[0])
+	function := "_" + regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(command, "_")
+
+	var flags []string
+
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "--"+f.Name)
+	})
+
+	switch shell {
+	case "bash":
+		fmt.Fprintf(w, `%[1]s() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then
+		COMPREPLY=($(compgen -W "%[3]s" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "%[4]s" -- "$cur"))
+	fi
+}
+complete -o default -F %[1]s %[2]s
+`, function, command, strings.Join(subcommandNames(), " "), strings.Join(flags, " "))
+	case "zsh":
+		fmt.Fprintf(w, `#compdef %[2]s
+%[1]s() {
+	if (( CURRENT == 2 )) && [[ $words[CURRENT] != -* ]]; then
+		compadd -- %[3]s
+	else
+		compadd -- %[4]s
+	fi
+}
+compdef %[1]s %[2]s
+`, function, command, strings.Join(subcommandNames(), " "), strings.Join(flags, " "))
+	case "fish":
+		for _, sub := range subcommands {
+			for _, name := range append([]string{sub.Name}, sub.Aliases...) {
+				fmt.Fprintf(w, "complete -c %s -f -n __fish_use_subcommand -a %s -d %s\n", command, name, fishQuote(sub.Summary))
+			}
+		}
+
+		flag.VisitAll(func(f *flag.Flag) {
+			option := "-r"
+			if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+				option = "-f"
+			}
+
+			fmt.Fprintf(w, "complete -c %s %s -l %s -d %s\n", command, option, f.Name, fishQuote(f.Usage))
+		})
+	}
+}
+
+func fishQuote(text string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(text) + "'"
+}
+
+// resolvedTarget is a syncTarget together with the security groups it resolved to.
+type resolvedTarget struct {
+	syncTarget
+	sgupdater.Resolved
+}
+
+func main() {
+	opts, err := parseOptions()
+	if err != nil {
+		slog.Error("Invalid options", "error", err)
+		flag.Usage()
+		os.Exit(exitFatal)
+	}
+
+	if opts.Completion != "" {
+		printCompletion(os.Stdout, opts.Completion)
+		return
+	}
+
+	colorMode = opts.Color
+
+	if opts.History {
+		os.Exit(printHistory(opts.HistoryFile, opts.HistoryLast, opts.OutputFormat))
+	}
+
+	if opts.Lambda {
+		lambda.Start(func(ctx context.Context, event lambdaEvent) (any, error) {
+			return handleLambda(ctx, opts, event)
+		})
+
+		return
+	}
+
+	if opts.Rollback {
+		ctx, stop := interruptContext()
+		exitCode := rollback(ctx, opts)
+		stop()
+
+		os.Exit(exitCode)
+	}
+
+	if opts.Doctor {
+		ctx, stop := interruptContext()
+		exitCode := doctor(ctx, opts)
+		stop()
+
+		os.Exit(exitCode)
+	}
+
+	if opts.IAMPolicy {
+		ctx, stop := interruptContext()
+		exitCode := printIAMPolicy(ctx, opts)
+		stop()
+
+		os.Exit(exitCode)
+	}
+
+	if opts.Select {
+		ctx, stop := interruptContext()
+		err := selectTargetGroups(ctx, &opts)
+		stop()
+
+		if err != nil {
+			fatal("Failed to select Security Groups", "error", err)
+		}
+	}
+
+	// fail pings --ping-url about a setup error before exiting on it.
+	fail := func(msg string, err error) {
+		pingSetupError(opts, msg, err)
+		fatal(msg, "error", err)
+	}
+
+	var targetCidrs []string
+	ipSource := "discovered"
+
+	// Roster members whose address could not be fetched are reported with every run.
+	var rosterFailures []sgupdater.Result
+
+	if opts.Roster != "" {
+		ipSource = rosterIPSource
+
+		if !opts.Remove && !opts.List {
+			rosterFailures = resolveRoster(opts.Targets)
+		}
+	} else if opts.CIDRSourceURL != "" {
+		ipSource = "from --cidr-source-url"
+
+		if !opts.Remove && !opts.List {
+			targetCidrs, err = fetchCIDRList(opts.CIDRSourceURL)
+			if err != nil {
+				fail("Failed to fetch the allowlist from --cidr-source-url", err)
+			}
+
+			slog.Info("Fetched the allowlist", "url", opts.CIDRSourceURL, "cidrs", len(targetCidrs))
+		}
+	} else if opts.IPOverride != "" {
+		targetCidr, err := parseIPOverride(opts.IPOverride)
+		if err != nil {
+			fail("Invalid --ip value", err)
+		}
+
+		slog.Info("Using IP from --ip flag, skipping public IP discovery", "cidr", targetCidr)
+		targetCidrs = append(targetCidrs, targetCidr)
+		ipSource = "from --ip flag"
+	} else if opts.IPParameter != "" {
+		targetCidr, err := readIPParameter(context.Background(), opts)
+		if err != nil {
+			fail("Failed to read the IP from --ip-parameter", err)
+		}
+
+		targetCidrs = append(targetCidrs, targetCidr)
+		ipSource = "from SSM parameter"
+	} else if !opts.Watch && opts.Listen == "" && !opts.Remove && !opts.List && !opts.CleanExpired {
+		targetCidrs, err = discoverTargetCidrs(opts.Families, opts.IPServices)
+		if err != nil {
+			fail("Failed to get public IP", err)
+		}
+	}
+
+	var state syncState
+
+	if opts.StateFile != "" {
+		state, err = loadState(opts.StateFile)
+		if err != nil {
+			slog.Warn("Ignoring unreadable state file", "path", opts.StateFile, "error", err)
+			state = syncState{Entries: make(map[string]stateEntry)}
+		}
+
+		if !opts.Force && !opts.DryRun && state.unchanged(opts, targetCidrs) {
+			slog.Info("IP unchanged, skipping", "cidrs", strings.Join(targetCidrs, ", "), "state_file", opts.StateFile)
+
+			if opts.PingURL != "" {
+				ping(opts.PingURL, "")
+			}
+
+			return
+		}
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	// In watch and --listen mode every sync gets --run-timeout of its own instead.
+	if opts.RunTimeout > 0 && !opts.Watch && opts.Listen == "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.RunTimeout)
+		defer cancel()
+	}
+
+	runs, err := prepareRuns(ctx, opts)
+	if err != nil {
+		fail("Failed to prepare the run", err)
+	}
+
+	if opts.List {
+		os.Exit(listRules(runs, opts.OutputFormat))
+	}
+
+	var metrics *daemonMetrics
+	stopMetrics := func() {}
+
+	if opts.MetricsAddr != "" {
+		metrics = newDaemonMetrics()
+		stopMetrics = serveMetrics(opts.MetricsAddr, metrics)
+	}
+
+	// Only the rules put in place by this run are revoked with --ephemeral.
+	var ephemeral *ephemeralRules
+
+	if opts.Ephemeral {
+		ephemeral = &ephemeralRules{}
+	}
+
+	if opts.Listen != "" {
+		exitCode := serveUpdates(ctx, opts, runs, metrics, ephemeral)
+		stopMetrics()
+
+		if opts.Ephemeral {
+			exitCode = max(exitCode, revokeEphemeral(runs, opts, ephemeral))
+		}
+
+		os.Exit(exitCode)
+	}
+
+	// Only the first sync may work from the groups described during resolution; in
+	// watch mode later syncs describe the rules again, since they may have changed.
+	firstSync := true
+
+	runOnce := func(targetCidrs []string) int {
+		ctx := ctx
+		if opts.RunTimeout > 0 && opts.Watch {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.RunTimeout)
+			defer cancel()
+		}
+
+		useResolvedGroups := firstSync
+		firstSync = false
+
+		noteExtraOverlap(opts.Targets, targetCidrs)
+
+		if opts.Check {
+			checkReports := append(syncRuns(ctx, runs, opts, targetCidrs, ipSource, true, useResolvedGroups), rosterFailures...)
+			exitCode := checkExitCode(checkReports)
+
+			if opts.OutputFormat == outputJSON {
+				printSummary(checkReports, nil, opts.OutputFormat, exitCode)
+			} else {
+				printCheck(os.Stdout, checkReports)
+			}
+
+			return exitCode
+		}
+
+		// A plan is a dry run rendered as a diff; with --apply or after confirmation the
+		// same changes are then made for real.
+		if opts.Plan || (opts.Confirm && !opts.DryRun) {
+			planReports := append(syncRuns(ctx, runs, opts, targetCidrs, ipSource, true, useResolvedGroups), rosterFailures...)
+
+			if opts.OutputFormat == outputText {
+				printPlan(os.Stdout, planReports)
+			} else if opts.Confirm {
+				printPlan(os.Stderr, planReports)
+			}
+
+			if opts.Plan && !opts.Apply {
+				exitCode := exitCodeFor(planReports)
+				printSummary(planReports, nil, opts.OutputFormat, exitCode)
+
+				return exitCode
+			}
+
+			if groupCount := changedGroupCount(planReports); opts.Confirm && groupCount > 0 {
+				if opts.Yes {
+					slog.Info("Applying changes, approved by --yes", "groups", groupCount)
+				} else {
+					approved, err := confirmChanges(groupCount)
+					if err != nil {
+						slog.Error("Confirmation failed", "error", err)
+						return exitFatal
+					}
+
+					if !approved {
+						slog.Warn("Changes were not approved, nothing was modified")
+						return exitFatal
+					}
+				}
+			}
+		}
+
+		if opts.BackupDir != "" && !opts.DryRun {
+			path, err := writeBackup(ctx, runs, opts)
+			if err != nil {
+				slog.Error("Failed to back up the rules, nothing was changed", "error", err)
+				return exitFatal
+			}
+
+			slog.Info("Backed up the rules before changing them", "path", path)
+		}
+
+		allReports := append(syncRuns(ctx, runs, opts, targetCidrs, ipSource, opts.DryRun, useResolvedGroups), rosterFailures...)
+
+		// The record is reported on its own and only once the groups are done, so a
+		// DNS failure never holds up the Security Group sync.
+		if opts.Route53Record != "" {
+			allReports = append(allReports, syncRoute53Record(ctx, runs, opts, targetCidrs, ipSource))
+		}
+
+		if opts.StateFile != "" && !opts.DryRun {
+			state.record(opts, allReports, targetCidrs)
+
+			if err := saveState(opts.StateFile, state); err != nil {
+				slog.Warn("Failed to write state file", "path", opts.StateFile, "error", err)
+			}
+		}
+
+		exitCode := exitCodeFor(allReports)
+
+		// The dials only prove something once the rules are in place, so a dry run
+		// skips them.
+		var connects []connectResult
+
+		if len(opts.TestConnect.Targets) > 0 && !opts.DryRun {
+			connects = testConnections(ctx, opts.TestConnect)
+
+			if exitCode == exitOK && slices.ContainsFunc(connects, func(result connectResult) bool { return result.Err != nil }) {
+				exitCode = exitConnectFailed
+			}
+		}
+
+		printSummary(allReports, connects, opts.OutputFormat, exitCode)
+
+		if opts.SummaryFile != "" {
+			if err := writeSummaryFile(opts.SummaryFile, allReports); err != nil {
+				slog.Warn("Failed to write summary file", "path", opts.SummaryFile, "error", err)
+			} else {
+				slog.Info("Wrote summary file", "path", opts.SummaryFile)
+			}
+		}
+
+		reportRun(ctx, runs, opts, allReports, targetCidrs, exitCode)
+		metrics.observeSync(allReports, targetCidrs)
+		ephemeral.record(allReports)
+
+		return exitCode
+	}
+
+	if opts.Watch {
+		slog.Info("Watch mode enabled, press Ctrl+C to stop", "interval", opts.Interval)
+
+		watch(ctx, opts, metrics, runOnce)
+		stopMetrics()
+
+		if opts.Ephemeral {
+			os.Exit(revokeEphemeral(runs, opts, ephemeral))
+		}
+
+		return
+	}
+
+	os.Exit(runOnce(targetCidrs))
+}
+
+// ownerSelf is the --owner-id value for the account the credentials belong to.
+const ownerSelf = "self"
+
+// isAccountID reports whether id looks like an AWS account ID: 12 digits.
+func isAccountID(id string) bool {
+	return len(id) == 12 && strings.Trim(id, "0123456789") == ""
+}
+
+// callerIdentityAPI is the part of the STS client checkCallerAccount calls, so that
+// tests can replace it.
+type callerIdentityAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+var _ callerIdentityAPI = (*sts.Client)(nil)
+
+// checkCallerAccount logs the account and ARN the credentials belong to, and fails
+// when expectedAccounts is not empty and does not contain that account. It returns
+// the account.
+func checkCallerAccount(ctx context.Context, client callerIdentityAPI, expectedAccounts []string) (string, error) {
+	identity, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity: %w", err)
+	}
+
+	account := aws.ToString(identity.Account)
+	slog.Info("Caller identity", "arn", aws.ToString(identity.Arn), "account", account)
+
+	if len(expectedAccounts) > 0 && !slices.Contains(expectedAccounts, account) {
+		return "", fmt.Errorf("refusing to continue: expected AWS account %s but the credentials belong to %s", strings.Join(expectedAccounts, " or "), account)
+	}
+
+	return account, nil
+}
+
+// prepareProfile loads the AWS configuration for profile and resolves its targets in
+// every region it syncs. An error means nothing can be synced under the profile.
+func prepareProfile(ctx context.Context, opts options, profile string) ([]regionRun, error) {
+	var baseRegion string
+	if len(opts.Regions) > 0 {
+		baseRegion = opts.Regions[0]
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, profile, baseRegion, opts.Endpoint, opts.APICalls, opts.AssumeRole)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := checkCallerAccount(ctx, sts.NewFromConfig(awsCfg), opts.ExpectedAccounts)
+	if err != nil {
+		return nil, err
+	}
+
+	// A prefix list, IPSet or Lightsail instance has no groups to resolve; it is read
+	// when it is synced.
+	if opts.PrefixListID != "" || opts.WAFIPSet != nil || opts.LightsailInstance != "" {
+		return []regionRun{{Profile: profile, Region: awsCfg.Region, Config: awsCfg, Client: ec2.NewFromConfig(awsCfg)}}, nil
+	}
+
+	regions := opts.Regions
+
+	if opts.AllRegions {
+		regions, err = describeEnabledRegions(ctx, ec2.NewFromConfig(awsCfg))
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Info("Syncing in every enabled region", "count", len(regions), "regions", strings.Join(regions, ", "))
+	}
+
+	// A retry goes back to the regions the groups failed in.
+	if opts.Retry != nil && len(opts.Regions) == 0 && !opts.AllRegions {
+		regions = opts.Retry.regions(profile)
+	}
+
+	if len(regions) == 0 {
+		regions = []string{awsCfg.Region}
+	}
+
+	targets := targetsForProfile(opts.Targets, profile)
+	multiRegion := len(regions) > 1
+
+	for i := range targets {
+		targets[i].OwnerID = opts.OwnerID
+		if opts.OwnerID == ownerSelf {
+			targets[i].OwnerID = account
+		}
+	}
+
+	slog.Info("Resolving and validating target Security Groups")
+
+	runs := make([]regionRun, len(regions))
+
+	var resolveWg sync.WaitGroup
+
+	for i, region := range regions {
+		resolveWg.Add(1)
+
+		go func() {
+			defer resolveWg.Done()
+
+			client := ec2.NewFromConfig(awsCfg, func(o *ec2.Options) {
+				o.Region = region
+			})
+
+			elbClient := elasticloadbalancingv2.NewFromConfig(awsCfg, func(o *elasticloadbalancingv2.Options) {
+				o.Region = region
+			})
+
+			// A retry resolves only the failed groups, and skips those deleted since.
+			if opts.Retry != nil {
+				runs[i] = resolveRegion(ctx, client, elbClient, region, opts.Retry.restrict(targets, profile, region), true, opts.Guardrails)
+			} else {
+				runs[i] = resolveRegion(ctx, client, elbClient, region, targets, multiRegion, opts.Guardrails)
+			}
+
+			runs[i].Profile = profile
+			runs[i].Config = awsCfg
+		}()
+	}
+
+	resolveWg.Wait()
+
+	if opts.Retry != nil {
+		return retryRuns(runs, multiRegion)
+	}
+
+	checkTagMatches(runs, targets, multiRegion, opts.StrictTags)
+
+	if multiRegion {
+		if err := checkMultiRegionResolution(runs, targets); err != nil {
+			return nil, err
+		}
+
+		return runs, nil
+	}
+
+	if runs[0].Err != nil {
+		return nil, runs[0].Err
+	}
+
+	for _, target := range runs[0].Targets {
+		if len(target.GroupIDs) == 0 {
+			if unmatched := target.Resolution.UnmatchedTags(); len(unmatched) > 0 {
+				return nil, fmt.Errorf("no valid Security Groups found or resolved%s: %s matched nothing", targetLabel(target.Name), strings.Join(unmatched, ", "))
+			}
+
+			return nil, fmt.Errorf("no valid Security Groups found or resolved%s", targetLabel(target.Name))
+		}
+	}
+
+	return runs, nil
+}
+
+// interruptContext returns the root context, cancelled on SIGINT or SIGTERM so that
+// in-flight EC2 calls stop and the summary still reports what was completed. After
+// the first signal the default handling is restored, so a second one force-exits.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		<-ctx.Done()
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		stop()
+		slog.Warn("Interrupt received: cancelling in-flight requests. Press Ctrl+C again to force exit")
+	}()
+
+	return ctx, func() {
+		close(done)
+		stop()
+	}
+}
+
+// regionRun holds the EC2 client for one profile and region and the targets resolved
+// in it. Err is set when resolution failed, in which case the region (or the whole
+// profile, when Region is empty) is reported as failed without affecting the others.
+type regionRun struct {
+	Profile string
+	Region  string
+	// Config is the profile's AWS configuration, for clients other than EC2.
+	Config  aws.Config
+	Client  *ec2.Client
+	Targets []resolvedTarget
+	Err     error
+}
+
+func (r regionRun) label() string {
+	if r.Region == "" {
+		return fmt.Sprintf("profile %s", r.Profile)
+	}
+
+	if r.Profile != "" {
+		return fmt.Sprintf("profile %s, region %s", r.Profile, r.Region)
+	}
+
+	return fmt.Sprintf("region %s", r.Region)
+}
+
+func resolveRegion(ctx context.Context, client *ec2.Client, elbClient *elasticloadbalancingv2.Client, region string, targets []syncTarget, allowMissing bool, guards sgupdater.Guardrails) regionRun {
+	run := regionRun{Region: region, Client: client}
+
+	for _, target := range targets {
+		resolved, err := sgupdater.Resolve(ctx, client, elbClient, target.Target, allowMissing, guards)
+		if err != nil {
+			run.Err = fmt.Errorf("resolving Security Group identifiers%s: %w", targetLabel(target.Name), err)
+			return run
+		}
+
+		run.Targets = append(run.Targets, resolvedTarget{syncTarget: target, Resolved: resolved})
+	}
+
+	return run
+}
+
+// prepareRuns prepares every profile of the run. With a single profile its failure
+// is returned; with several, a failed profile is skipped and reported in the summary.
+func prepareRuns(ctx context.Context, opts options) ([]regionRun, error) {
+	multiProfile := len(opts.Profiles) > 1
+
+	var runs []regionRun
+
+	for _, profile := range opts.Profiles {
+		if multiProfile {
+			slog.Info("Preparing profile", "profile", profile)
+		}
+
+		profileRuns, err := prepareProfile(ctx, opts, profile)
+		if err != nil {
+			if !multiProfile {
+				return nil, err
+			}
+
+			slog.Warn("Profile will be skipped", "profile", profile, "error", err)
+			runs = append(runs, regionRun{Profile: profile, Err: err})
+
+			continue
+		}
+
+		runs = append(runs, profileRuns...)
+	}
+
+	return runs, nil
+}
+
+// syncRuns syncs every resolved target in every region concurrently and returns
+// one report per target, plus one per region or profile that failed to resolve.
+func syncRuns(ctx context.Context, runs []regionRun, opts options, targetCidrs []string, ipSource string, dryRun, useResolvedGroups bool) []sgupdater.Result {
+	reports := make([][]sgupdater.Result, len(runs))
+
+	// One failure stops every entry, region and profile of the run.
+	if opts.FailFast {
+		ctx = sgupdater.WithFailFast(ctx)
+	}
+
+	ctx, stopProgress := trackProgress(ctx, opts, dryRun)
+	defer stopProgress()
+
+	var wg sync.WaitGroup
+
+	for i, run := range runs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if run.Err != nil {
+				reports[i] = []sgupdater.Result{{
+					TargetCidrs: targetCidrs,
+					IPSource:    ipSource,
+					Region:      run.Region,
+					Profile:     run.Profile,
+					DryRun:      dryRun,
+					Remove:      opts.Remove,
+					Interrupted: ctx.Err() != nil,
+					TimedOut:    errors.Is(ctx.Err(), context.DeadlineExceeded),
+					Errors:      []error{fmt.Errorf("%s: %w", run.label(), run.Err)},
+				}}
+
+				return
+			}
+
+			if opts.PrefixListID != "" || opts.WAFIPSet != nil || opts.LightsailInstance != "" {
+				var report sgupdater.Result
+
+				switch {
+				case opts.WAFIPSet != nil:
+					report = sgupdater.SyncWAFIPSet(ctx, sgupdater.NewWAFClient(run.Config, opts.WAFIPSet), opts.WAFIPSet, targetCidrs, opts.Targets[0].Description, dryRun)
+				case opts.LightsailInstance != "":
+					report = sgupdater.SyncLightsailInstance(ctx, lightsail.NewFromConfig(run.Config), opts.LightsailInstance, targetCidrs, opts.Targets[0].Description, opts.Targets[0].Rule, dryRun)
+				default:
+					report = sgupdater.SyncPrefixList(ctx, run.Client, opts.PrefixListID, targetCidrs, opts.Targets[0].Description, dryRun)
+				}
+				report.IPSource = ipSource
+				report.Profile = run.Profile
+				report.Role = opts.AssumeRole.RoleARN
+				report.Region = run.Region
+				report.Interrupted = ctx.Err() != nil
+				report.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+				reports[i] = []sgupdater.Result{report}
+
+				return
+			}
+
+			for _, target := range run.Targets {
+				if len(target.GroupIDs) == 0 && len(target.Violations) == 0 {
+					continue
+				}
+
+				// A roster member is synced to their own address, and not at all when it
+				// could not be fetched; an --extra-cidr entry to its static range.
+				cidrs := targetCidrs
+				source := ipSource
+
+				if target.FixedCidrs != nil && !opts.Remove {
+					cidrs, source = target.FixedCidrs, extraCidrSource
+				}
+
+				var prunePrefix string
+				var pruneKeep func(string) bool
+
+				if member := target.Member; member != nil {
+					if member.Err != nil {
+						continue
+					}
+
+					if !opts.Remove {
+						cidrs = member.Cidrs
+					}
+
+					if member.Prune {
+						prunePrefix, pruneKeep = member.Prefix, member.Keep
+					}
+				}
+
+				report := sgupdater.SyncResolved(ctx, run.Client, target.Target, target.Resolved, cidrs, sgupdater.Settings{
+					DryRun:          dryRun,
+					Remove:          opts.Remove,
+					PrunePrefix:     cmp.Or(opts.PrunePrefix, prunePrefix),
+					PruneKeep:       pruneKeep,
+					ExpiredPrefix:   opts.CleanPrefix,
+					TTL:             opts.TTL,
+					GracePeriod:     opts.GracePeriod,
+					TagGroups:       opts.TagGroups,
+					FailOnOpen:      opts.FailOnOpen,
+					FailFast:        opts.FailFast,
+					SkipIfCovered:   opts.SkipIfCovered,
+					RulesQuota:      opts.RulesQuota,
+					QuotaMargin:     opts.CheckQuota,
+					MaxConcurrency:  opts.MaxConcurrency,
+					VerifyTimeout:   opts.VerifyTimeout,
+					RuleDescription: target.RuleDescription,
+					Match:           target.Match,
+					Allowlist:       opts.CIDRSourceURL != "",
+					Directions:      opts.Directions,
+					Strict:          opts.Guardrails.Strict,
+				}, useResolvedGroups)
+				report.IPSource = source
+				report.Profile = run.Profile
+				report.Role = opts.AssumeRole.RoleARN
+				report.Region = run.Region
+
+				reports[i] = append(reports[i], report)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return slices.Concat(reports...)
+}
+
+// trackProgress reports how many groups the SyncAll calls under the returned
+// context have finished, e.g. "synced 120/300 (3 failed)": on a terminal as a
+// status line under the logs, redrawn as each group finishes, and otherwise as a
+// log line every second while the count moves. Runs of a single group report
+// nothing, and neither does --output=json or a log level above info, e.g. with
+// --quiet. The returned func stops the reports and clears the status line.
+func trackProgress(ctx context.Context, opts options, dryRun bool) (context.Context, func()) {
+	if opts.OutputFormat == outputJSON || !slog.Default().Enabled(ctx, slog.LevelInfo) {
+		return ctx, func() {}
+	}
+
+	verb := "synced"
+	if dryRun {
+		verb = "checked"
+	}
+
+	terminal := isTerminal(os.Stderr) && os.Getenv("TERM") != "dumb"
+	progress := sgupdater.NewProgress()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		logged := -1
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-progress.Updates():
+				if !terminal {
+					continue
+				}
+			case <-ticker.C:
+			}
+
+			finished, failed, total := progress.Counts()
+			if total < 2 || (!terminal && finished == logged) {
+				continue
+			}
+
+			if terminal {
+				logOutput.setStatus(fmt.Sprintf("%s %d/%d (%d failed)", verb, finished, total, failed))
+			} else {
+				logged = finished
+				slog.Info("Sync progress", verb, finished, "total", total, "failed", failed)
+			}
+		}
+	}()
+
+	return sgupdater.WithProgress(ctx, progress), func() {
+		close(stop)
+		<-stopped
+		logOutput.setStatus("")
+	}
+}
+
+// reportRun sends the Slack message, webhook call, CloudWatch metrics, SNS message
+// and --ping-url ping configured for a finished run, and appends it to
+// --history-file. Their failures are only logged, the exit code reflects the sync.
+func reportRun(ctx context.Context, runs []regionRun, opts options, reports []sgupdater.Result, targetCidrs []string, exitCode int) {
+	if opts.SlackWebhookURL != "" && !opts.DryRun && (opts.NotifyAlways || needsNotification(reports)) {
+		if err := notifySlack(opts.SlackWebhookURL, slackMessage(reports, targetCidrs)); err != nil {
+			slog.Warn("Failed to send the Slack notification", "error", err)
+		} else {
+			slog.Info("Sent the Slack notification")
+		}
+	}
+
+	if opts.WebhookURL != "" && !opts.DryRun && webhookDue(opts.WebhookOn, reports) {
+		if err := callWebhook(opts, newWebhookPayload(reports, targetCidrs, exitCode)); err != nil {
+			slog.Warn("Failed to call the webhook", "error", err)
+		} else {
+			slog.Info("Called the webhook")
+		}
+	}
+
+	if opts.MetricsNamespace != "" && !opts.DryRun {
+		if err := publishMetrics(ctx, runs, opts.MetricsNamespace, reports); err != nil {
+			slog.Warn("Failed to publish CloudWatch metrics", "namespace", opts.MetricsNamespace, "error", err)
+		} else {
+			slog.Debug("Published CloudWatch metrics", "namespace", opts.MetricsNamespace)
+		}
+	}
+
+	if opts.SNSTopicARN != "" && !opts.DryRun {
+		if err := publishSNS(ctx, runs, opts.SNSTopicARN, reports, exitCode); err != nil {
+			slog.Warn("Failed to publish to SNS", "topic", opts.SNSTopicARN, "error", err)
+		} else {
+			slog.Info("Published the summary to SNS", "topic", opts.SNSTopicARN)
+		}
+	}
+
+	if opts.HistoryFile != "" && !opts.DryRun {
+		if err := appendHistory(opts.HistoryFile, newHistoryEntry(opts.HistoryFile, reports, targetCidrs, exitCode)); err != nil {
+			slog.Warn("Failed to append to the history file", "path", opts.HistoryFile, "error", err)
+		}
+	}
+
+	if opts.PingURL != "" && !opts.DryRun {
+		failure := ""
+		if exitCode != exitOK {
+			failure = failureSummary(reports, exitCode)
+		}
+
+		ping(opts.PingURL, failure)
+	}
+}
+
+// syncRoute53Record updates the --route53-record with the credentials of the first
+// profile that was prepared successfully.
+func syncRoute53Record(ctx context.Context, runs []regionRun, opts options, targetCidrs []string, ipSource string) sgupdater.Result {
+	index := slices.IndexFunc(runs, func(run regionRun) bool { return run.Err == nil })
+	if index < 0 {
+		return sgupdater.Result{
+			Record:      opts.Route53Record,
+			TargetCidrs: targetCidrs,
+			IPSource:    ipSource,
+			GroupCount:  1,
+			DryRun:      opts.DryRun,
+			Errors:      []error{fmt.Errorf("[%s] no profile was prepared successfully", opts.Route53Record)},
+		}
+	}
+
+	report := sgupdater.SyncRoute53Record(ctx, route53.NewFromConfig(runs[index].Config), opts.Route53ZoneID, opts.Route53Record, targetCidrs, opts.DryRun)
+	report.IPSource = ipSource
+	report.Profile = runs[index].Profile
+	report.Role = opts.AssumeRole.RoleARN
+
+	return report
+}
+
+// checkTagMatches finds the tag values of each target that matched no group in any
+// region. Every region already logged its own counts, so a multi-region run only
+// logs the values missing everywhere. With strict, each one is also reported as an
+// error of the target in the first region that resolved, so the groups that were
+// found are still synced but the run fails.
+func checkTagMatches(runs []regionRun, targets []syncTarget, multiRegion, strict bool) {
+	for i, target := range targets {
+		var tags []string
+		matched := make(map[string]bool)
+		first := -1
+
+		for j, run := range runs {
+			if run.Err != nil {
+				continue
+			}
+
+			if first < 0 {
+				first = j
+			}
+
+			for _, match := range run.Targets[i].Resolution.TagMatches {
+				if _, seen := matched[match.Tag]; !seen {
+					tags = append(tags, match.Tag)
+				}
+
+				matched[match.Tag] = matched[match.Tag] || match.Groups > 0
+			}
+		}
+
+		for _, tag := range tags {
+			if matched[tag] {
+				continue
+			}
+
+			if multiRegion {
+				slog.Warn("Tag value matched no Security Group in any region", "tag", tag, "entry", target.Name)
+			}
+
+			if strict {
+				run := &runs[first]
+				run.Targets[i].Violations = append(run.Targets[i].Violations, fmt.Errorf("tag %s matched no Security Group%s", tag, targetLabel(target.Name)))
+			}
+		}
+	}
+}
+
+// checkMultiRegionResolution fails when an explicit ID was not found in any region,
+// or when no region resolved any group at all. Regions that failed are only logged.
+func checkMultiRegionResolution(runs []regionRun, targets []syncTarget) error {
+	foundIDs := make(map[string]bool)
+	totalGroups := 0
+
+	for _, run := range runs {
+		if run.Err != nil {
+			slog.Warn("Skipping after failed resolution", "scope", run.label(), "error", run.Err)
+			continue
+		}
+
+		for _, target := range run.Targets {
+			totalGroups += len(target.GroupIDs)
+
+			for _, id := range slices.Concat(target.GroupIDs, target.Skipped) {
+				foundIDs[id] = true
+			}
+
+			for id := range target.Resolution.InstanceGroups {
+				foundIDs[id] = true
+			}
+
+			for lb := range target.Resolution.LoadBalancerGroups {
+				foundIDs[lb] = true
+			}
+		}
+	}
+
+	var missing []string
+
+	for _, target := range targets {
+		for _, id := range target.SgIDs {
+			if !foundIDs[id] && !slices.Contains(target.ExcludeIDs, id) {
+				missing = append(missing, id)
+			}
+		}
+
+		for _, id := range slices.Concat(target.InstanceIDs, target.LoadBalancers) {
+			if !foundIDs[id] {
+				missing = append(missing, id)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Security Group ID(s) not found in any region: %s", strings.Join(missing, ", "))
+	}
+
+	if totalGroups == 0 {
+		return fmt.Errorf("no valid Security Groups found or resolved in any region")
+	}
+
+	return nil
+}
+
+func describeEnabledRegions(ctx context.Context, client *ec2.Client) ([]string, error) {
+	result, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe regions: %w", err)
+	}
+
+	var regions []string
+
+	for _, region := range result.Regions {
+		regions = append(regions, aws.ToString(region.RegionName))
+	}
+
+	slices.Sort(regions)
+
+	return regions, nil
+}
+
+// targetLabel formats a config entry name for log messages, or nothing for the
+// single unnamed target defined by flags.
+func targetLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" for entry '%s'", name)
+}
+
+// discoverTargetCidrs looks up the public IP of every requested family and returns
+// the matching host CIDRs.
+func discoverTargetCidrs(families, ipServices []string) ([]string, error) {
+	var targetCidrs []string
+
+	for _, family := range families {
+		publicIP, err := getPublicIP(family, ipServices)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", family, err)
+		}
+
+		targetCidrs = append(targetCidrs, sgupdater.HostCIDR(publicIP))
+	}
+
+	return targetCidrs, nil
+}
+
+// syncState is the --state-file content: the CIDRs last synced successfully for
+// each profile, region selection, group selection and rule.
+type syncState struct {
+	Entries map[string]stateEntry `json:"entries"`
+}
+
+type stateEntry struct {
+	Cidrs    []string  `json:"cidrs"`
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+// stateKey identifies what a target under profile syncs, so that changing any
+// selector or the rule misses the cache.
+func stateKey(opts options, profile string, target syncTarget) string {
+	regions := strings.Join(opts.Regions, ",")
+	if opts.AllRegions {
+		regions = "all"
+	}
+
+	tags := make([]string, 0, len(target.SgTags))
+
+	for _, filter := range target.SgTags {
+		tags = append(tags, filter.String())
+	}
+
+	sorted := func(values []string) string {
+		return strings.Join(slices.Sorted(slices.Values(values)), ",")
+	}
+
+	wafIPSetKey := ""
+	if opts.WAFIPSet != nil {
+		wafIPSetKey = opts.WAFIPSet.Name + "|" + opts.WAFIPSet.ID + "|" + string(opts.WAFIPSet.Scope)
+	}
+
+	key := strings.Join([]string{
+		"profile=" + profile,
+		"role=" + opts.AssumeRole.RoleARN,
+		"regions=" + regions,
+		"prefix-list=" + opts.PrefixListID,
+		"wafv2-ipset=" + wafIPSetKey,
+		"lightsail-instance=" + opts.LightsailInstance,
+		"description=" + target.Description,
+		"rule=" + target.Rule.String(),
+		"sg-ids=" + sorted(target.SgIDs),
+		"sg-tag-names=" + sorted(target.SgTagNames),
+		"sg-tags=" + sorted(tags),
+		"sg-names=" + sorted(target.SgNames),
+		"vpc-id=" + target.VpcID,
+		"exclude=" + sorted(target.ExcludeIDs),
+	}, "|")
+
+	if len(target.InstanceIDs) > 0 {
+		key += "|instance-ids=" + sorted(target.InstanceIDs)
+	}
+
+	if len(target.LoadBalancers) > 0 {
+		key += "|load-balancers=" + sorted(target.LoadBalancers)
+	}
+
+	// Only --extra-cidr entries add their range, so other keys stay as they were.
+	if len(target.FixedCidrs) > 0 {
+		key += "|fixed-cidrs=" + sorted(target.FixedCidrs)
+	}
+
+	if len(target.ExtraRules) > 0 {
+		var extraRules []string
+
+		for _, rule := range target.ExtraRules {
+			extraRules = append(extraRules, rule.String())
+		}
+
+		key += "|extra-rules=" + strings.Join(extraRules, ",")
+	}
+
+	if len(opts.Directions) > 0 && !slices.Equal(opts.Directions, []sgupdater.Direction{sgupdater.Ingress}) {
+		key += "|direction=" + joinDirections(opts.Directions)
+	}
+
+	return key
+}
+
+// unchanged reports whether every target was last synced successfully to exactly
+// targetCidrs.
+func (s syncState) unchanged(opts options, targetCidrs []string) bool {
+	cidrs := slices.Sorted(slices.Values(targetCidrs))
+
+	for _, profile := range opts.Profiles {
+		for _, target := range targetsForProfile(opts.Targets, profile) {
+			entry, ok := s.Entries[stateKey(opts, profile, target)]
+			if !ok || !slices.Equal(entry.Cidrs, cidrs) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// record stores targetCidrs for every target whose reports all succeeded and drops
+// the entry of any other, so the next run retries it. A report without a name
+// covers every target of its profile, such as a profile that failed to resolve.
+func (s *syncState) record(opts options, reports []sgupdater.Result, targetCidrs []string) {
+	cidrs := slices.Sorted(slices.Values(targetCidrs))
+	now := time.Now().UTC()
+
+	for _, profile := range opts.Profiles {
+		for _, target := range targetsForProfile(opts.Targets, profile) {
+			succeeded := true
+
+			for _, report := range reports {
+				if report.Profile == profile && (report.Name == target.Name || report.Name == "") {
+					succeeded = succeeded && len(report.Errors) == 0 && !report.Interrupted
+				}
+			}
+
+			key := stateKey(opts, profile, target)
+
+			if succeeded {
+				s.Entries[key] = stateEntry{Cidrs: cidrs, SyncedAt: now}
+			} else {
+				delete(s.Entries, key)
+			}
+		}
+	}
+}
+
+// loadState reads the state file; a missing file is an empty state.
+func loadState(path string) (syncState, error) {
+	state := syncState{Entries: make(map[string]stateEntry)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+
+	if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse '%s': %w", path, err)
+	}
+
+	if state.Entries == nil {
+		state.Entries = make(map[string]stateEntry)
+	}
+
+	return state, nil
+}
+
+// writeSummaryFile writes the --output=json summary of reports to path through a
+// temporary file, so --retry-from never reads a truncated one.
+func writeSummaryFile(path string, reports []sgupdater.Result) error {
+	data, err := json.MarshalIndent(jsonDocument(reports), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// retrySet holds the groups a --retry-from summary lists as failed, not attempted,
+// interrupted or timed out, by the profile, region and entry they were synced for.
+type retrySet map[retryKey][]string
+
+type retryKey struct {
+	Profile string
+	Region  string
+	Entry   string
+}
+
+var retryActions = []sgupdater.Action{sgupdater.ActionFailed, sgupdater.ActionNotAttempted, sgupdater.ActionInterrupted, sgupdater.ActionTimedOut}
+
+func loadRetrySet(path string) (retrySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read summary file '%s': %w", path, err)
+	}
+
+	// A run with a single entry and region writes one object, others an array.
+	var summaries []jsonSummary
+
+	if err := json.Unmarshal(data, &summaries); err != nil {
+		var single jsonSummary
+
+		if err := json.Unmarshal(data, &single); err != nil {
+			return nil, fmt.Errorf("failed to parse summary file '%s': %w", path, err)
+		}
+
+		summaries = []jsonSummary{single}
+	}
+
+	retry := make(retrySet)
+
+	for _, summary := range summaries {
+		key := retryKey{Profile: summary.Profile, Region: summary.Region, Entry: summary.Entry}
+
+		if summary.Failed > 0 && len(summary.Groups) == 0 {
+			slog.Warn("Summary file has a failure before any group was synced, run it again without --retry-from", "profile", summary.Profile, "region", summary.Region, "entry", summary.Entry)
+		}
+
+		for _, group := range summary.Groups {
+			if sgIDPattern.MatchString(group.SgID) && slices.Contains(retryActions, sgupdater.Action(group.Action)) && !slices.Contains(retry[key], group.SgID) {
+				retry[key] = append(retry[key], group.SgID)
+			}
+		}
+	}
+
+	if len(retry) == 0 {
+		return nil, fmt.Errorf("summary file '%s' has no failed or unattempted groups to retry", path)
+	}
+
+	groups := 0
+	for _, ids := range retry {
+		groups += len(ids)
+	}
+
+	slog.Info("Retrying the groups that did not sync", "path", path, "groups", groups)
+
+	return retry, nil
+}
+
+// regions lists the regions with groups to retry under profile.
+func (r retrySet) regions(profile string) []string {
+	var regions []string
+
+	for key := range r {
+		if key.Profile == profile && key.Region != "" && !slices.Contains(regions, key.Region) {
+			regions = append(regions, key.Region)
+		}
+	}
+
+	slices.Sort(regions)
+
+	return regions
+}
+
+// restrict narrows every target to the groups to retry in region, dropping the
+// targets with none. Only the IDs select groups; the guardrails still apply.
+func (r retrySet) restrict(targets []syncTarget, profile, region string) []syncTarget {
+	var restricted []syncTarget
+
+	for _, target := range targets {
+		ids := r[retryKey{Profile: profile, Region: region, Entry: target.Name}]
+		if len(ids) == 0 {
+			slog.Info("Nothing to retry", "entry", target.Name, "region", region)
+			continue
+		}
+
+		target.SgIDs = ids
+		target.SgTagNames = nil
+		target.SgTags = nil
+		target.SgNames = nil
+		target.InstanceIDs = nil
+		target.LoadBalancers = nil
+		restricted = append(restricted, target)
+	}
+
+	return restricted
+}
+
+// retryRuns notes the groups to retry that no longer exist and drops the targets
+// left without groups. It fails when nothing is left to retry.
+func retryRuns(runs []regionRun, multiRegion bool) ([]regionRun, error) {
+	groups := 0
+
+	for i, run := range runs {
+		if run.Err != nil {
+			if !multiRegion {
+				return nil, run.Err
+			}
+
+			slog.Warn("Skipping after failed resolution", "scope", run.label(), "error", run.Err)
+
+			continue
+		}
+
+		var targets []resolvedTarget
+
+		for _, target := range run.Targets {
+			for _, id := range target.Resolution.MissingIDs {
+				slog.Warn("Skipping group from the retry file, it no longer exists", "sg_id", id, "region", run.Region)
+			}
+
+			if len(target.GroupIDs) > 0 || len(target.Violations) > 0 {
+				targets = append(targets, target)
+				groups += len(target.GroupIDs)
+			}
+		}
+
+		runs[i].Targets = targets
+	}
+
+	if groups == 0 {
+		return nil, fmt.Errorf("none of the groups to retry could be resolved")
+	}
+
+	return runs, nil
+}
+
+// saveState writes the state file through a temporary file, so an interrupted write
+// never leaves it truncated.
+func saveState(path string, state syncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// expandHome replaces a leading ~/ in path with the user's home directory.
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path, err
+	}
+
+	return filepath.Join(home, path[2:]), nil
+}
+
+// historyEntry is one line of --history-file: what a run allowed and changed.
+type historyEntry struct {
+	Time     time.Time `json:"time"`
+	Cidrs    []string  `json:"cidrs"`
+	IPSource string    `json:"ip_source,omitempty"`
+	// IPChanged is set when Cidrs differ from those of the previous entry, and for
+	// the first one.
+	IPChanged bool     `json:"ip_changed"`
+	Remove    bool     `json:"remove,omitempty"`
+	Groups    []string `json:"groups_changed"`
+	Errors    []string `json:"errors,omitempty"`
+	ExitCode  int      `json:"exit_code"`
+}
+
+// historyTailSize is how much of the end of the history file is read for its
+// last entry.
+const historyTailSize = 64 << 10
+
+func newHistoryEntry(path string, reports []sgupdater.Result, targetCidrs []string, exitCode int) historyEntry {
+	entry := historyEntry{
+		Time:     time.Now().UTC(),
+		Cidrs:    slices.Sorted(slices.Values(targetCidrs)),
+		ExitCode: exitCode,
+		Groups:   []string{},
+	}
+
+	for _, report := range reports {
+		entry.IPSource = cmp.Or(entry.IPSource, report.IPSource)
+		entry.Remove = entry.Remove || report.Remove
+
+		for _, result := range report.Results {
+			if result.SgID != "" && result.Err == nil && result.Changed() && !slices.Contains(entry.Groups, result.SgID) {
+				entry.Groups = append(entry.Groups, result.SgID)
+			}
+		}
+
+		for _, err := range report.Errors {
+			entry.Errors = append(entry.Errors, err.Error())
+		}
+	}
+
+	slices.Sort(entry.Groups)
+
+	last, ok := lastHistoryEntry(path)
+	entry.IPChanged = !ok || !slices.Equal(last.Cidrs, entry.Cidrs)
+
+	return entry
+}
+
+// lastHistoryEntry returns the newest entry of the history file, reading only its
+// tail. ok is false when the file is missing or empty, or its last line cannot be
+// read.
+func lastHistoryEntry(path string) (historyEntry, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return historyEntry{}, false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return historyEntry{}, false
+	}
+
+	offset := max(info.Size()-historyTailSize, 0)
+	tail := make([]byte, info.Size()-offset)
+
+	if _, err := f.ReadAt(tail, offset); err != nil && !errors.Is(err, io.EOF) {
+		return historyEntry{}, false
+	}
+
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+
+	var entry historyEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		return historyEntry{}, false
+	}
+
+	return entry, true
+}
+
+// appendHistory appends entry to the history file as a single line. The line is
+// written at once to a file opened with O_APPEND, so runs that finish together
+// never interleave their lines.
+func appendHistory(path string, entry historyEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// readHistory reads every entry of the history file; a missing file has none. A
+// line that cannot be parsed, such as one cut short by a full disk, is skipped with
+// a warning.
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("Skipping unreadable history line", "path", path, "line", lineNumber, "error", err)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// printHistory prints the last count entries of the history file, oldest first,
+// as a table or as a JSON array.
+func printHistory(path string, count int, outputFormat string) int {
+	entries, err := readHistory(path)
+	if err != nil {
+		slog.Error("Failed to read the history file", "path", path, "error", err)
+		return exitFatal
+	}
+
+	entries = entries[max(len(entries)-count, 0):]
+
+	if outputFormat == outputJSON {
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(entries); err != nil {
+			slog.Error("Failed to write JSON history", "error", err)
+		}
+
+		return exitOK
+	}
+
+	if len(entries) == 0 {
+		slog.Info("No runs recorded yet", "path", path)
+		return exitOK
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tIP\tIP CHANGED\tGROUPS CHANGED\tERRORS\tEXIT")
+
+	for _, entry := range entries {
+		changed := "no"
+		if entry.IPChanged {
+			changed = "yes"
+		}
+
+		// Long lists are cut short; --output=json has every group.
+		groups := strings.Join(entry.Groups[:min(len(entry.Groups), 3)], ", ")
+		if len(entry.Groups) > 3 {
+			groups += fmt.Sprintf(" and %d more", len(entry.Groups)-3)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", entry.Time.Local().Format(time.DateTime), cmp.Or(strings.Join(entry.Cidrs, ", "), "-"), changed, cmp.Or(groups, "-"), len(entry.Errors), entry.ExitCode)
+	}
+
+	if err := w.Flush(); err != nil {
+		slog.Error("Failed to write history", "error", err)
+	}
+
+	return exitOK
+}
+
+// writeBackup snapshots the rules the sync may change in every resolved group into
+// a new timestamped file in --backup-dir, and returns its path.
+func writeBackup(ctx context.Context, runs []regionRun, opts options) (string, error) {
+	backup := sgupdater.Backup{CreatedAt: time.Now().UTC(), Groups: []sgupdater.GroupBackup{}}
+
+	prefix := opts.PrunePrefix
+	if opts.CleanExpired {
+		prefix = opts.CleanPrefix
+	}
+
+	for _, run := range runs {
+		if run.Err != nil {
+			continue
+		}
+
+		for _, target := range run.Targets {
+			// The member pruning for the roster also backs up the rules it may prune.
+			targetPrefix := prefix
+			if target.Member != nil && target.Member.Prune {
+				targetPrefix = target.Member.Prefix
+			}
+
+			for _, sgID := range target.GroupIDs {
+				group, err := sgupdater.SnapshotGroup(ctx, run.Client, sgupdater.GroupBackup{
+					Profile:     run.Profile,
+					Region:      run.Region,
+					SgID:        sgID,
+					Description: target.Description,
+					Match:       target.Match,
+					Prefix:      targetPrefix,
+				})
+				if err != nil {
+					return "", err
+				}
+
+				backup.Groups = append(backup.Groups, group)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(opts.BackupDir, 0o700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(opts.BackupDir, "sg-updater-backup-"+backup.CreatedAt.Format("20060102T150405.000Z")+".json")
+
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+// rollback restores every group in the --backup file, with the credentials of the
+// profile and region it was backed up from.
+func rollback(ctx context.Context, opts options) int {
+	data, err := os.ReadFile(opts.BackupFile)
+	if err != nil {
+		slog.Error("Failed to read the backup", "error", err)
+		return exitFatal
+	}
+
+	var backup sgupdater.Backup
+
+	if err := json.Unmarshal(data, &backup); err != nil {
+		slog.Error("Failed to parse the backup", "path", opts.BackupFile, "error", err)
+		return exitFatal
+	}
+
+	slog.Info("Rolling back", "backup", opts.BackupFile, "created_at", backup.CreatedAt, "groups", len(backup.Groups))
+
+	type location struct {
+		profile string
+		region  string
+	}
+
+	var locations []location
+
+	groups := make(map[location][]sgupdater.GroupBackup)
+
+	for _, group := range backup.Groups {
+		loc := location{profile: group.Profile, region: group.Region}
+
+		if _, seen := groups[loc]; !seen {
+			locations = append(locations, loc)
+		}
+
+		groups[loc] = append(groups[loc], group)
+	}
+
+	var reports []sgupdater.Result
+
+	for _, loc := range locations {
+		report := sgupdater.Result{
+			Backup:     opts.BackupFile,
+			Profile:    loc.profile,
+			Role:       opts.AssumeRole.RoleARN,
+			Region:     loc.region,
+			DryRun:     opts.DryRun,
+			GroupCount: len(groups[loc]),
+		}
+
+		awsCfg, err := loadAWSConfig(ctx, loc.profile, loc.region, opts.Endpoint, opts.APICalls, opts.AssumeRole)
+		if err == nil {
+			_, err = checkCallerAccount(ctx, sts.NewFromConfig(awsCfg), opts.ExpectedAccounts)
+		}
+
+		if err != nil {
+			report.Errors = append(report.Errors, err)
+			reports = append(reports, report)
+
+			continue
+		}
+
+		client := ec2.NewFromConfig(awsCfg)
+
+		for _, group := range groups[loc] {
+			result, err := sgupdater.RollbackGroup(ctx, client, group, opts.DryRun)
+			result.Err = err
+			report.Results = append(report.Results, result)
+
+			if err != nil {
+				slog.Error("Failed to roll back", "sg_id", group.SgID, "error", err)
+				report.Errors = append(report.Errors, err)
+			} else {
+				report.SuccessCount++
+			}
+		}
+
+		report.Interrupted = ctx.Err() != nil
+		report.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		reports = append(reports, report)
+	}
+
+	exitCode := exitCodeFor(reports)
+	printSummary(reports, nil, opts.OutputFormat, exitCode)
+
+	return exitCode
+}
+
+// watch re-discovers the public IP every --interval and calls syncFn only when it
+// differs from the last successfully synced one, and the damper lets it through.
+// Discovery failures are retried with a growing delay capped at the interval. It
+// returns once ctx is cancelled, after the current iteration.
+func watch(ctx context.Context, opts options, metrics *daemonMetrics, syncFn func(targetCidrs []string) int) {
+	var lastSynced []string
+	interval := opts.Interval
+	retryDelay := min(watchRetryDelay, interval)
+	damper := &ipDamper{stableChecks: opts.StableChecks, minInterval: opts.MinUpdateInterval}
+
+	for {
+		wait := interval
+
+		targetCidrs, err := discoverTargetCidrs(opts.Families, opts.IPServices)
+		metrics.observeDiscovery(err)
+
+		if err != nil {
+			slog.Warn("Public IP discovery failed", "retry_in", retryDelay, "error", err)
+			wait = retryDelay
+			retryDelay = min(retryDelay*2, interval)
+		} else {
+			retryDelay = min(watchRetryDelay, interval)
+
+			if slices.Equal(targetCidrs, lastSynced) {
+				slog.Info("Public IP unchanged, skipping sync", "cidrs", strings.Join(targetCidrs, ", "))
+				damper.reset()
+			} else if held, reason := damper.hold(targetCidrs, lastSynced == nil, time.Now()); held {
+				slog.Info("Public IP changed, holding the sync back", "cidrs", strings.Join(targetCidrs, ", "), "reason", reason)
+			} else {
+				slog.Info("Public IP changed, syncing Security Groups", "cidrs", strings.Join(targetCidrs, ", "))
+				damper.synced(time.Now())
+
+				if syncFn(targetCidrs) == exitOK {
+					lastSynced = targetCidrs
+				} else {
+					slog.Warn("Sync did not complete for every Security Group, it will be retried on the next check")
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Received shutdown signal, stopping watch mode")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ephemeralRules records the rules a watch or --listen run authorized or updated, so
+// that --ephemeral revokes those on shutdown and leaves the rules that were already
+// in place alone. A nil *ephemeralRules records nothing.
+type ephemeralRules struct {
+	mu     sync.Mutex
+	groups []ephemeralGroup
+}
+
+// ephemeralGroup holds the rules recorded in one group, direction and description.
+type ephemeralGroup struct {
+	Profile     string
+	Region      string
+	SgID        string
+	Description string
+	Egress      bool
+	RuleIDs     []string
+}
+
+// record adds the rules the reports' syncs authorized or updated.
+func (e *ephemeralRules) record(reports []sgupdater.Result) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, report := range reports {
+		for _, result := range report.Results {
+			if result.DryRun || result.Removal || result.RuleID == "" || (!result.Authorize && result.ModifiedCidr == "") {
+				continue
+			}
+
+			group := ephemeralGroup{
+				Profile:     report.Profile,
+				Region:      report.Region,
+				SgID:        result.SgID,
+				Description: cmp.Or(report.Description, result.Description),
+				Egress:      result.Egress,
+			}
+
+			index := slices.IndexFunc(e.groups, func(other ephemeralGroup) bool {
+				return other.Profile == group.Profile && other.Region == group.Region && other.SgID == group.SgID && other.Description == group.Description && other.Egress == group.Egress
+			})
+			if index < 0 {
+				e.groups = append(e.groups, group)
+				index = len(e.groups) - 1
+			}
+
+			if !slices.Contains(e.groups[index].RuleIDs, result.RuleID) {
+				e.groups[index].RuleIDs = append(e.groups[index].RuleIDs, result.RuleID)
+			}
+		}
+	}
+}
+
+// groupsIn returns the groups with rules recorded under run's profile and region.
+func (e *ephemeralRules) groupsIn(run regionRun) []ephemeralGroup {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var groups []ephemeralGroup
+
+	for _, group := range e.groups {
+		if group.Profile == run.Profile && group.Region == run.Region {
+			group.RuleIDs = slices.Clone(group.RuleIDs)
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// revokeEphemeral revokes the rules recorded in rules when watch or --listen mode
+// shuts down with --ephemeral. The run's context is already cancelled by then, so
+// it gets --ephemeral-timeout of its own. It returns the exit code and logs every
+// group that still has a rule.
+func revokeEphemeral(runs []regionRun, opts options, rules *ephemeralRules) int {
+	if opts.DryRun {
+		return exitOK
+	}
+
+	slog.Info("Revoking the rules before exiting (--ephemeral)", "timeout", opts.EphemeralTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.EphemeralTimeout)
+	defer cancel()
+
+	var reports []sgupdater.Result
+
+	for _, run := range runs {
+		groups := rules.groupsIn(run)
+		if run.Err != nil || len(groups) == 0 {
+			continue
+		}
+
+		report := sgupdater.Result{Profile: run.Profile, Region: run.Region, Remove: true, GroupCount: len(groups)}
+
+		for _, group := range groups {
+			result, err := sgupdater.RevokeRuleIDs(ctx, run.Client, group.SgID, group.Description, group.Egress, group.RuleIDs)
+			result.Err = err
+			report.Results = append(report.Results, result)
+
+			if err != nil {
+				slog.Error("Rule is still present after shutdown", "sg_id", group.SgID, "region", run.Region, "description", group.Description, "rule_ids", strings.Join(group.RuleIDs, ", "), "error", err)
+				report.Errors = append(report.Errors, err)
+			} else {
+				report.SuccessCount++
+			}
+		}
+
+		report.Interrupted = ctx.Err() != nil
+		report.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		reports = append(reports, report)
+	}
+
+	exitCode := exitCodeFor(reports)
+	printSummary(reports, nil, opts.OutputFormat, exitCode)
+
+	return exitCode
+}
+
+// ipDamper keeps a flapping IP, such as a backup link that takes over for a few
+// minutes, from rewriting the rules back and forth in watch mode.
+type ipDamper struct {
+	// stableChecks is how many checks in a row a changed IP must be seen.
+	stableChecks int
+	// minInterval is the least time between two syncs.
+	minInterval time.Duration
+
+	candidate  []string
+	seen       int
+	lastUpdate time.Time
+}
+
+// hold reports whether the changed targetCidrs must wait rather than be synced now,
+// and why. The first sync of a run is never held back.
+func (d *ipDamper) hold(targetCidrs []string, first bool, now time.Time) (bool, string) {
+	if first {
+		return false, ""
+	}
+
+	if !slices.Equal(targetCidrs, d.candidate) {
+		d.candidate = slices.Clone(targetCidrs)
+		d.seen = 0
+	}
+
+	d.seen++
+
+	if d.seen < d.stableChecks {
+		return true, fmt.Sprintf("seen in %d of %d checks in a row", d.seen, d.stableChecks)
+	}
+
+	if !d.lastUpdate.IsZero() {
+		if wait := d.lastUpdate.Add(d.minInterval).Sub(now); wait > 0 {
+			return true, fmt.Sprintf("the last sync was less than %s ago, next one allowed in %s", d.minInterval, wait.Round(time.Second))
+		}
+	}
+
+	return false, ""
+}
+
+// synced records that a sync started at now. The candidate is kept, so that a sync
+// that failed is retried without waiting for more checks.
+func (d *ipDamper) synced(now time.Time) {
+	d.lastUpdate = now
+}
+
+// reset forgets the candidate, once the IP is back to the synced one.
+func (d *ipDamper) reset() {
+	d.candidate = nil
+	d.seen = 0
+}
+
+// readIPParameter reads the IP or CIDR to allow from the --ip-parameter SSM
+// parameter, with the credentials of the first profile.
+func readIPParameter(ctx context.Context, opts options) (string, error) {
+	var region string
+	if len(opts.Regions) > 0 {
+		region = opts.Regions[0]
+	}
+
+	cfg, err := loadAWSConfig(ctx, opts.Profiles[0], region, opts.Endpoint, opts.APICalls, opts.AssumeRole)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(opts.IPParameter),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read SSM parameter '%s': %w", opts.IPParameter, err)
+	}
+
+	targetCidr, err := parseIPOverride(strings.TrimSpace(aws.ToString(out.Parameter.Value)))
+	if err != nil {
+		return "", fmt.Errorf("SSM parameter '%s': %w", opts.IPParameter, err)
+	}
+
+	slog.Info("Using IP from SSM parameter", "parameter", opts.IPParameter, "cidr", targetCidr)
+
+	return targetCidr, nil
+}
+
+// lambdaEvent is the part of a Lambda invocation event that is read. A scheduled
+// EventBridge event carries none of it; an IP pushed by a DDNS client arrives as
+// {"ip": "..."}, or as the ip query string parameter through a function URL.
+type lambdaEvent struct {
+	IP                    string            `json:"ip"`
+	QueryStringParameters map[string]string `json:"queryStringParameters"`
+}
+
+// handleLambda syncs once for a Lambda invocation and returns the JSON summary. The
+// targets come from the flags' environment variables or a config file in the
+// package. Failures are returned rather than exited on, so that Lambda retries and
+// error alarms see them.
+func handleLambda(ctx context.Context, opts options, event lambdaEvent) (any, error) {
+	if opts.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.RunTimeout)
+		defer cancel()
+	}
+
+	targetCidrs, ipSource, err := lambdaTargetCidrs(ctx, opts, event)
+	if err != nil {
+		return nil, err
+	}
+
+	runs, err := prepareRuns(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare the run: %w", err)
+	}
+
+	reports := syncRuns(ctx, runs, opts, targetCidrs, ipSource, opts.DryRun, true)
+
+	if opts.Route53Record != "" {
+		reports = append(reports, syncRoute53Record(ctx, runs, opts, targetCidrs, ipSource))
+	}
+
+	exitCode := exitCodeFor(reports)
+	reportRun(ctx, runs, opts, reports, targetCidrs, exitCode)
+
+	if exitCode != exitOK {
+		// An error result replaces the summary, so it goes to the function's log instead.
+		printJSONSummary(reports, nil)
+
+		var errs []error
+		for _, report := range reports {
+			errs = append(errs, report.Errors...)
+		}
+
+		return nil, fmt.Errorf("%s: %w", exitCodeMeaning(exitCode), errors.Join(errs...))
+	}
+
+	return jsonDocument(reports), nil
+}
+
+// lambdaTargetCidrs picks the CIDR to allow for an invocation: the event's IP, then
+// --ip, then --ip-parameter, and otherwise the discovered public IP of the function.
+// The event's IP may come from whoever can call the function, so only a single
+// address is accepted from it.
+func lambdaTargetCidrs(ctx context.Context, opts options, event lambdaEvent) ([]string, string, error) {
+	if opts.Remove || opts.CleanExpired {
+		return nil, "", nil
+	}
+
+	const source = "from the Lambda event"
+
+	switch raw := cmp.Or(event.IP, event.QueryStringParameters["ip"]); {
+	case raw != "":
+		targetCidr, err := parseHostAddress(raw)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid IP %s: %w", source, err)
+		}
+
+		return []string{targetCidr}, source, nil
+	case opts.IPOverride != "":
+		targetCidr, err := parseIPOverride(opts.IPOverride)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid IP from --ip flag: %w", err)
+		}
+
+		return []string{targetCidr}, "from --ip flag", nil
+	case opts.IPParameter != "":
+		targetCidr, err := readIPParameter(ctx, opts)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return []string{targetCidr}, "from SSM parameter", nil
+	default:
+		targetCidrs, err := discoverTargetCidrs(opts.Families, opts.IPServices)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get public IP: %w", err)
+		}
+
+		return targetCidrs, "discovered", nil
+	}
+}
+
+// daemonMetrics are the Prometheus metrics served on --metrics-addr in watch and
+// --listen mode, updated after every sync. A nil *daemonMetrics records nothing.
+type daemonMetrics struct {
+	registry          *prometheus.Registry
+	lastSuccess       prometheus.Gauge
+	publicIP          *prometheus.GaugeVec
+	rulesUpdated      prometheus.Counter
+	discoveryFailures prometheus.Gauge
+	groupFailures     *prometheus.CounterVec
+}
+
+func newDaemonMetrics() *daemonMetrics {
+	m := &daemonMetrics{
+		registry: prometheus.NewRegistry(),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sg_updater_last_success_timestamp_seconds",
+			Help: "Unix time of the last sync in which no group failed.",
+		}),
+		publicIP: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sg_updater_public_ip_info",
+			Help: "The CIDRs allowed by the last sync, as labels.",
+		}, []string{"cidr"}),
+		rulesUpdated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sg_updater_rules_updated_total",
+			Help: "Security Groups whose rules were changed.",
+		}),
+		discoveryFailures: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sg_updater_ip_discovery_consecutive_failures",
+			Help: "Public IP discoveries that failed in a row, for every IP service.",
+		}),
+		groupFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sg_updater_group_failures_total",
+			Help: "Failed syncs of each Security Group.",
+		}, []string{"sg_id"}),
+	}
+
+	m.registry.MustRegister(m.lastSuccess, m.publicIP, m.rulesUpdated, m.discoveryFailures, m.groupFailures)
+
+	return m
+}
+
+// observeDiscovery counts consecutive public IP discovery failures.
+func (m *daemonMetrics) observeDiscovery(err error) {
+	if m == nil {
+		return
+	}
+
+	if err != nil {
+		m.discoveryFailures.Inc()
+	} else {
+		m.discoveryFailures.Set(0)
+	}
+}
+
+// observeSync records the outcome of a sync of targetCidrs.
+func (m *daemonMetrics) observeSync(reports []sgupdater.Result, targetCidrs []string) {
+	if m == nil {
+		return
+	}
+
+	failed := false
+
+	for _, report := range reports {
+		failed = failed || len(report.Errors) > 0
+
+		for _, result := range report.Results {
+			switch {
+			case result.Err != nil:
+				m.groupFailures.WithLabelValues(result.SgID).Inc()
+			case result.Changed() && !report.DryRun:
+				m.rulesUpdated.Inc()
+			}
+		}
+	}
+
+	if !failed {
+		m.lastSuccess.SetToCurrentTime()
+	}
+
+	m.publicIP.Reset()
+
+	for _, cidr := range targetCidrs {
+		m.publicIP.WithLabelValues(cidr).Set(1)
+	}
+}
+
+// serveMetrics serves m on addr under /metrics in the background and returns the
+// function that shuts the server down.
+func serveMetrics(addr string, m *daemonMetrics) func() {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "addr", addr, "error", err)
+		}
+	}()
+
+	slog.Info("Serving Prometheus metrics", "addr", addr, "path", "/metrics")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Metrics server did not shut down cleanly", "error", err)
+		}
+	}
+}
+
+// updateServer is the --listen mode: /update syncs the IP a client pushes, and
+// /healthz reports how the last sync went.
+type updateServer struct {
+	ctx     context.Context
+	opts    options
+	runs    []regionRun
+	metrics *daemonMetrics
+	// ephemeral records the rules pushes put in place, for --ephemeral.
+	ephemeral *ephemeralRules
+
+	// locks serializes the syncs of each description, so that two pushes never
+	// change the same rules at once.
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex
+
+	statusMu sync.Mutex
+	status   serverStatus
+}
+
+// serverStatus is the /healthz response.
+type serverStatus struct {
+	// Status is "waiting" until the first push, then "ok" or "failed".
+	Status   string    `json:"status"`
+	LastSync time.Time `json:"last_sync,omitzero"`
+	Cidrs    []string  `json:"cidrs,omitempty"`
+	ExitCode int       `json:"exit_code"`
+}
+
+// serveUpdates runs the --listen server until ctx is cancelled, then waits for the
+// requests in flight and returns the exit code.
+func serveUpdates(ctx context.Context, opts options, runs []regionRun, metrics *daemonMetrics, ephemeral *ephemeralRules) int {
+	s := &updateServer{
+		ctx:       ctx,
+		opts:      opts,
+		runs:      runs,
+		metrics:   metrics,
+		ephemeral: ephemeral,
+		locks:     make(map[string]*sync.Mutex),
+		status:    serverStatus{Status: "waiting"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /update", s.handleUpdate)
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+
+	server := &http.Server{Addr: opts.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	slog.Info("Listening for IP pushes", "addr", opts.Listen)
+
+	select {
+	case err := <-serveErr:
+		slog.Error("HTTP server failed", "addr", opts.Listen, "error", err)
+		return exitFatal
+	case <-ctx.Done():
+	}
+
+	slog.Info("Received shutdown signal, stopping the HTTP server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server did not shut down cleanly", "error", err)
+		return exitFatal
+	}
+
+	return exitOK
+}
+
+// handleUpdate syncs the ip query parameter, a single address, for the entry whose
+// description is the name parameter, or for every entry without one, and responds
+// with the JSON summary.
+func (s *updateServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.opts.ListenToken)) != 1 {
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("name")
+
+	targetCidr, err := parseHostAddress(query.Get("ip"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid ip: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	runs, descriptions := s.runsFor(name)
+	if len(descriptions) == 0 {
+		http.Error(w, fmt.Sprintf("no entry has the description '%s'", name), http.StatusNotFound)
+		return
+	}
+
+	slog.Info("Received IP push", "cidr", targetCidr, "descriptions", strings.Join(descriptions, ", "), "remote", r.RemoteAddr)
+
+	unlock := s.lock(descriptions)
+	defer unlock()
+
+	ctx := s.ctx
+	if s.opts.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.RunTimeout)
+		defer cancel()
+	}
+
+	targetCidrs := []string{targetCidr}
+	ipSource := "pushed to /update"
+	reports := syncRuns(ctx, runs, s.opts, targetCidrs, ipSource, s.opts.DryRun, false)
+
+	if s.opts.Route53Record != "" && name == "" {
+		reports = append(reports, syncRoute53Record(ctx, runs, s.opts, targetCidrs, ipSource))
+	}
+
+	exitCode := exitCodeFor(reports)
+	reportRun(ctx, runs, s.opts, reports, targetCidrs, exitCode)
+	s.metrics.observeSync(reports, targetCidrs)
+	s.ephemeral.record(reports)
+
+	status := serverStatus{Status: "ok", LastSync: time.Now().UTC(), Cidrs: targetCidrs, ExitCode: exitCode}
+	if exitCode != exitOK {
+		status.Status = "failed"
+	}
+
+	s.statusMu.Lock()
+	s.status = status
+	s.statusMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if exitCode != exitOK {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	if err := json.NewEncoder(w).Encode(jsonDocument(reports)); err != nil {
+		slog.Warn("Failed to write the /update response", "error", err)
+	}
+}
+
+// handleHealth reports the outcome of the last push, failing once a sync failed.
+func (s *updateServer) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	s.statusMu.Lock()
+	status := s.status
+	s.statusMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if status.Status == "failed" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		slog.Warn("Failed to write the /healthz response", "error", err)
+	}
+}
+
+// runsFor narrows the runs to the targets described as name, or keeps them all when
+// name is empty. It also returns the descriptions that will be synced.
+func (s *updateServer) runsFor(name string) ([]regionRun, []string) {
+	var descriptions []string
+
+	for _, target := range s.opts.Targets {
+		if name == "" || target.Description == name {
+			descriptions = append(descriptions, target.Description)
+		}
+	}
+
+	slices.Sort(descriptions)
+	descriptions = slices.Compact(descriptions)
+
+	if name == "" {
+		return s.runs, descriptions
+	}
+
+	runs := make([]regionRun, len(s.runs))
+
+	for i, run := range s.runs {
+		run.Targets = slices.DeleteFunc(slices.Clone(run.Targets), func(target resolvedTarget) bool {
+			return target.Description != name
+		})
+		runs[i] = run
+	}
+
+	return runs, descriptions
+}
+
+// lock takes the lock of every description, in sorted order so that overlapping
+// pushes cannot deadlock, and returns the function releasing them.
+func (s *updateServer) lock(descriptions []string) func() {
+	var held []*sync.Mutex
+
+	for _, description := range descriptions {
+		s.locksMu.Lock()
+		mu, ok := s.locks[description]
+		if !ok {
+			mu = &sync.Mutex{}
+			s.locks[description] = mu
+		}
+		s.locksMu.Unlock()
+
+		mu.Lock()
+		held = append(held, mu)
+	}
+
+	return func() {
+		for _, mu := range held {
+			mu.Unlock()
+		}
+	}
+}
+
+// printPlan renders the planned changes as a diff in the style of terraform plan:
+// one block per security group listing its rules with our description, prefixed
+// with '-' when they would be revoked and '+' when they would be authorized.
+func printPlan(w io.Writer, reports []sgupdater.Result) {
+	colors := paletteFor(w)
+	changedGroups, unchangedGroups := 0, 0
+
+	fmt.Fprintln(w, "Planned changes:")
+
+	for _, report := range reports {
+		byGroup := make(map[string][]sgupdater.GroupResult)
+		var sgIDs []string
+
+		for _, result := range report.Results {
+			if _, seen := byGroup[result.SgID]; !seen {
+				sgIDs = append(sgIDs, result.SgID)
+			}
+
+			byGroup[result.SgID] = append(byGroup[result.SgID], result)
+		}
+
+		for _, sgID := range sgIDs {
+			results := byGroup[sgID]
+			marker := " "
+
+			if slices.ContainsFunc(results, func(r sgupdater.GroupResult) bool { return r.Err == nil && r.Changed() }) {
+				marker = colors.yellow("~")
+				changedGroups++
+			} else {
+				unchangedGroups++
+			}
+
+			header := sgID
+
+			if results[0].GroupName != "" {
+				header += fmt.Sprintf(" (%s)", results[0].GroupName)
+			}
+
+			if report.Region != "" {
+				header += " in " + report.Region
+			}
+
+			fmt.Fprintf(w, "%s %s%s\n", marker, header, targetLabel(report.Name))
+
+			for _, result := range results {
+				if result.Err != nil {
+					fmt.Fprintf(w, "    %s\n", colors.red(fmt.Sprintf("! %v", result.Err)))
+					continue
+				}
+
+				for _, change := range result.Diff {
+					fmt.Fprintf(w, "    %s\n", colors.change(change))
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "Plan: %d group(s) to change, %d unchanged.\n", changedGroups, unchangedGroups)
+}
+
+// printCheck lists each out-of-date rule as "sg-id (name) in region: plan", followed
+// by any errors. It prints nothing when every group is in sync.
+func printCheck(w io.Writer, reports []sgupdater.Result) {
+	colors := paletteFor(w)
+
+	for _, report := range reports {
+		for _, result := range report.Results {
+			if result.Err != nil || result.Deleted || !result.Changed() {
+				continue
+			}
+
+			header := result.SgID
+
+			if result.GroupName != "" {
+				header += fmt.Sprintf(" (%s)", result.GroupName)
+			}
+
+			if report.Region != "" {
+				header += " in " + report.Region
+			}
+
+			fmt.Fprintf(w, "%s%s: %s\n", header, targetLabel(report.Name), colors.yellow(result.Plan()))
+		}
+
+		for _, err := range report.Errors {
+			fmt.Fprintln(w, colors.red(fmt.Sprintf("error: %v", err)))
+		}
+	}
+}
+
+// changedGroupCount counts the distinct groups with at least one planned change.
+func changedGroupCount(reports []sgupdater.Result) int {
+	changed := make(map[string]bool)
+
+	for _, report := range reports {
+		for _, result := range report.Results {
+			if result.Err == nil && result.Changed() {
+				changed[report.Region+"/"+result.SgID] = true
+			}
+		}
+	}
+
+	return len(changed)
+}
+
+// confirmChanges asks once on stderr whether to apply the planned changes and reads
+// the answer from stdin. It refuses to prompt when stdin is not a terminal.
+func confirmChanges(groupCount int) (bool, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false, fmt.Errorf("--confirm needs an interactive terminal; pass --yes to approve the changes non-interactively")
+	}
+
+	fmt.Fprintf(os.Stderr, "Apply these changes to %d security group(s)? [y/N] ", groupCount)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("failed to read the answer: %w", err)
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes", nil
+}
+
+// selectTargetGroups lists the groups the target's tags and VPC narrow down to, or
+// every group of the region without them, and asks on stderr which ones to sync.
+// The picked groups replace the target's selectors, and the equivalent --sg-id flag
+// is printed so the selection can be reused. It refuses to prompt when stdin is not
+// a terminal.
+func selectTargetGroups(ctx context.Context, opts *options) error {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("--select needs an interactive terminal; pass the groups with --sg-id instead")
+	}
+
+	var region string
+	if len(opts.Regions) > 0 {
+		region = opts.Regions[0]
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, opts.Profiles[0], region, opts.Endpoint, opts.APICalls, opts.AssumeRole)
+	if err != nil {
+		return err
+	}
+
+	account, err := checkCallerAccount(ctx, sts.NewFromConfig(awsCfg), opts.ExpectedAccounts)
+	if err != nil {
+		return err
+	}
+
+	target := &opts.Targets[0]
+	query := target.Target
+	query.OwnerID = opts.OwnerID
+
+	if opts.OwnerID == ownerSelf {
+		query.OwnerID = account
+	}
+
+	candidates, err := sgupdater.CandidateGroups(ctx, ec2.NewFromConfig(awsCfg), query)
+	if err != nil {
+		return err
+	}
+
+	if len(candidates) == 0 {
+		return fmt.Errorf("no Security Groups to select from in %s", awsCfg.Region)
+	}
+
+	picked, err := pickGroups(os.Stderr, bufio.NewReader(os.Stdin), candidates)
+	if err != nil {
+		return err
+	}
+
+	target.SgIDs = picked
+	target.SgTagNames = nil
+	target.SgTags = nil
+
+	fmt.Fprintf(os.Stderr, "Selected %d group(s). To sync the same ones next time, pass:\n  --sg-id=%s\n", len(picked), strings.Join(picked, ","))
+
+	return nil
+}
+
+// pickGroups numbers the candidates and reads a selection such as "1,3-5". Any other
+// answer narrows the list to the groups whose ID, names, VPC or description contain
+// its letters in order, keeping their numbers, and asks again.
+func pickGroups(w io.Writer, r *bufio.Reader, candidates []types.SecurityGroup) ([]string, error) {
+	shown := candidates
+
+	for {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+		for _, sg := range shown {
+			number := slices.IndexFunc(candidates, func(c types.SecurityGroup) bool { return c.GroupId == sg.GroupId }) + 1
+			fmt.Fprintf(tw, "%3d)\t%s\t%s\t%s\t%s\n", number, aws.ToString(sg.GroupId), groupLabel(sg), aws.ToString(sg.VpcId), aws.ToString(sg.Description))
+		}
+
+		tw.Flush()
+		fmt.Fprint(w, "Groups to sync (e.g. 1,3-5), or text to filter the list: ")
+
+		answer, err := r.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || answer == "") {
+			return nil, fmt.Errorf("failed to read the selection: %w", err)
+		}
+
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			return nil, fmt.Errorf("no Security Group selected")
+		}
+
+		numbers, err := parseSelection(answer, len(candidates))
+		if err == nil {
+			picked := make([]string, 0, len(numbers))
+
+			for _, n := range numbers {
+				picked = append(picked, aws.ToString(candidates[n-1].GroupId))
+			}
+
+			return picked, nil
+		}
+
+		if strings.ContainsFunc(answer, func(r rune) bool { return r != ',' && r != '-' && r != ' ' && (r < '0' || r > '9') }) {
+			var matches []types.SecurityGroup
+
+			for _, sg := range candidates {
+				if fuzzyMatch(answer, strings.Join([]string{aws.ToString(sg.GroupId), groupLabel(sg), aws.ToString(sg.VpcId), aws.ToString(sg.Description)}, " ")) {
+					matches = append(matches, sg)
+				}
+			}
+
+			if len(matches) > 0 {
+				shown = matches
+				continue
+			}
+
+			fmt.Fprintf(w, "No group matches '%s'.\n", answer)
+			shown = candidates
+
+			continue
+		}
+
+		fmt.Fprintf(w, "%v.\n", err)
+	}
+}
+
+// groupLabel is the group name, followed by its Name tag when that differs.
+func groupLabel(sg types.SecurityGroup) string {
+	name := aws.ToString(sg.GroupName)
+	if tag := sgupdater.TagValue(sg.Tags, "Name"); tag != "" && tag != name {
+		return fmt.Sprintf("%s (%s)", name, tag)
+	}
+
+	return name
+}
+
+// parseSelection parses comma-separated numbers and ranges between 1 and count,
+// dropping repeats and keeping the order they were given in.
+func parseSelection(answer string, count int) ([]int, error) {
+	var numbers []int
+
+	for _, part := range strings.Split(answer, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lowRaw, highRaw, isRange := strings.Cut(part, "-")
+		if !isRange {
+			highRaw = lowRaw
+		}
+
+		low, lowErr := strconv.Atoi(strings.TrimSpace(lowRaw))
+		high, highErr := strconv.Atoi(strings.TrimSpace(highRaw))
+
+		if lowErr != nil || highErr != nil || low < 1 || high > count || low > high {
+			return nil, fmt.Errorf("'%s' is not a number or range between 1 and %d", part, count)
+		}
+
+		for n := low; n <= high; n++ {
+			if !slices.Contains(numbers, n) {
+				numbers = append(numbers, n)
+			}
+		}
+	}
+
+	if len(numbers) == 0 {
+		return nil, fmt.Errorf("no group number given")
+	}
+
+	return numbers, nil
+}
+
+// fuzzyMatch reports whether text contains the letters of query in order, ignoring
+// case and spaces.
+func fuzzyMatch(query, text string) bool {
+	text = strings.ToLower(text)
+
+	for _, r := range strings.ToLower(strings.ReplaceAll(query, " ", "")) {
+		i := strings.IndexRune(text, r)
+		if i < 0 {
+			return false
+		}
+
+		text = text[i+len(string(r)):]
+	}
+
+	return true
+}
+
+// needsNotification reports whether a run is worth notifying about: a rule was
+// added, updated or revoked, or something failed.
+func needsNotification(reports []sgupdater.Result) bool {
+	for _, report := range reports {
+		if len(report.Errors) > 0 {
+			return true
+		}
+
+		for _, result := range report.Results {
+			if result.Err == nil && result.Changed() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// previousCidrs returns the CIDRs a sync replaced with the current ones, if the IP
+// changed since the rules were written.
+func previousCidrs(reports []sgupdater.Result) []string {
+	var cidrs []string
+
+	for _, report := range reports {
+		for _, result := range report.Results {
+			if result.Err != nil || result.Removal {
+				continue
+			}
+
+			for _, cidr := range slices.Concat([]string{result.ModifiedCidr}, result.RevokeCidrs, result.DeferredCidrs) {
+				if cidr != "" && !slices.Contains(cidrs, cidr) {
+					cidrs = append(cidrs, cidr)
+				}
+			}
+		}
+	}
+
+	return cidrs
+}
+
+// slackMessage summarizes a run in Slack mrkdwn: the old and new IP, the groups that
+// changed and any errors.
+func slackMessage(reports []sgupdater.Result, targetCidrs []string) string {
+	var changes, failures []string
+
+	oldCidrs := previousCidrs(reports)
+
+	for _, report := range reports {
+		for _, result := range report.Results {
+			if result.Err != nil || result.Deleted || !result.Changed() {
+				continue
+			}
+
+			group := result.SgID
+			if result.GroupName != "" {
+				group += fmt.Sprintf(" (%s)", result.GroupName)
+			}
+
+			if report.Region != "" {
+				group += " in " + report.Region
+			}
+
+			changes = append(changes, fmt.Sprintf("• %s: %s", group, result.Action()))
+		}
+
+		for _, err := range report.Errors {
+			failures = append(failures, fmt.Sprintf("• %v", err))
+		}
+	}
+
+	var lines []string
+
+	switch {
+	case len(oldCidrs) > 0:
+		lines = append(lines, fmt.Sprintf("*aws-sg-updater*: IP changed %s → %s", strings.Join(oldCidrs, ", "), strings.Join(targetCidrs, ", ")))
+	case len(changes) > 0:
+		lines = append(lines, fmt.Sprintf("*aws-sg-updater*: authorized %s", strings.Join(targetCidrs, ", ")))
+	case len(failures) > 0:
+		lines = append(lines, "*aws-sg-updater*: sync failed")
+	default:
+		lines = append(lines, fmt.Sprintf("*aws-sg-updater*: no changes, %s already authorized", strings.Join(targetCidrs, ", ")))
+	}
+
+	if len(changes) > 0 {
+		lines = append(lines, fmt.Sprintf("Updated groups (%d):", len(changes)))
+		lines = append(lines, changes...)
+	}
+
+	if len(failures) > 0 {
+		lines = append(lines, fmt.Sprintf("Errors (%d):", len(failures)))
+		lines = append(lines, failures...)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// notifySlack posts text to a Slack incoming webhook.
+func notifySlack(webhookURL, text string) error {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{Timeout: notifyTimeout}
+
+	resp, err := httpClient.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// ping reports the end of a run to a healthchecks.io-style pingURL: a GET when
+// failure is empty, otherwise failure POSTed to <pingURL>/fail. Problems are only
+// logged, the exit code reflects the sync.
+func ping(pingURL, failure string) {
+	httpClient := &http.Client{Timeout: pingTimeout}
+
+	var resp *http.Response
+	var err error
+
+	if failure == "" {
+		resp, err = httpClient.Get(pingURL)
+	} else {
+		resp, err = httpClient.Post(strings.TrimSuffix(pingURL, "/")+"/fail", "text/plain; charset=utf-8", strings.NewReader(failure))
+	}
+
+	if err != nil {
+		slog.Warn("Failed to ping --ping-url", "error", err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.Warn("Ping URL returned an error", "status", resp.Status)
+		return
+	}
+
+	slog.Debug("Pinged --ping-url", "failed", failure != "")
+}
+
+// pingSetupError reports a setup error to --ping-url, since the run exits on it
+// before reportRun could.
+func pingSetupError(opts options, msg string, err error) {
+	if opts.PingURL != "" && !opts.DryRun {
+		ping(opts.PingURL, fmt.Sprintf("%s: %v", msg, err))
+	}
+}
+
+// --test-connect outcomes.
+const (
+	connectOK      = "ok"
+	connectDNS     = "dns_failure"
+	connectTimeout = "timeout"
+	connectFailed  = "failed"
+)
+
+// connectResult is the outcome of one --test-connect dial.
+type connectResult struct {
+	Target  string
+	Outcome string
+	Elapsed time.Duration
+	Err     error
+}
+
+func (r connectResult) String() string {
+	switch r.Outcome {
+	case connectOK:
+		return fmt.Sprintf("connected in %s", r.Elapsed.Round(time.Millisecond))
+	case connectDNS:
+		return fmt.Sprintf("DNS lookup failed: %v", r.Err)
+	case connectTimeout:
+		return fmt.Sprintf("timed out after %s", r.Elapsed.Round(time.Millisecond))
+	default:
+		return fmt.Sprintf("connection failed: %v", r.Err)
+	}
+}
+
+// testConnections opens a TCP connection to every --test-connect target, one at a
+// time, and closes it straight away. A DNS failure is told apart from a timeout,
+// which usually means a group on the way still drops our traffic.
+func testConnections(ctx context.Context, tests connectTestOptions) []connectResult {
+	var results []connectResult
+
+	for _, target := range tests.Targets {
+		dialer := net.Dialer{Timeout: tests.Timeout}
+		start := time.Now()
+
+		conn, err := dialer.DialContext(ctx, "tcp", target)
+		result := connectResult{Target: target, Elapsed: time.Since(start), Err: err}
+
+		var dnsErr *net.DNSError
+		var netErr net.Error
+
+		switch {
+		case err == nil:
+			conn.Close()
+			result.Outcome = connectOK
+			slog.Info("Connectivity test passed", "target", target, "elapsed", result.Elapsed.Round(time.Millisecond))
+		case errors.As(err, &dnsErr):
+			result.Outcome = connectDNS
+		case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+			result.Outcome = connectTimeout
+		default:
+			result.Outcome = connectFailed
+		}
+
+		if err != nil {
+			slog.Warn("Connectivity test failed", "target", target, "outcome", result.Outcome, "error", err)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// failureSummary describes a failed run for --ping-url: the exit code, then every
+// error on its own line.
+func failureSummary(reports []sgupdater.Result, exitCode int) string {
+	lines := []string{fmt.Sprintf("exit code %d: %s", exitCode, exitCodeMeaning(exitCode))}
+
+	for _, report := range reports {
+		for _, err := range report.Errors {
+			lines = append(lines, err.Error())
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// resultLabel names the outcome of a run for notifications: success, partial or
+// failure.
+func resultLabel(exitCode int) string {
+	switch exitCode {
+	case exitOK:
+		return "success"
+	case exitPartialFailure:
+		return "partial"
+	default:
+		return "failure"
+	}
+}
+
+// --webhook-on values.
+const (
+	webhookOnChange  = "change"
+	webhookOnFailure = "failure"
+	webhookOnAlways  = "always"
+)
+
+// webhookDue reports whether --webhook-on selects a run with these reports.
+func webhookDue(on string, reports []sgupdater.Result) bool {
+	switch on {
+	case webhookOnAlways:
+		return true
+	case webhookOnFailure:
+		return slices.ContainsFunc(reports, func(report sgupdater.Result) bool { return len(report.Errors) > 0 })
+	default:
+		return needsNotification(reports)
+	}
+}
+
+// webhookPayload is the JSON body sent to --webhook-url.
+type webhookPayload struct {
+	Result       string         `json:"result"`
+	ExitCode     int            `json:"exit_code"`
+	IP           []string       `json:"ip"`
+	PreviousIP   []string       `json:"previous_ip"`
+	Descriptions []string       `json:"descriptions"`
+	Groups       []webhookGroup `json:"groups"`
+	Errors       []string       `json:"errors"`
+}
+
+type webhookGroup struct {
+	Profile     string `json:"profile,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Entry       string `json:"entry,omitempty"`
+	SgID        string `json:"sg_id"`
+	Description string `json:"description"`
+	Cidr        string `json:"cidr,omitempty"`
+	Action      string `json:"action"`
+	Error       string `json:"error,omitempty"`
+}
+
+func newWebhookPayload(reports []sgupdater.Result, targetCidrs []string, exitCode int) webhookPayload {
+	payload := webhookPayload{
+		Result:       resultLabel(exitCode),
+		ExitCode:     exitCode,
+		IP:           targetCidrs,
+		PreviousIP:   previousCidrs(reports),
+		Descriptions: []string{},
+		Groups:       []webhookGroup{},
+		Errors:       []string{},
+	}
+
+	if payload.PreviousIP == nil {
+		payload.PreviousIP = []string{}
+	}
+
+	for _, report := range reports {
+		if report.Description != "" && !slices.Contains(payload.Descriptions, report.Description) {
+			payload.Descriptions = append(payload.Descriptions, report.Description)
+		}
+
+		for _, result := range report.Results {
+			group := webhookGroup{
+				Profile:     report.Profile,
+				Region:      report.Region,
+				Entry:       report.Name,
+				SgID:        result.SgID,
+				Description: result.Description,
+				Cidr:        result.TargetCidr,
+				Action:      string(result.Action()),
+			}
+
+			if result.Err != nil {
+				group.Error = result.Err.Error()
+			}
+
+			payload.Groups = append(payload.Groups, group)
+		}
+
+		for _, err := range report.Errors {
+			payload.Errors = append(payload.Errors, err.Error())
+		}
+	}
+
+	return payload
+}
+
+// callWebhook posts payload to the webhook, retrying once after a 5xx response.
+func callWebhook(opts options, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{Timeout: opts.WebhookTimeout}
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, opts.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		req.Header = opts.WebhookHeaders.Clone()
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("request failed: %w", err)
+		}
+
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 500 && attempt == 1:
+			slog.Warn("Webhook failed, retrying once", "status", resp.Status)
+			time.Sleep(time.Second)
+		case resp.StatusCode >= 300:
+			return fmt.Errorf("webhook returned status %s", resp.Status)
+		default:
+			return nil
+		}
+	}
+}
+
+// publishMetrics publishes the SyncSuccess, SyncFailure, RulesUpdated and IPChanged
+// metrics of every report, with Description and Region dimensions, using the
+// configuration of the profile and region the report came from. It gives up after
+// metricsTimeout and never retries.
+func publishMetrics(ctx context.Context, runs []regionRun, namespace string, reports []sgupdater.Result) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), metricsTimeout)
+	defer cancel()
+
+	data := make(map[int][]cwtypes.MetricDatum)
+	now := time.Now()
+
+	for _, report := range reports {
+		index := slices.IndexFunc(runs, func(run regionRun) bool {
+			return run.Err == nil && run.Profile == report.Profile && run.Region == report.Region
+		})
+		if index < 0 || report.Description == "" {
+			continue
+		}
+
+		rulesUpdated, ipChanged := 0, 0
+
+		for _, result := range report.Results {
+			if result.Err == nil && result.Changed() {
+				rulesUpdated++
+			}
+		}
+
+		if len(previousCidrs([]sgupdater.Result{report})) > 0 {
+			ipChanged = 1
+		}
+
+		dimensions := []cwtypes.Dimension{
+			{Name: aws.String("Description"), Value: aws.String(report.Description)},
+			{Name: aws.String("Region"), Value: aws.String(report.Region)},
+		}
+
+		for name, value := range map[string]int{
+			"SyncSuccess":  report.SuccessCount,
+			"SyncFailure":  len(report.Errors),
+			"RulesUpdated": rulesUpdated,
+			"IPChanged":    ipChanged,
+		} {
+			data[index] = append(data[index], cwtypes.MetricDatum{
+				MetricName: aws.String(name),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(now),
+				Unit:       cwtypes.StandardUnitCount,
+				Value:      aws.Float64(float64(value)),
+			})
+		}
+	}
+
+	var errs []error
+
+	for index, datums := range data {
+		run := runs[index]
+
+		client := cloudwatch.NewFromConfig(run.Config, func(o *cloudwatch.Options) {
+			o.Region = run.Region
+			o.RetryMaxAttempts = 1
+		})
+
+		if _, err := client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{Namespace: aws.String(namespace), MetricData: datums}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", run.label(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// publishSNS publishes the JSON summary of a run to topicARN with the configuration of
+// the first profile that was prepared. The result and ip_changed message attributes
+// let subscribers filter.
+func publishSNS(ctx context.Context, runs []regionRun, topicARN string, reports []sgupdater.Result, exitCode int) error {
+	index := slices.IndexFunc(runs, func(run regionRun) bool { return run.Err == nil })
+	if index < 0 {
+		return fmt.Errorf("no profile was prepared successfully")
+	}
+
+	message, err := json.Marshal(jsonDocument(reports))
 	if err != nil {
-		return "", fmt.Errorf("failed to get public IP from %s: %w", ipServiceURL, err)
+		return err
+	}
+
+	result := resultLabel(exitCode)
+	ipChanged := strconv.FormatBool(len(previousCidrs(reports)) > 0)
+
+	// The topic's own region wins over the profile's.
+	client := sns.NewFromConfig(runs[index].Config, func(o *sns.Options) {
+		if parsed, err := arn.Parse(topicARN); err == nil {
+			o.Region = parsed.Region
+		}
+	})
+
+	// Publish even after an interrupt, but not for longer than notifyTimeout.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	defer cancel()
+
+	_, err = client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topicARN),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"result":     {DataType: aws.String("String"), StringValue: aws.String(result)},
+			"ip_changed": {DataType: aws.String("String"), StringValue: aws.String(ipChanged)},
+		},
+	})
+
+	return err
+}
+
+// exitCodeFor picks the process exit code for a finished run: every group synced,
+// some failed, or all of them failed. Groups left undone by --fail-fast did not
+// fail, so they make a failure partial.
+func exitCodeFor(reports []sgupdater.Result) int {
+	succeeded, failed, notAttempted := 0, 0, 0
+
+	for _, report := range reports {
+		succeeded += report.SuccessCount
+		failed += len(report.Errors)
+		notAttempted += len(report.NotAttempted)
+	}
+
+	switch {
+	case failed == 0:
+		return exitOK
+	case succeeded == 0 && notAttempted == 0:
+		return exitAllFailed
+	default:
+		return exitPartialFailure
+	}
+}
+
+// checkExitCode picks the exit code for --check: that of exitCodeFor, except that a
+// check where nothing failed but some group would change exits with
+// exitChangesNeeded.
+func checkExitCode(reports []sgupdater.Result) int {
+	exitCode := exitCodeFor(reports)
+
+	if exitCode == exitOK && changedGroupCount(reports) > 0 {
+		return exitChangesNeeded
+	}
+
+	return exitCode
+}
+
+func exitCodeMeaning(code int) string {
+	switch code {
+	case exitOK:
+		return "all Security Groups are in sync"
+	case exitFatal:
+		return "setup failed"
+	case exitPartialFailure:
+		return "some Security Groups failed"
+	case exitAllFailed:
+		return "every Security Group failed"
+	case exitChangesNeeded:
+		return "changes are needed"
+	case exitConnectFailed:
+		return "a connectivity test failed"
+	default:
+		return "unknown"
+	}
+}
+
+// joinDirections lists directions as --direction names them, e.g. "ingress and
+// egress".
+func joinDirections(directions []sgupdater.Direction) string {
+	names := make([]string, 0, len(directions))
+
+	for _, direction := range directions {
+		names = append(names, string(direction))
+	}
+
+	return strings.Join(names, " and ")
+}
+
+// describeRules lists the protocols and ports a report synced, e.g. "tcp 443, udp
+// 51820" with --rule given twice.
+func describeRules(report sgupdater.Result) string {
+	rules := []string{report.Rule.String()}
+
+	for _, rule := range report.ExtraRules {
+		rules = append(rules, rule.String())
+	}
+
+	return strings.Join(rules, ", ")
+}
+
+func printSummary(reports []sgupdater.Result, connects []connectResult, outputFormat string, exitCode int) {
+	if outputFormat == outputJSON {
+		printJSONSummary(reports, connects)
+		return
+	}
+
+	defer fmt.Printf("Exit code: %d (%s)\n", exitCode, exitCodeMeaning(exitCode))
+
+	for _, report := range reports {
+		printTextSummary(report)
+	}
+
+	printEntryBreakdown(reports)
+
+	printBreakdown(reports, "Per-Region Summary:", func(report sgupdater.Result) string {
+		return report.Region
+	})
+
+	printBreakdown(reports, "Per-Profile Summary:", func(report sgupdater.Result) string {
+		if report.Profile == "" {
+			return "(default credential chain)"
+		}
+
+		return report.Profile
+	})
+
+	if len(connects) > 0 {
+		fmt.Println("Connectivity Tests:")
+
+		for _, result := range connects {
+			fmt.Printf("  %s: %s\n", result.Target, result)
+		}
+
+		fmt.Println("-----------------------------------------------------------------------------------")
+	}
+}
+
+// printEntryBreakdown prints what happened to every group of every entry, e.g. each
+// member of a --roster or --extra-cidr, when the run has more than one entry. An
+// entry without a name is labelled with its description.
+func printEntryBreakdown(reports []sgupdater.Result) {
+	names := make(map[string]bool)
+
+	for _, report := range reports {
+		if label := cmp.Or(report.Name, report.Description); label != "" {
+			names[label] = true
+		}
+	}
+
+	if len(names) < 2 {
+		return
+	}
+
+	fmt.Println("Per-Entry Summary:")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	for _, report := range reports {
+		label := cmp.Or(report.Name, report.Description)
+		if label == "" {
+			continue
+		}
+
+		if len(report.Results) == 0 {
+			for _, err := range report.Errors {
+				fmt.Fprintf(w, "  %s\t-\tfailed: %v\n", label, err)
+			}
+
+			continue
+		}
+
+		for _, result := range report.Results {
+			if result.Pruned && !result.Changed() {
+				continue
+			}
+
+			action := string(result.Action())
+			if result.TargetCidr != "" && (action == "added" || action == "updated" || action == "unchanged") {
+				detail := result.TargetCidr
+				if len(report.ExtraRules) > 0 {
+					detail += ", " + result.Rule.String()
+				}
+
+				action += " (" + detail + ")"
+			}
+
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", label, result.SgID, action)
+		}
+	}
+
+	w.Flush()
+	fmt.Println("-----------------------------------------------------------------------------------")
+}
+
+// printBreakdown prints synced and failed counts per key (a region or a profile)
+// when a run spans more than one of them.
+func printBreakdown(reports []sgupdater.Result, title string, keyOf func(sgupdater.Result) string) {
+	type breakdownCounts struct {
+		synced int
+		failed int
+	}
+
+	counts := make(map[string]*breakdownCounts)
+	var keys []string
+
+	for _, report := range reports {
+		key := keyOf(report)
+		if key == "" {
+			continue
+		}
+
+		if counts[key] == nil {
+			counts[key] = &breakdownCounts{}
+			keys = append(keys, key)
+		}
+
+		counts[key].synced += report.SuccessCount
+		counts[key].failed += len(report.Errors)
+	}
+
+	if len(keys) < 2 {
+		return
+	}
+
+	fmt.Println(title)
+
+	for _, key := range keys {
+		fmt.Printf("  %s: %d synced, %d failed\n", key, counts[key].synced, counts[key].failed)
+	}
+
+	fmt.Println("-----------------------------------------------------------------------------------")
+}
+
+// slowestGroups lists up to count groups of the report that took longest to sync,
+// slowest first, e.g. "sg-11111111 (web) 2.4s".
+func slowestGroups(report sgupdater.Result, count int) []string {
+	names := make(map[string]string)
+
+	for _, result := range report.Results {
+		if result.GroupName != "" {
+			names[result.SgID] = result.GroupName
+		}
+	}
+
+	sgIDs := slices.SortedFunc(maps.Keys(report.Durations), func(a, b string) int {
+		return cmp.Or(cmp.Compare(report.Durations[b], report.Durations[a]), strings.Compare(a, b))
+	})
+
+	var slowest []string
+
+	for _, sgID := range sgIDs[:min(count, len(sgIDs))] {
+		label := sgID
+		if name := names[sgID]; name != "" {
+			label += " (" + name + ")"
+		}
+
+		slowest = append(slowest, label+" "+report.Durations[sgID].Round(time.Millisecond).String())
+	}
+
+	return slowest
+}
+
+func printTextSummary(report sgupdater.Result) {
+	colors := paletteFor(os.Stdout)
+
+	fmt.Println("-----------------------------------------------------------------------------------")
+	fmt.Println("Sync Process Summary:")
+
+	if report.Name != "" {
+		fmt.Printf("  Entry: %s\n", report.Name)
+	}
+
+	if report.Record != "" {
+		fmt.Printf("  Route53 record: %s\n", report.Record)
+	}
+
+	if report.DryRun {
+		fmt.Println("  DRY RUN: no rules were revoked or authorized.")
+	}
+
+	if report.TimedOut {
+		fmt.Println(colors.red("  TIMED OUT: --run-timeout passed, only the groups counted as synced were completed."))
+	} else if report.Interrupted {
+		fmt.Println(colors.red("  INTERRUPTED: the run was cancelled, only the groups counted as synced were completed."))
+	}
+
+	if report.ExpiredPrefix != "" {
+		fmt.Printf("  Mode: clean expired rules starting with %s\n", report.ExpiredPrefix)
+	} else if report.Backup != "" {
+		fmt.Printf("  Mode: roll back to %s\n", report.Backup)
+	} else if report.Remove {
+		fmt.Println("  Mode: remove rules")
+	} else {
+		fmt.Printf("  Allowed traffic from: %s (%s)\n", strings.Join(report.TargetCidrs, ", "), report.IPSource)
+		if report.Rule.Protocol != "" {
+			fmt.Printf("  Protocol and ports: %s\n", describeRules(report))
+		}
+
+		if len(report.Directions) > 0 && !slices.Equal(report.Directions, []sgupdater.Direction{sgupdater.Ingress}) {
+			fmt.Printf("  Direction: %s\n", joinDirections(report.Directions))
+		}
+	}
+
+	if report.Description != "" && report.ExpiredPrefix == "" {
+		fmt.Printf("  Rule description: %s\n", report.Description)
+	}
+
+	if report.PrunePrefix != "" {
+		fmt.Printf("  Pruning descriptions starting with: %s\n", report.PrunePrefix)
+	}
+
+	if report.Profile != "" {
+		fmt.Printf("  Using AWS Profile: %s\n", report.Profile)
+	} else {
+		fmt.Println("  Using AWS Profile: (default credential chain)")
+	}
+
+	if report.Role != "" {
+		fmt.Printf("  Assumed Role: %s\n", report.Role)
+	}
+
+	if report.Region != "" {
+		fmt.Printf("  Using AWS Region: %s\n", report.Region)
+	}
+
+	fmt.Printf("  Total Security Groups Processed: %d\n", report.GroupCount)
+
+	if selectors := report.Resolution.SelectorCounts(); len(selectors) > 1 {
+		fmt.Printf("    By selector: %s (%d selected more than once)\n", strings.Join(selectors, ", "), report.Resolution.Overlap)
+	}
+
+	if tags := report.Resolution.TagMatches; len(tags) > 1 {
+		counts := make([]string, 0, len(tags))
+
+		for _, match := range tags {
+			counts = append(counts, fmt.Sprintf("%s %d", match.Tag, match.Groups))
+		}
+
+		fmt.Printf("    By tag value: %s\n", strings.Join(counts, ", "))
+	}
+
+	for _, instanceID := range slices.Sorted(maps.Keys(report.Resolution.InstanceGroups)) {
+		fmt.Printf("    From instance %s: %s\n", instanceID, cmp.Or(strings.Join(report.Resolution.InstanceGroups[instanceID], ", "), "none"))
+	}
+
+	for _, lb := range slices.Sorted(maps.Keys(report.Resolution.LoadBalancerGroups)) {
+		fmt.Printf("    From load balancer %s: %s\n", lb, cmp.Or(strings.Join(report.Resolution.LoadBalancerGroups[lb], ", "), "none"))
+	}
+
+	if report.Resolution.Excluded > 0 {
+		fmt.Printf("    Excluded by --exclude-sg-id: %d\n", report.Resolution.Excluded)
+	}
+
+	if report.Resolution.OtherOwners > 0 {
+		fmt.Printf("    Owned by another account: %d\n", report.Resolution.OtherOwners)
+	}
+
+	if report.Resolution.Skipped > 0 {
+		fmt.Printf("    Skipped by guardrails: %d\n", report.Resolution.Skipped)
+	}
+
+	fmt.Printf("  Successfully Synced: %d\n", report.SuccessCount)
+	if failed := fmt.Sprintf("  Failed: %d", len(report.Errors)); len(report.Errors) > 0 {
+		fmt.Println(colors.red(failed))
+	} else {
+		fmt.Println(failed)
+	}
+
+	if len(report.Deleted) > 0 {
+		fmt.Println(colors.yellow(fmt.Sprintf("  Skipped (deleted): %d (%s)", len(report.Deleted), strings.Join(report.Deleted, ", "))))
+	}
+
+	if len(report.NotAttempted) > 0 {
+		fmt.Println(colors.yellow(fmt.Sprintf("  Not attempted (--fail-fast): %d (%s)", len(report.NotAttempted), strings.Join(report.NotAttempted, ", "))))
+	}
+
+	if counts := report.ActionCounts(); len(counts) > 0 {
+		var parts []string
+
+		for _, action := range sgupdater.Actions {
+			if counts[action] > 0 {
+				parts = append(parts, fmt.Sprintf("%s %d", colors.action(action), counts[action]))
+			}
+		}
+
+		label := "By action"
+		if report.DryRun {
+			label = "By planned action"
+		}
+
+		fmt.Printf("  %s: %s\n", label, strings.Join(parts, ", "))
+	}
+
+	interruptedCount, timedOutCount := 0, 0
+
+	for _, result := range report.Results {
+		switch {
+		case result.Interrupted():
+			interruptedCount++
+		case result.TimedOut():
+			timedOutCount++
+		}
+	}
+
+	if interruptedCount > 0 {
+		fmt.Printf("    Interrupted before completing: %d\n", interruptedCount)
+	}
+
+	if timedOutCount > 0 {
+		fmt.Printf("    Timed out (--api-timeout or --run-timeout): %d\n", timedOutCount)
+	}
+
+	if retries := report.Retries(); retries > 0 {
+		fmt.Printf("  Throttled Calls Retried: %d\n", retries)
+	}
+
+	if len(report.Durations) > 1 {
+		fmt.Printf("  Slowest Groups: %s\n", strings.Join(slowestGroups(report, 3), ", "))
+	}
+
+	if !report.DryRun && !report.Remove {
+		var changed, listed []sgupdater.GroupResult
+
+		var pruned []sgupdater.GroupResult
+
+		for _, result := range report.Results {
+			switch {
+			case result.Pruned:
+				if result.Err == nil && result.Changed() {
+					pruned = append(pruned, result)
+				}
+			case result.Err != nil || result.Deleted || !result.Changed():
+				listed = append(listed, result)
+			default:
+				changed = append(changed, result)
+				listed = append(listed, result)
+			}
+		}
+
+		if len(changed) > 0 {
+			fmt.Printf("  Groups Changed: %d\n", len(changed))
+		}
+
+		if len(listed) > 0 {
+			printGroupTable(report, listed)
+		}
+
+		for _, result := range changed {
+			// Rollbacks and allowlists change many CIDRs at once, so they are listed
+			// rule by rule.
+			if result.Restored || result.TargetCidr == "" {
+				for _, change := range result.Diff {
+					if change.Op != ' ' {
+						fmt.Printf("    [%s] %s\n", result.SgID, colors.change(change))
+					}
+				}
+			}
+		}
+
+		if len(pruned) > 0 {
+			prunedCount := 0
+
+			for _, result := range pruned {
+				prunedCount += len(result.Diff)
+			}
+
+			fmt.Printf("  Rules Pruned: %d\n", prunedCount)
+
+			for _, result := range pruned {
+				for _, change := range result.Diff {
+					fmt.Printf("    [%s] %s %s\n", result.SgID, colors.red("pruned"), change.Rule)
+				}
+			}
+		}
 	}
 
-	defer resp.Body.Close()
+	if report.Remove && !report.DryRun {
+		removedCount := 0
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get public IP: service %s returned status %s", ipServiceURL, resp.Status)
+		for _, result := range report.Results {
+			if result.Err == nil {
+				removedCount += len(result.RevokeCidrs)
+			}
+		}
+
+		fmt.Printf("  Rules Removed: %d\n", removedCount)
+
+		for _, result := range report.Results {
+			if result.Err == nil {
+				fmt.Printf("    [%s] %s %d rule(s) %s\n", result.SgID, colors.red("removed"), len(result.RevokeCidrs), strings.Join(result.RevokeCidrs, ", "))
+			}
+		}
 	}
 
-	ipBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body from IP service: %w", err)
+	if report.DryRun {
+		plannedChanges := 0
+
+		for _, result := range report.Results {
+			if result.Err == nil && result.Changed() {
+				plannedChanges++
+			}
+		}
+
+		fmt.Printf("  Planned Changes: %d\n", plannedChanges)
+
+		for _, result := range report.Results {
+			if result.Err == nil && result.Changed() {
+				fmt.Printf("    [%s] %s\n", result.SgID, colors.yellow(result.Plan()))
+			} else if result.Err == nil {
+				fmt.Printf("    [%s] %s\n", result.SgID, result.Plan())
+			}
+		}
 	}
 
-	ip := strings.TrimSpace(string(ipBytes))
-	if net.ParseIP(ip) == nil {
-		return "", fmt.Errorf("invalid IP address received: %s", ip)
+	var covered []sgupdater.GroupResult
+
+	for _, result := range report.Results {
+		if result.Err == nil && result.CoveredBy != "" {
+			covered = append(covered, result)
+		}
 	}
 
-	log.Printf("Discovered public IP: %s\n", ip)
-	return ip, nil
-}
+	if len(covered) > 0 {
+		fmt.Printf("  Already Covered: %d\n", len(covered))
 
-func loadAWSConfig(ctx context.Context, profileName string) (aws.Config, error) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(profileName))
-	if err != nil {
-		return aws.Config{}, fmt.Errorf("failed to load AWS configuration for profile '%s': %w", profileName, err)
+		for _, result := range covered {
+			fmt.Printf("    [%s] %s covered by %s\n", result.SgID, result.TargetCidr, result.CoveredBy)
+		}
 	}
 
-	log.Printf("Loaded AWS configuration using profile: %s\n", profileName)
+	var warnings []string
 
-	if cfg.Region == "" {
-		log.Println("Warning: AWS Region not specified in profile or environment variables. SDK might default to one (e.g., us-east-1) or fail if region is required.")
+	for _, result := range report.Results {
+		// A group synced for several CIDRs or rules can repeat the same warning.
+		for _, warning := range result.Warnings {
+			if line := fmt.Sprintf("[%s] %s", result.SgID, warning); !slices.Contains(warnings, line) {
+				warnings = append(warnings, line)
+			}
+		}
+	}
+
+	if len(warnings) > 0 {
+		fmt.Println(colors.yellow("  Warnings:"))
+		for _, warning := range warnings {
+			fmt.Println(colors.yellow("    - " + warning))
+		}
+	}
+
+	if len(report.Errors) > 0 {
+		fmt.Println(colors.red("  Errors Encountered:"))
+		for _, syncErr := range report.Errors {
+			fmt.Println(colors.red(fmt.Sprintf("    - %v", syncErr)))
+		}
+		fmt.Println("-----------------------------------------------------------------------------------")
 	} else {
-		log.Printf("Using AWS Region: %s\n", cfg.Region)
+		fmt.Println("-----------------------------------------------------------------------------------")
+		if report.DryRun {
+			fmt.Println(colors.green("✅ Plan computed successfully for all specified Security Groups."))
+		} else {
+			fmt.Println(colors.green("✅ All specified Security Groups synced successfully."))
+		}
 	}
+}
 
-	return cfg, nil
+// printGroupTable prints one row per result: the group, its Name tag, the action,
+// the CIDR (old -> new for an update), the rule ID when known, and the VPC, rule,
+// direction and propagation time where they apply.
+func printGroupTable(report sgupdater.Result, results []sgupdater.GroupResult) {
+	colors := paletteFor(os.Stdout)
+
+	fmt.Println("  Groups:")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	for _, result := range results {
+		cidr := cmp.Or(result.TargetCidr, "-")
+		if result.ModifiedCidr != "" {
+			cidr = result.ModifiedCidr + " -> " + result.TargetCidr
+		}
+
+		var notes []string
+
+		if result.VpcID != "" {
+			notes = append(notes, "in "+result.VpcID)
+		}
+
+		if len(report.ExtraRules) > 0 {
+			notes = append(notes, result.Rule.String())
+		}
+
+		if result.Egress {
+			notes = append(notes, "egress")
+		}
+
+		if result.Propagation > 0 {
+			notes = append(notes, "visible after "+result.Propagation.Round(time.Millisecond).String())
+		}
+
+		fmt.Fprintf(w, "    %s\t%s\t%s\t%s\t%s\t%s\n", result.SgID, cmp.Or(result.GroupName, "-"), colors.action(result.Action()), cidr, cmp.Or(result.RuleID, "-"), strings.Join(notes, ", "))
+	}
+
+	w.Flush()
 }
 
-func findSecurityGroupIDs(ctx context.Context, client *ec2.Client, sgIDs []string, sgTagNames []string) ([]string, error) {
-	resolvedIDs := make(map[string]struct{})
-	var errorList []string
+type jsonSummary struct {
+	Entry        string            `json:"entry,omitempty"`
+	Record       string            `json:"route53_record,omitempty"`
+	Backup       string            `json:"backup,omitempty"`
+	AllowedCidrs []string          `json:"allowed_cidrs"`
+	IPSource     string            `json:"ip_source"`
+	Description  string            `json:"description"`
+	Rule         string            `json:"rule"`
+	Profile      string            `json:"profile,omitempty"`
+	Role         string            `json:"role_arn,omitempty"`
+	Region       string            `json:"region"`
+	DryRun       bool              `json:"dry_run"`
+	Remove       bool              `json:"remove"`
+	Interrupted  bool              `json:"interrupted"`
+	TimedOut     bool              `json:"timed_out"`
+	Succeeded    int               `json:"succeeded"`
+	Failed       int               `json:"failed"`
+	Retries      int               `json:"retries"`
+	Groups       []jsonGroupResult `json:"security_groups"`
 
-	if len(sgIDs) > 0 {
-		log.Printf("Attempting to verify %d provided Security Group ID(s)...\n", len(sgIDs))
+	// SkippedDeleted lists the groups deleted during the run, which were skipped.
+	SkippedDeleted []string `json:"skipped_deleted,omitempty"`
 
-		var wg sync.WaitGroup
-		var mu sync.Mutex
+	// NotAttempted lists the groups left undone after a failure with --fail-fast.
+	NotAttempted []string `json:"not_attempted,omitempty"`
 
-		for _, id := range sgIDs {
-			if id == "" {
-				continue
-			}
+	// Actions counts the groups by what the run did to them, e.g. "added": 2.
+	Actions map[string]int `json:"actions"`
 
-			wg.Add(1)
+	// SyncSeconds holds how long each group took to sync, by group ID.
+	SyncSeconds map[string]float64 `json:"sync_seconds,omitempty"`
 
-			go func(sgID string) {
-				defer wg.Done()
+	// Connectivity lists the --test-connect results, which cover the whole run.
+	Connectivity []jsonConnectResult `json:"connectivity,omitempty"`
+}
 
-				input := &ec2.DescribeSecurityGroupsInput{
-					GroupIds: []string{sgID},
-				}
+type jsonConnectResult struct {
+	Target         string  `json:"target"`
+	Outcome        string  `json:"outcome"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Error          string  `json:"error,omitempty"`
+}
 
-				_, err := client.DescribeSecurityGroups(ctx, input)
+func newJSONConnectResult(result connectResult) jsonConnectResult {
+	connect := jsonConnectResult{
+		Target:         result.Target,
+		Outcome:        result.Outcome,
+		ElapsedSeconds: result.Elapsed.Seconds(),
+	}
 
-				mu.Lock()
+	if result.Err != nil {
+		connect.Error = result.Err.Error()
+	}
 
-				defer mu.Unlock()
+	return connect
+}
 
-				if err != nil {
-					var apiErr *smithy.GenericAPIError
-					if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidGroup.NotFound" {
-						errorList = append(errorList, fmt.Sprintf("ID '%s' not found", sgID))
-					} else {
-						errorList = append(errorList, fmt.Sprintf("failed to verify ID '%s': %v", sgID, err))
-					}
-				} else {
-					resolvedIDs[sgID] = struct{}{}
-				}
-			}(id)
-		}
+type jsonGroupResult struct {
+	SgID         string   `json:"sg_id"`
+	VpcID        string   `json:"vpc_id,omitempty"`
+	Cidr         string   `json:"cidr"`
+	Action       string   `json:"action"`
+	Name         string   `json:"name,omitempty"`
+	RuleID       string   `json:"rule_id,omitempty"`
+	RevokedCidrs []string `json:"revoked_cidrs"`
+	ModifiedCidr string   `json:"modified_cidr,omitempty"`
+	Warnings     []string `json:"warnings,omitempty"`
+	Retries      int      `json:"retries,omitempty"`
+	// PropagationSeconds is how long --verify waited for the rule to be visible.
+	PropagationSeconds float64  `json:"propagation_seconds,omitempty"`
+	Diff               []string `json:"diff,omitempty"`
+	AuthorizedCidrs    []string `json:"authorized_cidrs,omitempty"`
+	Egress             bool     `json:"egress,omitempty"`
+	CoveredBy          string   `json:"covered_by,omitempty"`
+	Error              string   `json:"error,omitempty"`
+}
 
-		wg.Wait()
+// printJSONSummary writes the run summary to stdout as a single JSON document: an
+// object for a single target, or an array of objects when a config file defines entries.
+// jsonDocument is the --output=json summary: one object for a single report, or
+// an array of them.
+func jsonDocument(reports []sgupdater.Result) any {
+	var summaries []jsonSummary
 
-		if len(errorList) > 0 {
-			return nil, fmt.Errorf("encountered errors validating SG IDs: %s", strings.Join(errorList, "; "))
-		}
+	for _, report := range reports {
+		summaries = append(summaries, newJSONSummary(report))
+	}
 
-		log.Printf("Successfully verified %d unique Security Group ID(s).\n", len(resolvedIDs))
+	if len(summaries) == 1 {
+		return summaries[0]
 	}
 
-	if len(sgTagNames) > 0 {
-		log.Printf("Searching for Security Groups with tag Name(s): %v\n", sgTagNames)
+	return summaries
+}
 
-		input := &ec2.DescribeSecurityGroupsInput{
-			Filters: []types.Filter{
-				{
-					Name:   aws.String("tag:Name"),
-					Values: sgTagNames,
-				},
-			},
-		}
+// printJSONSummary writes jsonDocument to stdout. The connectivity tests cover the
+// whole run, so every summary object lists all of them.
+func printJSONSummary(reports []sgupdater.Result, connects []connectResult) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
 
-		result, err := client.DescribeSecurityGroups(ctx, input)
-		if err != nil {
-			return nil, fmt.Errorf("failed to describe security groups with tags '%v': %w", sgTagNames, err)
+	document := jsonDocument(reports)
+
+	if len(connects) > 0 {
+		var tests []jsonConnectResult
+
+		for _, result := range connects {
+			tests = append(tests, newJSONConnectResult(result))
 		}
 
-		if len(result.SecurityGroups) == 0 {
-			log.Printf("Warning: No security groups found matching tag Name(s): %v\n", sgTagNames)
-			return nil, nil
-		} else {
-			for _, sg := range result.SecurityGroups {
-				resolvedIDs[*sg.GroupId] = struct{}{}
+		switch summaries := document.(type) {
+		case jsonSummary:
+			summaries.Connectivity = tests
+			document = summaries
+		case []jsonSummary:
+			for i := range summaries {
+				summaries[i].Connectivity = tests
 			}
-
-			log.Printf("Found %d unique Security Group ID(s) matching tags.\n", len(resolvedIDs))
 		}
 	}
 
-	finalIDs := make([]string, 0, len(resolvedIDs))
+	if err := encoder.Encode(document); err != nil {
+		slog.Error("Failed to write JSON summary", "error", err)
+	}
+}
 
-	for id := range resolvedIDs {
-		finalIDs = append(finalIDs, id)
+func newJSONSummary(report sgupdater.Result) jsonSummary {
+	summary := jsonSummary{
+		Entry:        report.Name,
+		Record:       report.Record,
+		Backup:       report.Backup,
+		AllowedCidrs: report.TargetCidrs,
+		IPSource:     report.IPSource,
+		Description:  report.Description,
+		Rule:         describeRules(report),
+		Profile:      report.Profile,
+		Role:         report.Role,
+		Region:       report.Region,
+		DryRun:       report.DryRun,
+		Remove:       report.Remove,
+		Interrupted:  report.Interrupted,
+		TimedOut:     report.TimedOut,
+		Succeeded:    report.SuccessCount,
+		Failed:       len(report.Errors),
+		Retries:      report.Retries(),
+		Groups:       []jsonGroupResult{},
 	}
 
-	if len(finalIDs) == 0 && len(errorList) == 0 {
-		log.Println("Warning: No valid or matching Security Group IDs were resolved.")
+	summary.SkippedDeleted = report.Deleted
+	summary.NotAttempted = report.NotAttempted
+	summary.Actions = make(map[string]int)
+
+	for action, count := range report.ActionCounts() {
+		summary.Actions[string(action)] = count
 	}
 
-	return finalIDs, nil
-}
+	for sgID, duration := range report.Durations {
+		if summary.SyncSeconds == nil {
+			summary.SyncSeconds = make(map[string]float64)
+		}
+
+		summary.SyncSeconds[sgID] = duration.Seconds()
+	}
+
+	for _, result := range report.Results {
+		groupResult := jsonGroupResult{
+			SgID:         result.SgID,
+			VpcID:        result.VpcID,
+			Cidr:         result.TargetCidr,
+			Action:       string(result.Action()),
+			Name:         result.GroupName,
+			RuleID:       result.RuleID,
+			RevokedCidrs: result.RevokeCidrs,
+			ModifiedCidr: result.ModifiedCidr,
+			Warnings:     result.Warnings,
+			Retries:      result.Retries,
+		}
+
+		if result.Propagation > 0 {
+			groupResult.PropagationSeconds = result.Propagation.Seconds()
+		}
+
+		for _, change := range result.Diff {
+			groupResult.Diff = append(groupResult.Diff, change.String())
+		}
+
+		groupResult.AuthorizedCidrs = result.AuthorizeCidrs
+		groupResult.Egress = result.Egress
+		groupResult.CoveredBy = result.CoveredBy
 
-func syncSecurityGroupRule(ctx context.Context, client *ec2.Client, sgID, publicIP, description string) error {
-	targetCidrIP := publicIP + "/32"
-	ruleNeedsAdding := true
-	var ruleToRevoke *types.IpPermission = nil
+		if groupResult.RevokedCidrs == nil {
+			groupResult.RevokedCidrs = []string{}
+		}
 
-	log.Printf("[%s] Checking existing rules for description '%s'\n", sgID, description)
+		if result.Err != nil {
+			groupResult.Error = result.Err.Error()
+		}
 
-	descInput := &ec2.DescribeSecurityGroupsInput{
-		GroupIds: []string{sgID},
+		summary.Groups = append(summary.Groups, groupResult)
 	}
 
-	sgDesc, err := client.DescribeSecurityGroups(ctx, descInput)
-	if err != nil {
-		var apiErr *smithy.GenericAPIError
+	return summary
+}
 
-		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidGroup.NotFound" {
-			return fmt.Errorf("[%s] Security group not found during rule sync", sgID)
+// doctor checks what a real run depends on: the public IP service, the
+// credentials, resolving the groups and, on the first group of every target, the
+// EC2 permissions a sync uses. It prints one line per finding and fails when any of
+// them would block a run.
+func doctor(ctx context.Context, opts options) int {
+	blocked := false
+
+	report := func(status, subject, detail string) {
+		if status == doctorFail {
+			blocked = true
 		}
 
-		return fmt.Errorf("[%s] Failed to describe security group: %w", sgID, err)
+		fmt.Printf("[%-4s] %s: %s\n", status, subject, detail)
 	}
 
-	if len(sgDesc.SecurityGroups) == 0 {
-		return fmt.Errorf("[%s] Security group description returned empty list", sgID)
+	switch {
+	case opts.IPOverride != "":
+		report(doctorOK, "Public IP", "not discovered, --ip is set")
+	case opts.IPParameter != "":
+		if targetCidr, err := readIPParameter(ctx, opts); err != nil {
+			report(doctorFail, "Public IP", err.Error())
+		} else {
+			report(doctorOK, "Public IP", targetCidr+" from --ip-parameter")
+		}
+	default:
+		if targetCidrs, err := discoverTargetCidrs(opts.Families, opts.IPServices); err != nil {
+			report(doctorFail, "Public IP", err.Error())
+		} else {
+			report(doctorOK, "Public IP", strings.Join(targetCidrs, ", "))
+		}
 	}
 
-	theGroup := sgDesc.SecurityGroups[0]
+	runs, err := prepareRuns(ctx, opts)
+	if err != nil {
+		report(doctorFail, "Credentials and groups", err.Error())
+		return exitFatal
+	}
 
-	for _, ipPerm := range theGroup.IpPermissions {
-		if aws.ToString(ipPerm.IpProtocol) == "tcp" && aws.ToInt32(ipPerm.FromPort) == 0 && aws.ToInt32(ipPerm.ToPort) == 65535 {
-			var rangesToRevoke []types.IpRange
+	checkedProfiles := make(map[string]bool)
 
-			for _, ipRange := range ipPerm.IpRanges {
-				if aws.ToString(ipRange.Description) == description {
-					if aws.ToString(ipRange.CidrIp) == targetCidrIP {
-						log.Printf("[%s] Found existing rule for description '%s' with correct IP %s. No changes needed.\n", sgID, description, targetCidrIP)
-						ruleNeedsAdding = false
-						break
-					} else {
-						log.Printf("[%s] Found existing rule for description '%s' with outdated IP %s. Marking for removal.\n", sgID, description, aws.ToString(ipRange.CidrIp))
-						rangesToRevoke = append(rangesToRevoke, ipRange)
-					}
-				}
+	for _, run := range runs {
+		if run.Err != nil {
+			report(doctorFail, run.label(), run.Err.Error())
+			continue
+		}
+
+		if !checkedProfiles[run.Profile] {
+			checkedProfiles[run.Profile] = true
+
+			creds, err := run.Config.Credentials.Retrieve(ctx)
+
+			switch {
+			case err != nil:
+				report(doctorFail, "Credentials of "+profileLabel(run.Profile), err.Error())
+			case creds.CanExpire && time.Until(creds.Expires) < 5*time.Minute:
+				report(doctorWarn, "Credentials of "+profileLabel(run.Profile), "expire at "+creds.Expires.Format(time.RFC3339))
+			case creds.CanExpire:
+				report(doctorOK, "Credentials of "+profileLabel(run.Profile), "valid until "+creds.Expires.Format(time.RFC3339))
+			default:
+				report(doctorOK, "Credentials of "+profileLabel(run.Profile), "valid, they do not expire")
 			}
+		}
 
-			if len(rangesToRevoke) > 0 {
-				ruleToRevoke = &types.IpPermission{
-					IpProtocol: ipPerm.IpProtocol,
-					FromPort:   ipPerm.FromPort,
-					ToPort:     ipPerm.ToPort,
-					IpRanges:   rangesToRevoke,
-				}
+		for _, target := range run.Targets {
+			scope := run.label()
+			if target.Name != "" {
+				scope = fmt.Sprintf("entry %s, %s", target.Name, scope)
+			}
 
-				break
+			if len(target.GroupIDs) == 0 {
+				report(doctorWarn, scope, "no Security Group was resolved, permissions were not checked")
+				continue
 			}
 
-			if !ruleNeedsAdding {
-				break
+			sgID := target.GroupIDs[0]
+			report(doctorOK, scope, fmt.Sprintf("%d Security Group(s) resolved, checking permissions on %s", len(target.GroupIDs), sgID))
+
+			for _, check := range sgupdater.CheckPermissions(ctx, run.Client, sgID, target.Description, target.Rule) {
+				switch {
+				case check.Allowed:
+					report(doctorOK, check.Action, "allowed on "+sgID)
+				case check.Missing:
+					report(doctorFail, check.Action, "missing, denied on "+sgID)
+				default:
+					report(doctorWarn, check.Action, check.Err.Error())
+				}
 			}
 		}
 	}
 
-	if ruleToRevoke != nil {
-		log.Printf("[%s] Revoking outdated rule(s) for description '%s'...\n", sgID, description)
+	if blocked {
+		fmt.Println("Something above would block a real run.")
+		return exitFatal
+	}
 
-		revokeInput := &ec2.RevokeSecurityGroupIngressInput{
-			GroupId:       aws.String(sgID),
-			IpPermissions: []types.IpPermission{*ruleToRevoke},
-		}
+	fmt.Println("Nothing would block a real run.")
 
-		_, err := client.RevokeSecurityGroupIngress(ctx, revokeInput)
-		if err != nil {
-			var apiErr *smithy.GenericAPIError
-			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.NotFound" {
-				log.Printf("[%s] Warning: Rule to revoke was not found (maybe already deleted): %v\n", sgID, err)
-			} else {
-				return fmt.Errorf("[%s] Failed to revoke old security group rule for '%s': %w", sgID, description, err)
-			}
-		} else {
-			log.Printf("[%s] Successfully revoked outdated rule(s) for description '%s'.\n", sgID, description)
-		}
+	return exitOK
+}
+
+// iamPolicy is an IAM policy document, as printed by the iam-policy subcommand.
+type iamPolicy struct {
+	Version   string         `json:"Version"`
+	Statement []iamStatement `json:"Statement"`
+}
+
+type iamStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Action    []string                     `json:"Action"`
+	Resource  []string                     `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+// policyScope is where one prepared run acts: its partition, account and region,
+// and the groups it resolved. A scope of wildcards stands for a run that could not
+// be prepared.
+type policyScope struct {
+	Partition string
+	Account   string
+	Region    string
+	GroupIDs  []string
+}
+
+// printIAMPolicy prints the least-privilege policy for the run the other flags
+// describe. The groups are resolved with the current credentials; without them the
+// policy allows any group and says so in the statement ID.
+func printIAMPolicy(ctx context.Context, opts options) int {
+	var scopes []policyScope
+
+	unresolved := false
+
+	runs, err := prepareRuns(ctx, opts)
+	if err != nil {
+		slog.Warn("Could not resolve the Security Groups, the policy allows any group instead", "error", err)
+		unresolved = true
 	}
 
-	if ruleNeedsAdding {
-		log.Printf("[%s] Authorizing rule for description '%s' with IP %s...\n", sgID, description, targetCidrIP)
+	identities := make(map[string]policyScope)
+
+	for _, run := range runs {
+		if run.Err != nil {
+			slog.Warn("Could not resolve the Security Groups, the policy allows any group instead", "scope", run.label(), "error", run.Err)
+			unresolved = true
 
-		authInput := &ec2.AuthorizeSecurityGroupIngressInput{
-			GroupId: aws.String(sgID),
-			IpPermissions: []types.IpPermission{
-				{
-					IpProtocol: aws.String("tcp"),
-					FromPort:   aws.Int32(0),
-					ToPort:     aws.Int32(65535),
-					IpRanges: []types.IpRange{
-						{
-							CidrIp:      aws.String(targetCidrIP),
-							Description: aws.String(description),
-						},
-					},
-				},
-			},
+			continue
 		}
 
-		_, err := client.AuthorizeSecurityGroupIngress(ctx, authInput)
-		if err != nil {
-			var apiErr *smithy.GenericAPIError
-			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.Duplicate" {
-				log.Printf("[%s] Rule for %s already exists (possibly added concurrently or revoke failed silently). No changes needed.\n", sgID, targetCidrIP)
-			} else {
-				return fmt.Errorf("[%s] Failed to authorize security group rule for '%s': %w", sgID, description, err)
+		identity, seen := identities[run.Profile]
+		if !seen {
+			out, err := sts.NewFromConfig(run.Config).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+			if err != nil {
+				slog.Warn("Could not get the account, the policy allows any group instead", "scope", run.label(), "error", err)
+				unresolved = true
+
+				continue
 			}
-		} else {
-			log.Printf("[%s] Successfully authorized rule for description '%s' with IP %s.\n", sgID, description, targetCidrIP)
+
+			identity = policyScope{Partition: strings.Split(aws.ToString(out.Arn), ":")[1], Account: aws.ToString(out.Account)}
+			identities[run.Profile] = identity
+		}
+
+		scope := policyScope{Partition: identity.Partition, Account: identity.Account, Region: run.Region}
+
+		for _, target := range run.Targets {
+			scope.GroupIDs = append(scope.GroupIDs, target.GroupIDs...)
 		}
+
+		scopes = append(scopes, scope)
 	}
 
-	return nil
+	if unresolved {
+		scopes = append(scopes, policyScope{Partition: "aws", Account: "*", Region: "*", GroupIDs: []string{"*"}})
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(buildIAMPolicy(opts, scopes, unresolved)); err != nil {
+		slog.Error("Failed to write the IAM policy", "error", err)
+		return exitFatal
+	}
+
+	return exitOK
 }
 
-func main() {
-	myName := flag.String("my-name", "", "Name of the host to resolve")
-	profileName := flag.String("profile", "default", "AWS profile name from credentials")
-	sgIDsRaw := flag.String("sg-id", "", "Comma-separated list of target Security Group IDs")
-	sgTagNamesRaw := flag.String("sg-tag-name", "", "Comma-separated list of target Security Group Tag 'Name' values")
+// buildIAMPolicy lists only the actions the features enabled in opts call, on the
+// resources of scopes wherever IAM supports resource-level permissions.
+func buildIAMPolicy(opts options, scopes []policyScope, unresolved bool) iamPolicy {
+	policy := iamPolicy{Version: "2012-10-17"}
 
-	flag.Parse()
+	add := func(sid string, actions, resources []string, condition map[string]map[string]string) {
+		slices.Sort(resources)
 
-	if *myName == "" {
-		fmt.Println("Error: --my-name is required")
-		flag.Usage()
-		os.Exit(1)
+		policy.Statement = append(policy.Statement, iamStatement{
+			Sid:       sid,
+			Effect:    "Allow",
+			Action:    actions,
+			Resource:  slices.Compact(resources),
+			Condition: condition,
+		})
 	}
 
-	if *sgIDsRaw == "" && *sgTagNamesRaw == "" {
-		log.Println("Error: You must provide at least one Security Group identifier via --sg-id or --sg-tag-name.")
-		flag.Usage()
-		os.Exit(1)
+	var first policyScope
+	if len(scopes) > 0 {
+		first = scopes[0]
 	}
 
-	if *sgIDsRaw != "" && *sgTagNamesRaw != "" {
-		log.Println("Error: Please use either --sg-id OR --sg-tag-name, not both.")
-		flag.Usage()
-		os.Exit(1)
-	}
+	// A dry run, check, plan without --apply or list only reads.
+	readOnly := opts.DryRun || opts.Check || opts.List || (opts.Plan && !opts.Apply)
 
-	var sgIDs []string
-	var sgTagNames []string
+	switch {
+	case opts.PrefixListID != "":
+		var resources []string
 
-	if *sgIDsRaw != "" {
-		sgIDs = strings.Split(*sgIDsRaw, ",")
+		for _, scope := range scopes {
+			resources = append(resources, fmt.Sprintf("arn:%s:ec2:%s:%s:prefix-list/%s", scope.Partition, scope.Region, scope.Account, opts.PrefixListID))
+		}
+
+		add("DescribePrefixLists", []string{"ec2:DescribeManagedPrefixLists"}, []string{"*"}, nil)
 
-		for i := range sgIDs {
-			sgIDs[i] = strings.TrimSpace(sgIDs[i])
+		actions := []string{"ec2:GetManagedPrefixListEntries"}
+		if !readOnly {
+			actions = append(actions, "ec2:ModifyManagedPrefixList")
 		}
 
-		cleanedIDs := []string{}
+		add("PrefixListEntries", actions, resources, nil)
+	case opts.WAFIPSet != nil:
+		var resources []string
 
-		for _, id := range sgIDs {
-			if id != "" {
-				cleanedIDs = append(cleanedIDs, id)
+		for _, scope := range scopes {
+			region, kind := scope.Region, "regional"
+			if opts.WAFIPSet.Scope == "CLOUDFRONT" {
+				region, kind = "us-east-1", "global"
 			}
+
+			resources = append(resources, fmt.Sprintf("arn:%s:wafv2:%s:%s:%s/ipset/%s/%s", scope.Partition, region, scope.Account, kind, opts.WAFIPSet.Name, opts.WAFIPSet.ID))
+		}
+
+		actions := []string{"wafv2:GetIPSet", "wafv2:ListTagsForResource"}
+		if !readOnly {
+			actions = append(actions, "wafv2:UpdateIPSet", "wafv2:TagResource")
 		}
 
-		sgIDs = cleanedIDs
+		add("WAFIPSet", actions, resources, nil)
+	case opts.LightsailInstance != "":
+		// Lightsail instance ARNs hold a generated ID rather than the name.
+		actions := []string{"lightsail:GetInstance", "lightsail:GetInstancePortStates"}
+		if !readOnly {
+			actions = append(actions, "lightsail:PutInstancePublicPorts", "lightsail:TagResource")
+		}
 
-		if len(sgIDs) == 0 {
-			log.Fatal("Error: --sg-id flag provided but contained no valid IDs after parsing.")
+		add("LightsailFirewall", actions, []string{"*"}, nil)
+	default:
+		describeActions := []string{"ec2:DescribeSecurityGroups", "ec2:DescribeSecurityGroupRules"}
+		if slices.ContainsFunc(opts.Targets, func(t syncTarget) bool { return len(t.InstanceIDs) > 0 }) {
+			describeActions = append(describeActions, "ec2:DescribeInstances")
+		}
+
+		if opts.AllRegions {
+			describeActions = append(describeActions, "ec2:DescribeRegions")
+		}
+
+		// EC2 describe calls do not support resource-level permissions.
+		add("DescribeSecurityGroups", describeActions, []string{"*"}, nil)
+
+		if slices.ContainsFunc(opts.Targets, func(t syncTarget) bool { return len(t.LoadBalancers) > 0 }) {
+			add("DescribeLoadBalancers", []string{"elasticloadbalancing:DescribeLoadBalancers"}, []string{"*"}, nil)
 		}
-	} else {
-		sgTagNames = strings.Split(*sgTagNamesRaw, ",")
 
-		for i := range sgTagNames {
-			sgTagNames[i] = strings.TrimSpace(sgTagNames[i])
+		if readOnly {
+			break
 		}
 
-		cleanedTags := []string{}
+		var groups, rules []string
 
-		for _, tag := range sgTagNames {
-			if tag != "" {
-				cleanedTags = append(cleanedTags, tag)
+		for _, scope := range scopes {
+			prefix := fmt.Sprintf("arn:%s:ec2:%s:%s:", scope.Partition, scope.Region, scope.Account)
+			rules = append(rules, prefix+"security-group-rule/*")
+
+			for _, sgID := range scope.GroupIDs {
+				groups = append(groups, prefix+"security-group/"+sgID)
 			}
 		}
 
-		sgTagNames = cleanedTags
+		sid := "ChangeRules"
+		if unresolved {
+			sid = "ChangeRulesInAnyGroupUnresolved"
+		}
+
+		// The EC2 actions come in an Ingress and an Egress variant.
+		var suffixes []string
 
-		if len(sgTagNames) == 0 {
-			log.Fatal("Error: --sg-tag-name flag provided but contained no valid tag names after parsing.")
+		for _, direction := range opts.Directions {
+			if direction == sgupdater.Egress {
+				suffixes = append(suffixes, "Egress")
+			} else {
+				suffixes = append(suffixes, "Ingress")
+			}
 		}
-	}
 
-	publicIP, err := getPublicIP()
-	if err != nil {
-		log.Fatalf("Error getting public IP: %v", err)
+		var actions []string
+
+		for _, suffix := range suffixes {
+			actions = append(actions, "ec2:RevokeSecurityGroup"+suffix)
+		}
+
+		if !opts.Remove && !opts.CleanExpired {
+			for _, suffix := range suffixes {
+				actions = append(actions, "ec2:AuthorizeSecurityGroup"+suffix)
+			}
+
+			actions = append(actions, "ec2:ModifySecurityGroupRules")
+		}
+
+		// Only outdated rules kept for --grace-period are relabelled.
+		if opts.GracePeriod > 0 {
+			for _, suffix := range suffixes {
+				actions = append(actions, "ec2:UpdateSecurityGroupRuleDescriptions"+suffix)
+			}
+		}
+
+		add(sid, actions, slices.Concat(groups, rules), nil)
+
+		// New rules are tagged as they are authorized.
+		if !opts.Remove && !opts.CleanExpired {
+			for _, suffix := range suffixes {
+				sid := "TagNewRules"
+				if suffix == "Egress" {
+					sid = "TagNewEgressRules"
+				}
+
+				add(sid, []string{"ec2:CreateTags"}, rules, map[string]map[string]string{
+					"StringEquals": {"ec2:CreateAction": "AuthorizeSecurityGroup" + suffix},
+				})
+			}
+		}
+
+		if opts.TagGroups {
+			add("TagGroups", []string{"ec2:CreateTags"}, groups, nil)
+		}
 	}
 
-	ctx := context.TODO()
-	awsCfg, err := loadAWSConfig(ctx, *profileName)
-	if err != nil {
-		log.Fatalf("Error loading AWS config: %v", err)
+	if opts.Route53Record != "" && !readOnly {
+		add("Route53Record", []string{"route53:ListResourceRecordSets", "route53:ChangeResourceRecordSets"}, []string{fmt.Sprintf("arn:%s:route53:::hostedzone/%s", cmp.Or(first.Partition, "aws"), opts.Route53ZoneID)}, nil)
 	}
 
-	ec2Client := ec2.NewFromConfig(awsCfg)
+	if opts.IPParameter != "" {
+		resource := opts.IPParameter
+		if !strings.HasPrefix(resource, "arn:") {
+			resource = fmt.Sprintf("arn:%s:ssm:%s:%s:parameter/%s", cmp.Or(first.Partition, "aws"), cmp.Or(first.Region, "*"), cmp.Or(first.Account, "*"), strings.TrimPrefix(resource, "/"))
+		}
 
-	log.Println("Resolving and validating target Security Group(s)...")
+		add("ReadIPParameter", []string{"ssm:GetParameter"}, []string{resource}, nil)
+	}
 
-	finalSgIDs, err := findSecurityGroupIDs(ctx, ec2Client, sgIDs, sgTagNames)
-	if err != nil {
-		log.Fatalf("Error resolving Security Group identifiers: %v", err)
+	if opts.SNSTopicARN != "" && !readOnly {
+		add("PublishSummary", []string{"sns:Publish"}, []string{opts.SNSTopicARN}, nil)
 	}
 
-	if len(finalSgIDs) == 0 {
-		log.Fatalf("No valid Security Groups found or resolved. Exiting.")
+	if opts.MetricsNamespace != "" && !readOnly {
+		add("PublishMetrics", []string{"cloudwatch:PutMetricData"}, []string{"*"}, map[string]map[string]string{
+			"StringEquals": {"cloudwatch:namespace": opts.MetricsNamespace},
+		})
 	}
 
-	log.Printf("Resolved %d unique Security Group ID(s) to process: %v", len(finalSgIDs), finalSgIDs)
+	return policy
+}
 
-	log.Printf("Starting rule sync process for %d Security Group(s)...", len(finalSgIDs))
+// Statuses of a doctor finding.
+const (
+	doctorOK   = "OK"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
 
-	var wg sync.WaitGroup
-	errorChannel := make(chan error, len(finalSgIDs))
-	successCount := 0
-	var successMu sync.Mutex
+// listedRule is one row printed by the list subcommand: an ingress CIDR rule whose
+// description equals the configured one.
+type listedRule struct {
+	Profile     string `json:"profile,omitempty"`
+	Region      string `json:"region,omitempty"`
+	SgID        string `json:"sg_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Protocol    string `json:"protocol"`
+	Ports       string `json:"ports"`
+	Cidr        string `json:"cidr"`
+	// LastSync and LastIP come from the tags --tag-groups writes, if any.
+	LastSync string `json:"last_sync,omitempty"`
+	LastIP   string `json:"last_ip,omitempty"`
+}
 
-	for _, sgID := range finalSgIDs {
-		wg.Add(1)
+// describePorts renders a permission's port range as "22", "8000-8100" or "all",
+// and an ICMP permission as "type/code".
+func describePorts(perm types.IpPermission) string {
+	switch {
+	case perm.FromPort == nil || perm.ToPort == nil || (*perm.FromPort == -1 && *perm.ToPort == -1):
+		return "all"
+	case sgupdater.NormalizeProtocol(aws.ToString(perm.IpProtocol)) == "icmp":
+		return fmt.Sprintf("%d/%d", *perm.FromPort, *perm.ToPort)
+	case *perm.FromPort == *perm.ToPort:
+		return strconv.Itoa(int(*perm.FromPort))
+	default:
+		return fmt.Sprintf("%d-%d", *perm.FromPort, *perm.ToPort)
+	}
+}
 
-		go func(currentSgID string) {
-			defer wg.Done()
+// collectListedRules gathers the rules with each target's description from the
+// groups described during resolution. A group selected by several targets with the
+// same description is listed once.
+func collectListedRules(runs []regionRun) []listedRule {
+	rows := []listedRule{}
+	seen := make(map[string]bool)
 
-			log.Printf("[%s] Starting sync...", currentSgID)
+	for _, run := range runs {
+		for _, target := range run.Targets {
+			for _, sgID := range target.GroupIDs {
+				key := strings.Join([]string{run.Profile, run.Region, sgID, target.Description}, "/")
+				if seen[key] {
+					continue
+				}
 
-			err := syncSecurityGroupRule(ctx, ec2Client, currentSgID, publicIP, *myName)
-			if err != nil {
-				log.Printf("[%s] Error syncing rule: %v", currentSgID, err)
-				errorChannel <- fmt.Errorf("[%s] %w", currentSgID, err)
-			} else {
-				log.Printf("[%s] Sync completed successfully.", currentSgID)
-				successMu.Lock()
-				successCount++
-				successMu.Unlock()
+				seen[key] = true
+				group := target.Groups[sgID]
+
+				for _, owned := range sgupdater.OwnedRulesFromPermissions(group.IpPermissions, target.owns()) {
+					protocol := sgupdater.NormalizeProtocol(aws.ToString(owned.Permission.IpProtocol))
+					if protocol == "-1" {
+						protocol = "all"
+					}
+
+					rows = append(rows, listedRule{
+						Profile:     run.Profile,
+						Region:      run.Region,
+						SgID:        sgID,
+						Name:        sgupdater.TagValue(group.Tags, "Name"),
+						Description: owned.Description,
+						Protocol:    protocol,
+						Ports:       describePorts(owned.Permission),
+						Cidr:        owned.Cidr,
+						LastSync:    sgupdater.TagValue(group.Tags, sgupdater.LastSyncTagKey),
+						LastIP:      sgupdater.TagValue(group.Tags, sgupdater.LastIPTagKey(target.Description, owned.IPv6)),
+					})
+				}
 			}
-		}(sgID)
+		}
 	}
 
-	wg.Wait()
-
-	close(errorChannel)
+	return rows
+}
 
-	var syncErrors []error
+// listRules prints the rules with our description in every resolved group, as a
+// tab-aligned table or JSON, and returns the exit code. It never changes anything.
+func listRules(runs []regionRun, outputFormat string) int {
+	succeeded, failed := 0, 0
 
-	for err := range errorChannel {
-		syncErrors = append(syncErrors, err)
+	for _, run := range runs {
+		if run.Err != nil {
+			slog.Error("Could not list rules", "scope", run.label(), "error", run.Err)
+			failed++
+		} else {
+			succeeded++
+		}
 	}
 
-	fmt.Println("-----------------------------------------------------------------------------------")
-	fmt.Println("Sync Process Summary:")
-	fmt.Printf("  Allowed TCP traffic from: %s/32\n", publicIP)
-	fmt.Printf("  Rule description: %s\n", *myName)
-	fmt.Printf("  Using AWS Profile: %s\n", *profileName)
-	fmt.Printf("  Using AWS Region: %s\n", awsCfg.Region)
-	fmt.Printf("  Total Security Groups Processed: %d\n", len(finalSgIDs))
-	fmt.Printf("  Successfully Synced: %d\n", successCount)
-	fmt.Printf("  Failed: %d\n", len(syncErrors))
-
-	if len(syncErrors) > 0 {
-		fmt.Println("  Errors Encountered:")
-		for _, syncErr := range syncErrors {
-			fmt.Printf("    - %v\n", syncErr)
+	rows := collectListedRules(runs)
+
+	if outputFormat == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(rows); err != nil {
+			slog.Error("Failed to write JSON rule list", "error", err)
 		}
-		fmt.Println("-----------------------------------------------------------------------------------")
-		os.Exit(1)
 	} else {
-		fmt.Println("-----------------------------------------------------------------------------------")
-		fmt.Println("✅ All specified Security Groups synced successfully.")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PROFILE\tREGION\tSG ID\tNAME\tDESCRIPTION\tPROTOCOL\tPORTS\tCIDR\tLAST SYNC\tLAST IP")
+
+		for _, row := range rows {
+			profile := row.Profile
+			if profile == "" {
+				profile = "default"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", profile, row.Region, row.SgID, row.Name, row.Description, row.Protocol, row.Ports, row.Cidr, cmp.Or(row.LastSync, "-"), cmp.Or(row.LastIP, "-"))
+		}
+
+		if err := w.Flush(); err != nil {
+			slog.Error("Failed to write rule list", "error", err)
+		}
+	}
+
+	switch {
+	case failed == 0:
+		return exitOK
+	case succeeded == 0:
+		return exitAllFailed
+	default:
+		return exitPartialFailure
 	}
 }
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/roicp/aws-sg-updater/sgupdater"
+)
+
+// fakeSTS answers GetCallerIdentity with a fixed account, or err.
+type fakeSTS struct {
+	account string
+	err     error
+}
+
+func (f fakeSTS) GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String(f.account),
+		Arn:     aws.String("arn:aws:iam::" + f.account + ":user/test"),
+	}, nil
+}
+
+func TestCheckCallerAccount(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   fakeSTS
+		expected []string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:   "no expected accounts",
+			client: fakeSTS{account: "111111111111"},
+			want:   "111111111111",
+		},
+		{
+			name:     "expected account",
+			client:   fakeSTS{account: "222222222222"},
+			expected: []string{"111111111111", "222222222222"},
+			want:     "222222222222",
+		},
+		{
+			name:     "unexpected account",
+			client:   fakeSTS{account: "333333333333"},
+			expected: []string{"111111111111", "222222222222"},
+			wantErr:  "expected AWS account 111111111111 or 222222222222 but the credentials belong to 333333333333",
+		},
+		{
+			name:     "identity error",
+			client:   fakeSTS{err: errors.New("expired token")},
+			expected: []string{"111111111111"},
+			wantErr:  "failed to get caller identity: expired token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkCallerAccount(context.Background(), tt.client, tt.expected)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkCallerAccount() error = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("checkCallerAccount() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("checkCallerAccount() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCodeFor(t *testing.T) {
+	synced := sgupdater.GroupResult{SgID: "sg-1", Authorize: true}
+	inSync := sgupdater.GroupResult{SgID: "sg-2"}
+	failed := errors.New("[sg-3] UnauthorizedOperation")
+
+	tests := []struct {
+		name      string
+		reports   []sgupdater.Result
+		want      int
+		wantCheck int
+	}{
+		{
+			name:      "all synced",
+			reports:   []sgupdater.Result{{SuccessCount: 2, Results: []sgupdater.GroupResult{synced, inSync}}},
+			want:      exitOK,
+			wantCheck: exitChangesNeeded,
+		},
+		{
+			name:      "no-op",
+			reports:   []sgupdater.Result{{SuccessCount: 1, Results: []sgupdater.GroupResult{inSync}}},
+			want:      exitOK,
+			wantCheck: exitOK,
+		},
+		{
+			name: "partial",
+			reports: []sgupdater.Result{
+				{Region: "us-east-1", SuccessCount: 1, Results: []sgupdater.GroupResult{synced}},
+				{Region: "eu-west-1", Errors: []error{failed}},
+			},
+			want:      exitPartialFailure,
+			wantCheck: exitPartialFailure,
+		},
+		{
+			name:      "not attempted after --fail-fast",
+			reports:   []sgupdater.Result{{Errors: []error{failed}, NotAttempted: []string{"sg-4"}}},
+			want:      exitPartialFailure,
+			wantCheck: exitPartialFailure,
+		},
+		{
+			name:      "group deleted during the run",
+			reports:   []sgupdater.Result{{SuccessCount: 1, Deleted: []string{"sg-5"}, Results: []sgupdater.GroupResult{inSync, {SgID: "sg-5", Deleted: true}}}},
+			want:      exitOK,
+			wantCheck: exitOK,
+		},
+		{
+			name:      "group deleted during the run with --strict",
+			reports:   []sgupdater.Result{{Errors: []error{errors.New("[sg-5] InvalidGroup.NotFound")}, Results: []sgupdater.GroupResult{{SgID: "sg-5", Err: errors.New("InvalidGroup.NotFound")}}}},
+			want:      exitAllFailed,
+			wantCheck: exitAllFailed,
+		},
+		{
+			name: "all failed",
+			reports: []sgupdater.Result{
+				{Region: "us-east-1", Errors: []error{failed}},
+				{Region: "eu-west-1", Errors: []error{failed}},
+			},
+			want:      exitAllFailed,
+			wantCheck: exitAllFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCodeFor(tt.reports); got != tt.want {
+				t.Errorf("exitCodeFor() = %d (%s), want %d (%s)", got, exitCodeMeaning(got), tt.want, exitCodeMeaning(tt.want))
+			}
+
+			if got := checkExitCode(tt.reports); got != tt.wantCheck {
+				t.Errorf("checkExitCode() = %d (%s), want %d (%s)", got, exitCodeMeaning(got), tt.wantCheck, exitCodeMeaning(tt.wantCheck))
+			}
+		})
+	}
+}
+
+// TestSetupErrorsExitFatal runs main in a child process, since setup errors exit
+// it, and checks that each one exits with exitFatal.
+func TestSetupErrorsExitFatal(t *testing.T) {
+	if args, ok := os.LookupEnv("SG_UPDATER_TEST_MAIN"); ok {
+		os.Args = append([]string{"aws-sg-updater"}, strings.Fields(args)...)
+		main()
+		os.Exit(exitOK)
+	}
+
+	tests := []struct {
+		name    string
+		args    string
+		wantLog string
+	}{
+		{
+			name:    "unknown subcommand",
+			args:    "frobnicate",
+			wantLog: "unknown subcommand 'frobnicate'",
+		},
+		{
+			name:    "invalid option",
+			args:    "--sg-id sg-1",
+			wantLog: "is not a Security Group ID",
+		},
+		{
+			name:    "invalid --ip",
+			args:    "--sg-id sg-12345678 --my-name test --ip nonsense",
+			wantLog: "Invalid --ip value",
+		},
+		{
+			name:    "unreachable --cidr-source-url",
+			args:    "--sg-id sg-12345678 --my-name test --cidr-source-url http://127.0.0.1:1/cidrs",
+			wantLog: "Failed to fetch the allowlist from --cidr-source-url",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSetupErrorsExitFatal$")
+			cmd.Env = append(os.Environ(), "SG_UPDATER_TEST_MAIN="+tt.args, "AWS_REGION=us-east-1")
+
+			out, err := cmd.CombinedOutput()
+
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitFatal {
+				t.Fatalf("exit = %v, want %d; output:\n%s", err, exitFatal, out)
+			}
+
+			if !strings.Contains(string(out), tt.wantLog) {
+				t.Errorf("output does not mention %q:\n%s", tt.wantLog, out)
+			}
+		})
+	}
+}
+
+func TestParseHostAddress(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "203.0.113.7", want: "203.0.113.7/32"},
+		{raw: " 203.0.113.7\n", want: "203.0.113.7/32"},
+		{raw: "203.0.113.7/32", want: "203.0.113.7/32"},
+		{raw: "2001:db8::7", want: "2001:db8::7/128"},
+		{raw: "2001:db8::7/128", want: "2001:db8::7/128"},
+		{raw: "203.0.113.0/24", wantErr: true},
+		{raw: "0.0.0.0/0", wantErr: true},
+		{raw: "2001:db8::/64", wantErr: true},
+		{raw: "::/0", wantErr: true},
+		{raw: "not-an-ip", wantErr: true},
+		{raw: "203.0.113.7/33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseHostAddress(tt.raw)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseHostAddress(%q) = %q, want an error", tt.raw, got)
+				}
+
+				return
+			}
+
+			if err != nil || got != tt.want {
+				t.Errorf("parseHostAddress(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLambdaTargetCidrs(t *testing.T) {
+	tests := []struct {
+		name       string
+		ipOverride string
+		event      lambdaEvent
+		want       string
+		wantSource string
+		wantErr    bool
+	}{
+		{
+			name:       "event ip",
+			event:      lambdaEvent{IP: "203.0.113.7"},
+			want:       "203.0.113.7/32",
+			wantSource: "from the Lambda event",
+		},
+		{
+			name:       "function URL query string",
+			event:      lambdaEvent{QueryStringParameters: map[string]string{"ip": "2001:db8::7/128"}},
+			want:       "2001:db8::7/128",
+			wantSource: "from the Lambda event",
+		},
+		{
+			name:    "event network rejected",
+			event:   lambdaEvent{IP: "0.0.0.0/0"},
+			wantErr: true,
+		},
+		{
+			name:    "query string network rejected",
+			event:   lambdaEvent{QueryStringParameters: map[string]string{"ip": "203.0.113.0/24"}},
+			wantErr: true,
+		},
+		{
+			name:       "--ip may still be a network",
+			ipOverride: "203.0.113.0/24",
+			want:       "203.0.113.0/24",
+			wantSource: "from --ip flag",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, source, err := lambdaTargetCidrs(context.Background(), options{IPOverride: tt.ipOverride}, tt.event)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("lambdaTargetCidrs() = %v, want an error", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("lambdaTargetCidrs() error = %v", err)
+			}
+
+			if len(got) != 1 || got[0] != tt.want || source != tt.wantSource {
+				t.Errorf("lambdaTargetCidrs() = %v %q, want [%s] %q", got, source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestHandleUpdateRejectsNetworks(t *testing.T) {
+	s := &updateServer{ctx: context.Background(), opts: options{ListenToken: "secret"}}
+
+	tests := []struct {
+		name  string
+		token string
+		ip    string
+		want  int
+	}{
+		{name: "missing token", ip: "203.0.113.7", want: http.StatusUnauthorized},
+		{name: "IPv4 network", token: "secret", ip: "203.0.113.0/24", want: http.StatusBadRequest},
+		{name: "everyone", token: "secret", ip: "0.0.0.0/0", want: http.StatusBadRequest},
+		{name: "IPv6 network", token: "secret", ip: "2001:db8::/64", want: http.StatusBadRequest},
+		{name: "not an address", token: "secret", ip: "router", want: http.StatusBadRequest},
+		// A single address gets past parsing; without entries nothing matches it.
+		{name: "host CIDR", token: "secret", ip: "203.0.113.7/32", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/update?ip="+tt.ip, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			s.handleUpdate(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+// pingRequest is a request received by a --ping-url test server.
+type pingRequest struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// pingServer starts a test server standing in for --ping-url and returns its URL
+// and a function listing the requests it received.
+func pingServer(t *testing.T) (string, func() []pingRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []pingRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		requests = append(requests, pingRequest{Method: r.Method, Path: r.URL.Path, Body: string(body)})
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/ping/abc", func() []pingRequest {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return slices.Clone(requests)
+	}
+}
+
+func TestReportRunPing(t *testing.T) {
+	failed := errors.New("[sg-2] UnauthorizedOperation")
+
+	tests := []struct {
+		name       string
+		reports    []sgupdater.Result
+		dryRun     bool
+		want       []string
+		wantInFail []string
+	}{
+		{
+			name:    "success",
+			reports: []sgupdater.Result{{SuccessCount: 1}},
+			want:    []string{"GET /ping/abc"},
+		},
+		{
+			name:       "partial failure",
+			reports:    []sgupdater.Result{{SuccessCount: 1, Errors: []error{failed}}},
+			want:       []string{"POST /ping/abc/fail"},
+			wantInFail: []string{"exit code 2: some Security Groups failed", failed.Error()},
+		},
+		{
+			name:    "dry run",
+			reports: []sgupdater.Result{{SuccessCount: 1}},
+			dryRun:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requests := pingServer(t)
+			opts := options{PingURL: url, DryRun: tt.dryRun}
+
+			reportRun(context.Background(), nil, opts, tt.reports, []string{"203.0.113.7/32"}, exitCodeFor(tt.reports))
+
+			var got []string
+			for _, request := range requests() {
+				got = append(got, request.Method+" "+request.Path)
+
+				for _, want := range tt.wantInFail {
+					if !strings.Contains(request.Body, want) {
+						t.Errorf("body %q does not contain %q", request.Body, want)
+					}
+				}
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("requests = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingSetupError(t *testing.T) {
+	url, requests := pingServer(t)
+
+	pingSetupError(options{PingURL: url}, "Failed to get public IP", errors.New("every IP service failed"))
+
+	want := []pingRequest{{Method: http.MethodPost, Path: "/ping/abc/fail", Body: "Failed to get public IP: every IP service failed"}}
+	if got := requests(); !slices.Equal(got, want) {
+		t.Errorf("requests = %+v, want %+v", got, want)
+	}
+}
+
+func TestIPDamperHold(t *testing.T) {
+	const a, b = "203.0.113.1/32", "198.51.100.2/32"
+
+	// check is one watch-mode check: the address discovered, this long after the
+	// first one.
+	type check struct {
+		cidr string
+		at   time.Duration
+	}
+
+	tests := []struct {
+		name         string
+		stableChecks int
+		minInterval  time.Duration
+		checks       []check
+		// wantSynced lists the checks, by index, that sync.
+		wantSynced []int
+	}{
+		{
+			name:         "flap",
+			stableChecks: 3,
+			checks:       []check{{a, 0}, {b, 1 * time.Minute}, {a, 2 * time.Minute}, {b, 3 * time.Minute}, {b, 4 * time.Minute}, {a, 5 * time.Minute}},
+			wantSynced:   []int{0},
+		},
+		{
+			name:         "genuine change",
+			stableChecks: 3,
+			checks:       []check{{a, 0}, {b, 1 * time.Minute}, {b, 2 * time.Minute}, {b, 3 * time.Minute}, {b, 4 * time.Minute}},
+			wantSynced:   []int{0, 3},
+		},
+		{
+			name:         "flap then genuine change",
+			stableChecks: 2,
+			checks:       []check{{a, 0}, {b, 1 * time.Minute}, {a, 2 * time.Minute}, {b, 3 * time.Minute}, {b, 4 * time.Minute}, {a, 5 * time.Minute}, {a, 6 * time.Minute}},
+			wantSynced:   []int{0, 4, 6},
+		},
+		{
+			name:         "min interval",
+			stableChecks: 1,
+			minInterval:  10 * time.Minute,
+			checks:       []check{{a, 0}, {b, 1 * time.Minute}, {b, 9 * time.Minute}, {b, 10 * time.Minute}, {a, 11 * time.Minute}, {a, 20 * time.Minute}},
+			wantSynced:   []int{0, 3, 5},
+		},
+		{
+			name:         "first sync never held",
+			stableChecks: 3,
+			minInterval:  time.Hour,
+			checks:       []check{{a, 0}},
+			wantSynced:   []int{0},
+		},
+	}
+
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damper := &ipDamper{stableChecks: tt.stableChecks, minInterval: tt.minInterval}
+			var lastSynced []string
+			var synced []int
+
+			// This follows watch, with every sync succeeding.
+			for i, check := range tt.checks {
+				targetCidrs := []string{check.cidr}
+				now := start.Add(check.at)
+
+				if slices.Equal(targetCidrs, lastSynced) {
+					damper.reset()
+				} else if held, _ := damper.hold(targetCidrs, lastSynced == nil, now); !held {
+					damper.synced(now)
+					lastSynced = targetCidrs
+					synced = append(synced, i)
+				}
+			}
+
+			if !slices.Equal(synced, tt.wantSynced) {
+				t.Errorf("synced at checks %v, want %v", synced, tt.wantSynced)
+			}
+		})
+	}
+}
+
+func TestEphemeralRulesRecord(t *testing.T) {
+	rules := &ephemeralRules{}
+
+	rules.record([]sgupdater.Result{{
+		Region:      "us-east-1",
+		Description: "laptop",
+		Results: []sgupdater.GroupResult{
+			{SgID: "sg-1", RuleID: "sgr-added", Authorize: true},
+			{SgID: "sg-1", RuleID: "sgr-modified", ModifiedCidr: "198.51.100.1/32"},
+			{SgID: "sg-1", RuleID: "sgr-egress", Authorize: true, Egress: true},
+			// The rule was already in place, so it is not the run's to revoke.
+			{SgID: "sg-2", RuleID: "sgr-unchanged"},
+			{SgID: "sg-3", RuleID: "sgr-dry-run", Authorize: true, DryRun: true},
+			{SgID: "sg-4", Removal: true, RevokeCidrs: []string{"198.51.100.1/32"}},
+		},
+	}})
+
+	// A later sync that replaced the address records the new rule alongside.
+	rules.record([]sgupdater.Result{{
+		Region:      "us-east-1",
+		Description: "laptop",
+		Results:     []sgupdater.GroupResult{{SgID: "sg-1", RuleID: "sgr-added", Authorize: true}, {SgID: "sg-1", RuleID: "sgr-later", Authorize: true}},
+	}})
+
+	want := []ephemeralGroup{
+		{Region: "us-east-1", SgID: "sg-1", Description: "laptop", RuleIDs: []string{"sgr-added", "sgr-modified", "sgr-later"}},
+		{Region: "us-east-1", SgID: "sg-1", Description: "laptop", Egress: true, RuleIDs: []string{"sgr-egress"}},
+	}
+
+	if got := rules.groupsIn(regionRun{Region: "us-east-1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupsIn() = %+v, want %+v", got, want)
+	}
+
+	if got := rules.groupsIn(regionRun{Region: "eu-west-1"}); len(got) != 0 {
+		t.Errorf("groupsIn(eu-west-1) = %+v, want none", got)
+	}
+
+	var disabled *ephemeralRules
+	disabled.record([]sgupdater.Result{{Results: []sgupdater.GroupResult{{SgID: "sg-1", RuleID: "sgr-1", Authorize: true}}}})
+
+	if got := disabled.groupsIn(regionRun{}); got != nil {
+		t.Errorf("nil ephemeralRules recorded %+v", got)
+	}
+}
+
+func TestHostnameDescription(t *testing.T) {
+	long := strings.Repeat("build-agent-", 30) + "01"
+
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{hostname: "My_Host.local", want: "my_host.local"},
+		{hostname: "LAPTOP-7QX2", want: "laptop-7qx2"},
+		{hostname: "Müller-PC", want: "mller-pc"},
+		{hostname: "日本語-host", want: "-host"},
+		{hostname: "[prod] box", want: "prod box"},
+		{hostname: long, want: strings.TrimSpace(long[:hostnameDescriptionLimit])},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got := hostnameDescription(tt.hostname)
+
+			if got != tt.want {
+				t.Errorf("hostnameDescription(%q) = %q, want %q", tt.hostname, got, tt.want)
+			}
+
+			if err := checkDescription(got, hostnameDescriptionLimit); err != nil {
+				t.Errorf("hostnameDescription(%q) = %q, which EC2 rejects: %v", tt.hostname, got, err)
+			}
+		})
+	}
+}
+
+func TestCheckDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		limit       int
+		wantErr     string
+	}{
+		{name: "plain", description: "alice laptop", limit: ec2DescriptionLimit},
+		{name: "specials", description: "ops/vpn (home) #1 alice@example.com", limit: ec2DescriptionLimit},
+		{name: "leading and trailing spaces", description: "  alice  ", limit: ec2DescriptionLimit},
+		{name: "emoji", description: "alice 🚀", limit: ec2DescriptionLimit, wantErr: `has '🚀' at position 7`},
+		{name: "accent", description: "josé", limit: ec2DescriptionLimit, wantErr: `has 'é' at position 4`},
+		{name: "at the limit", description: strings.Repeat("a", ec2DescriptionLimit), limit: ec2DescriptionLimit},
+		{name: "over the limit", description: strings.Repeat("a", ec2DescriptionLimit+1), limit: ec2DescriptionLimit, wantErr: "256 characters long, EC2 allows 255"},
+		{name: "over the limit left by markers", description: strings.Repeat("a", 240), limit: descriptionLimit(true, true), wantErr: "leave room for the --ttl and --grace-period markers"},
+		// 128 runes but 256 bytes: the character is what EC2 rejects, not the length.
+		{name: "multibyte runes", description: strings.Repeat("é", 128), limit: ec2DescriptionLimit, wantErr: `has 'é' at position 1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDescription(tt.description, tt.limit)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkDescription() error = %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkDescription() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		limit       int
+		want        string
+	}{
+		{name: "valid", description: "alice laptop", limit: 255, want: "alice laptop"},
+		{name: "emoji", description: "alice 🚀 laptop", limit: 255, want: "alice  laptop"},
+		{name: "leading and trailing spaces", description: "  alice\t", limit: 255, want: "alice"},
+		{name: "only rejected characters", description: "🚀✨", limit: 255, want: ""},
+		{name: "spaces left by truncating", description: "alice laptop", limit: 6, want: "alice"},
+		// Every character is two bytes: the limit counts the bytes left once
+		// they are dropped.
+		{name: "multibyte runes", description: strings.Repeat("é", 200) + strings.Repeat("a", 20), limit: 10, want: strings.Repeat("a", 10)},
+		{name: "mixed runes", description: "zoë-" + strings.Repeat("x", 300), limit: 255, want: "zo-" + strings.Repeat("x", 252)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeDescription(tt.description, tt.limit)
+
+			if got != tt.want {
+				t.Errorf("sanitizeDescription() = %q, want %q", got, tt.want)
+			}
+
+			if got != "" {
+				if err := checkDescription(got, tt.limit); err != nil {
+					t.Errorf("sanitizeDescription() = %q, which EC2 rejects: %v", got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplatedDescription(t *testing.T) {
+	today := time.Now().UTC().Format(time.DateOnly)
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly)
+
+	tests := []struct {
+		name        string
+		template    string
+		matchPrefix string
+		sanitize    bool
+		wantPrefix  string
+		wantRule    string
+		// owned and notOwned are descriptions of existing rules, which the prefix
+		// must and must not match.
+		owned    []string
+		notOwned []string
+		wantErr  string
+	}{
+		{
+			name:       "stable prefix before the date",
+			template:   "{{.Name}} {{.Date}} {{.IP}}",
+			wantPrefix: "laptop ",
+			wantRule:   "laptop " + today + " 203.0.113.7",
+			owned:      []string{"laptop " + yesterday + " 198.51.100.1", "laptop " + today + " 203.0.113.7"},
+			notOwned:   []string{"laptop2 " + yesterday + " 198.51.100.1", "desktop " + today + " 203.0.113.7"},
+		},
+		{
+			name:       "stable prefix before the IP",
+			template:   "vpn-{{.Name}}-{{.IP}}",
+			wantPrefix: "vpn-laptop-",
+			wantRule:   "vpn-laptop-203.0.113.7",
+			owned:      []string{"vpn-laptop-198.51.100.1"},
+			notOwned:   []string{"vpn-desktop-198.51.100.1"},
+		},
+		{
+			name:        "--match-prefix narrows the prefix",
+			template:    "{{.Name}} by {{.User}} on {{.Date}}",
+			matchPrefix: "laptop by",
+			wantPrefix:  "laptop by",
+			owned:       []string{"laptop by someone-else on " + yesterday},
+			notOwned:    []string{"laptop " + yesterday},
+		},
+		{
+			name:       "sanitized prefix",
+			template:   "{{.Name}} ✨ {{.Date}}",
+			sanitize:   true,
+			wantPrefix: "laptop  ",
+			wantRule:   "laptop  " + today,
+			owned:      []string{"laptop  " + yesterday},
+		},
+		{
+			name:        "--match-prefix the rendering does not start with",
+			template:    "{{.Name}} {{.Date}}",
+			matchPrefix: "desktop",
+			wantErr:     `does not start with match prefix "desktop"`,
+		},
+		{
+			name:     "starts with the date",
+			template: "{{.Date}} {{.Name}}",
+			wantErr:  "set --match-prefix",
+		},
+		{
+			name:     "starts with the IP",
+			template: "{{.IP}} {{.Name}}",
+			wantErr:  "set --match-prefix",
+		},
+		{
+			name:     "only spaces before the date",
+			template: "  {{.Date}} {{.Name}}",
+			wantErr:  "set --match-prefix",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := template.Must(template.New("description").Option("missingkey=error").Parse(tt.template))
+
+			describe, prefix, err := templatedDescription(tmpl, tt.matchPrefix, "laptop", ec2DescriptionLimit, tt.sanitize)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("templatedDescription() error = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("templatedDescription() error = %v", err)
+			}
+
+			if prefix != tt.wantPrefix {
+				t.Errorf("prefix = %q, want %q", prefix, tt.wantPrefix)
+			}
+
+			rule := describe("203.0.113.7/32")
+			if tt.wantRule != "" && rule != tt.wantRule {
+				t.Errorf("describe() = %q, want %q", rule, tt.wantRule)
+			}
+
+			owns := sgupdater.MatchPrefix.Owns(prefix)
+
+			if !owns(rule) {
+				t.Errorf("prefix %q does not match the rule it renders, %q", prefix, rule)
+			}
+
+			for _, description := range tt.owned {
+				if !owns(description) {
+					t.Errorf("prefix %q does not match %q", prefix, description)
+				}
+			}
+
+			for _, description := range tt.notOwned {
+				if owns(description) {
+					t.Errorf("prefix %q matches %q", prefix, description)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandServices(t *testing.T) {
+	ssh := sgupdater.RuleSpec{Protocol: "tcp", FromPort: aws.Int32(22), ToPort: aws.Int32(22)}
+
+	tests := []struct {
+		name        string
+		targets     []syncTarget
+		services    []string
+		keepTargets bool
+		limit       int
+		want        []string
+		wantErr     string
+	}{
+		{
+			name:     "per service description",
+			targets:  []syncTarget{{Target: sgupdater.Target{Description: "laptop", Rule: ssh}}},
+			services: []string{"SSH,https"},
+			limit:    255,
+			want:     []string{"laptop-ssh laptop-ssh tcp 22", "laptop-https laptop-https tcp 443"},
+		},
+		{
+			name:     "named target",
+			targets:  []syncTarget{{Target: sgupdater.Target{Name: "office", Description: "laptop"}}},
+			services: []string{"ssh"},
+			limit:    255,
+			want:     []string{"office/ssh laptop-ssh tcp 22"},
+		},
+		{
+			name:     "several rules",
+			targets:  []syncTarget{{Target: sgupdater.Target{Description: "laptop"}}},
+			services: []string{"dns"},
+			limit:    255,
+			want:     []string{"laptop-dns laptop-dns tcp 53 udp 53"},
+		},
+		{
+			name:        "keep targets",
+			targets:     []syncTarget{{Target: sgupdater.Target{Description: "laptop", Rule: ssh}}},
+			services:    []string{"rdp"},
+			keepTargets: true,
+			limit:       255,
+			want:        []string{" laptop tcp 22", "laptop-rdp laptop-rdp tcp 3389"},
+		},
+		{
+			name:     "given twice",
+			targets:  []syncTarget{{Target: sgupdater.Target{Description: "laptop"}}},
+			services: []string{"ssh", "SSH"},
+			limit:    255,
+			wantErr:  "service 'ssh' is given more than once",
+		},
+		{
+			name:     "unknown",
+			targets:  []syncTarget{{Target: sgupdater.Target{Description: "laptop"}}},
+			services: []string{"telnet"},
+			limit:    255,
+			wantErr:  "unknown service 'telnet'",
+		},
+		{
+			name:     "too long",
+			targets:  []syncTarget{{Target: sgupdater.Target{Description: "laptop"}}},
+			services: []string{"postgresql"},
+			limit:    len("laptop-postgres"),
+			wantErr:  "rule description is 17 characters long, at most 15",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, err := parseServices(tt.services)
+
+			var targets []syncTarget
+			if err == nil {
+				targets, err = expandServices(tt.targets, services, tt.keepTargets, tt.limit)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+
+			var got []string
+
+			for _, target := range targets {
+				summary := target.Name + " " + target.Description + " " + target.Rule.String()
+
+				for _, rule := range target.ExtraRules {
+					summary += " " + rule.String()
+				}
+
+				got = append(got, summary)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("targets = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
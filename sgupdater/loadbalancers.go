@@ -0,0 +1,49 @@
+package sgupdater
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+)
+
+// ELBAPI is the part of the Elastic Load Balancing v2 client that resolving
+// --load-balancer-name and --load-balancer-arn needs.
+type ELBAPI interface {
+	DescribeLoadBalancers(ctx context.Context, params *elasticloadbalancingv2.DescribeLoadBalancersInput, optFns ...func(*elasticloadbalancingv2.Options)) (*elasticloadbalancingv2.DescribeLoadBalancersOutput, error)
+}
+
+var _ ELBAPI = (*elasticloadbalancingv2.Client)(nil)
+
+// errLoadBalancerNotFound marks a load balancer that does not exist in the region.
+var errLoadBalancerNotFound = errors.New("load balancer not found")
+
+// describeLoadBalancerGroups returns the IDs of the groups attached to the load
+// balancer with this name or ARN, and its type. Load balancers are looked up one by
+// one, since a single missing one fails the whole DescribeLoadBalancers call.
+func describeLoadBalancerGroups(ctx context.Context, client ELBAPI, loadBalancer string) ([]string, elbtypes.LoadBalancerTypeEnum, error) {
+	input := &elasticloadbalancingv2.DescribeLoadBalancersInput{}
+	if strings.HasPrefix(loadBalancer, "arn:") {
+		input.LoadBalancerArns = []string{loadBalancer}
+	} else {
+		input.Names = []string{loadBalancer}
+	}
+
+	out, err := client.DescribeLoadBalancers(ctx, input)
+	if err != nil {
+		var notFound *elbtypes.LoadBalancerNotFoundException
+		if errors.As(err, &notFound) {
+			return nil, "", errLoadBalancerNotFound
+		}
+
+		return nil, "", wrapAPIError(err)
+	}
+
+	if len(out.LoadBalancers) == 0 {
+		return nil, "", errLoadBalancerNotFound
+	}
+
+	return out.LoadBalancers[0].SecurityGroups, out.LoadBalancers[0].Type, nil
+}
@@ -0,0 +1,49 @@
+package sgupdater
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// servicePresets are the well-known services --service names, with the protocols
+// and ports each one needs.
+var servicePresets = map[string][]RuleSpec{
+	"ssh":        {portRule("tcp", 22)},
+	"rdp":        {portRule("tcp", 3389)},
+	"vnc":        {portRule("tcp", 5900)},
+	"http":       {portRule("tcp", 80)},
+	"https":      {portRule("tcp", 443)},
+	"dns":        {portRule("tcp", 53), portRule("udp", 53)},
+	"smb":        {portRule("tcp", 445)},
+	"wireguard":  {portRule("udp", 51820)},
+	"openvpn":    {portRule("udp", 1194)},
+	"postgresql": {portRule("tcp", 5432)},
+	"mysql":      {portRule("tcp", 3306)},
+	"redis":      {portRule("tcp", 6379)},
+	"mongodb":    {portRule("tcp", 27017)},
+	"ping":       {{Protocol: "icmp", FromPort: aws.Int32(-1), ToPort: aws.Int32(-1)}},
+}
+
+func portRule(protocol string, port int32) RuleSpec {
+	return RuleSpec{Protocol: protocol, FromPort: aws.Int32(port), ToPort: aws.Int32(port)}
+}
+
+// ServiceNames lists the known service presets in alphabetical order.
+func ServiceNames() []string {
+	return slices.Sorted(maps.Keys(servicePresets))
+}
+
+// ServiceRules returns the rule specs of a service preset, e.g. tcp 22 for "ssh".
+// The name is matched case-insensitively.
+func ServiceRules(name string) ([]RuleSpec, error) {
+	rules, ok := servicePresets[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return nil, fmt.Errorf("unknown service '%s': use one of %s", name, strings.Join(ServiceNames(), ", "))
+	}
+
+	return slices.Clone(rules), nil
+}
@@ -0,0 +1,81 @@
+package sgupdater
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestServiceRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		want    []RuleSpec
+		wantErr string
+	}{
+		{"preset", "ssh", []RuleSpec{ssh}, ""},
+		{"upper case", "SSH", []RuleSpec{ssh}, ""},
+		{"mixed case and spaces", " Https ", []RuleSpec{portRule("tcp", 443)}, ""},
+		{"several rules", "dns", []RuleSpec{portRule("tcp", 53), portRule("udp", 53)}, ""},
+		{"icmp", "ping", []RuleSpec{{Protocol: "icmp", FromPort: aws.Int32(-1), ToPort: aws.Int32(-1)}}, ""},
+		{"unknown", "telnet", nil, "unknown service 'telnet': use one of " + strings.Join(ServiceNames(), ", ")},
+		{"empty", "", nil, "unknown service '': use one of "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ServiceRules(tt.service)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("ServiceRules(%q) error = %v, want %q", tt.service, err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ServiceRules(%q): %v", tt.service, err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ServiceRules(%q) = %v, want %v", tt.service, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceRulesReturnsCopy(t *testing.T) {
+	rules, err := ServiceRules("dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules[0] = ssh
+
+	again, err := ServiceRules("dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := again[0].String(); got != "tcp 53" {
+		t.Errorf("dns preset changed to %s after editing a returned copy", got)
+	}
+}
+
+func TestServiceNames(t *testing.T) {
+	names := ServiceNames()
+
+	if !slices.IsSorted(names) {
+		t.Errorf("ServiceNames() = %v, want sorted", names)
+	}
+
+	for _, name := range names {
+		if _, err := ServiceRules(name); err != nil {
+			t.Errorf("ServiceRules(%q): %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,4546 @@
+// Package sgupdater keeps a Security Group ingress rule, tagged with a description,
+// allowing a changing public IP: it resolves the groups a Target selects, revokes
+// or updates the rules left for an earlier IP and authorizes the current one. The
+// aws-sg-updater command is a flag-parsing wrapper around it.
+package sgupdater
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	lightsailtypes "github.com/aws/aws-sdk-go-v2/service/lightsail/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	route53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	wafv2types "github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+	"github.com/aws/smithy-go"
+)
+
+// Authorize and revoke calls are retried again on top of the SDK, since a throttled
+// change is worth waiting for more than a throttled read.
+const (
+	changeRetryAttempts  = 4
+	changeRetryBaseDelay = time.Second
+)
+
+// DefaultRulesQuota is EC2's default quota of rules per security group, counted
+// separately for inbound and outbound rules and for IPv4 and IPv6.
+const DefaultRulesQuota = 60
+
+// --verify polls for a new rule quickly at first and backs off while it stays
+// invisible.
+const (
+	verifyPollDelay    = 500 * time.Millisecond
+	verifyMaxPollDelay = 5 * time.Second
+)
+
+// retryableErrorCodes are the EC2 error codes worth retrying a rule change for.
+var retryableErrorCodes = map[string]bool{
+	"RequestLimitExceeded": true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"Unavailable":          true,
+	"ServiceUnavailable":   true,
+}
+
+// EC2API is the part of the EC2 client the sync calls, so that tests can replace it
+// with a fake. Options is only used for the client's region.
+type EC2API interface {
+	DescribeSecurityGroups(ctx context.Context, params *ec2.DescribeSecurityGroupsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error)
+	DescribeSecurityGroupRules(ctx context.Context, params *ec2.DescribeSecurityGroupRulesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	AuthorizeSecurityGroupEgress(ctx context.Context, params *ec2.AuthorizeSecurityGroupEgressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupEgressOutput, error)
+	RevokeSecurityGroupIngress(ctx context.Context, params *ec2.RevokeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error)
+	RevokeSecurityGroupEgress(ctx context.Context, params *ec2.RevokeSecurityGroupEgressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupEgressOutput, error)
+	ModifySecurityGroupRules(ctx context.Context, params *ec2.ModifySecurityGroupRulesInput, optFns ...func(*ec2.Options)) (*ec2.ModifySecurityGroupRulesOutput, error)
+	UpdateSecurityGroupRuleDescriptionsIngress(ctx context.Context, params *ec2.UpdateSecurityGroupRuleDescriptionsIngressInput, optFns ...func(*ec2.Options)) (*ec2.UpdateSecurityGroupRuleDescriptionsIngressOutput, error)
+	UpdateSecurityGroupRuleDescriptionsEgress(ctx context.Context, params *ec2.UpdateSecurityGroupRuleDescriptionsEgressInput, optFns ...func(*ec2.Options)) (*ec2.UpdateSecurityGroupRuleDescriptionsEgressOutput, error)
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	DescribeManagedPrefixLists(ctx context.Context, params *ec2.DescribeManagedPrefixListsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeManagedPrefixListsOutput, error)
+	GetManagedPrefixListEntries(ctx context.Context, params *ec2.GetManagedPrefixListEntriesInput, optFns ...func(*ec2.Options)) (*ec2.GetManagedPrefixListEntriesOutput, error)
+	ModifyManagedPrefixList(ctx context.Context, params *ec2.ModifyManagedPrefixListInput, optFns ...func(*ec2.Options)) (*ec2.ModifyManagedPrefixListOutput, error)
+	Options() ec2.Options
+}
+
+var _ EC2API = (*ec2.Client)(nil)
+
+// APIError is a failed AWS call with the details AWS support asks for. The SDK
+// error stays reachable through errors.As.
+type APIError struct {
+	Operation string
+	Code      string
+	Message   string
+	RequestID string
+	// Attempts is how often the SDK tried the call before giving up, or 0 when it
+	// did not run out of retries.
+	Attempts int
+	Err      error
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s: %s: %s", e.Operation, e.Code, e.Message)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request ID %s)", e.RequestID)
+	}
+
+	if e.Attempts > 0 {
+		msg += fmt.Sprintf(", gave up after %d attempts", e.Attempts)
+	}
+
+	return msg
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// groupDeleted reports whether err is EC2 saying the group does not exist, as when
+// it was deleted after it was resolved.
+func groupDeleted(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidGroup.NotFound"
+}
+
+// wrapAPIError turns an error returned by AWS into an *APIError, leaving others,
+// such as a canceled context, as they are.
+func wrapAPIError(err error) error {
+	var opErr *smithy.OperationError
+	var apiErr smithy.APIError
+
+	if !errors.As(err, &opErr) || !errors.As(err, &apiErr) {
+		return err
+	}
+
+	wrapped := &APIError{
+		Operation: opErr.Operation(),
+		Code:      apiErr.ErrorCode(),
+		Message:   apiErr.ErrorMessage(),
+		Err:       err,
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		wrapped.RequestID = respErr.ServiceRequestID()
+	}
+
+	var attemptsErr *retry.MaxAttemptsError
+	if errors.As(err, &attemptsErr) {
+		wrapped.Attempts = attemptsErr.Attempt
+	}
+
+	return wrapped
+}
+
+// groupLogger returns a logger that tags every message with the group and region,
+// and with the group's name and VPC once SyncAll has put them in ctx.
+func groupLogger(ctx context.Context, client EC2API, sgID string) *slog.Logger {
+	logger := loggerFrom(ctx).With("sg_id", sgID)
+
+	if label, ok := ctx.Value(groupLabelKey{}).(groupLabel); ok && label.SgID == sgID {
+		if label.Name != "" {
+			logger = logger.With("sg_name", label.Name)
+		}
+
+		if label.VpcID != "" {
+			logger = logger.With("vpc_id", label.VpcID)
+		}
+	}
+
+	return logger.With("region", client.Options().Region)
+}
+
+type groupLabelKey struct{}
+
+// groupLabel is the name and VPC of the group a SyncAll worker syncs.
+type groupLabel struct {
+	SgID  string
+	Name  string
+	VpcID string
+}
+
+// GroupDisplayName is the group's Name tag, or its group name without one.
+func GroupDisplayName(group types.SecurityGroup) string {
+	return cmp.Or(TagValue(group.Tags, "Name"), aws.ToString(group.GroupName))
+}
+
+// logRequest logs the parameters of an EC2 request at debug level.
+func logRequest(ctx context.Context, logger *slog.Logger, operation string, input any) {
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	params, err := json.Marshal(input)
+	if err != nil {
+		params = []byte(fmt.Sprintf("%+v", input))
+	}
+
+	logger.Debug("Sending EC2 request", "operation", operation, "params", string(params))
+}
+
+// TagFilter selects security groups carrying the tag Key with value Value.
+type TagFilter struct {
+	Key   string
+	Value string
+}
+
+func (t TagFilter) String() string {
+	return t.Key + "=" + t.Value
+}
+
+// ParseTagFilter parses Key=Value. Only the first '=' separates key and value, so
+// values may contain '=' and ','.
+func ParseTagFilter(raw string) (TagFilter, error) {
+	key, value, found := strings.Cut(raw, "=")
+	key = strings.TrimSpace(key)
+
+	if !found || key == "" {
+		return TagFilter{}, fmt.Errorf("invalid tag filter '%s': use Key=Value", raw)
+	}
+
+	return TagFilter{Key: key, Value: value}, nil
+}
+
+// RuleSpec is the protocol and port range of the rule to keep current. FromPort and
+// ToPort are nil for protocols without ports.
+type RuleSpec struct {
+	Protocol string
+	FromPort *int32
+	ToPort   *int32
+}
+
+// matches reports whether an existing permission has the same protocol and port range.
+func (r RuleSpec) matches(perm types.IpPermission) bool {
+	if NormalizeProtocol(aws.ToString(perm.IpProtocol)) != r.Protocol {
+		return false
+	}
+
+	if r.FromPort == nil {
+		return true
+	}
+
+	return perm.FromPort != nil && perm.ToPort != nil && *perm.FromPort == *r.FromPort && *perm.ToPort == *r.ToPort
+}
+
+// overlaps reports whether an existing permission allows any of the traffic r does.
+// ICMP types and codes are not compared, as r allows all of them.
+func (r RuleSpec) overlaps(perm types.IpPermission) bool {
+	protocol := NormalizeProtocol(aws.ToString(perm.IpProtocol))
+	if protocol != "-1" && r.Protocol != "-1" && protocol != r.Protocol {
+		return false
+	}
+
+	if r.FromPort == nil || perm.FromPort == nil || perm.ToPort == nil || *r.FromPort == -1 || *perm.FromPort == -1 {
+		return true
+	}
+
+	return *perm.FromPort <= *r.ToPort && *r.FromPort <= *perm.ToPort
+}
+
+// coveredBy reports whether an existing permission allows all of the traffic r
+// does.
+func (r RuleSpec) coveredBy(perm types.IpPermission) bool {
+	protocol := NormalizeProtocol(aws.ToString(perm.IpProtocol))
+	if protocol != "-1" && protocol != r.Protocol {
+		return false
+	}
+
+	if perm.FromPort == nil || perm.ToPort == nil || *perm.FromPort == -1 {
+		return true
+	}
+
+	return r.FromPort != nil && *r.FromPort != -1 && *perm.FromPort <= *r.FromPort && *r.ToPort <= *perm.ToPort
+}
+
+func (r RuleSpec) String() string {
+	return DescribePermission(types.IpPermission{IpProtocol: aws.String(r.Protocol), FromPort: r.FromPort, ToPort: r.ToPort})
+}
+
+// DescribePermission renders a permission's protocol and ports, e.g. "tcp 22".
+func DescribePermission(perm types.IpPermission) string {
+	protocol := NormalizeProtocol(aws.ToString(perm.IpProtocol))
+
+	switch {
+	case protocol == "-1":
+		return "all traffic"
+	case perm.FromPort == nil || perm.ToPort == nil:
+		return fmt.Sprintf("protocol %s", protocol)
+	case *perm.FromPort == -1 && *perm.ToPort == -1:
+		return fmt.Sprintf("%s all", protocol)
+	case protocol == "icmp":
+		return fmt.Sprintf("icmp type %d code %d", *perm.FromPort, *perm.ToPort)
+	case *perm.FromPort == *perm.ToPort:
+		return fmt.Sprintf("%s %d", protocol, *perm.FromPort)
+	default:
+		return fmt.Sprintf("%s %d-%d", protocol, *perm.FromPort, *perm.ToPort)
+	}
+}
+
+// NormalizeProtocol maps the protocol numbers EC2 reports by name back to that name,
+// so "6" and "tcp" compare equal.
+func NormalizeProtocol(protocol string) string {
+	switch strings.ToLower(strings.TrimSpace(protocol)) {
+	case "6", "tcp":
+		return "tcp"
+	case "17", "udp":
+		return "udp"
+	case "1", "icmp":
+		return "icmp"
+	case "-1", "all":
+		return "-1"
+	default:
+		return strings.ToLower(strings.TrimSpace(protocol))
+	}
+}
+
+// BuildRuleSpec validates a protocol and port range given as text. The port range
+// applies to tcp and udp; other protocols fail when portSet says one was given.
+func BuildRuleSpec(protocolRaw, portRaw string, portSet bool) (RuleSpec, error) {
+	protocol := NormalizeProtocol(protocolRaw)
+
+	switch protocol {
+	case "tcp", "udp":
+		fromPort, toPort, err := parsePortRange(portRaw)
+		if err != nil {
+			return RuleSpec{}, err
+		}
+
+		return RuleSpec{Protocol: protocol, FromPort: aws.Int32(fromPort), ToPort: aws.Int32(toPort)}, nil
+	case "icmp":
+		if portSet {
+			return RuleSpec{}, fmt.Errorf("--port is not supported with protocol icmp; all ICMP types and codes are allowed")
+		}
+
+		return RuleSpec{Protocol: protocol, FromPort: aws.Int32(-1), ToPort: aws.Int32(-1)}, nil
+	case "-1":
+		if portSet {
+			return RuleSpec{}, fmt.Errorf("--port is not supported with protocol -1 (all traffic)")
+		}
+
+		return RuleSpec{Protocol: protocol}, nil
+	}
+
+	number, err := strconv.Atoi(protocol)
+	if err != nil || number < 0 || number > 255 {
+		return RuleSpec{}, fmt.Errorf("invalid protocol '%s': use tcp, udp, icmp, -1 or a protocol number between 0 and 255", protocolRaw)
+	}
+
+	if portSet {
+		return RuleSpec{}, fmt.Errorf("--port is not supported with protocol %d", number)
+	}
+
+	return RuleSpec{Protocol: strconv.Itoa(number)}, nil
+}
+
+func parsePortRange(raw string) (int32, int32, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, 0, fmt.Errorf("port range is empty")
+	}
+
+	fromRaw, toRaw, isRange := strings.Cut(raw, "-")
+	if !isRange {
+		toRaw = fromRaw
+	}
+
+	fromPort, err := strconv.Atoi(strings.TrimSpace(fromRaw))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port '%s' in range '%s'", fromRaw, raw)
+	}
+
+	toPort, err := strconv.Atoi(strings.TrimSpace(toRaw))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port '%s' in range '%s'", toRaw, raw)
+	}
+
+	if fromPort < 0 || fromPort > 65535 || toPort < 0 || toPort > 65535 {
+		return 0, 0, fmt.Errorf("port range '%s' must be within 0-65535", raw)
+	}
+
+	if fromPort > toPort {
+		return 0, 0, fmt.Errorf("port range '%s' is reversed", raw)
+	}
+
+	return int32(fromPort), int32(toPort), nil
+}
+
+// HostCIDR returns the single-address CIDR for ip: /32 for IPv4 and /128 for IPv6.
+func HostCIDR(ip string) string {
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+
+	return ip + "/32"
+}
+
+// OwnedRule is one security group rule carrying our description, with its rule ID,
+// CIDR and the permission (protocol and ports) it grants.
+type OwnedRule struct {
+	RuleID      string
+	Permission  types.IpPermission
+	Cidr        string
+	IPv6        bool
+	Description string
+	// Egress is set for an outbound rule, which allows traffic to Cidr rather than
+	// from it.
+	Egress bool
+}
+
+// Direction is the traffic a synced rule applies to: inbound from the target CIDR,
+// or outbound to it.
+type Direction string
+
+const (
+	Ingress Direction = "ingress"
+	Egress  Direction = "egress"
+)
+
+func (d Direction) egress() bool {
+	return d == Egress
+}
+
+// OwnDescription matches rule descriptions equal to description, with or without
+// the expiry marker --ttl appends and the revoke deadline --grace-period appends.
+func OwnDescription(description string) func(string) bool {
+	return func(ruleDescription string) bool {
+		base, _, _ := parseExpiry(ruleDescription)
+		return base == description
+	}
+}
+
+// OwnPrefix matches rule descriptions starting with prefix, the stable part of a
+// templated description that changes from one run to the next.
+func OwnPrefix(prefix string) func(string) bool {
+	return func(ruleDescription string) bool {
+		return strings.HasPrefix(ruleDescription, prefix)
+	}
+}
+
+// ManagedMarker starts the marker appended to a free-form rule description, e.g.
+// "#sg-updater:marc-laptop", by which the tool finds the rule whatever the text
+// before it says.
+const ManagedMarker = "#sg-updater:"
+
+// MarkerFor returns the managed-by marker for name.
+func MarkerFor(name string) string {
+	return ManagedMarker + name
+}
+
+// OwnMarker matches rule descriptions ending in marker, before the markers --ttl
+// and --grace-period append.
+func OwnMarker(marker string) func(string) bool {
+	return func(ruleDescription string) bool {
+		base, _, _ := parseExpiry(ruleDescription)
+		return base == marker || strings.HasSuffix(base, " "+marker)
+	}
+}
+
+// Match says how the rules synced under a description are recognised.
+type Match string
+
+const (
+	// MatchExact matches rules described as the description, see OwnDescription.
+	MatchExact Match = ""
+	// MatchPrefix matches rules whose description starts with it, see OwnPrefix.
+	MatchPrefix Match = "prefix"
+	// MatchMarker matches rules carrying it as their managed-by marker, see OwnMarker.
+	MatchMarker Match = "marker"
+	// MatchLegacy matches like MatchMarker, and also rules described as the bare
+	// name, as written before the marker existed.
+	MatchLegacy Match = "marker+legacy"
+)
+
+// Owns returns the matcher for the rules synced under description.
+func (m Match) Owns(description string) func(string) bool {
+	switch m {
+	case MatchPrefix:
+		return OwnPrefix(description)
+	case MatchMarker:
+		return OwnMarker(description)
+	case MatchLegacy:
+		marked := OwnMarker(description)
+		legacy := OwnDescription(strings.TrimPrefix(description, ManagedMarker))
+
+		return func(ruleDescription string) bool {
+			return marked(ruleDescription) || legacy(ruleDescription)
+		}
+	default:
+		return OwnDescription(description)
+	}
+}
+
+// expiryMarker and revokeAfterMarker start the suffixes --ttl and --grace-period
+// append to rule descriptions; markerLayout is the UTC timestamp inside them.
+const (
+	expiryMarker      = " [expires="
+	revokeAfterMarker = " [revoke-after="
+	markerLayout      = "2006-01-02T15:04Z"
+)
+
+// withMarker appends marker and at to description, e.g.
+// "laptop [expires=2024-06-01T12:00Z]".
+func withMarker(description, marker string, at time.Time) string {
+	return description + marker + at.UTC().Format(markerLayout) + "]"
+}
+
+func withExpiry(description string, expires time.Time) string {
+	return withMarker(description, expiryMarker, expires)
+}
+
+// parseMarker splits a description ending in marker into the description before it
+// and the marker's time. ok is false, and description is returned unchanged, when
+// there is no valid marker.
+func parseMarker(description, marker string) (base string, at time.Time, ok bool) {
+	index := strings.LastIndex(description, marker)
+	if index < 0 || !strings.HasSuffix(description, "]") {
+		return description, time.Time{}, false
+	}
+
+	at, err := time.Parse(markerLayout, description[index+len(marker):len(description)-1])
+	if err != nil {
+		return description, time.Time{}, false
+	}
+
+	return description[:index], at, true
+}
+
+// parseExpiry returns a description without its markers and the expiry time, if it
+// has one. A revoke deadline always comes after the expiry marker.
+func parseExpiry(description string) (base string, expires time.Time, ok bool) {
+	base, _, _ = parseMarker(description, revokeAfterMarker)
+	return parseMarker(base, expiryMarker)
+}
+
+// ownedRuleFromSecurityGroupRule converts a rule returned by DescribeSecurityGroupRules.
+// Port numbers of -1 are dropped for protocols that have no ports, matching how
+// DescribeSecurityGroups reports them.
+func ownedRuleFromSecurityGroupRule(sgRule types.SecurityGroupRule) OwnedRule {
+	perm := types.IpPermission{IpProtocol: sgRule.IpProtocol}
+
+	switch NormalizeProtocol(aws.ToString(sgRule.IpProtocol)) {
+	case "tcp", "udp", "icmp", "58":
+		perm.FromPort = sgRule.FromPort
+		perm.ToPort = sgRule.ToPort
+	}
+
+	owned := OwnedRule{
+		RuleID:      aws.ToString(sgRule.SecurityGroupRuleId),
+		Permission:  perm,
+		Cidr:        aws.ToString(sgRule.CidrIpv4),
+		Description: aws.ToString(sgRule.Description),
+		Egress:      aws.ToBool(sgRule.IsEgress),
+	}
+
+	if sgRule.CidrIpv6 != nil {
+		owned.Cidr = aws.ToString(sgRule.CidrIpv6)
+		owned.IPv6 = true
+	}
+
+	return owned
+}
+
+func ownedRuleCidrs(rules []OwnedRule) []string {
+	cidrs := make([]string, 0, len(rules))
+
+	for _, rule := range rules {
+		cidrs = append(cidrs, rule.Cidr)
+	}
+
+	return cidrs
+}
+
+// permissionWithCidrs copies the protocol and ports of perm and fills in cidrs as
+// IpRanges or Ipv6Ranges, all carrying description.
+func permissionWithCidrs(perm types.IpPermission, cidrs []string, description string, ipv6 bool) types.IpPermission {
+	result := types.IpPermission{
+		IpProtocol: perm.IpProtocol,
+		FromPort:   perm.FromPort,
+		ToPort:     perm.ToPort,
+	}
+
+	for _, cidr := range cidrs {
+		if ipv6 {
+			result.Ipv6Ranges = append(result.Ipv6Ranges, types.Ipv6Range{CidrIpv6: aws.String(cidr), Description: aws.String(description)})
+		} else {
+			result.IpRanges = append(result.IpRanges, types.IpRange{CidrIp: aws.String(cidr), Description: aws.String(description)})
+		}
+	}
+
+	return result
+}
+
+// ResolutionStats counts where the resolved security group IDs came from. A group
+// selected by more than one selector is counted under each of them, and once in
+// Overlap for every selector after the first.
+type ResolutionStats struct {
+	FromIDs           int
+	FromInstances     int
+	FromLoadBalancers int
+	FromTags          int
+	FromNames         int
+	Overlap           int
+	// Excluded counts selected groups dropped by --exclude-sg-id.
+	Excluded int
+	// OtherOwners counts tag or name matches dropped for belonging to another
+	// account than Target.OwnerID, as groups shared through a VPC do.
+	OtherOwners int
+	// Skipped counts selected groups dropped by the guardrails.
+	Skipped int
+	// MissingIDs lists explicit IDs that were not found, when missing IDs are allowed.
+	MissingIDs []string
+	// InstanceGroups lists, for every instance found, the selected groups attached
+	// to it.
+	InstanceGroups map[string][]string
+	// MissingInstances lists instances that were not found, when missing IDs are
+	// allowed.
+	MissingInstances []string
+	// LoadBalancerGroups lists, for every load balancer found, the selected groups
+	// attached to it.
+	LoadBalancerGroups map[string][]string
+	// MissingLoadBalancers lists load balancers that were not found, when missing
+	// IDs are allowed.
+	MissingLoadBalancers []string
+	// TagMatches counts the groups each requested tag value matched, in the order the
+	// values were given.
+	TagMatches []TagMatch
+}
+
+// TagMatch is the number of groups one tag value, e.g. Name=web-*, matched.
+type TagMatch struct {
+	Tag    string
+	Groups int
+}
+
+// UnmatchedTags lists the requested tag values that matched no group.
+func (s ResolutionStats) UnmatchedTags() []string {
+	var unmatched []string
+
+	for _, match := range s.TagMatches {
+		if match.Groups == 0 {
+			unmatched = append(unmatched, match.Tag)
+		}
+	}
+
+	return unmatched
+}
+
+// SelectorCounts describes how many groups each selector contributed, omitting
+// selectors that matched nothing.
+func (s ResolutionStats) SelectorCounts() []string {
+	var counts []string
+
+	if s.FromIDs > 0 {
+		counts = append(counts, fmt.Sprintf("--sg-id %d", s.FromIDs))
+	}
+
+	if s.FromInstances > 0 {
+		counts = append(counts, fmt.Sprintf("--instance-id %d", s.FromInstances))
+	}
+
+	if s.FromLoadBalancers > 0 {
+		counts = append(counts, fmt.Sprintf("load balancers %d", s.FromLoadBalancers))
+	}
+
+	if s.FromTags > 0 {
+		counts = append(counts, fmt.Sprintf("tags %d", s.FromTags))
+	}
+
+	if s.FromNames > 0 {
+		counts = append(counts, fmt.Sprintf("--sg-name %d", s.FromNames))
+	}
+
+	return counts
+}
+
+// tagFilters builds the DescribeSecurityGroups filters for the tag selectors. Names
+// are alternatives within one tag:Name filter; every other tag is its own filter, and
+// the API requires all filters to match.
+func tagFilters(tagNames []string, tags []TagFilter) []types.Filter {
+	var filters []types.Filter
+
+	if len(tagNames) > 0 {
+		filters = append(filters, types.Filter{Name: aws.String("tag:Name"), Values: tagNames})
+	}
+
+	for _, tag := range tags {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + tag.Key), Values: []string{tag.Value}})
+	}
+
+	return filters
+}
+
+// tagValuePattern compiles a filter value, where * matches any run of characters
+// and ? any single one, as EC2 filters do.
+func tagValuePattern(value string) *regexp.Regexp {
+	pattern := strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(value))
+
+	return regexp.MustCompile("^(?s:" + pattern + ")$")
+}
+
+// tagMatchCounts counts, for every requested tag value, the matched groups carrying
+// it. The tags are ANDed in the query, so each of them is carried by every group it
+// returned; the Name values are alternatives and split the groups between them.
+func tagMatchCounts(tagNames []string, tags []TagFilter, groups map[string]types.SecurityGroup) []TagMatch {
+	selectors := make([]TagFilter, 0, len(tagNames)+len(tags))
+
+	for _, name := range tagNames {
+		selectors = append(selectors, TagFilter{Key: "Name", Value: name})
+	}
+
+	selectors = append(selectors, tags...)
+	counts := make([]TagMatch, 0, len(selectors))
+
+	for _, selector := range selectors {
+		pattern := tagValuePattern(selector.Value)
+		count := 0
+
+		for _, sg := range groups {
+			if pattern.MatchString(TagValue(sg.Tags, selector.Key)) {
+				count++
+			}
+		}
+
+		counts = append(counts, TagMatch{Tag: selector.String(), Groups: count})
+	}
+
+	return counts
+}
+
+// vpcFilter restricts a DescribeSecurityGroups query to vpcID, or returns no filter
+// when vpcID is empty.
+func vpcFilter(vpcID string) []types.Filter {
+	if vpcID == "" {
+		return nil
+	}
+
+	return []types.Filter{{Name: aws.String("vpc-id"), Values: []string{vpcID}}}
+}
+
+// vpcLabel formats a VPC restriction for log messages, or nothing without one.
+func vpcLabel(vpcID string) string {
+	if vpcID == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" in %s", vpcID)
+}
+
+// describeFilters formats filters for logs, e.g. tag:Name=["a" "b"] AND tag:Team=["platform"].
+func describeFilters(filters []types.Filter) string {
+	parts := make([]string, 0, len(filters))
+
+	for _, filter := range filters {
+		parts = append(parts, fmt.Sprintf("%s=%q", aws.ToString(filter.Name), filter.Values))
+	}
+
+	return strings.Join(parts, " AND ")
+}
+
+// describeSecurityGroupsWithFilters returns every group matching all filters, keyed
+// by ID, and the number of pages it took.
+func describeSecurityGroupsWithFilters(ctx context.Context, client EC2API, filters []types.Filter) (map[string]types.SecurityGroup, int, error) {
+	matches := make(map[string]types.SecurityGroup)
+	pages := 0
+
+	paginator := ec2.NewDescribeSecurityGroupsPaginator(client, &ec2.DescribeSecurityGroupsInput{
+		Filters: filters,
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, pages, wrapAPIError(err)
+		}
+
+		pages++
+
+		for _, sg := range page.SecurityGroups {
+			if sg.GroupId == nil {
+				continue
+			}
+
+			matches[*sg.GroupId] = sg
+		}
+	}
+
+	return matches, pages, nil
+}
+
+// groupIDFilterChunk is how many IDs go into one group-id filter; EC2 caps the
+// number of values a single filter accepts.
+const groupIDFilterChunk = 200
+
+// describeSecurityGroupsByID looks up the given IDs with a group-id filter, which,
+// unlike GroupIds, returns the groups that exist instead of failing the whole call
+// with InvalidGroup.NotFound. Missing IDs are simply absent from the result.
+func describeSecurityGroupsByID(ctx context.Context, client EC2API, sgIDs []string) (map[string]types.SecurityGroup, error) {
+	found := make(map[string]types.SecurityGroup)
+
+	for chunk := range slices.Chunk(sgIDs, groupIDFilterChunk) {
+		paginator := ec2.NewDescribeSecurityGroupsPaginator(client, &ec2.DescribeSecurityGroupsInput{
+			Filters: []types.Filter{
+				{
+					Name:   aws.String("group-id"),
+					Values: chunk,
+				},
+			},
+		})
+
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, wrapAPIError(err)
+			}
+
+			for _, sg := range page.SecurityGroups {
+				if sg.GroupId == nil {
+					continue
+				}
+
+				found[*sg.GroupId] = sg
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// describeInstanceGroups looks up the given instances with an instance-id filter, so
+// that missing ones are simply absent, and returns the state of each one found and
+// the IDs of the groups attached to its network interfaces.
+func describeInstanceGroups(ctx context.Context, client EC2API, instanceIDs []string) (map[string]types.InstanceStateName, map[string][]string, error) {
+	states := make(map[string]types.InstanceStateName)
+	groups := make(map[string][]string)
+
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: instanceIDs,
+			},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, wrapAPIError(err)
+		}
+
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.InstanceId == nil {
+					continue
+				}
+
+				id := *instance.InstanceId
+
+				states[id] = ""
+				if instance.State != nil {
+					states[id] = instance.State.Name
+				}
+
+				var sgIDs []string
+
+				for _, sg := range instance.SecurityGroups {
+					sgIDs = append(sgIDs, aws.ToString(sg.GroupId))
+				}
+
+				for _, eni := range instance.NetworkInterfaces {
+					for _, sg := range eni.Groups {
+						sgIDs = append(sgIDs, aws.ToString(sg.GroupId))
+					}
+				}
+
+				slices.Sort(sgIDs)
+				groups[id] = slices.Compact(sgIDs)
+			}
+		}
+	}
+
+	return states, groups, nil
+}
+
+// FindSecurityGroups verifies the explicit IDs and looks up the tagged groups, and
+// returns them sorted by ID. The groups are returned in full so the first sync can
+// work from their rules without describing them again. When allowMissing is set, as
+// in multi-region runs, IDs that do not exist in this region are reported in the
+// stats instead of failing the lookup. elbClient is only used when target selects
+// load balancers.
+func FindSecurityGroups(ctx context.Context, client EC2API, elbClient ELBAPI, target Target, allowMissing bool) ([]types.SecurityGroup, ResolutionStats, error) {
+	sgIDs := target.SgIDs
+	region := client.Options().Region
+	resolvedIDs := make(map[string]types.SecurityGroup)
+	var errorList []string
+	var stats ResolutionStats
+
+	if len(sgIDs) > 0 {
+		loggerFrom(ctx).Info("Verifying provided Security Group IDs", "count", len(sgIDs), "region", region)
+
+		found, err := describeSecurityGroupsByID(ctx, client, sgIDs)
+		if err != nil {
+			return nil, stats, fmt.Errorf("failed to verify Security Group IDs: %w", err)
+		}
+
+		for _, id := range sgIDs {
+			if sg, ok := found[id]; ok {
+				if target.VpcID != "" && aws.ToString(sg.VpcId) != target.VpcID {
+					errorList = append(errorList, fmt.Sprintf("ID '%s' belongs to %s, not the requested VPC %s", id, aws.ToString(sg.VpcId), target.VpcID))
+					continue
+				}
+
+				if owner := aws.ToString(sg.OwnerId); target.OwnerID != "" && owner != target.OwnerID {
+					errorList = append(errorList, fmt.Sprintf("ID '%s' is owned by account %s, not %s, and cannot be modified from this account (see --owner-id)", id, owner, target.OwnerID))
+					continue
+				}
+
+				resolvedIDs[id] = sg
+			} else if allowMissing {
+				stats.MissingIDs = append(stats.MissingIDs, id)
+			} else {
+				errorList = append(errorList, fmt.Sprintf("ID '%s' not found", id))
+			}
+		}
+
+		if len(errorList) > 0 {
+			return nil, stats, fmt.Errorf("encountered errors validating SG IDs: %s", strings.Join(errorList, "; "))
+		}
+
+		stats.FromIDs = len(resolvedIDs)
+		loggerFrom(ctx).Info("Verified Security Group IDs", "count", len(resolvedIDs), "region", region)
+	}
+
+	// dropOtherOwners removes the matches owned by another account than the target's.
+	dropOtherOwners := func(matches map[string]types.SecurityGroup) {
+		if target.OwnerID == "" {
+			return
+		}
+
+		for id, sg := range matches {
+			if owner := aws.ToString(sg.OwnerId); owner != target.OwnerID {
+				loggerFrom(ctx).Info("Excluding Security Group owned by another account", "sg_id", id, "owner_id", owner, "region", region)
+				delete(matches, id)
+				stats.OtherOwners++
+			}
+		}
+	}
+
+	// merge adds matches to the resolved groups and returns how many there were.
+	merge := func(matches map[string]types.SecurityGroup) int {
+		for id, sg := range matches {
+			if _, alreadySelected := resolvedIDs[id]; alreadySelected {
+				stats.Overlap++
+			}
+
+			resolvedIDs[id] = sg
+		}
+
+		return len(matches)
+	}
+
+	// addAttached selects the groups attached to resources, e.g. instances, that pass
+	// the owner and VPC checks. It returns the groups kept for every resource found
+	// and how many groups were selected.
+	addAttached := func(kind string, resources []string, attached map[string][]string) (map[string][]string, int, error) {
+		var sgIDs []string
+
+		for _, resource := range resources {
+			sgIDs = append(sgIDs, attached[resource]...)
+		}
+
+		slices.Sort(sgIDs)
+
+		matches, err := describeSecurityGroupsByID(ctx, client, slices.Compact(sgIDs))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to describe the Security Groups of %ss: %w", kind, err)
+		}
+
+		dropOtherOwners(matches)
+
+		for id, sg := range matches {
+			if target.VpcID != "" && aws.ToString(sg.VpcId) != target.VpcID {
+				loggerFrom(ctx).Info("Excluding attached Security Group outside the requested VPC", "sg_id", id, "vpc_id", aws.ToString(sg.VpcId), "region", region)
+				delete(matches, id)
+			}
+		}
+
+		kept := make(map[string][]string)
+
+		for _, resource := range resources {
+			if _, found := attached[resource]; !found {
+				continue
+			}
+
+			kept[resource] = []string{}
+
+			for _, sgID := range attached[resource] {
+				if _, ok := matches[sgID]; ok {
+					kept[resource] = append(kept[resource], sgID)
+				}
+			}
+
+			loggerFrom(ctx).Info("Found Security Groups attached to "+kind, strings.ReplaceAll(kind, " ", "_"), resource, "sg_ids", strings.Join(kept[resource], ", "), "region", region)
+		}
+
+		return kept, merge(matches), nil
+	}
+
+	if len(target.InstanceIDs) > 0 {
+		loggerFrom(ctx).Info("Looking up the Security Groups of instances", "instances", strings.Join(target.InstanceIDs, ", "), "region", region)
+
+		states, groupsByInstance, err := describeInstanceGroups(ctx, client, target.InstanceIDs)
+		if err != nil {
+			return nil, stats, fmt.Errorf("failed to describe instances: %w", err)
+		}
+
+		var instanceErrors []string
+
+		for _, id := range target.InstanceIDs {
+			state, found := states[id]
+
+			switch {
+			case !found && allowMissing:
+				stats.MissingInstances = append(stats.MissingInstances, id)
+			case !found:
+				instanceErrors = append(instanceErrors, fmt.Sprintf("instance '%s' not found", id))
+			case state == types.InstanceStateNameTerminated || state == types.InstanceStateNameShuttingDown:
+				instanceErrors = append(instanceErrors, fmt.Sprintf("instance '%s' is %s and has no Security Groups left", id, state))
+			}
+		}
+
+		if len(instanceErrors) > 0 {
+			return nil, stats, fmt.Errorf("encountered errors resolving instances: %s", strings.Join(instanceErrors, "; "))
+		}
+
+		stats.InstanceGroups, stats.FromInstances, err = addAttached("instance", target.InstanceIDs, groupsByInstance)
+		if err != nil {
+			return nil, stats, err
+		}
+	}
+
+	if len(target.LoadBalancers) > 0 {
+		if elbClient == nil {
+			return nil, stats, errors.New("selecting load balancers needs an Elastic Load Balancing client")
+		}
+
+		loggerFrom(ctx).Info("Looking up the Security Groups of load balancers", "load_balancers", strings.Join(target.LoadBalancers, ", "), "region", region)
+
+		groupsByLoadBalancer := make(map[string][]string)
+		var loadBalancerErrors []string
+
+		for _, lb := range target.LoadBalancers {
+			sgIDs, lbType, err := describeLoadBalancerGroups(ctx, elbClient, lb)
+
+			switch {
+			case errors.Is(err, errLoadBalancerNotFound) && allowMissing:
+				stats.MissingLoadBalancers = append(stats.MissingLoadBalancers, lb)
+			case errors.Is(err, errLoadBalancerNotFound):
+				loadBalancerErrors = append(loadBalancerErrors, fmt.Sprintf("load balancer '%s' not found (classic load balancers are not supported)", lb))
+			case err != nil:
+				return nil, stats, fmt.Errorf("failed to describe load balancer '%s': %w", lb, err)
+			case len(sgIDs) == 0:
+				loadBalancerErrors = append(loadBalancerErrors, fmt.Sprintf("load balancer '%s' is not an ALB or NLB with security groups (type %s)", lb, lbType))
+			default:
+				groupsByLoadBalancer[lb] = sgIDs
+			}
+		}
+
+		if len(loadBalancerErrors) > 0 {
+			return nil, stats, fmt.Errorf("encountered errors resolving load balancers: %s", strings.Join(loadBalancerErrors, "; "))
+		}
+
+		var err error
+
+		stats.LoadBalancerGroups, stats.FromLoadBalancers, err = addAttached("load balancer", target.LoadBalancers, groupsByLoadBalancer)
+		if err != nil {
+			return nil, stats, err
+		}
+	}
+
+	if len(target.SgTagNames) > 0 || len(target.SgTags) > 0 {
+		filters := append(tagFilters(target.SgTagNames, target.SgTags), vpcFilter(target.VpcID)...)
+		filterSet := describeFilters(filters)
+
+		loggerFrom(ctx).Info("Searching for Security Groups by tag", "filters", filterSet, "region", region)
+
+		tagMatches, pages, err := describeSecurityGroupsWithFilters(ctx, client, filters)
+		if err != nil {
+			return nil, stats, fmt.Errorf("failed to describe security groups with filters %s: %w", filterSet, err)
+		}
+
+		loggerFrom(ctx).Info("Fetched Security Groups matching tags", "pages", pages, "region", region)
+		dropOtherOwners(tagMatches)
+
+		stats.TagMatches = tagMatchCounts(target.SgTagNames, target.SgTags, tagMatches)
+
+		for _, match := range stats.TagMatches {
+			if match.Groups == 0 {
+				loggerFrom(ctx).Warn("Tag value matched no Security Group", "tag", match.Tag, "region", region)
+			} else {
+				loggerFrom(ctx).Info("Tag value matched Security Groups", "tag", match.Tag, "count", match.Groups, "region", region)
+			}
+		}
+
+		if len(tagMatches) == 0 {
+			loggerFrom(ctx).Warn("No security groups found matching filters", "filters", filterSet, "region", region)
+		} else {
+			stats.FromTags = merge(tagMatches)
+			loggerFrom(ctx).Info("Found Security Groups matching tags", "count", len(tagMatches), "region", region)
+		}
+	}
+
+	if len(target.SgNames) > 0 {
+		loggerFrom(ctx).Info("Searching for Security Groups by name", "names", strings.Join(target.SgNames, ", "), "vpc_id", target.VpcID, "region", region)
+
+		filters := []types.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: target.SgNames,
+			},
+		}
+
+		filters = append(filters, vpcFilter(target.VpcID)...)
+
+		nameMatches, _, err := describeSecurityGroupsWithFilters(ctx, client, filters)
+		if err != nil {
+			return nil, stats, fmt.Errorf("failed to describe security groups named '%v': %w", target.SgNames, err)
+		}
+
+		dropOtherOwners(nameMatches)
+
+		vpcsByName := make(map[string][]string)
+
+		for _, sg := range nameMatches {
+			name := aws.ToString(sg.GroupName)
+			vpcsByName[name] = append(vpcsByName[name], aws.ToString(sg.VpcId))
+		}
+
+		// Group names are only unique within a VPC, so one name may select several groups.
+		for _, name := range target.SgNames {
+			vpcs := vpcsByName[name]
+			slices.Sort(vpcs)
+
+			switch {
+			case len(vpcs) == 0:
+				loggerFrom(ctx).Warn("No security group found with this name", "name", name, "region", region)
+			case len(vpcs) > 1:
+				loggerFrom(ctx).Info("Security group name matches groups in several VPCs, all of them are included", "name", name, "count", len(vpcs), "vpcs", strings.Join(vpcs, ", "), "region", region)
+			}
+		}
+
+		if len(nameMatches) > 0 {
+			stats.FromNames = merge(nameMatches)
+			loggerFrom(ctx).Info("Found Security Groups matching names", "count", len(nameMatches), "region", region)
+		}
+	}
+
+	for _, id := range target.ExcludeIDs {
+		if _, selected := resolvedIDs[id]; selected {
+			loggerFrom(ctx).Info("Excluding Security Group as requested by --exclude-sg-id", "sg_id", id, "region", region)
+			delete(resolvedIDs, id)
+			stats.Excluded++
+		}
+	}
+
+	groups := make([]types.SecurityGroup, 0, len(resolvedIDs))
+
+	for _, id := range slices.Sorted(maps.Keys(resolvedIDs)) {
+		groups = append(groups, resolvedIDs[id])
+	}
+
+	if len(groups) == 0 && len(errorList) == 0 {
+		loggerFrom(ctx).Warn("No valid or matching Security Group IDs were resolved", "region", region)
+	}
+
+	return groups, stats, nil
+}
+
+// GroupResult records what syncSecurityGroupRule changed, or would change in dry-run mode,
+// for one target CIDR in one security group.
+type GroupResult struct {
+	SgID        string
+	VpcID       string
+	GroupName   string
+	Description string
+	Rule        RuleSpec
+	TargetCidr  string
+	RevokeCidrs []string
+	// ModifiedCidr is the old CIDR of a rule updated in place to TargetCidr.
+	ModifiedCidr string
+	// RuleID is the ID of the rule for TargetCidr that was added, updated or found
+	// unchanged, when EC2 reported it. Rules read from a pre-fetched group have none.
+	RuleID string
+	// DeferredCidrs are outdated rules kept for the grace period.
+	DeferredCidrs []string
+	Authorize     bool
+	DryRun        bool
+	Removal       bool
+	// Egress marks a result for outbound rules.
+	Egress bool
+	// Deleted marks a group skipped because it was deleted during the run.
+	Deleted bool
+	// NotAttempted marks a sync left undone because another group failed first
+	// with Settings.FailFast.
+	NotAttempted bool
+	// CoveredBy names the broader rule, e.g. "203.0.113.0/24 (description: office)",
+	// that made the sync leave TargetCidr unauthorized.
+	CoveredBy string
+	// AuthorizeCidrs are the CIDRs an allowlist sync authorizes at once; such a
+	// result has no TargetCidr.
+	AuthorizeCidrs []string
+	// Pruned marks a removal of rules left under earlier names by --prune-prefix.
+	Pruned bool
+	// Expired marks a removal of expired rules by clean-expired.
+	Expired bool
+	// Restored marks a rollback to a backup; Diff lists what it changed.
+	Restored bool
+	Warnings []string
+	// Retries counts authorize and revoke attempts repeated after throttling.
+	Retries int
+	// Propagation is how long the rule took to show up in describe calls after it
+	// was put in place, when verified with Settings.VerifyTimeout.
+	Propagation time.Duration
+	// Diff lists the group's rules with our description before and after the sync.
+	Diff []RuleChange
+	Err  error
+}
+
+// RuleChange is one line of a plan diff: a rule that is kept (' '), revoked ('-')
+// or authorized ('+').
+type RuleChange struct {
+	Op   byte
+	Rule string
+}
+
+func (c RuleChange) String() string {
+	return string(c.Op) + " " + c.Rule
+}
+
+func (o OwnedRule) String() string {
+	return fmt.Sprintf("%s from %s", DescribePermission(o.Permission), o.Cidr)
+}
+
+// Changed reports whether the group's rules were, or in dry-run mode would be, changed.
+func (r GroupResult) Changed() bool {
+	if r.Restored {
+		return slices.ContainsFunc(r.Diff, func(change RuleChange) bool { return change.Op != ' ' })
+	}
+
+	return r.Authorize || r.ModifiedCidr != "" || len(r.RevokeCidrs) > 0 || len(r.DeferredCidrs) > 0
+}
+
+// Interrupted reports whether the sync was cut short by cancellation rather than
+// failing on an API error.
+func (r GroupResult) Interrupted() bool {
+	return errors.Is(r.Err, context.Canceled)
+}
+
+// TimedOut reports whether the sync failed because a deadline passed, of a single
+// AWS call or of the whole run.
+func (r GroupResult) TimedOut() bool {
+	return errors.Is(r.Err, context.DeadlineExceeded)
+}
+
+// Action is what a sync did, or would do in dry-run mode, to one group.
+type Action string
+
+const (
+	ActionAdded          Action = "added"
+	ActionUpdated        Action = "updated"
+	ActionUnchanged      Action = "unchanged"
+	ActionRemoved        Action = "removed"
+	ActionPruned         Action = "pruned"
+	ActionRolledBack     Action = "rolled back"
+	ActionSkippedDeleted Action = "skipped (deleted)"
+	ActionNotAttempted   Action = "not attempted"
+	ActionFailed         Action = "failed"
+	ActionInterrupted    Action = "interrupted"
+	ActionTimedOut       Action = "timed out"
+)
+
+// Actions lists every Action in the order summaries count them.
+var Actions = []Action{ActionAdded, ActionUpdated, ActionUnchanged, ActionRemoved, ActionPruned, ActionRolledBack, ActionSkippedDeleted, ActionNotAttempted, ActionFailed, ActionInterrupted, ActionTimedOut}
+
+// Action classifies the result as added, updated, removed, pruned, unchanged, failed,
+// skipped (deleted), not attempted, interrupted or timed out.
+func (r GroupResult) Action() Action {
+	switch {
+	case r.Interrupted():
+		return ActionInterrupted
+	case r.TimedOut():
+		return ActionTimedOut
+	case r.Err != nil:
+		return ActionFailed
+	case r.Deleted:
+		return ActionSkippedDeleted
+	case r.NotAttempted:
+		return ActionNotAttempted
+	case r.Restored && r.Changed():
+		return ActionRolledBack
+	case r.Pruned && len(r.RevokeCidrs) > 0:
+		return ActionPruned
+	case r.Removal && len(r.RevokeCidrs) > 0:
+		return ActionRemoved
+	case r.ModifiedCidr != "" || len(r.RevokeCidrs) > 0 || len(r.DeferredCidrs) > 0:
+		return ActionUpdated
+	case r.Authorize:
+		return ActionAdded
+	default:
+		return ActionUnchanged
+	}
+}
+
+// Plan describes the result as "would revoke ..., would authorize ..." for dry-run output.
+func (r GroupResult) Plan() string {
+	if r.Restored {
+		if !r.Changed() {
+			return "no changes, the rules already match the backup"
+		}
+
+		var steps []string
+
+		for _, change := range r.Diff {
+			switch change.Op {
+			case '+':
+				steps = append(steps, "would restore "+change.Rule)
+			case '-':
+				steps = append(steps, "would revoke "+change.Rule)
+			}
+		}
+
+		return strings.Join(steps, ", ")
+	}
+
+	if r.Pruned || r.Expired {
+		verb, kind := "prune", "to prune"
+		if r.Expired {
+			verb, kind = "revoke expired", "expired"
+		}
+
+		if !r.Changed() {
+			return fmt.Sprintf("no changes, no rules matching %s %s", r.Description, kind)
+		}
+
+		rules := make([]string, 0, len(r.Diff))
+
+		for _, change := range r.Diff {
+			rules = append(rules, change.Rule)
+		}
+
+		return fmt.Sprintf("would %s %s", verb, strings.Join(rules, ", "))
+	}
+
+	if r.Removal && !r.Changed() {
+		return "no changes, no rules to remove"
+	}
+
+	if !r.Changed() && r.TargetCidr == "" {
+		return "no changes, the allowlist is already authorized"
+	}
+
+	if !r.Changed() && r.CoveredBy != "" {
+		return fmt.Sprintf("no changes, %s is covered by %s", r.TargetCidr, r.CoveredBy)
+	}
+
+	if !r.Changed() {
+		return fmt.Sprintf("no changes, %s already authorized", r.TargetCidr)
+	}
+
+	var steps []string
+
+	if r.ModifiedCidr != "" {
+		steps = append(steps, fmt.Sprintf("would update %s to %s", r.ModifiedCidr, r.TargetCidr))
+	}
+
+	if len(r.RevokeCidrs) > 0 {
+		steps = append(steps, "would revoke "+strings.Join(r.RevokeCidrs, ", "))
+	}
+
+	if len(r.AuthorizeCidrs) > 0 {
+		steps = append(steps, "would authorize "+strings.Join(r.AuthorizeCidrs, ", "))
+	} else if r.Authorize {
+		steps = append(steps, "would authorize "+r.TargetCidr)
+	}
+
+	if len(r.DeferredCidrs) > 0 {
+		steps = append(steps, "would keep "+strings.Join(r.DeferredCidrs, ", ")+" for the grace period")
+	}
+
+	direction := ""
+	if r.Egress {
+		direction = "egress "
+	}
+
+	if r.Removal || r.Rule.Protocol == "" {
+		return fmt.Sprintf("%s (%sdescription=%s)", strings.Join(steps, ", "), direction, r.Description)
+	}
+
+	return fmt.Sprintf("%s (%s%s, description=%s)", strings.Join(steps, ", "), direction, r.Rule, r.Description)
+}
+
+// splitOwnedRules picks the rule in targetCidr's family that already matches rule
+// and targetCidr, if any; every other rule in that family is stale, whatever shape
+// an earlier run or a human gave it.
+func splitOwnedRules(rules []OwnedRule, isIPv6 bool, rule RuleSpec, targetCidr string) (*OwnedRule, []OwnedRule) {
+	var current *OwnedRule
+	var stale []OwnedRule
+
+	for _, owned := range rules {
+		if owned.IPv6 != isIPv6 {
+			continue
+		}
+
+		if current == nil && rule.matches(owned.Permission) && owned.Cidr == targetCidr {
+			current = &owned
+		} else {
+			stale = append(stale, owned)
+		}
+	}
+
+	return current, stale
+}
+
+// claimRules narrows a group's rules with our description to those the sync of
+// rule, one of the run's specs, answers for in isIPv6's family: the rules matching
+// rule before any other spec. A rule matching no spec, as left by a spec since
+// changed or dropped, goes to the first spec with no rule of its own, to be updated
+// in place, or otherwise to the last spec, to be revoked. Rules of the other family
+// are kept for the caller to skip.
+func claimRules(rules []OwnedRule, isIPv6 bool, rule RuleSpec, specs []RuleSpec) []OwnedRule {
+	if len(specs) < 2 {
+		return rules
+	}
+
+	claimed := make([][]OwnedRule, len(specs))
+	var others, orphans []OwnedRule
+
+	for _, owned := range rules {
+		if owned.IPv6 != isIPv6 {
+			others = append(others, owned)
+			continue
+		}
+
+		index := slices.IndexFunc(specs, func(spec RuleSpec) bool { return spec.matches(owned.Permission) })
+		if index < 0 {
+			orphans = append(orphans, owned)
+			continue
+		}
+
+		claimed[index] = append(claimed[index], owned)
+	}
+
+	for i := range claimed {
+		if len(orphans) > 0 && len(claimed[i]) == 0 {
+			claimed[i] = orphans[:1]
+			orphans = orphans[1:]
+		}
+	}
+
+	last := len(specs) - 1
+	claimed[last] = append(claimed[last], orphans...)
+
+	index := slices.IndexFunc(specs, func(spec RuleSpec) bool { return spec.String() == rule.String() })
+	if index < 0 {
+		return rules
+	}
+
+	return append(others, claimed[index]...)
+}
+
+// ruleEvaluation is what syncing one target CIDR into a group would change, worked
+// out from the rules the group already has with our description.
+type ruleEvaluation struct {
+	// Current is the rule that already matches the target, if any.
+	Current *OwnedRule
+	// Modify is an outdated rule to update in place to the target, when there is no
+	// current one.
+	Modify *OwnedRule
+	// Revoke lists the outdated rules to revoke.
+	Revoke []OwnedRule
+	// Defer lists outdated rules to keep for the grace period, which get a revoke
+	// deadline; Waiting lists those whose deadline has not passed yet.
+	Defer   []OwnedRule
+	Waiting []OwnedRule
+	// Unmark is set when the current rule still carries a revoke deadline from an
+	// earlier address change, because the address changed back.
+	Unmark bool
+	// Adopt is set when the current rule was only found by its legacy description
+	// and still has to be given the managed-by marker.
+	Adopt bool
+	// NeedsAdd is set when there is neither a current rule nor one to modify.
+	NeedsAdd bool
+	Diff     []RuleChange
+}
+
+// skipAdd drops authorizing the target, for when a broader rule already covers it:
+// a rule that would have been updated to the target is revoked like the others.
+func (e *ruleEvaluation) skipAdd() {
+	if e.Modify != nil {
+		e.Revoke = append(slices.Clone(e.Revoke), *e.Modify)
+		e.Modify = nil
+	}
+
+	e.NeedsAdd = false
+	// The diff already lists the rule that was to be updated as revoked.
+	e.Diff = slices.DeleteFunc(slices.Clone(e.Diff), func(change RuleChange) bool { return change.Op == '+' })
+}
+
+// outdated reports whether any existing rule has to be modified, relabeled or revoked.
+func (e ruleEvaluation) outdated() bool {
+	return e.Modify != nil || len(e.Revoke) > 0 || len(e.Defer) > 0 || e.Unmark || e.Adopt
+}
+
+// evaluateOwnedRules decides how to bring rules in line with rule and targetCidr
+// without calling EC2. Without a current rule, a stale one is updated in place
+// (preferring one that already has the configured protocol and ports) instead of
+// authorizing a new rule. With a grace period, stale rules are instead kept until
+// their revoke deadline, which is set grace after now.
+func evaluateOwnedRules(rules []OwnedRule, isIPv6 bool, rule RuleSpec, targetCidr string, grace time.Duration, now time.Time) ruleEvaluation {
+	var eval ruleEvaluation
+
+	current, stale := splitOwnedRules(rules, isIPv6, rule, targetCidr)
+	eval.Current = current
+
+	if current != nil {
+		_, _, eval.Unmark = parseMarker(current.Description, revokeAfterMarker)
+	}
+
+	if grace > 0 {
+		var expired []OwnedRule
+
+		for _, owned := range stale {
+			_, deadline, marked := parseMarker(owned.Description, revokeAfterMarker)
+
+			switch {
+			case !marked:
+				eval.Defer = append(eval.Defer, owned)
+			case deadline.After(now):
+				eval.Waiting = append(eval.Waiting, owned)
+			default:
+				expired = append(expired, owned)
+			}
+		}
+
+		stale = expired
+	} else if current == nil && len(stale) > 0 {
+		modifyIndex := 0
+
+		for i, owned := range stale {
+			if rule.matches(owned.Permission) {
+				modifyIndex = i
+				break
+			}
+		}
+
+		eval.Modify = &stale[modifyIndex]
+		stale = slices.Delete(slices.Clone(stale), modifyIndex, modifyIndex+1)
+	}
+
+	eval.Revoke = stale
+	eval.NeedsAdd = current == nil && eval.Modify == nil
+	targetRule := fmt.Sprintf("%s from %s", rule, targetCidr)
+
+	if current != nil {
+		eval.Diff = append(eval.Diff, RuleChange{' ', current.String()})
+	}
+
+	if eval.Modify != nil {
+		eval.Diff = append(eval.Diff, RuleChange{'-', eval.Modify.String()}, RuleChange{'+', targetRule})
+	}
+
+	for _, owned := range eval.Waiting {
+		_, deadline, _ := parseMarker(owned.Description, revokeAfterMarker)
+		eval.Diff = append(eval.Diff, RuleChange{' ', fmt.Sprintf("%s (revoked after %s)", owned, deadline.Format(markerLayout))})
+	}
+
+	for _, owned := range eval.Defer {
+		eval.Diff = append(eval.Diff, RuleChange{' ', fmt.Sprintf("%s (kept until %s)", owned, now.Add(grace).UTC().Format(markerLayout))})
+	}
+
+	for _, owned := range eval.Revoke {
+		eval.Diff = append(eval.Diff, RuleChange{'-', owned.String()})
+	}
+
+	if eval.NeedsAdd {
+		eval.Diff = append(eval.Diff, RuleChange{'+', targetRule})
+	}
+
+	return eval
+}
+
+// allowlistPlan is what an allowlist sync changes in a group, worked out from the
+// rules the group already has with our description.
+type allowlistPlan struct {
+	Keep   []OwnedRule
+	Revoke []OwnedRule
+	Add    []string
+}
+
+// planAllowlist keeps one rule per CIDR of cidrs that already allows it under rule,
+// revokes every other rule and adds the CIDRs left without one.
+func planAllowlist(rules []OwnedRule, rule RuleSpec, cidrs []string) allowlistPlan {
+	var plan allowlistPlan
+
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr] = true
+	}
+
+	covered := make(map[string]bool, len(cidrs))
+
+	for _, owned := range rules {
+		if wanted[owned.Cidr] && !covered[owned.Cidr] && rule.matches(owned.Permission) {
+			covered[owned.Cidr] = true
+			plan.Keep = append(plan.Keep, owned)
+		} else {
+			plan.Revoke = append(plan.Revoke, owned)
+		}
+	}
+
+	for _, cidr := range cidrs {
+		if !covered[cidr] {
+			covered[cidr] = true
+			plan.Add = append(plan.Add, cidr)
+		}
+	}
+
+	return plan
+}
+
+func (p allowlistPlan) diff(rule RuleSpec) []RuleChange {
+	var changes []RuleChange
+
+	for _, owned := range p.Keep {
+		changes = append(changes, RuleChange{' ', owned.String()})
+	}
+
+	for _, owned := range p.Revoke {
+		changes = append(changes, RuleChange{'-', owned.String()})
+	}
+
+	for _, cidr := range p.Add {
+		changes = append(changes, RuleChange{'+', fmt.Sprintf("%s from %s", rule, cidr)})
+	}
+
+	return changes
+}
+
+// OwnedRulesFromPermissions extracts the CIDR rules whose description satisfies match
+// from a described group's permissions. They have no RuleID.
+func OwnedRulesFromPermissions(perms []types.IpPermission, match func(string) bool) []OwnedRule {
+	var rules []OwnedRule
+
+	for _, perm := range perms {
+		shape := types.IpPermission{IpProtocol: perm.IpProtocol, FromPort: perm.FromPort, ToPort: perm.ToPort}
+
+		for _, ipRange := range perm.IpRanges {
+			if description := aws.ToString(ipRange.Description); match(description) {
+				rules = append(rules, OwnedRule{Permission: shape, Cidr: aws.ToString(ipRange.CidrIp), Description: description})
+			}
+		}
+
+		for _, ipv6Range := range perm.Ipv6Ranges {
+			if description := aws.ToString(ipv6Range.Description); match(description) {
+				rules = append(rules, OwnedRule{Permission: shape, Cidr: aws.ToString(ipv6Range.CidrIpv6), IPv6: true, Description: description})
+			}
+		}
+	}
+
+	return rules
+}
+
+// groupOwnedRules is OwnedRulesFromPermissions over a described group's ingress
+// or, with egress, egress permissions.
+func groupOwnedRules(group types.SecurityGroup, egress bool, match func(string) bool) []OwnedRule {
+	perms := group.IpPermissions
+	if egress {
+		perms = group.IpPermissionsEgress
+	}
+
+	rules := OwnedRulesFromPermissions(perms, match)
+
+	for i := range rules {
+		rules[i].Egress = egress
+	}
+
+	return rules
+}
+
+// ruleOwnerDescription is the description a rule is matched on. A rule tagged as ours
+// is matched on its owner tag, plus any markers its description carries, whatever
+// else the description now says; rules created before rules were tagged fall back to
+// their description.
+func ruleOwnerDescription(sgRule types.SecurityGroupRule) string {
+	description := aws.ToString(sgRule.Description)
+	owner := TagValue(sgRule.Tags, ownerTagKey)
+
+	if TagValue(sgRule.Tags, managedByTagKey) != managedByTagValue || owner == "" {
+		return description
+	}
+
+	base, _, _ := parseExpiry(description)
+
+	return owner + description[len(base):]
+}
+
+// describeOwnedRules returns the group's ingress or, with egress, egress CIDR rules
+// whose owner description satisfies match, including their rule IDs. Tagged and
+// untagged rules are told apart on one listing of the group's rules, rather than a
+// tag-filtered query plus a fallback one.
+func describeOwnedRules(ctx context.Context, client EC2API, sgID string, egress bool, match func(string) bool) ([]OwnedRule, error) {
+	sgRules, err := describeGroupRules(ctx, client, sgID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ownedRulesFromList(sgRules, egress, match), nil
+}
+
+// describeGroupRules lists all of the group's rules.
+func describeGroupRules(ctx context.Context, client EC2API, sgID string) ([]types.SecurityGroupRule, error) {
+	input := &ec2.DescribeSecurityGroupRulesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("group-id"),
+				Values: []string{sgID},
+			},
+		},
+	}
+
+	var sgRules []types.SecurityGroupRule
+
+	paginator := ec2.NewDescribeSecurityGroupRulesPaginator(client, input)
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] Failed to describe security group rules: %w", sgID, wrapAPIError(err))
+		}
+
+		sgRules = append(sgRules, page.SecurityGroupRules...)
+	}
+
+	return sgRules, nil
+}
+
+// ownedRulesFromList picks the ingress or, with egress, egress CIDR rules of a
+// describeGroupRules listing whose owner description satisfies match.
+func ownedRulesFromList(sgRules []types.SecurityGroupRule, egress bool, match func(string) bool) []OwnedRule {
+	var rules []OwnedRule
+
+	for _, sgRule := range sgRules {
+		if aws.ToBool(sgRule.IsEgress) != egress || !match(ruleOwnerDescription(sgRule)) {
+			continue
+		}
+
+		if sgRule.CidrIpv4 == nil && sgRule.CidrIpv6 == nil {
+			continue
+		}
+
+		rules = append(rules, ownedRuleFromSecurityGroupRule(sgRule))
+	}
+
+	return rules
+}
+
+// quotaRuleCount counts the rules of a describeGroupRules listing that count toward
+// the group's quota in one direction and isIPv6's family: those with a CIDR of that
+// family, and those referencing a group or prefix list, which count in both.
+func quotaRuleCount(sgRules []types.SecurityGroupRule, egress, isIPv6 bool) int {
+	count := 0
+
+	for _, sgRule := range sgRules {
+		if aws.ToBool(sgRule.IsEgress) != egress {
+			continue
+		}
+
+		switch {
+		case sgRule.CidrIpv4 != nil:
+			if !isIPv6 {
+				count++
+			}
+		case sgRule.CidrIpv6 != nil:
+			if isIPv6 {
+				count++
+			}
+		default:
+			count++
+		}
+	}
+
+	return count
+}
+
+// groupQuotaRuleCount is quotaRuleCount over a described group's permissions.
+func groupQuotaRuleCount(group types.SecurityGroup, egress, isIPv6 bool) int {
+	perms := group.IpPermissions
+	if egress {
+		perms = group.IpPermissionsEgress
+	}
+
+	count := 0
+
+	for _, perm := range perms {
+		if isIPv6 {
+			count += len(perm.Ipv6Ranges)
+		} else {
+			count += len(perm.IpRanges)
+		}
+
+		count += len(perm.UserIdGroupPairs) + len(perm.PrefixListIds)
+	}
+
+	return count
+}
+
+// anyDescription matches every rule, whoever it belongs to.
+func anyDescription(string) bool {
+	return true
+}
+
+// coveringRule finds a rule that is not ours, whatever its description, allowing
+// everything rule does from a range containing targetCidr, if any.
+func coveringRule(rules []OwnedRule, rule RuleSpec, targetCidr string, isOwn func(string) bool) *OwnedRule {
+	target, err := netip.ParsePrefix(targetCidr)
+	if err != nil {
+		return nil
+	}
+
+	for _, owned := range rules {
+		if isOwn(owned.Description) || !rule.coveredBy(owned.Permission) {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(owned.Cidr)
+		if err == nil && prefix.Bits() <= target.Bits() && prefix.Contains(target.Addr()) {
+			return &owned
+		}
+	}
+
+	return nil
+}
+
+// openRules picks the rules in isIPv6's family that allow the whole internet,
+// 0.0.0.0/0 or ::/0, any of the traffic rule allows, which makes a rule for a
+// single address pointless.
+func openRules(rules []OwnedRule, isIPv6 bool, rule RuleSpec) []OwnedRule {
+	var open []OwnedRule
+
+	for _, owned := range rules {
+		if owned.IPv6 == isIPv6 && (owned.Cidr == "0.0.0.0/0" || owned.Cidr == "::/0") && rule.overlaps(owned.Permission) {
+			open = append(open, owned)
+		}
+	}
+
+	return open
+}
+
+// retryChange calls fn until it succeeds, fails with a non-retryable error or runs out
+// of attempts, sleeping with jittered exponential backoff in between. It returns the
+// number of retries made.
+func retryChange(ctx context.Context, logger *slog.Logger, operation string, fn func() error) (int, error) {
+	delay := changeRetryBaseDelay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+
+		var apiErr smithy.APIError
+		if err == nil || attempt == changeRetryAttempts || !errors.As(err, &apiErr) || !retryableErrorCodes[apiErr.ErrorCode()] {
+			return attempt - 1, err
+		}
+
+		wait := delay/2 + rand.N(delay)
+		logger.Debug("Retrying throttled EC2 call", "operation", operation, "code", apiErr.ErrorCode(), "wait", wait.Round(time.Millisecond), "attempt", attempt+1, "max_attempts", changeRetryAttempts)
+
+		select {
+		case <-ctx.Done():
+			return attempt - 1, fmt.Errorf("%w (while waiting to retry after: %v)", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+	}
+}
+
+// ruleOwnerTags are the tags of a rule authorized under description.
+func ruleOwnerTags(description string) []types.Tag {
+	return []types.Tag{
+		{Key: aws.String(managedByTagKey), Value: aws.String(managedByTagValue)},
+		{Key: aws.String(ownerTagKey), Value: aws.String(description)},
+	}
+}
+
+// authorizePermissions authorizes perms as ingress or, with egress, egress rules
+// carrying tags, retrying throttled attempts. The two directions differ only in the
+// call made, so every authorize goes through here.
+func authorizePermissions(ctx context.Context, client EC2API, sgID string, egress bool, perms []types.IpPermission, tags []types.Tag) (int, []string, error) {
+	logger := groupLogger(ctx, client, sgID)
+	tagSpecifications := []types.TagSpecification{{ResourceType: types.ResourceTypeSecurityGroupRule, Tags: tags}}
+
+	var created []types.SecurityGroupRule
+
+	if egress {
+		input := &ec2.AuthorizeSecurityGroupEgressInput{GroupId: aws.String(sgID), IpPermissions: perms, TagSpecifications: tagSpecifications}
+		logRequest(ctx, logger, "AuthorizeSecurityGroupEgress", input)
+
+		retries, err := retryChange(ctx, logger, "AuthorizeSecurityGroupEgress", func() error {
+			out, err := client.AuthorizeSecurityGroupEgress(ctx, input)
+			if err == nil {
+				created = out.SecurityGroupRules
+			}
+
+			return err
+		})
+
+		return retries, createdRuleIDs(created), err
+	}
+
+	input := &ec2.AuthorizeSecurityGroupIngressInput{GroupId: aws.String(sgID), IpPermissions: perms, TagSpecifications: tagSpecifications}
+	logRequest(ctx, logger, "AuthorizeSecurityGroupIngress", input)
+
+	retries, err := retryChange(ctx, logger, "AuthorizeSecurityGroupIngress", func() error {
+		out, err := client.AuthorizeSecurityGroupIngress(ctx, input)
+		if err == nil {
+			created = out.SecurityGroupRules
+		}
+
+		return err
+	})
+
+	return retries, createdRuleIDs(created), err
+}
+
+func createdRuleIDs(rules []types.SecurityGroupRule) []string {
+	var ids []string
+
+	for _, rule := range rules {
+		if rule.SecurityGroupRuleId != nil {
+			ids = append(ids, *rule.SecurityGroupRuleId)
+		}
+	}
+
+	return ids
+}
+
+// revokeRuleIDs revokes ingress or, with egress, egress rules by ID, retrying
+// throttled attempts.
+func revokeRuleIDs(ctx context.Context, client EC2API, sgID string, egress bool, ruleIDs []string) (int, error) {
+	logger := groupLogger(ctx, client, sgID)
+
+	if egress {
+		input := &ec2.RevokeSecurityGroupEgressInput{GroupId: aws.String(sgID), SecurityGroupRuleIds: ruleIDs}
+		logRequest(ctx, logger, "RevokeSecurityGroupEgress", input)
+
+		return retryChange(ctx, logger, "RevokeSecurityGroupEgress", func() error {
+			_, err := client.RevokeSecurityGroupEgress(ctx, input)
+			return err
+		})
+	}
+
+	input := &ec2.RevokeSecurityGroupIngressInput{GroupId: aws.String(sgID), SecurityGroupRuleIds: ruleIDs}
+	logRequest(ctx, logger, "RevokeSecurityGroupIngress", input)
+
+	return retryChange(ctx, logger, "RevokeSecurityGroupIngress", func() error {
+		_, err := client.RevokeSecurityGroupIngress(ctx, input)
+		return err
+	})
+}
+
+// revokeOwnedRules revokes rules, with one call per direction they span.
+func revokeOwnedRules(ctx context.Context, client EC2API, sgID, description string, rules []OwnedRule) (int, error) {
+	logger := groupLogger(ctx, client, sgID)
+	total := 0
+
+	for _, egress := range []bool{false, true} {
+		var ruleIDs []string
+
+		for _, rule := range rules {
+			if rule.Egress == egress {
+				ruleIDs = append(ruleIDs, rule.RuleID)
+			}
+		}
+
+		if len(ruleIDs) == 0 {
+			continue
+		}
+
+		retries, err := revokeRuleIDs(ctx, client, sgID, egress, ruleIDs)
+		total += retries
+
+		if err != nil {
+			var apiErr *smithy.GenericAPIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.NotFound" {
+				logger.Warn("Rule to revoke was not found (maybe already deleted)", "error", err)
+				continue
+			}
+
+			return total, fmt.Errorf("[%s] Failed to revoke security group rule for '%s': %w", sgID, description, wrapAPIError(err))
+		}
+	}
+
+	return total, nil
+}
+
+// modifyOwnedRule rewrites an existing rule in place with the configured protocol,
+// ports and CIDR, so the old and new address are swapped atomically.
+func modifyOwnedRule(ctx context.Context, client EC2API, sgID, description string, owned OwnedRule, rule RuleSpec, targetCidrIP string) error {
+	request := &types.SecurityGroupRuleRequest{
+		IpProtocol:  aws.String(rule.Protocol),
+		FromPort:    aws.Int32(-1),
+		ToPort:      aws.Int32(-1),
+		Description: aws.String(description),
+	}
+
+	if rule.FromPort != nil {
+		request.FromPort = rule.FromPort
+		request.ToPort = rule.ToPort
+	}
+
+	if owned.IPv6 {
+		request.CidrIpv6 = aws.String(targetCidrIP)
+	} else {
+		request.CidrIpv4 = aws.String(targetCidrIP)
+	}
+
+	modifyInput := &ec2.ModifySecurityGroupRulesInput{
+		GroupId: aws.String(sgID),
+		SecurityGroupRules: []types.SecurityGroupRuleUpdate{
+			{
+				SecurityGroupRuleId: aws.String(owned.RuleID),
+				SecurityGroupRule:   request,
+			},
+		},
+	}
+
+	logRequest(ctx, groupLogger(ctx, client, sgID), "ModifySecurityGroupRules", modifyInput)
+
+	if _, err := client.ModifySecurityGroupRules(ctx, modifyInput); err != nil {
+		return fmt.Errorf("[%s] Failed to update security group rule %s for '%s': %w", sgID, owned.RuleID, description, wrapAPIError(err))
+	}
+
+	return nil
+}
+
+// tagSyncedGroup records on the group when it was last synced and which CIDR the
+// rule for description allows, for audits.
+func tagSyncedGroup(ctx context.Context, client EC2API, sgID, description, targetCidrIP string, now time.Time) error {
+	input := &ec2.CreateTagsInput{
+		Resources: []string{sgID},
+		Tags: []types.Tag{
+			{Key: aws.String(LastSyncTagKey), Value: aws.String(now.UTC().Format(time.RFC3339))},
+			{Key: aws.String(LastIPTagKey(description, strings.Contains(targetCidrIP, ":"))), Value: aws.String(targetCidrIP)},
+		},
+	}
+
+	logRequest(ctx, groupLogger(ctx, client, sgID), "CreateTags", input)
+
+	if _, err := client.CreateTags(ctx, input); err != nil {
+		return fmt.Errorf("[%s] Failed to tag security group: %w", sgID, wrapAPIError(err))
+	}
+
+	return nil
+}
+
+// tagOwnedRule tags an existing rule as ours under description, so that a rule
+// adopted from its legacy description is matched by the marker from then on.
+func tagOwnedRule(ctx context.Context, client EC2API, sgID string, owned OwnedRule, description string) error {
+	input := &ec2.CreateTagsInput{
+		Resources: []string{owned.RuleID},
+		Tags:      ruleOwnerTags(description),
+	}
+
+	logRequest(ctx, groupLogger(ctx, client, sgID), "CreateTags", input)
+
+	if _, err := client.CreateTags(ctx, input); err != nil {
+		return fmt.Errorf("[%s] Failed to tag security group rule %s: %w", sgID, owned.RuleID, wrapAPIError(err))
+	}
+
+	return nil
+}
+
+// authorizeAllowlist authorizes cidrs under rule in one call, as ranges of a single
+// permission, each with its own description.
+func authorizeAllowlist(ctx context.Context, client EC2API, sgID string, cidrs []string, description string, rule RuleSpec, settings Settings) (int, error) {
+	logger := groupLogger(ctx, client, sgID)
+	now := time.Now()
+
+	perm := types.IpPermission{
+		IpProtocol: aws.String(rule.Protocol),
+		FromPort:   rule.FromPort,
+		ToPort:     rule.ToPort,
+	}
+
+	for _, cidr := range cidrs {
+		ruleDescription := description
+		if settings.RuleDescription != nil {
+			ruleDescription = settings.RuleDescription(cidr)
+		}
+
+		if settings.TTL > 0 {
+			ruleDescription = withExpiry(ruleDescription, now.Add(settings.TTL))
+		}
+
+		if strings.Contains(cidr, ":") {
+			perm.Ipv6Ranges = append(perm.Ipv6Ranges, types.Ipv6Range{CidrIpv6: aws.String(cidr), Description: aws.String(ruleDescription)})
+		} else {
+			perm.IpRanges = append(perm.IpRanges, types.IpRange{CidrIp: aws.String(cidr), Description: aws.String(ruleDescription)})
+		}
+	}
+
+	logger.Info("Authorizing allowlist rules", "description", description, "count", len(cidrs))
+
+	retries, _, err := authorizePermissions(ctx, client, sgID, false, []types.IpPermission{perm}, ruleOwnerTags(description))
+	if err != nil {
+		// EC2 rejects the whole call when one range already exists, e.g. added
+		// concurrently; the next run authorizes the others.
+		return retries, fmt.Errorf("[%s] Failed to authorize the allowlist for '%s', outdated rules were left in place: %w", sgID, description, wrapAPIError(err))
+	}
+
+	logger.Info("Authorized allowlist rules", "description", description, "cidrs", strings.Join(cidrs, ", "))
+
+	return retries, nil
+}
+
+// syncAllowlist makes the group's rules with our description allow exactly cidrs
+// under rule: the missing CIDRs are authorized in one call, then every other rule
+// with our description is revoked.
+func syncAllowlist(ctx context.Context, client EC2API, sgID string, group *types.SecurityGroup, cidrs []string, description string, rule RuleSpec, settings Settings) (GroupResult, error) {
+	logger := groupLogger(ctx, client, sgID)
+	dryRun := settings.DryRun
+	isOwn := settings.owns(description)
+
+	result := GroupResult{
+		SgID:        sgID,
+		Description: description,
+		Rule:        rule,
+		DryRun:      dryRun,
+	}
+
+	var ownedRules []OwnedRule
+
+	if group != nil {
+		ownedRules = groupOwnedRules(*group, false, isOwn)
+	}
+
+	plan := planAllowlist(ownedRules, rule, cidrs)
+
+	// As for a single rule, the rules are described again before any change, since
+	// revoking them takes their rule IDs.
+	if group == nil || ((len(plan.Add) > 0 || len(plan.Revoke) > 0) && !dryRun) {
+		var err error
+
+		ownedRules, err = describeOwnedRules(ctx, client, sgID, false, isOwn)
+		if err != nil {
+			return result, err
+		}
+
+		plan = planAllowlist(ownedRules, rule, cidrs)
+	}
+
+	result.AuthorizeCidrs = plan.Add
+	result.Authorize = len(plan.Add) > 0
+	result.RevokeCidrs = ownedRuleCidrs(plan.Revoke)
+	result.Diff = plan.diff(rule)
+
+	logger.Info("Compared the allowlist with the group's rules", "description", description, "unchanged", len(plan.Keep), "to_authorize", len(plan.Add), "to_revoke", len(plan.Revoke))
+
+	if dryRun {
+		logger.Info("Dry run", "plan", result.Plan())
+		return result, nil
+	}
+
+	if err := stopped(ctx); err != nil {
+		return result, fmt.Errorf("[%s] interrupted before changing any rule: %w", sgID, err)
+	}
+
+	if len(plan.Add) > 0 {
+		retries, err := authorizeAllowlist(ctx, client, sgID, plan.Add, description, rule, settings)
+		result.Retries += retries
+
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if len(plan.Revoke) > 0 {
+		logger.Info("Revoking rules no longer in the allowlist", "description", description, "cidrs", strings.Join(result.RevokeCidrs, ", "))
+
+		retries, err := revokeOwnedRules(ctx, client, sgID, description, plan.Revoke)
+		result.Retries += retries
+
+		if err != nil {
+			return result, err
+		}
+
+		logger.Info("Revoked rules no longer in the allowlist", "description", description)
+	}
+
+	return result, nil
+}
+
+// relabelOwnedRule replaces the description of an existing rule, leaving the rule
+// itself untouched.
+func relabelOwnedRule(ctx context.Context, client EC2API, sgID string, owned OwnedRule, description string) error {
+	descriptions := []types.SecurityGroupRuleDescription{
+		{
+			SecurityGroupRuleId: aws.String(owned.RuleID),
+			Description:         aws.String(description),
+		},
+	}
+
+	var err error
+
+	if owned.Egress {
+		input := &ec2.UpdateSecurityGroupRuleDescriptionsEgressInput{GroupId: aws.String(sgID), SecurityGroupRuleDescriptions: descriptions}
+		logRequest(ctx, groupLogger(ctx, client, sgID), "UpdateSecurityGroupRuleDescriptionsEgress", input)
+		_, err = client.UpdateSecurityGroupRuleDescriptionsEgress(ctx, input)
+	} else {
+		input := &ec2.UpdateSecurityGroupRuleDescriptionsIngressInput{GroupId: aws.String(sgID), SecurityGroupRuleDescriptions: descriptions}
+		logRequest(ctx, groupLogger(ctx, client, sgID), "UpdateSecurityGroupRuleDescriptionsIngress", input)
+		_, err = client.UpdateSecurityGroupRuleDescriptionsIngress(ctx, input)
+	}
+
+	if err != nil {
+		return fmt.Errorf("[%s] Failed to update the description of security group rule %s: %w", sgID, owned.RuleID, wrapAPIError(err))
+	}
+
+	return nil
+}
+
+// syncSecurityGroupRule makes sure the group allows traffic from targetCidrIP or,
+// in the egress direction, to it under rule with our description, updating or
+// revoking outdated rules. With settings.TTL, a rule it authorizes or updates gets
+// an expiry marker; an existing rule's marker is left alone. With
+// settings.GracePeriod, outdated rules get a revoke deadline instead and are only
+// revoked by a later run once it has passed.
+func syncSecurityGroupRule(ctx context.Context, client EC2API, sgID string, group *types.SecurityGroup, targetCidrIP, description string, rule RuleSpec, direction Direction, settings Settings) (GroupResult, error) {
+	isIPv6 := strings.Contains(targetCidrIP, ":")
+	logger := groupLogger(ctx, client, sgID)
+	dryRun := settings.DryRun
+	now := time.Now()
+
+	isOwn := settings.owns(description)
+
+	ruleDescription := description
+	if settings.RuleDescription != nil {
+		ruleDescription = settings.RuleDescription(targetCidrIP)
+	}
+
+	result := GroupResult{
+		SgID:        sgID,
+		Description: ruleDescription,
+		Rule:        rule,
+		TargetCidr:  targetCidrIP,
+		DryRun:      dryRun,
+		Egress:      direction.egress(),
+	}
+
+	if settings.TTL > 0 {
+		ruleDescription = withExpiry(ruleDescription, now.Add(settings.TTL))
+	}
+
+	// allRules are every rule of the group in direction, checked for ranges that
+	// already cover the target; ruleCount is how many count toward its quota.
+	var ownedRules, allRules []OwnedRule
+	var ruleCount int
+
+	if group != nil {
+		ownedRules = claimRules(groupOwnedRules(*group, direction.egress(), isOwn), isIPv6, rule, settings.specs(rule))
+		allRules = groupOwnedRules(*group, direction.egress(), anyDescription)
+		ruleCount = groupQuotaRuleCount(*group, direction.egress(), isIPv6)
+	}
+
+	eval := evaluateOwnedRules(ownedRules, isIPv6, rule, targetCidrIP, settings.GracePeriod, now)
+	eval.Adopt = settings.adopts(description, eval.Current)
+
+	// The pre-fetched group carries neither rule IDs nor rule tags, so the rules are
+	// described again before any change, which also finds rules whose description was
+	// edited, or when nothing was pre-fetched.
+	if group == nil || ((eval.outdated() || eval.NeedsAdd) && !dryRun) {
+		logger.Info("Checking existing rules", "description", description)
+
+		sgRules, err := describeGroupRules(ctx, client, sgID)
+		if err != nil {
+			return result, err
+		}
+
+		ownedRules = claimRules(ownedRulesFromList(sgRules, direction.egress(), isOwn), isIPv6, rule, settings.specs(rule))
+		allRules = ownedRulesFromList(sgRules, direction.egress(), anyDescription)
+		ruleCount = quotaRuleCount(sgRules, direction.egress(), isIPv6)
+		eval = evaluateOwnedRules(ownedRules, isIPv6, rule, targetCidrIP, settings.GracePeriod, now)
+		eval.Adopt = settings.adopts(description, eval.Current)
+	} else {
+		logger.Debug("Using the rules fetched while resolving the group")
+	}
+
+	if covering := coveringRule(allRules, rule, targetCidrIP, isOwn); covering != nil && eval.Current == nil {
+		logger.Info("Address is already covered by a broader rule", "cidr", targetCidrIP, "covered_by", covering.Cidr, "covering_description", covering.Description, "skip", settings.SkipIfCovered)
+
+		if settings.SkipIfCovered {
+			result.CoveredBy = fmt.Sprintf("%s (description: %s)", covering.Cidr, covering.Description)
+			eval.skipAdd()
+		}
+	}
+
+	if eval.Current != nil {
+		logger.Info("Found existing rule with correct IP, no changes needed", "description", description, "cidr", targetCidrIP)
+	}
+
+	if eval.Modify != nil {
+		logger.Info("Found existing rule with outdated IP", "description", description, "cidr", eval.Modify.Cidr, "rule", DescribePermission(eval.Modify.Permission))
+	}
+
+	for _, stale := range slices.Concat(eval.Revoke, eval.Defer) {
+		logger.Info("Found existing rule with outdated IP", "description", description, "cidr", stale.Cidr, "rule", DescribePermission(stale.Permission))
+	}
+
+	for _, waiting := range eval.Waiting {
+		logger.Info("Keeping outdated rule until its grace period ends", "description", waiting.Description, "cidr", waiting.Cidr)
+	}
+
+	// Every group has an egress rule open to the internet by default, so only ingress
+	// is checked.
+	if !direction.egress() {
+		for _, open := range openRules(allRules, isIPv6, rule) {
+			warning := fmt.Sprintf("group already allows %s from %s, which covers the rule for %s", DescribePermission(open.Permission), open.Cidr, targetCidrIP)
+
+			if settings.FailOnOpen {
+				return result, fmt.Errorf("[%s] %s", sgID, warning)
+			}
+
+			logger.Warn("Group is open to the internet on the managed ports", "cidr", open.Cidr, "rule", DescribePermission(open.Permission), "description", open.Description)
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+
+	quota := settings.rulesQuota()
+	family := "IPv4"
+	if isIPv6 {
+		family = "IPv6"
+	}
+
+	if settings.QuotaMargin > 0 && ruleCount >= quota-settings.QuotaMargin {
+		warning := fmt.Sprintf("group has %d of its %d %s %s rules, within %d of the quota", ruleCount, quota, family, direction, settings.QuotaMargin)
+		logger.Warn("Group is close to its rules quota", "rules", ruleCount, "quota", quota, "family", family, "direction", direction)
+		result.Warnings = append(result.Warnings, warning)
+	}
+
+	ruleToModify := eval.Modify
+	staleRules := eval.Revoke
+	ruleNeedsAdding := eval.NeedsAdd
+
+	if ruleToModify != nil {
+		result.ModifiedCidr = ruleToModify.Cidr
+		result.RuleID = ruleToModify.RuleID
+	} else if eval.Current != nil {
+		result.RuleID = eval.Current.RuleID
+	}
+
+	result.RevokeCidrs = ownedRuleCidrs(staleRules)
+	result.DeferredCidrs = ownedRuleCidrs(eval.Defer)
+	result.Authorize = ruleNeedsAdding
+	result.Diff = eval.Diff
+
+	if dryRun {
+		logger.Info("Dry run", "plan", result.Plan())
+		return result, nil
+	}
+
+	if err := stopped(ctx); err != nil {
+		return result, fmt.Errorf("[%s] interrupted before changing any rule: %w", sgID, err)
+	}
+
+	if ruleToModify != nil {
+		logger.Info("Updating rule", "rule_id", ruleToModify.RuleID, "description", description, "from", ruleToModify.Cidr, "to", targetCidrIP)
+
+		if err := modifyOwnedRule(ctx, client, sgID, ruleDescription, *ruleToModify, rule, targetCidrIP); err != nil {
+			return result, err
+		}
+
+		logger.Info("Updated rule", "rule_id", ruleToModify.RuleID, "description", description, "cidr", targetCidrIP)
+
+		if settings.adopts(description, ruleToModify) {
+			if err := tagOwnedRule(ctx, client, sgID, *ruleToModify, description); err != nil {
+				warning := fmt.Sprintf("rule for %s was updated but not tagged with its managed-by marker: %v", targetCidrIP, err)
+				logger.Warn(warning)
+				result.Warnings = append(result.Warnings, warning)
+			}
+		}
+	}
+
+	// Authorize first so there is never a window without a rule for our IP; the
+	// stale rules are only revoked once the new one is in place.
+	if ruleNeedsAdding {
+		logger.Info("Authorizing rule", "description", description, "cidr", targetCidrIP, "direction", direction)
+
+		perm := permissionWithCidrs(types.IpPermission{
+			IpProtocol: aws.String(rule.Protocol),
+			FromPort:   rule.FromPort,
+			ToPort:     rule.ToPort,
+		}, []string{targetCidrIP}, ruleDescription, isIPv6)
+
+		retries, ruleIDs, err := authorizePermissions(ctx, client, sgID, direction.egress(), []types.IpPermission{perm}, ruleOwnerTags(description))
+		result.Retries += retries
+
+		if len(ruleIDs) > 0 {
+			result.RuleID = ruleIDs[0]
+		}
+
+		if err != nil {
+			var apiErr *smithy.GenericAPIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.Duplicate" {
+				logger.Info("Rule already exists (possibly added concurrently), no changes needed", "cidr", targetCidrIP)
+			} else if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RulesPerSecurityGroupLimitExceeded" {
+				// Nothing was revoked yet, so the rules for earlier addresses still allow
+				// access; only a quota increase or fewer rules lets the new one in.
+				return result, fmt.Errorf("[%s] Failed to authorize security group rule for '%s': the group already has %d of its %d %s %s rules, outdated rules were left in place: %w", sgID, description, ruleCount, quota, family, direction, wrapAPIError(err))
+			} else {
+				return result, fmt.Errorf("[%s] Failed to authorize security group rule for '%s', outdated rules were left in place: %w", sgID, description, wrapAPIError(err))
+			}
+		} else {
+			logger.Info("Authorized rule", "description", description, "cidr", targetCidrIP)
+		}
+	}
+
+	if settings.VerifyTimeout > 0 && (ruleToModify != nil || ruleNeedsAdding) {
+		propagation, err := verifyRule(ctx, client, sgID, direction.egress(), isOwn, rule, targetCidrIP, settings.VerifyTimeout)
+		result.Propagation = propagation
+
+		if err != nil {
+			return result, err
+		}
+
+		logger.Info("Verified rule", "cidr", targetCidrIP, "propagation", propagation.Round(time.Millisecond))
+	}
+
+	if settings.TagGroups && (ruleToModify != nil || ruleNeedsAdding) {
+		if err := tagSyncedGroup(ctx, client, sgID, description, targetCidrIP, now); err != nil {
+			warning := fmt.Sprintf("rule for %s is in place but the group could not be tagged: %v", targetCidrIP, err)
+			logger.Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+
+	if eval.Adopt {
+		// The new description keeps the rule's expiry, as for any current rule, but not
+		// a revoke deadline: the rule is back in use.
+		label := result.Description
+		if _, expires, ok := parseExpiry(eval.Current.Description); ok {
+			label = withExpiry(label, expires)
+		}
+
+		err := relabelOwnedRule(ctx, client, sgID, *eval.Current, label)
+		if err == nil {
+			err = tagOwnedRule(ctx, client, sgID, *eval.Current, description)
+		}
+
+		if err != nil {
+			warning := fmt.Sprintf("rule for %s was found by its legacy description but could not be given the managed-by marker, the next run will try again: %v", targetCidrIP, err)
+			logger.Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+		} else {
+			logger.Info("Gave the rule found by its legacy description the managed-by marker", "cidr", targetCidrIP, "description", label)
+		}
+	} else if eval.Unmark {
+		base, _, _ := parseMarker(eval.Current.Description, revokeAfterMarker)
+
+		if err := relabelOwnedRule(ctx, client, sgID, *eval.Current, base); err != nil {
+			warning := fmt.Sprintf("rule for %s is back in use but its revoke deadline could not be cleared: %v", targetCidrIP, err)
+			logger.Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+		} else {
+			logger.Info("Cleared the revoke deadline of the rule back in use", "cidr", targetCidrIP)
+		}
+	}
+
+	// The old rules stay for the grace period; a later run revokes them once the
+	// deadline in their description has passed.
+	for _, owned := range eval.Defer {
+		deadline := now.Add(settings.GracePeriod)
+
+		if err := relabelOwnedRule(ctx, client, sgID, owned, withMarker(owned.Description, revokeAfterMarker, deadline)); err != nil {
+			warning := fmt.Sprintf("outdated rule for %s could not be given a revoke deadline, the next run will try again: %v", owned.Cidr, err)
+			logger.Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+		} else {
+			logger.Info("Keeping outdated rule for the grace period", "cidr", owned.Cidr, "revoke_after", deadline.UTC().Format(markerLayout))
+		}
+	}
+
+	// The rule for our IP is in place at this point, so an interrupt only leaves the
+	// outdated rules behind for the next run to clean up.
+	if err := stopped(ctx); err != nil && len(staleRules) > 0 {
+		if errors.Is(err, ErrFailFast) {
+			warning := fmt.Sprintf("new rule for %s is in place but outdated rule(s) %s were left for the next run, as another group failed", targetCidrIP, strings.Join(result.RevokeCidrs, ", "))
+			logger.Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+			result.RevokeCidrs = nil
+
+			return result, nil
+		}
+
+		return result, fmt.Errorf("[%s] interrupted before revoking outdated rule(s) %s: %w", sgID, strings.Join(result.RevokeCidrs, ", "), err)
+	}
+
+	if len(staleRules) > 0 {
+		logger.Info("Revoking outdated rules", "description", description, "cidrs", strings.Join(result.RevokeCidrs, ", "))
+
+		retries, err := revokeOwnedRules(ctx, client, sgID, description, staleRules)
+		result.Retries += retries
+
+		if err != nil {
+			warning := fmt.Sprintf("new rule for %s is in place but outdated rule(s) %s could not be revoked: %v", targetCidrIP, strings.Join(result.RevokeCidrs, ", "), err)
+			logger.Warn(warning)
+			result.Warnings = append(result.Warnings, warning)
+			result.RevokeCidrs = nil
+		} else {
+			logger.Info("Revoked outdated rules", "description", description)
+		}
+	}
+
+	return result, nil
+}
+
+// verifyRule polls the group's rules until the rule for targetCidrIP whose
+// description satisfies isOwn is visible, and returns how long that took. EC2 is eventually
+// consistent, so a rule can be missing from describe calls for a while after the
+// call that added it succeeded.
+func verifyRule(ctx context.Context, client EC2API, sgID string, egress bool, isOwn func(string) bool, rule RuleSpec, targetCidrIP string, timeout time.Duration) (time.Duration, error) {
+	logger := groupLogger(ctx, client, sgID)
+	start := time.Now()
+
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for delay := verifyPollDelay; ; delay = min(delay*2, verifyMaxPollDelay) {
+		ownedRules, err := describeOwnedRules(pollCtx, client, sgID, egress, isOwn)
+		if err == nil {
+			for _, owned := range ownedRules {
+				if owned.Cidr == targetCidrIP && rule.matches(owned.Permission) {
+					return time.Since(start), nil
+				}
+			}
+
+			logger.Debug("Rule is not visible yet", "cidr", targetCidrIP, "elapsed", time.Since(start).Round(time.Millisecond))
+		} else if pollCtx.Err() == nil {
+			logger.Debug("Could not describe rules while verifying, will try again", "error", err)
+		}
+
+		select {
+		case <-pollCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return time.Since(start), fmt.Errorf("[%s] interrupted while verifying the rule for %s: %w", sgID, targetCidrIP, err)
+			}
+
+			return time.Since(start), fmt.Errorf("[%s] rule for %s was put in place but is still not visible after %s", sgID, targetCidrIP, timeout)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// removeSecurityGroupRules revokes every rule in direction in the group whose
+// description satisfies isOwn, in both address families and under any protocol or
+// port range.
+func removeSecurityGroupRules(ctx context.Context, client EC2API, sgID string, group *types.SecurityGroup, description string, isOwn func(string) bool, direction Direction, dryRun bool) (GroupResult, error) {
+	result := GroupResult{
+		SgID:        sgID,
+		Description: description,
+		DryRun:      dryRun,
+		Removal:     true,
+		Egress:      direction.egress(),
+	}
+
+	return revokeMatchingRules(ctx, client, group, result, isOwn)
+}
+
+// pruneSecurityGroupRules revokes the rules left behind under earlier names: every
+// rule whose description starts with prefix, except those isOwn matches.
+func pruneSecurityGroupRules(ctx context.Context, client EC2API, sgID string, group *types.SecurityGroup, prefix string, isOwn func(string) bool, dryRun bool) (GroupResult, error) {
+	result := GroupResult{
+		SgID:        sgID,
+		Description: prefix + "*",
+		DryRun:      dryRun,
+		Removal:     true,
+		Pruned:      true,
+	}
+
+	return revokeMatchingRules(ctx, client, group, result, func(ruleDescription string) bool {
+		return strings.HasPrefix(ruleDescription, prefix) && !isOwn(ruleDescription)
+	})
+}
+
+// cleanExpiredRules revokes every rule whose description starts with prefix and
+// carries an expiry marker that has passed, whoever's name is on it.
+func cleanExpiredRules(ctx context.Context, client EC2API, sgID string, group *types.SecurityGroup, prefix string, dryRun bool) (GroupResult, error) {
+	result := GroupResult{
+		SgID:        sgID,
+		Description: prefix + "*",
+		DryRun:      dryRun,
+		Removal:     true,
+		Expired:     true,
+	}
+
+	now := time.Now()
+
+	return revokeMatchingRules(ctx, client, group, result, func(ruleDescription string) bool {
+		_, expires, hasExpiry := parseExpiry(ruleDescription)
+		return strings.HasPrefix(ruleDescription, prefix) && hasExpiry && !expires.After(now)
+	})
+}
+
+// RevokeRuleIDs revokes the rules with the given IDs from the group, in one
+// direction, as a removal labelled with description. IDs the group no longer has,
+// such as rules revoked by a later sync, are skipped rather than failing the call.
+func RevokeRuleIDs(ctx context.Context, client EC2API, sgID, description string, egress bool, ruleIDs []string) (GroupResult, error) {
+	result := GroupResult{
+		SgID:        sgID,
+		Description: description,
+		Removal:     true,
+		Egress:      egress,
+	}
+
+	sgRules, err := describeGroupRules(ctx, client, sgID)
+	if err != nil {
+		return result, err
+	}
+
+	var ownedRules []OwnedRule
+
+	for _, sgRule := range sgRules {
+		if aws.ToBool(sgRule.IsEgress) == egress && slices.Contains(ruleIDs, aws.ToString(sgRule.SecurityGroupRuleId)) {
+			ownedRules = append(ownedRules, ownedRuleFromSecurityGroupRule(sgRule))
+		}
+	}
+
+	result.RevokeCidrs = ownedRuleCidrs(ownedRules)
+
+	for _, owned := range ownedRules {
+		result.Diff = append(result.Diff, RuleChange{'-', owned.String()})
+	}
+
+	logger := groupLogger(ctx, client, sgID)
+
+	if len(ownedRules) == 0 {
+		logger.Info("Rules are already gone, nothing to remove", "rule_ids", strings.Join(ruleIDs, ", "))
+		return result, nil
+	}
+
+	retries, err := revokeOwnedRules(ctx, client, sgID, description, ownedRules)
+	result.Retries = retries
+
+	if err != nil {
+		return result, err
+	}
+
+	logger.Info("Removed rules", "count", len(ownedRules), "description", description)
+	return result, nil
+}
+
+// revokeMatchingRules revokes every rule in result's group, in result's direction,
+// whose description satisfies match, and records them in result. result.Description
+// labels the rules in logs; rules with another description are listed with their
+// own.
+func revokeMatchingRules(ctx context.Context, client EC2API, group *types.SecurityGroup, result GroupResult, match func(string) bool) (GroupResult, error) {
+	sgID := result.SgID
+	logger := groupLogger(ctx, client, sgID)
+	logger.Info("Looking for rules to remove", "description", result.Description)
+
+	var ownedRules []OwnedRule
+
+	if group != nil {
+		ownedRules = groupOwnedRules(*group, result.Egress, match)
+	}
+
+	// Revoking needs rule IDs, which only a fresh describe provides.
+	if group == nil || (len(ownedRules) > 0 && !result.DryRun) {
+		var err error
+
+		ownedRules, err = describeOwnedRules(ctx, client, sgID, result.Egress, match)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.RevokeCidrs = ownedRuleCidrs(ownedRules)
+
+	for _, owned := range ownedRules {
+		line := owned.String()
+		if owned.Description != result.Description {
+			line += fmt.Sprintf(" (%s)", owned.Description)
+		}
+
+		result.Diff = append(result.Diff, RuleChange{'-', line})
+	}
+
+	if len(ownedRules) == 0 {
+		logger.Info("No rules found, nothing to remove", "description", result.Description)
+		return result, nil
+	}
+
+	for _, owned := range ownedRules {
+		logger.Info("Found rule to remove", "description", owned.Description, "cidr", owned.Cidr, "rule", DescribePermission(owned.Permission))
+	}
+
+	if result.DryRun {
+		logger.Info("Dry run", "plan", result.Plan())
+		return result, nil
+	}
+
+	if err := stopped(ctx); err != nil {
+		return result, fmt.Errorf("[%s] interrupted before revoking any rule: %w", sgID, err)
+	}
+
+	retries, err := revokeOwnedRules(ctx, client, sgID, result.Description, ownedRules)
+	result.Retries = retries
+
+	if err != nil {
+		return result, err
+	}
+
+	logger.Info("Removed rules", "count", len(ownedRules), "description", result.Description)
+	return result, nil
+}
+
+// prefixListConflictCodes are the errors ModifyManagedPrefixList returns when the
+// list changed since it was read, or is still being modified.
+var prefixListConflictCodes = map[string]bool{
+	"IncorrectState":            true,
+	"PrefixListVersionMismatch": true,
+}
+
+// doctorCidr is the documentation address (RFC 5737) CheckPermissions names in its
+// dry-run calls; nothing is ever authorized for it.
+const doctorCidr = "192.0.2.1/32"
+
+// PermissionCheck is whether the credentials may make one EC2 call against a group.
+// Allowed and Missing are both false when the answer was inconclusive; Err then
+// says why.
+type PermissionCheck struct {
+	Action  string
+	Allowed bool
+	Missing bool
+	Err     error
+}
+
+// dryRunCheck reads the answer to a call made with DryRun: EC2 answers
+// DryRunOperation when IAM would allow it and UnauthorizedOperation when it would
+// not.
+func dryRunCheck(action string, err error) PermissionCheck {
+	check := PermissionCheck{Action: action}
+
+	var apiErr smithy.APIError
+
+	switch {
+	case err == nil, errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation":
+		check.Allowed = true
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "UnauthorizedOperation":
+		check.Missing = true
+		check.Err = wrapAPIError(err)
+	default:
+		check.Err = wrapAPIError(err)
+	}
+
+	return check
+}
+
+// CheckPermissions finds out which of the calls a sync makes against the group the
+// credentials are allowed. The rules are described for real; every change is made
+// with DryRun, so nothing is modified. Updating a rule can only be tried on an
+// existing rule with our description, and is inconclusive without one.
+func CheckPermissions(ctx context.Context, client EC2API, sgID, description string, rule RuleSpec) []PermissionCheck {
+	perm := permissionWithCidrs(types.IpPermission{
+		IpProtocol: aws.String(rule.Protocol),
+		FromPort:   rule.FromPort,
+		ToPort:     rule.ToPort,
+	}, []string{doctorCidr}, description, false)
+
+	var checks []PermissionCheck
+
+	ownedRules, err := describeOwnedRules(ctx, client, sgID, false, OwnDescription(description))
+	describeCheck := dryRunCheck("ec2:DescribeSecurityGroupRules", err)
+	if err != nil && !describeCheck.Missing {
+		describeCheck.Err = err
+	}
+
+	checks = append(checks, describeCheck)
+
+	_, err = client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		DryRun:        aws.Bool(true),
+		GroupId:       aws.String(sgID),
+		IpPermissions: []types.IpPermission{perm},
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSecurityGroupRule,
+				Tags: []types.Tag{
+					{Key: aws.String(managedByTagKey), Value: aws.String(managedByTagValue)},
+					{Key: aws.String(ownerTagKey), Value: aws.String(description)},
+				},
+			},
+		},
+	})
+	checks = append(checks, dryRunCheck("ec2:AuthorizeSecurityGroupIngress", err))
+
+	_, err = client.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+		DryRun:        aws.Bool(true),
+		GroupId:       aws.String(sgID),
+		IpPermissions: []types.IpPermission{perm},
+	})
+	checks = append(checks, dryRunCheck("ec2:RevokeSecurityGroupIngress", err))
+
+	_, err = client.CreateTags(ctx, &ec2.CreateTagsInput{
+		DryRun:    aws.Bool(true),
+		Resources: []string{sgID},
+		Tags:      []types.Tag{{Key: aws.String(LastSyncTagKey), Value: aws.String(time.Now().UTC().Format(time.RFC3339))}},
+	})
+	checks = append(checks, dryRunCheck("ec2:CreateTags", err))
+
+	if len(ownedRules) == 0 {
+		noRule := fmt.Errorf("not checked, the group has no rule described '%s' to try it on", description)
+
+		return append(checks,
+			PermissionCheck{Action: "ec2:ModifySecurityGroupRules", Err: noRule},
+			PermissionCheck{Action: "ec2:UpdateSecurityGroupRuleDescriptionsIngress", Err: noRule},
+		)
+	}
+
+	owned := ownedRules[0]
+
+	_, err = client.ModifySecurityGroupRules(ctx, &ec2.ModifySecurityGroupRulesInput{
+		DryRun:  aws.Bool(true),
+		GroupId: aws.String(sgID),
+		SecurityGroupRules: []types.SecurityGroupRuleUpdate{
+			{
+				SecurityGroupRuleId: aws.String(owned.RuleID),
+				SecurityGroupRule:   ruleRequest(owned),
+			},
+		},
+	})
+	checks = append(checks, dryRunCheck("ec2:ModifySecurityGroupRules", err))
+
+	_, err = client.UpdateSecurityGroupRuleDescriptionsIngress(ctx, &ec2.UpdateSecurityGroupRuleDescriptionsIngressInput{
+		DryRun:  aws.Bool(true),
+		GroupId: aws.String(sgID),
+		SecurityGroupRuleDescriptions: []types.SecurityGroupRuleDescription{
+			{
+				SecurityGroupRuleId: aws.String(owned.RuleID),
+				Description:         aws.String(owned.Description),
+			},
+		},
+	})
+	checks = append(checks, dryRunCheck("ec2:UpdateSecurityGroupRuleDescriptionsIngress", err))
+
+	return checks
+}
+
+// ruleRequest describes an existing rule as it is, for a ModifySecurityGroupRules
+// call that changes nothing.
+func ruleRequest(owned OwnedRule) *types.SecurityGroupRuleRequest {
+	request := &types.SecurityGroupRuleRequest{
+		IpProtocol:  owned.Permission.IpProtocol,
+		FromPort:    aws.Int32(-1),
+		ToPort:      aws.Int32(-1),
+		Description: aws.String(owned.Description),
+	}
+
+	if owned.Permission.FromPort != nil {
+		request.FromPort = owned.Permission.FromPort
+		request.ToPort = owned.Permission.ToPort
+	}
+
+	if owned.IPv6 {
+		request.CidrIpv6 = aws.String(owned.Cidr)
+	} else {
+		request.CidrIpv4 = aws.String(owned.Cidr)
+	}
+
+	return request
+}
+
+// Backup is a snapshot of the rules a run may change, taken before it changes any
+// so that RollbackGroup can put them back.
+type Backup struct {
+	CreatedAt time.Time     `json:"created_at"`
+	Groups    []GroupBackup `json:"groups"`
+}
+
+// GroupBackup holds one group's ingress CIDR rules whose description is
+// Description, with or without markers, or starts with Prefix. A rollback never
+// touches the group's other rules.
+type GroupBackup struct {
+	Profile     string `json:"profile,omitempty"`
+	Region      string `json:"region"`
+	SgID        string `json:"sg_id"`
+	Description string `json:"description,omitempty"`
+	// Match says how rules are matched to Description.
+	Match  Match        `json:"match,omitempty"`
+	Prefix string       `json:"prefix,omitempty"`
+	Rules  []BackupRule `json:"rules"`
+}
+
+// BackupRule is one rule as EC2 described it. The ports are left out for protocols
+// that have none.
+type BackupRule struct {
+	Protocol    string `json:"protocol"`
+	FromPort    *int32 `json:"from_port,omitempty"`
+	ToPort      *int32 `json:"to_port,omitempty"`
+	Cidr        string `json:"cidr"`
+	Description string `json:"description"`
+}
+
+func backupRuleFromOwned(owned OwnedRule) BackupRule {
+	return BackupRule{
+		Protocol:    aws.ToString(owned.Permission.IpProtocol),
+		FromPort:    owned.Permission.FromPort,
+		ToPort:      owned.Permission.ToPort,
+		Cidr:        owned.Cidr,
+		Description: owned.Description,
+	}
+}
+
+func (r BackupRule) permission() types.IpPermission {
+	return types.IpPermission{IpProtocol: aws.String(r.Protocol), FromPort: r.FromPort, ToPort: r.ToPort}
+}
+
+// key identifies the rule regardless of its description: EC2 allows only one rule
+// per protocol, port range and CIDR.
+func (r BackupRule) key() string {
+	return fmt.Sprintf("%s %s %s", NormalizeProtocol(r.Protocol), r.portRange(), r.Cidr)
+}
+
+func (r BackupRule) portRange() string {
+	if r.FromPort == nil || r.ToPort == nil {
+		return "-"
+	}
+
+	return fmt.Sprintf("%d-%d", *r.FromPort, *r.ToPort)
+}
+
+func (r BackupRule) String() string {
+	return fmt.Sprintf("%s from %s (%s)", DescribePermission(r.permission()), r.Cidr, r.Description)
+}
+
+func (b GroupBackup) matches(ruleDescription string) bool {
+	return b.owns(ruleDescription) || (b.Prefix != "" && strings.HasPrefix(ruleDescription, b.Prefix))
+}
+
+// owns reports whether ruleDescription is under the backup's own description.
+func (b GroupBackup) owns(ruleDescription string) bool {
+	return b.Description != "" && b.Match.Owns(b.Description)(ruleDescription)
+}
+
+// SnapshotGroup fills backup.Rules with the group's current rules in its scope.
+func SnapshotGroup(ctx context.Context, client EC2API, backup GroupBackup) (GroupBackup, error) {
+	ownedRules, err := describeOwnedRules(ctx, client, backup.SgID, false, backup.matches)
+	if err != nil {
+		return backup, err
+	}
+
+	backup.Rules = make([]BackupRule, 0, len(ownedRules))
+
+	for _, owned := range ownedRules {
+		backup.Rules = append(backup.Rules, backupRuleFromOwned(owned))
+	}
+
+	return backup, nil
+}
+
+// RollbackGroup puts the group's rules in backup's scope back the way backup
+// recorded them: rules revoked since are authorized again, rules added since are
+// revoked, and rules whose description changed get the recorded one back. Rules
+// are authorized before any is revoked, and once the group matches the backup a
+// second rollback changes nothing.
+func RollbackGroup(ctx context.Context, client EC2API, backup GroupBackup, dryRun bool) (GroupResult, error) {
+	sgID := backup.SgID
+	logger := groupLogger(ctx, client, sgID)
+
+	result := GroupResult{
+		SgID:        sgID,
+		Description: backup.Description,
+		DryRun:      dryRun,
+		Restored:    true,
+	}
+
+	current, err := describeOwnedRules(ctx, client, sgID, false, backup.matches)
+	if err != nil {
+		return result, err
+	}
+
+	currentByKey := make(map[string]OwnedRule, len(current))
+
+	for _, owned := range current {
+		currentByKey[backupRuleFromOwned(owned).key()] = owned
+	}
+
+	type relabel struct {
+		owned       OwnedRule
+		description string
+	}
+
+	var missing []BackupRule
+	var relabels []relabel
+	var added []OwnedRule
+
+	backedUp := make(map[string]bool, len(backup.Rules))
+
+	for _, rule := range backup.Rules {
+		backedUp[rule.key()] = true
+		owned, found := currentByKey[rule.key()]
+
+		switch {
+		case !found:
+			missing = append(missing, rule)
+			result.Diff = append(result.Diff, RuleChange{Op: '+', Rule: rule.String()})
+		case owned.Description != rule.Description:
+			relabels = append(relabels, relabel{owned: owned, description: rule.Description})
+			result.Diff = append(result.Diff, RuleChange{Op: '-', Rule: backupRuleFromOwned(owned).String()}, RuleChange{Op: '+', Rule: rule.String()})
+		default:
+			result.Diff = append(result.Diff, RuleChange{Op: ' ', Rule: rule.String()})
+		}
+	}
+
+	for _, owned := range current {
+		if !backedUp[backupRuleFromOwned(owned).key()] {
+			added = append(added, owned)
+			result.Diff = append(result.Diff, RuleChange{Op: '-', Rule: backupRuleFromOwned(owned).String()})
+		}
+	}
+
+	result.Authorize = len(missing) > 0
+	result.RevokeCidrs = ownedRuleCidrs(added)
+
+	if dryRun {
+		logger.Info("Dry run", "plan", result.Plan())
+		return result, nil
+	}
+
+	for _, rule := range missing {
+		if err := restoreRule(ctx, client, backup, rule); err != nil {
+			return result, err
+		}
+
+		logger.Info("Restored rule", "rule", rule)
+	}
+
+	for _, change := range relabels {
+		if err := relabelOwnedRule(ctx, client, sgID, change.owned, change.description); err != nil {
+			return result, err
+		}
+
+		logger.Info("Restored rule description", "cidr", change.owned.Cidr, "description", change.description)
+	}
+
+	if len(added) > 0 {
+		retries, err := revokeOwnedRules(ctx, client, sgID, backup.Description, added)
+		result.Retries += retries
+
+		if err != nil {
+			return result, err
+		}
+
+		logger.Info("Revoked rules added since the backup", "cidrs", strings.Join(result.RevokeCidrs, ", "))
+	}
+
+	return result, nil
+}
+
+// restoreRule authorizes a backed-up rule again. Only rules under the backup's own
+// description get the owner tag, so that rules restored under other names are not
+// mistaken for ours later.
+func restoreRule(ctx context.Context, client EC2API, backup GroupBackup, rule BackupRule) error {
+	tags := ruleOwnerTags(backup.Description)
+
+	if !backup.owns(rule.Description) {
+		tags = tags[:1]
+	}
+
+	logger := groupLogger(ctx, client, backup.SgID)
+	perm := permissionWithCidrs(rule.permission(), []string{rule.Cidr}, rule.Description, strings.Contains(rule.Cidr, ":"))
+
+	_, _, err := authorizePermissions(ctx, client, backup.SgID, false, []types.IpPermission{perm}, tags)
+	if err != nil {
+		var apiErr *smithy.GenericAPIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.Duplicate" {
+			logger.Info("Rule already exists (possibly restored concurrently)", "rule", rule)
+			return nil
+		}
+
+		return fmt.Errorf("[%s] Failed to restore rule %s: %w", backup.SgID, rule, wrapAPIError(err))
+	}
+
+	return nil
+}
+
+// SyncPrefixList keeps the entries of a customer-managed prefix list that carry our
+// description set to targetCidrs, in one ModifyManagedPrefixList call. When the list
+// changed concurrently it is read again and the change retried once. The prefix list
+// is reported like a group, so the usual summary applies.
+func SyncPrefixList(ctx context.Context, client EC2API, prefixListID string, targetCidrs []string, description string, dryRun bool) Result {
+	report := Result{
+		TargetCidrs: targetCidrs,
+		GroupCount:  1,
+		Description: description,
+		DryRun:      dryRun,
+	}
+
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		report.Results, err = updatePrefixList(ctx, client, prefixListID, targetCidrs, description, dryRun)
+
+		var apiErr smithy.APIError
+		if err == nil || attempt == 2 || !errors.As(err, &apiErr) || !prefixListConflictCodes[apiErr.ErrorCode()] {
+			break
+		}
+
+		loggerFrom(ctx).Warn("Prefix list changed while updating it, reading it again", "prefix_list_id", prefixListID, "code", apiErr.ErrorCode())
+	}
+
+	if err != nil {
+		loggerFrom(ctx).Error("Prefix list sync failed", "prefix_list_id", prefixListID, "error", err)
+		report.Errors = []error{fmt.Errorf("[%s] %w", prefixListID, err)}
+
+		for i := range report.Results {
+			report.Results[i].Err = err
+		}
+	} else {
+		report.SuccessCount = 1
+	}
+
+	return report
+}
+
+// planReplacement records on r how a list holding plain CIDRs changes: the stale
+// addresses go and the target is added unless current. Replacing one address is a
+// single change, reported like a rule updated in place.
+func (r *GroupResult) planReplacement(current bool, stale []string) {
+	if current {
+		r.Diff = append(r.Diff, RuleChange{' ', r.TargetCidr})
+	}
+
+	for _, cidr := range stale {
+		r.Diff = append(r.Diff, RuleChange{'-', cidr})
+	}
+
+	switch {
+	case current:
+		r.RevokeCidrs = stale
+	case len(stale) > 0:
+		r.Diff = append(r.Diff, RuleChange{'+', r.TargetCidr})
+		r.ModifiedCidr = stale[0]
+		r.RevokeCidrs = stale[1:]
+	default:
+		r.Diff = append(r.Diff, RuleChange{'+', r.TargetCidr})
+		r.Authorize = true
+	}
+}
+
+// updatePrefixList reads the prefix list and its entries, works out the entries to
+// add and remove for each target CIDR of the list's address family, and applies
+// them against the version that was read.
+func updatePrefixList(ctx context.Context, client EC2API, prefixListID string, targetCidrs []string, description string, dryRun bool) ([]GroupResult, error) {
+	logger := loggerFrom(ctx).With("prefix_list_id", prefixListID, "region", client.Options().Region)
+
+	described, err := client.DescribeManagedPrefixLists(ctx, &ec2.DescribeManagedPrefixListsInput{
+		PrefixListIds: []string{prefixListID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the prefix list: %w", wrapAPIError(err))
+	}
+
+	if len(described.PrefixLists) == 0 {
+		return nil, fmt.Errorf("prefix list not found")
+	}
+
+	prefixList := described.PrefixLists[0]
+	listIPv6 := aws.ToString(prefixList.AddressFamily) == "IPv6"
+	isOwn := OwnDescription(description)
+
+	var owned []types.PrefixListEntry
+
+	paginator := ec2.NewGetManagedPrefixListEntriesPaginator(client, &ec2.GetManagedPrefixListEntriesInput{
+		PrefixListId:  aws.String(prefixListID),
+		TargetVersion: prefixList.Version,
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the prefix list entries: %w", wrapAPIError(err))
+		}
+
+		for _, entry := range page.Entries {
+			if isOwn(aws.ToString(entry.Description)) {
+				owned = append(owned, entry)
+			}
+		}
+	}
+
+	var results []GroupResult
+	var addEntries []types.AddPrefixListEntry
+	var removeEntries []types.RemovePrefixListEntry
+
+	for _, targetCidr := range targetCidrs {
+		isIPv6 := strings.Contains(targetCidr, ":")
+		if isIPv6 != listIPv6 {
+			logger.Warn("Skipping address of the other family", "cidr", targetCidr, "address_family", aws.ToString(prefixList.AddressFamily))
+			continue
+		}
+
+		result := GroupResult{
+			SgID:        prefixListID,
+			GroupName:   aws.ToString(prefixList.PrefixListName),
+			Description: description,
+			TargetCidr:  targetCidr,
+			DryRun:      dryRun,
+		}
+
+		current := false
+		var stale []string
+
+		for _, entry := range owned {
+			cidr := aws.ToString(entry.Cidr)
+
+			switch {
+			case strings.Contains(cidr, ":") != isIPv6:
+			case cidr == targetCidr:
+				current = true
+			default:
+				stale = append(stale, cidr)
+			}
+		}
+
+		if !current {
+			addEntries = append(addEntries, types.AddPrefixListEntry{Cidr: aws.String(targetCidr), Description: aws.String(description)})
+		}
+
+		for _, cidr := range stale {
+			removeEntries = append(removeEntries, types.RemovePrefixListEntry{Cidr: aws.String(cidr)})
+		}
+
+		result.planReplacement(current, stale)
+		logger.Info("Checked prefix list entries", "cidr", targetCidr, "plan", result.Plan())
+		results = append(results, result)
+	}
+
+	if dryRun || (len(addEntries) == 0 && len(removeEntries) == 0) {
+		return results, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return results, fmt.Errorf("interrupted before changing the prefix list: %w", err)
+	}
+
+	modifyInput := &ec2.ModifyManagedPrefixListInput{
+		PrefixListId:   aws.String(prefixListID),
+		CurrentVersion: prefixList.Version,
+		AddEntries:     addEntries,
+		RemoveEntries:  removeEntries,
+	}
+
+	logRequest(ctx, logger, "ModifyManagedPrefixList", modifyInput)
+
+	if _, err := client.ModifyManagedPrefixList(ctx, modifyInput); err != nil {
+		return results, fmt.Errorf("failed to modify the prefix list: %w", wrapAPIError(err))
+	}
+
+	logger.Info("Updated prefix list", "version", aws.ToInt64(prefixList.Version), "added", len(addEntries), "removed", len(removeEntries))
+
+	return results, nil
+}
+
+// lightsailPortRange is the Lightsail protocol and port range for rule, which
+// names every protocol "all" and needs explicit ports.
+func lightsailPortRange(rule RuleSpec) (lightsailtypes.NetworkProtocol, int32, int32) {
+	protocol := lightsailtypes.NetworkProtocol(rule.Protocol)
+	if rule.Protocol == "-1" {
+		protocol = lightsailtypes.NetworkProtocolAll
+	}
+
+	if rule.FromPort == nil || protocol == lightsailtypes.NetworkProtocolAll {
+		return protocol, 0, 65535
+	}
+
+	return protocol, *rule.FromPort, *rule.ToPort
+}
+
+// mergeLightsailPorts returns the complete firewall to write back for an instance
+// whose current port states are states: every port state unchanged, except that
+// the one for protocol and ports loses the stale addresses and gains the missing
+// target CIDRs. It is added when no port state matches. The lists are copied
+// non-nil, because PutInstancePublicPorts opens a port to everyone when its cidrs
+// are left out.
+func mergeLightsailPorts(states []lightsailtypes.InstancePortState, protocol lightsailtypes.NetworkProtocol, fromPort, toPort int32, targetCidrs, stale []string) []lightsailtypes.PortInfo {
+	infos := make([]lightsailtypes.PortInfo, 0, len(states)+1)
+	matched := false
+
+	for _, state := range states {
+		info := lightsailtypes.PortInfo{
+			Protocol:        state.Protocol,
+			FromPort:        state.FromPort,
+			ToPort:          state.ToPort,
+			Cidrs:           append([]string{}, state.Cidrs...),
+			Ipv6Cidrs:       append([]string{}, state.Ipv6Cidrs...),
+			CidrListAliases: append([]string{}, state.CidrListAliases...),
+		}
+
+		if !matched && state.Protocol == protocol && state.FromPort == fromPort && state.ToPort == toPort {
+			matched = true
+			isStale := func(cidr string) bool { return slices.Contains(stale, cidr) }
+			info.Cidrs = slices.DeleteFunc(info.Cidrs, isStale)
+			info.Ipv6Cidrs = slices.DeleteFunc(info.Ipv6Cidrs, isStale)
+			info.Cidrs, info.Ipv6Cidrs = withTargetCidrs(info.Cidrs, info.Ipv6Cidrs, targetCidrs)
+		}
+
+		infos = append(infos, info)
+	}
+
+	if !matched {
+		info := lightsailtypes.PortInfo{Protocol: protocol, FromPort: fromPort, ToPort: toPort, CidrListAliases: []string{}}
+		info.Cidrs, info.Ipv6Cidrs = withTargetCidrs([]string{}, []string{}, targetCidrs)
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// withTargetCidrs appends the target CIDRs missing from the IPv4 or IPv6 list.
+func withTargetCidrs(cidrs, ipv6Cidrs, targetCidrs []string) ([]string, []string) {
+	for _, targetCidr := range targetCidrs {
+		switch {
+		case strings.Contains(targetCidr, ":"):
+			if !slices.Contains(ipv6Cidrs, targetCidr) {
+				ipv6Cidrs = append(ipv6Cidrs, targetCidr)
+			}
+		case !slices.Contains(cidrs, targetCidr):
+			cidrs = append(cidrs, targetCidr)
+		}
+	}
+
+	return cidrs, ipv6Cidrs
+}
+
+// SyncLightsailInstance keeps targetCidrs allowed for rule in the firewall of a
+// Lightsail instance. Firewall entries have no descriptions, so the addresses we
+// added are recorded in tags on the instance, as with a WAFv2 IPSet. The instance is
+// reported like a group, so the usual summary applies.
+func SyncLightsailInstance(ctx context.Context, client *lightsail.Client, instance string, targetCidrs []string, description string, rule RuleSpec, dryRun bool) Result {
+	report := Result{
+		TargetCidrs: targetCidrs,
+		GroupCount:  1,
+		Rule:        rule,
+		Description: description,
+		DryRun:      dryRun,
+	}
+
+	var err error
+
+	report.Results, err = updateLightsailPorts(ctx, client, instance, targetCidrs, description, rule, dryRun)
+	if err != nil {
+		loggerFrom(ctx).Error("Lightsail firewall sync failed", "instance", instance, "error", err)
+		report.Errors = []error{fmt.Errorf("[%s] %w", instance, err)}
+
+		for i := range report.Results {
+			report.Results[i].Err = err
+		}
+	} else {
+		report.SuccessCount = 1
+	}
+
+	return report
+}
+
+// updateLightsailPorts reads the instance's tags and port states, and writes the
+// whole firewall back with our previous addresses replaced. PutInstancePublicPorts
+// replaces every port state, so the write is built from the states just read and
+// skipped when nothing would change.
+func updateLightsailPorts(ctx context.Context, client *lightsail.Client, instance string, targetCidrs []string, description string, rule RuleSpec, dryRun bool) ([]GroupResult, error) {
+	logger := loggerFrom(ctx).With("instance", instance, "region", client.Options().Region)
+
+	got, err := client.GetInstance(ctx, &lightsail.GetInstanceInput{InstanceName: aws.String(instance)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the instance: %w", err)
+	}
+
+	var previous []string
+
+	for _, tag := range got.Instance.Tags {
+		if key := aws.ToString(tag.Key); key == LastIPTagKey(description, false) || key == LastIPTagKey(description, true) {
+			previous = append(previous, strings.Fields(aws.ToString(tag.Value))...)
+		}
+	}
+
+	ports, err := client.GetInstancePortStates(ctx, &lightsail.GetInstancePortStatesInput{InstanceName: aws.String(instance)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the firewall: %w", err)
+	}
+
+	protocol, fromPort, toPort := lightsailPortRange(rule)
+
+	var allowed []string
+
+	for _, state := range ports.PortStates {
+		if state.Protocol == protocol && state.FromPort == fromPort && state.ToPort == toPort {
+			allowed = slices.Concat(state.Cidrs, state.Ipv6Cidrs)
+			break
+		}
+	}
+
+	var results []GroupResult
+	var stale []string
+
+	for _, targetCidr := range targetCidrs {
+		isIPv6 := strings.Contains(targetCidr, ":")
+
+		var targetStale []string
+
+		for _, cidr := range previous {
+			if strings.Contains(cidr, ":") == isIPv6 && !slices.Contains(targetCidrs, cidr) && slices.Contains(allowed, cidr) {
+				targetStale = append(targetStale, cidr)
+			}
+		}
+
+		result := GroupResult{
+			SgID:        instance,
+			GroupName:   instance,
+			Description: description,
+			TargetCidr:  targetCidr,
+			DryRun:      dryRun,
+		}
+		result.planReplacement(slices.Contains(allowed, targetCidr), targetStale)
+
+		logger.Info("Checked firewall", "cidr", targetCidr, "plan", result.Plan())
+		results = append(results, result)
+		stale = append(stale, targetStale...)
+	}
+
+	portsChanged := slices.ContainsFunc(results, GroupResult.Changed)
+	tagsChanged := !slices.Equal(slices.Sorted(slices.Values(previous)), slices.Sorted(slices.Values(targetCidrs)))
+
+	if dryRun || (!portsChanged && !tagsChanged) {
+		return results, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return results, fmt.Errorf("interrupted before changing the firewall: %w", err)
+	}
+
+	if portsChanged {
+		putInput := &lightsail.PutInstancePublicPortsInput{
+			InstanceName: aws.String(instance),
+			PortInfos:    mergeLightsailPorts(ports.PortStates, protocol, fromPort, toPort, targetCidrs, stale),
+		}
+
+		logRequest(ctx, logger, "PutInstancePublicPorts", putInput)
+
+		if _, err := client.PutInstancePublicPorts(ctx, putInput); err != nil {
+			return results, fmt.Errorf("failed to update the firewall: %w", err)
+		}
+
+		logger.Info("Updated firewall", "port_states", len(putInput.PortInfos))
+	}
+
+	var tags []lightsailtypes.Tag
+
+	for _, ipv6 := range []bool{false, true} {
+		var cidrs []string
+
+		for _, cidr := range targetCidrs {
+			if strings.Contains(cidr, ":") == ipv6 {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+
+		if len(cidrs) > 0 {
+			tags = append(tags, lightsailtypes.Tag{Key: aws.String(LastIPTagKey(description, ipv6)), Value: aws.String(strings.Join(cidrs, " "))})
+		}
+	}
+
+	if _, err := client.TagResource(ctx, &lightsail.TagResourceInput{ResourceName: aws.String(instance), Tags: tags}); err != nil {
+		logger.Warn("Failed to record our addresses on the instance", "error", err)
+	}
+
+	return results, nil
+}
+
+// route53TTL is the TTL of the --route53-record records, short so that resolvers
+// pick up a new IP quickly.
+const route53TTL = 60
+
+// SyncRoute53Record upserts the A and AAAA records of name in zoneID to point at
+// targetCidrs in one change batch. A record that already holds only the IP is left
+// alone. The record is reported like a group, with the previous addresses as the
+// modified and revoked CIDRs.
+func SyncRoute53Record(ctx context.Context, client *route53.Client, zoneID, name string, targetCidrs []string, dryRun bool) Result {
+	report := Result{
+		Record:      name,
+		TargetCidrs: targetCidrs,
+		GroupCount:  1,
+		DryRun:      dryRun,
+	}
+
+	var err error
+
+	report.Results, err = upsertRecords(ctx, client, zoneID, name, targetCidrs, dryRun)
+	report.Interrupted = ctx.Err() != nil
+	report.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+
+	if err != nil {
+		loggerFrom(ctx).Error("Route53 record update failed", "record", name, "error", err)
+		report.Errors = []error{fmt.Errorf("[%s] %w", name, err)}
+
+		for i := range report.Results {
+			report.Results[i].Err = err
+		}
+	} else {
+		report.SuccessCount = 1
+	}
+
+	return report
+}
+
+// upsertRecords reads the current A or AAAA record for each target CIDR and
+// upserts the ones that do not already hold just that IP.
+func upsertRecords(ctx context.Context, client *route53.Client, zoneID, name string, targetCidrs []string, dryRun bool) ([]GroupResult, error) {
+	logger := loggerFrom(ctx).With("zone_id", zoneID, "record", name)
+
+	var results []GroupResult
+	var changes []route53types.Change
+
+	for _, targetCidr := range targetCidrs {
+		ip, _, _ := strings.Cut(targetCidr, "/")
+
+		recordType := route53types.RRTypeA
+		if strings.Contains(ip, ":") {
+			recordType = route53types.RRTypeAaaa
+		}
+
+		existing, err := client.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+			HostedZoneId:    aws.String(zoneID),
+			StartRecordName: aws.String(name),
+			StartRecordType: recordType,
+			MaxItems:        aws.Int32(1),
+		})
+		if err != nil {
+			return results, fmt.Errorf("failed to read the %s record: %w", recordType, err)
+		}
+
+		current := false
+		var stale []string
+
+		for _, set := range existing.ResourceRecordSets {
+			if set.Type != recordType || !strings.EqualFold(strings.TrimSuffix(aws.ToString(set.Name), "."), strings.TrimSuffix(name, ".")) {
+				continue
+			}
+
+			for _, value := range set.ResourceRecords {
+				if aws.ToString(value.Value) == ip {
+					current = true
+				} else {
+					stale = append(stale, HostCIDR(aws.ToString(value.Value)))
+				}
+			}
+		}
+
+		result := GroupResult{
+			SgID:       zoneID,
+			GroupName:  name,
+			TargetCidr: targetCidr,
+			DryRun:     dryRun,
+		}
+		result.planReplacement(current, stale)
+
+		if !current || len(stale) > 0 {
+			changes = append(changes, route53types.Change{
+				Action: route53types.ChangeActionUpsert,
+				ResourceRecordSet: &route53types.ResourceRecordSet{
+					Name:            aws.String(name),
+					Type:            recordType,
+					TTL:             aws.Int64(route53TTL),
+					ResourceRecords: []route53types.ResourceRecord{{Value: aws.String(ip)}},
+				},
+			})
+		}
+
+		logger.Info("Checked DNS record", "type", recordType, "ip", ip, "plan", result.Plan())
+		results = append(results, result)
+	}
+
+	if dryRun || len(changes) == 0 {
+		return results, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return results, fmt.Errorf("interrupted before changing the record: %w", err)
+	}
+
+	changeInput := &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &route53types.ChangeBatch{
+			Comment: aws.String("aws-sg-updater"),
+			Changes: changes,
+		},
+	}
+
+	logRequest(ctx, logger, "ChangeResourceRecordSets", changeInput)
+
+	if _, err := client.ChangeResourceRecordSets(ctx, changeInput); err != nil {
+		return results, fmt.Errorf("failed to upsert the record: %w", err)
+	}
+
+	logger.Info("Updated DNS record", "changes", len(changes), "ttl", route53TTL)
+
+	return results, nil
+}
+
+// WAFIPSet identifies a WAFv2 IPSet given as --wafv2-ipset "name|id|scope".
+type WAFIPSet struct {
+	Name  string
+	ID    string
+	Scope wafv2types.Scope
+}
+
+// ParseWAFIPSet parses the --wafv2-ipset value.
+func ParseWAFIPSet(value string) (*WAFIPSet, error) {
+	parts := strings.Split(value, "|")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%q is not name|id|scope", value)
+	}
+
+	set := &WAFIPSet{
+		Name:  strings.TrimSpace(parts[0]),
+		ID:    strings.TrimSpace(parts[1]),
+		Scope: wafv2types.Scope(strings.ToUpper(strings.TrimSpace(parts[2]))),
+	}
+
+	if set.Name == "" || set.ID == "" {
+		return nil, fmt.Errorf("%q needs both a name and an id", value)
+	}
+
+	if set.Scope != wafv2types.ScopeRegional && set.Scope != wafv2types.ScopeCloudfront {
+		return nil, fmt.Errorf("scope %q must be REGIONAL or CLOUDFRONT", parts[2])
+	}
+
+	return set, nil
+}
+
+// NewWAFClient returns a WAFv2 client for the IPSet's scope. CLOUDFRONT IPSets only
+// exist in us-east-1, whatever region is configured.
+func NewWAFClient(cfg aws.Config, set *WAFIPSet) *wafv2.Client {
+	return wafv2.NewFromConfig(cfg, func(o *wafv2.Options) {
+		if set.Scope == wafv2types.ScopeCloudfront {
+			o.Region = "us-east-1"
+		}
+	})
+}
+
+// SyncWAFIPSet keeps the addresses we added to a WAFv2 IPSet set to targetCidrs.
+// IPSet addresses have no descriptions, so the addresses we own are recorded in a
+// tag on the IPSet named after our description. When the IPSet changed since it was
+// read the update is retried once with a fresh lock token. The IPSet is reported
+// like a group, so the usual summary applies.
+func SyncWAFIPSet(ctx context.Context, client *wafv2.Client, set *WAFIPSet, targetCidrs []string, description string, dryRun bool) Result {
+	report := Result{
+		TargetCidrs: targetCidrs,
+		GroupCount:  1,
+		Description: description,
+		DryRun:      dryRun,
+	}
+
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		report.Results, err = updateWAFIPSet(ctx, client, set, targetCidrs, description, dryRun)
+
+		var lockErr *wafv2types.WAFOptimisticLockException
+		if err == nil || attempt == 2 || !errors.As(err, &lockErr) {
+			break
+		}
+
+		loggerFrom(ctx).Warn("IPSet changed while updating it, reading it again", "ipset", set.Name)
+	}
+
+	if err != nil {
+		loggerFrom(ctx).Error("IPSet sync failed", "ipset", set.Name, "error", err)
+		report.Errors = []error{fmt.Errorf("[%s] %w", set.Name, err)}
+
+		for i := range report.Results {
+			report.Results[i].Err = err
+		}
+	} else {
+		report.SuccessCount = 1
+	}
+
+	return report
+}
+
+// updateWAFIPSet reads the IPSet and the tag recording our previous addresses,
+// replaces those with the target CIDRs of the IPSet's address family, and writes the
+// addresses back under the lock token that was read before updating the tag.
+func updateWAFIPSet(ctx context.Context, client *wafv2.Client, set *WAFIPSet, targetCidrs []string, description string, dryRun bool) ([]GroupResult, error) {
+	logger := loggerFrom(ctx).With("ipset", set.Name, "scope", set.Scope, "region", client.Options().Region)
+
+	got, err := client.GetIPSet(ctx, &wafv2.GetIPSetInput{
+		Name:  aws.String(set.Name),
+		Id:    aws.String(set.ID),
+		Scope: set.Scope,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the IPSet: %w", err)
+	}
+
+	ipSet := got.IPSet
+	setIPv6 := ipSet.IPAddressVersion == wafv2types.IPAddressVersionIpv6
+	tagKey := LastIPTagKey(description, setIPv6)
+
+	tags, err := client.ListTagsForResource(ctx, &wafv2.ListTagsForResourceInput{
+		ResourceARN: ipSet.ARN,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the IPSet tags: %w", err)
+	}
+
+	var previous []string
+
+	if tags.TagInfoForResource != nil {
+		for _, tag := range tags.TagInfoForResource.TagList {
+			if aws.ToString(tag.Key) == tagKey {
+				previous = strings.Fields(aws.ToString(tag.Value))
+			}
+		}
+	}
+
+	var results []GroupResult
+	var owned []string
+	addresses := ipSet.Addresses
+
+	for _, targetCidr := range targetCidrs {
+		if strings.Contains(targetCidr, ":") != setIPv6 {
+			logger.Warn("Skipping address of the other family", "cidr", targetCidr, "address_family", ipSet.IPAddressVersion)
+			continue
+		}
+
+		owned = append(owned, targetCidr)
+
+		result := GroupResult{
+			SgID:        set.ID,
+			GroupName:   set.Name,
+			Description: description,
+			TargetCidr:  targetCidr,
+			DryRun:      dryRun,
+		}
+
+		var stale []string
+
+		for _, cidr := range previous {
+			if cidr != targetCidr && !slices.Contains(targetCidrs, cidr) && slices.Contains(addresses, cidr) {
+				stale = append(stale, cidr)
+			}
+		}
+
+		current := slices.Contains(addresses, targetCidr)
+
+		addresses = slices.DeleteFunc(slices.Clone(addresses), func(cidr string) bool {
+			return slices.Contains(stale, cidr)
+		})
+		if !current {
+			addresses = append(addresses, targetCidr)
+		}
+
+		result.planReplacement(current, stale)
+		logger.Info("Checked IPSet addresses", "cidr", targetCidr, "plan", result.Plan())
+		results = append(results, result)
+	}
+
+	addressesChanged := !slices.Equal(addresses, ipSet.Addresses)
+	tagChanged := !slices.Equal(previous, owned)
+
+	if dryRun || (!addressesChanged && !tagChanged) {
+		return results, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return results, fmt.Errorf("interrupted before changing the IPSet: %w", err)
+	}
+
+	if addressesChanged {
+		// UpdateIPSet replaces every mutable field, so the description is sent back.
+		updateInput := &wafv2.UpdateIPSetInput{
+			Name:        aws.String(set.Name),
+			Id:          aws.String(set.ID),
+			Scope:       set.Scope,
+			Addresses:   addresses,
+			Description: ipSet.Description,
+			LockToken:   got.LockToken,
+		}
+
+		logRequest(ctx, logger, "UpdateIPSet", updateInput)
+
+		if _, err := client.UpdateIPSet(ctx, updateInput); err != nil {
+			return results, fmt.Errorf("failed to update the IPSet: %w", err)
+		}
+
+		logger.Info("Updated IPSet", "addresses", len(addresses))
+	}
+
+	_, err = client.TagResource(ctx, &wafv2.TagResourceInput{
+		ResourceARN: ipSet.ARN,
+		Tags:        []wafv2types.Tag{{Key: aws.String(tagKey), Value: aws.String(strings.Join(owned, " "))}},
+	})
+	if err != nil {
+		logger.Warn("Failed to record our addresses on the IPSet", "tag", tagKey, "error", err)
+	}
+
+	return results, nil
+}
+
+// Target is one set of security groups to keep a rule in, together with the
+// rule's description and shape. The flags describe one target; a config file can
+// define several named ones.
+type Target struct {
+	Name        string
+	Description string
+	Rule        RuleSpec
+	SgIDs       []string
+	SgTagNames  []string
+	// ExtraRules are synced alongside Rule, each as its own rule under the same
+	// description.
+	ExtraRules []RuleSpec
+	// SgTags must all match a group for it to be selected by tag, together with
+	// SgTagNames when both are set.
+	SgTags []TagFilter
+	// SgNames selects groups by group name, in any VPC unless VpcID is set.
+	SgNames []string
+	// VpcID, when set, restricts tag and name matches to one VPC and requires every
+	// explicit ID to belong to it.
+	VpcID string
+	// ExcludeIDs are dropped after resolution, however they were selected.
+	ExcludeIDs []string
+	// InstanceIDs select the groups attached to the network interfaces of these
+	// EC2 instances.
+	InstanceIDs []string
+	// LoadBalancers select the groups attached to these ALBs or NLBs, given by name
+	// or ARN.
+	LoadBalancers []string
+	// OwnerID, when set, is the account the groups must belong to. Tag and name
+	// matches owned by another account are dropped; an explicit ID is an error.
+	OwnerID string
+}
+
+// OptOutTagKey and OptOutTagValue mark a group the tool must never modify.
+const (
+	OptOutTagKey   = "sg-updater:ignore"
+	OptOutTagValue = "true"
+)
+
+// Rules the tool authorizes carry these tags, so they stay recognisable as ours even
+// when someone edits their description.
+const (
+	managedByTagKey   = "managed-by"
+	managedByTagValue = "aws-sg-updater"
+	ownerTagKey       = "owner"
+)
+
+// LastSyncTagKey is the --tag-groups tag holding when a group's rule was last put in
+// place.
+const LastSyncTagKey = "sg-updater:last-sync"
+
+// LastIPTagKey is the --tag-groups tag holding the CIDR last authorized for
+// description, with a separate key for IPv6 so dual-stack runs keep both.
+func LastIPTagKey(description string, ipv6 bool) string {
+	if ipv6 {
+		return "sg-updater:last-ipv6-for-" + description
+	}
+
+	return "sg-updater:last-ip-for-" + description
+}
+
+// guardrails are organisation-level checks applied to every resolved group,
+// whichever selector picked it.
+type Guardrails struct {
+	// IgnoreOptOut disables the opt-out tag check, for break-glass use.
+	IgnoreOptOut bool
+	// RequireTag, when set, must be carried by every group the tool modifies.
+	RequireTag *TagFilter
+	// Strict turns a group skipped for lacking RequireTag into a failure.
+	Strict bool
+}
+
+// Apply returns the groups that pass the guardrails and the IDs of those that do not,
+// logging a warning for each group dropped. In strict mode it also returns an error
+// for each group skipped for lacking the required tag.
+func (g Guardrails) Apply(ctx context.Context, region string, groups []types.SecurityGroup) ([]types.SecurityGroup, []string, []error) {
+	var kept []types.SecurityGroup
+	var skipped []string
+	var violations []error
+
+	for _, sg := range groups {
+		id := aws.ToString(sg.GroupId)
+
+		if HasTag(sg.Tags, OptOutTagKey, OptOutTagValue) {
+			if !g.IgnoreOptOut {
+				loggerFrom(ctx).Warn("Skipping opted-out group (use --ignore-opt-out to override)", "sg_id", id, "region", region, "tag", OptOutTagKey+"="+OptOutTagValue)
+				skipped = append(skipped, id)
+
+				continue
+			}
+
+			loggerFrom(ctx).Warn("Modifying opted-out group because of --ignore-opt-out", "sg_id", id, "region", region, "tag", OptOutTagKey+"="+OptOutTagValue)
+		}
+
+		if g.RequireTag != nil && !HasTag(sg.Tags, g.RequireTag.Key, g.RequireTag.Value) {
+			loggerFrom(ctx).Warn("GROUP WILL NOT BE MODIFIED: it does not carry the required tag", "sg_id", id, "region", region, "tag", g.RequireTag.String())
+			skipped = append(skipped, id)
+
+			if g.Strict {
+				violations = append(violations, fmt.Errorf("[%s] missing required tag %s", id, g.RequireTag))
+			}
+
+			continue
+		}
+
+		kept = append(kept, sg)
+	}
+
+	return kept, skipped, violations
+}
+
+// TagValue returns the value of the tag key, or "" when it is not set.
+func TagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+
+	return ""
+}
+
+// HasTag reports whether the tag key is set to value.
+func HasTag(tags []types.Tag, key, value string) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key && aws.ToString(tag.Value) == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Result collects the outcome of one pass over every target security group.
+type Result struct {
+	Name         string
+	TargetCidrs  []string
+	IPSource     string
+	Results      []GroupResult
+	Errors       []error
+	SuccessCount int
+	GroupCount   int
+	Resolution   ResolutionStats
+	Rule         RuleSpec
+	Description  string
+	Profile      string
+	Role         string
+	Region       string
+	DryRun       bool
+	Remove       bool
+	// ExtraRules are the rules synced alongside Rule, if any.
+	ExtraRules []RuleSpec
+	// Directions are the directions the rules were synced in.
+	Directions []Direction
+	// Deleted lists the groups skipped because they were deleted after they were
+	// resolved; they count neither as synced nor as failed.
+	Deleted []string
+	// NotAttempted lists the groups left undone, wholly or in part, because another
+	// group failed first with Settings.FailFast; they count neither as synced nor
+	// as failed.
+	NotAttempted []string
+	// Durations holds how long each group took to sync, by group ID; groups not
+	// attempted have none.
+	Durations map[string]time.Duration
+	// PrunePrefix is the --prune-prefix of rules pruned alongside the sync, if any.
+	PrunePrefix string
+	// ExpiredPrefix is the --prefix of a clean-expired run.
+	ExpiredPrefix string
+	// Record is the --route53-record of a report on the DNS record rather than groups.
+	Record string
+	// Backup is the backup file a rollback restored.
+	Backup      string
+	Interrupted bool
+	// TimedOut is set with Interrupted when the context's deadline, rather than a
+	// cancellation, cut the run short.
+	TimedOut bool
+}
+
+// ActionCounts counts the results by Action. Prune passes that found nothing to
+// revoke are left out, as they only ride along with the sync of the same group.
+func (r Result) ActionCounts() map[Action]int {
+	counts := make(map[Action]int)
+
+	for _, result := range r.Results {
+		if result.Pruned && result.Err == nil && !result.Changed() {
+			continue
+		}
+
+		counts[result.Action()]++
+	}
+
+	return counts
+}
+
+// Retries totals the throttling retries of every result.
+func (r Result) Retries() int {
+	total := 0
+
+	for _, result := range r.Results {
+		total += result.Retries
+	}
+
+	return total
+}
+
+// Settings are the run-wide choices SyncAll applies to every group.
+type Settings struct {
+	DryRun bool
+	Remove bool
+	// PrunePrefix, when set, also revokes rules left under earlier names.
+	PrunePrefix string
+	// PruneKeep, when set, spares the rules it matches from PrunePrefix besides our
+	// own, e.g. those of the other members of a roster.
+	PruneKeep func(string) bool
+	// ExpiredPrefix, when set, revokes expired rules whose description starts with it.
+	ExpiredPrefix string
+	// TTL, when set, gives the rules the sync authorizes or updates an expiry marker.
+	TTL time.Duration
+	// GracePeriod, when set, keeps outdated rules this long instead of revoking them.
+	GracePeriod time.Duration
+	// TagGroups tags a group with the last sync time and CIDR after a rule is put in
+	// place.
+	TagGroups bool
+	// MaxConcurrency bounds how many groups are synced at once; below 1 they are
+	// synced one at a time.
+	MaxConcurrency int
+	// VerifyTimeout, when set, waits up to this long for each rule put in place to
+	// show up in describe calls, and fails the group if it does not.
+	VerifyTimeout time.Duration
+	// RuleDescription, when set, gives the text written on a rule put in place for a
+	// CIDR, e.g. a rendered description template. The description is then only what
+	// the rules are matched by, as Match says.
+	RuleDescription func(targetCidr string) string
+	Match           Match
+	// Allowlist syncs the target CIDRs as one set: each gets a rule with our
+	// description and every other rule with it is revoked, instead of each CIDR
+	// replacing the rules of its address family.
+	Allowlist bool
+	// ExtraRules are synced for every target CIDR after the rule itself, each as its
+	// own rule under the same description. Rules of a spec no longer given are
+	// updated to one still missing or revoked.
+	ExtraRules []RuleSpec
+	// RulesQuota is the account's quota of rules per group, per direction and
+	// address family; DefaultRulesQuota when unset.
+	RulesQuota int
+	// QuotaMargin, when set, warns about groups within this many rules of
+	// RulesQuota.
+	QuotaMargin int
+	// SkipIfCovered leaves the target unauthorized in a group where a rule that is
+	// not ours already allows it from a broader range; outdated rules of ours are
+	// still revoked.
+	SkipIfCovered bool
+	// Strict fails a group deleted between resolution and the sync, which is
+	// otherwise skipped.
+	Strict bool
+	// FailFast stops at the first group that fails: the groups not started yet are
+	// left alone, and those in progress make no further change. See WithFailFast.
+	FailFast bool
+	// FailOnOpen fails a group that already allows the whole internet any of the
+	// traffic the rule does, instead of only warning about it.
+	FailOnOpen bool
+	// Directions are the directions the rules are synced or removed in; without
+	// any, only ingress rules are. Pruning, clean-expired and allowlists only ever
+	// look at ingress rules.
+	Directions []Direction
+
+	// described holds the groups as described during resolution, for their names
+	// and VPCs in the logs even when their rules are described afresh.
+	described map[string]types.SecurityGroup
+}
+
+// rulesQuota is RulesQuota, or DefaultRulesQuota when unset.
+func (s Settings) rulesQuota() int {
+	if s.RulesQuota > 0 {
+		return s.RulesQuota
+	}
+
+	return DefaultRulesQuota
+}
+
+// directions lists the directions to sync, ingress when none are set.
+func (s Settings) directions() []Direction {
+	if len(s.Directions) == 0 {
+		return []Direction{Ingress}
+	}
+
+	return s.Directions
+}
+
+// specs lists the rule specs synced for every target CIDR: rule, then ExtraRules.
+func (s Settings) specs(rule RuleSpec) []RuleSpec {
+	return append([]RuleSpec{rule}, s.ExtraRules...)
+}
+
+// owns matches the rules synced under description.
+func (s Settings) owns(description string) func(string) bool {
+	return s.Match.Owns(description)
+}
+
+// keeps matches the rules PrunePrefix spares: our own and those PruneKeep matches.
+func (s Settings) keeps(description string) func(string) bool {
+	isOwn := s.owns(description)
+	if s.PruneKeep == nil {
+		return isOwn
+	}
+
+	return func(ruleDescription string) bool {
+		return isOwn(ruleDescription) || s.PruneKeep(ruleDescription)
+	}
+}
+
+// adopts reports whether current is a rule only found by its legacy description,
+// which the sync gives the managed-by marker.
+func (s Settings) adopts(description string, current *OwnedRule) bool {
+	return s.Match == MatchLegacy && current != nil && !OwnMarker(description)(current.Description)
+}
+
+// SyncAll syncs every target CIDR into every group, at most settings.MaxConcurrency
+// groups at a time. In remove mode targetCidrs is ignored and the groups' rules for
+// description are revoked instead. groups holds the groups as described during
+// resolution; when nil, every group's rules are described afresh.
+func SyncAll(ctx context.Context, client EC2API, sgIDs []string, groups map[string]types.SecurityGroup, targetCidrs []string, description string, rule RuleSpec, settings Settings) Result {
+	dryRun := settings.DryRun
+	loggerFrom(ctx).Info("Starting rule sync", "groups", len(sgIDs), "region", client.Options().Region)
+
+	var wg sync.WaitGroup
+	errorChannel := make(chan error, len(sgIDs))
+	successCount := 0
+	var results []GroupResult
+	var deleted []string
+	var notAttempted []string
+	durations := make(map[string]time.Duration)
+	var successMu sync.Mutex
+	semaphore := make(chan struct{}, max(settings.MaxConcurrency, 1))
+
+	progress, _ := ctx.Value(progressKey{}).(*Progress)
+	progress.add(len(sgIDs))
+
+	failed, shared := ctx.Value(failFastKey{}).(*atomic.Bool)
+	if settings.FailFast && !shared {
+		ctx = WithFailFast(ctx)
+		failed = ctx.Value(failFastKey{}).(*atomic.Bool)
+	}
+
+	for _, sgID := range sgIDs {
+		wg.Add(1)
+
+		go func(currentSgID string) {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			groupFailed := false
+			defer func() { progress.finish(groupFailed) }()
+
+			var group *types.SecurityGroup
+			if sg, ok := groups[currentSgID]; ok {
+				group = &sg
+			}
+
+			ctx := ctx
+			if sg, ok := settings.described[currentSgID]; ok || group != nil {
+				if !ok {
+					sg = *group
+				}
+
+				ctx = context.WithValue(ctx, groupLabelKey{}, groupLabel{SgID: currentSgID, Name: GroupDisplayName(sg), VpcID: aws.ToString(sg.VpcId)})
+			}
+
+			logger := groupLogger(ctx, client, currentSgID)
+
+			if errors.Is(stopped(ctx), ErrFailFast) {
+				logger.Info("Not syncing, another group failed first")
+				successMu.Lock()
+				results = append(results, GroupResult{SgID: currentSgID, Description: description, DryRun: dryRun, NotAttempted: true})
+				notAttempted = append(notAttempted, currentSgID)
+				successMu.Unlock()
+
+				return
+			}
+
+			logger.Info("Starting sync")
+
+			start := time.Now()
+			var err error
+			skipped := false
+
+			// record keeps a step's result; a step stopped by another group's failure is
+			// not attempted rather than failed.
+			record := func(result GroupResult, stepErr error) {
+				switch {
+				case errors.Is(stepErr, ErrFailFast):
+					result.NotAttempted = true
+					skipped = true
+				case stepErr != nil:
+					err = errors.Join(err, stepErr)
+					result.Err = stepErr
+				}
+
+				successMu.Lock()
+				results = append(results, result)
+				successMu.Unlock()
+			}
+
+			if settings.Remove {
+				for _, direction := range settings.directions() {
+					record(removeSecurityGroupRules(ctx, client, currentSgID, group, description, settings.owns(description), direction, dryRun))
+				}
+			}
+
+			if settings.Allowlist && !settings.Remove {
+				record(syncAllowlist(ctx, client, currentSgID, group, targetCidrs, description, rule, settings))
+			} else {
+				for _, targetCidr := range targetCidrs {
+					for _, direction := range settings.directions() {
+						for _, spec := range settings.specs(rule) {
+							record(syncSecurityGroupRule(ctx, client, currentSgID, group, targetCidr, description, spec, direction, settings))
+						}
+					}
+				}
+			}
+
+			if settings.PrunePrefix != "" {
+				record(pruneSecurityGroupRules(ctx, client, currentSgID, group, settings.PrunePrefix, settings.keeps(description), dryRun))
+			}
+
+			if settings.ExpiredPrefix != "" {
+				record(cleanExpiredRules(ctx, client, currentSgID, group, settings.ExpiredPrefix, dryRun))
+			}
+
+			elapsed := time.Since(start)
+			successMu.Lock()
+			durations[currentSgID] = elapsed
+			successMu.Unlock()
+
+			// A group deleted since it was resolved, e.g. with an ephemeral environment,
+			// has nothing left to sync.
+			if err != nil && !settings.Strict && groupDeleted(err) {
+				logger.Warn("Security group was deleted during the run, skipping it", "error", err)
+				successMu.Lock()
+				deleted = append(deleted, currentSgID)
+
+				for i := range results {
+					if results[i].SgID == currentSgID {
+						results[i].Err = nil
+						results[i].Deleted = true
+					}
+				}
+
+				successMu.Unlock()
+
+				return
+			}
+
+			if err != nil {
+				logger.Error("Sync failed", "error", err, "elapsed", elapsed)
+				errorChannel <- fmt.Errorf("[%s] %w", currentSgID, err)
+				groupFailed = true
+
+				if settings.FailFast && failed.CompareAndSwap(false, true) {
+					logger.Warn("Stopping the other groups after this failure (fail fast)")
+				}
+			} else if skipped {
+				logger.Info("Sync stopped part way, another group failed first")
+				successMu.Lock()
+				notAttempted = append(notAttempted, currentSgID)
+				successMu.Unlock()
+			} else {
+				logger.Info("Sync completed", "elapsed", elapsed)
+				successMu.Lock()
+				successCount++
+				successMu.Unlock()
+			}
+		}(sgID)
+	}
+
+	wg.Wait()
+
+	close(errorChannel)
+
+	var syncErrors []error
+
+	for err := range errorChannel {
+		syncErrors = append(syncErrors, err)
+	}
+
+	// A group's results for the same CIDR stay in the order of the rule specs.
+	slices.SortStableFunc(results, func(a, b GroupResult) int {
+		return strings.Compare(a.SgID+a.TargetCidr, b.SgID+b.TargetCidr)
+	})
+
+	return Result{
+		TargetCidrs:   targetCidrs,
+		Results:       results,
+		Errors:        syncErrors,
+		SuccessCount:  successCount,
+		GroupCount:    len(sgIDs),
+		Rule:          rule,
+		Description:   description,
+		DryRun:        dryRun,
+		Remove:        settings.Remove || settings.ExpiredPrefix != "",
+		PrunePrefix:   settings.PrunePrefix,
+		ExpiredPrefix: settings.ExpiredPrefix,
+		ExtraRules:    settings.ExtraRules,
+		Directions:    settings.directions(),
+		Deleted:       slices.Sorted(slices.Values(deleted)),
+		NotAttempted:  slices.Sorted(slices.Values(notAttempted)),
+		Durations:     durations,
+	}
+}
+
+// ErrFailFast marks the changes left undone because another group failed first
+// with Settings.FailFast.
+var ErrFailFast = errors.New("another group failed first (fail fast)")
+
+type failFastKey struct{}
+
+// WithFailFast returns a context whose SyncAll calls with Settings.FailFast share
+// one failure flag, so the first failure in any of them stops them all. Without
+// it, each SyncAll call only stops its own groups.
+func WithFailFast(ctx context.Context) context.Context {
+	return context.WithValue(ctx, failFastKey{}, new(atomic.Bool))
+}
+
+// stopped returns why no further change may be made: ctx is done, or a group has
+// failed under Settings.FailFast. Calls in flight are not cut short by the latter.
+func stopped(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if failed, ok := ctx.Value(failFastKey{}).(*atomic.Bool); ok && failed.Load() {
+		return ErrFailFast
+	}
+
+	return nil
+}
+
+// Progress counts the groups the SyncAll calls of a context have finished, so a
+// caller can report how far a long run is. Each call adds its groups to the total
+// when it starts, so the total grows as the entries and regions of a run begin.
+type Progress struct {
+	total   atomic.Int64
+	done    atomic.Int64
+	failed  atomic.Int64
+	updates chan struct{}
+}
+
+// NewProgress returns a Progress with nothing counted yet.
+func NewProgress() *Progress {
+	return &Progress{updates: make(chan struct{}, 1)}
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context whose SyncAll calls count their groups in progress.
+func WithProgress(ctx context.Context, progress *Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// Counts returns the groups finished so far, how many of them failed, and the
+// groups to sync in all.
+func (p *Progress) Counts() (done, failed, total int) {
+	return int(p.done.Load()), int(p.failed.Load()), int(p.total.Load())
+}
+
+// Updates receives after groups finish; updates that come while one is pending are
+// merged into it.
+func (p *Progress) Updates() <-chan struct{} {
+	return p.updates
+}
+
+// add counts groups to sync; a nil Progress counts nothing.
+func (p *Progress) add(count int) {
+	if p != nil {
+		p.total.Add(int64(count))
+	}
+}
+
+// finish counts a finished group, failed or not; a nil Progress counts nothing.
+func (p *Progress) finish(failed bool) {
+	if p == nil {
+		return
+	}
+
+	if failed {
+		p.failed.Add(1)
+	}
+
+	p.done.Add(1)
+
+	select {
+	case p.updates <- struct{}{}:
+	default:
+	}
+}
+
+type loggerKey struct{}
+
+// loggerFrom returns the logger Sync was given, or the default logger when the
+// package is used without one.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// CandidateGroups lists the groups an interactive selection offers: those matching
+// the target's tags and VPC, or every group in the region without them, sorted by
+// ID. With OwnerID set, groups owned by other accounts are left out.
+func CandidateGroups(ctx context.Context, client EC2API, target Target) ([]types.SecurityGroup, error) {
+	filters := append(tagFilters(target.SgTagNames, target.SgTags), vpcFilter(target.VpcID)...)
+
+	matches, _, err := describeSecurityGroupsWithFilters(ctx, client, filters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Security Groups: %w", err)
+	}
+
+	groups := make([]types.SecurityGroup, 0, len(matches))
+
+	for _, id := range slices.Sorted(maps.Keys(matches)) {
+		if target.OwnerID == "" || aws.ToString(matches[id].OwnerId) == target.OwnerID {
+			groups = append(groups, matches[id])
+		}
+	}
+
+	return groups, nil
+}
+
+// Resolved is a Target's groups in one region, after the guardrails.
+type Resolved struct {
+	GroupIDs   []string
+	Groups     map[string]types.SecurityGroup
+	Resolution ResolutionStats
+	// Skipped lists groups that were selected but dropped by the guardrails.
+	Skipped []string
+	// Violations are guardrail failures reported as errors in strict mode.
+	Violations []error
+}
+
+// Resolve finds the groups target selects in the client's region and applies
+// guards to them. With allowMissing, explicit IDs absent from the region are not an
+// error, for runs that span several regions.
+func Resolve(ctx context.Context, client EC2API, elbClient ELBAPI, target Target, allowMissing bool, guards Guardrails) (Resolved, error) {
+	region := client.Options().Region
+
+	groups, resolution, err := FindSecurityGroups(ctx, client, elbClient, target, allowMissing)
+	if err != nil {
+		return Resolved{}, err
+	}
+
+	resolved := Resolved{Groups: make(map[string]types.SecurityGroup), Resolution: resolution}
+
+	groups, resolved.Skipped, resolved.Violations = guards.Apply(ctx, region, groups)
+	resolved.Resolution.Skipped = len(resolved.Skipped)
+
+	for _, sg := range groups {
+		id := aws.ToString(sg.GroupId)
+		resolved.GroupIDs = append(resolved.GroupIDs, id)
+		resolved.Groups[id] = sg
+	}
+
+	if len(resolved.GroupIDs) > 0 {
+		loggerFrom(ctx).Info("Resolved Security Groups to process", "region", region, "entry", target.Name, "count", len(resolved.GroupIDs), "sg_ids", strings.Join(resolved.GroupIDs, ", "))
+	}
+
+	return resolved, nil
+}
+
+// SyncResolved syncs the groups of an earlier Resolve of target. With reuseGroups
+// the rules described during resolution are used; otherwise, as when the same
+// resolution serves several runs, every group is described afresh.
+func SyncResolved(ctx context.Context, client EC2API, target Target, resolved Resolved, targetCidrs []string, settings Settings, reuseGroups bool) Result {
+	var groups map[string]types.SecurityGroup
+	if reuseGroups {
+		groups = resolved.Groups
+	}
+
+	settings.ExtraRules = target.ExtraRules
+	settings.described = resolved.Groups
+	result := SyncAll(ctx, client, resolved.GroupIDs, groups, targetCidrs, target.Description, target.Rule, settings)
+	result.Name = target.Name
+	result.Resolution = resolved.Resolution
+	result.Region = client.Options().Region
+	result.Interrupted = ctx.Err() != nil
+	result.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	result.Errors = append(result.Errors, resolved.Violations...)
+
+	for i := range result.Results {
+		group := resolved.Groups[result.Results[i].SgID]
+		result.Results[i].VpcID = aws.ToString(group.VpcId)
+		result.Results[i].GroupName = GroupDisplayName(group)
+	}
+
+	return result
+}
+
+// Options configures Sync: the groups and rule of Target, the CIDRs to allow in
+// them, and how the change is made.
+type Options struct {
+	Target
+	Settings
+	// TargetCidrs are the CIDRs to allow, usually HostCIDR of the public IP.
+	TargetCidrs []string
+	Guardrails  Guardrails
+	// Logger receives every message of the sync; slog.Default() when nil.
+	Logger *slog.Logger
+}
+
+// Sync resolves the groups opts selects in the region of cfg and keeps the rule for
+// opts.TargetCidrs current in each. The error is only set when the groups cannot be
+// resolved: a group that fails to sync does not stop the others, and is reported in
+// Result.Errors.
+func Sync(ctx context.Context, cfg aws.Config, opts Options) (Result, error) {
+	if opts.Logger != nil {
+		ctx = context.WithValue(ctx, loggerKey{}, opts.Logger)
+	}
+
+	client := ec2.NewFromConfig(cfg)
+
+	resolved, err := Resolve(ctx, client, elasticloadbalancingv2.NewFromConfig(cfg), opts.Target, false, opts.Guardrails)
+	if err != nil {
+		return Result{}, fmt.Errorf("resolving Security Group identifiers: %w", err)
+	}
+
+	return SyncResolved(ctx, client, opts.Target, resolved, opts.TargetCidrs, opts.Settings, true), nil
+}
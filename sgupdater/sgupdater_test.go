@@ -0,0 +1,982 @@
+package sgupdater
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	lightsailtypes "github.com/aws/aws-sdk-go-v2/service/lightsail/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeEC2 is an in-memory EC2API holding groups and their rules. Every call is
+// recorded in calls, and a call whose operation has an entry in errs fails with it
+// without changing anything. With pageSize set, DescribeSecurityGroups returns
+// that many groups per page. Methods it does not implement panic through the nil
+// embedded interface.
+type fakeEC2 struct {
+	EC2API
+
+	mu       sync.Mutex
+	groups   []types.SecurityGroup
+	rules    []types.SecurityGroupRule
+	pageSize int
+	errs     map[string]error
+	calls    []string
+	nextID   int
+}
+
+func (f *fakeEC2) call(operation string) error {
+	f.calls = append(f.calls, operation)
+	return f.errs[operation]
+}
+
+func (f *fakeEC2) Options() ec2.Options {
+	return ec2.Options{Region: "us-east-1"}
+}
+
+// DescribeSecurityGroups pages through every group, ignoring the filters but for
+// group-id.
+func (f *fakeEC2) DescribeSecurityGroups(_ context.Context, params *ec2.DescribeSecurityGroupsInput, _ ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeSecurityGroups"); err != nil {
+		return nil, err
+	}
+
+	var groupIDs []string
+	for _, filter := range params.Filters {
+		if aws.ToString(filter.Name) == "group-id" {
+			groupIDs = filter.Values
+		}
+	}
+
+	var groups []types.SecurityGroup
+	for _, group := range f.groups {
+		if groupIDs == nil || slices.Contains(groupIDs, aws.ToString(group.GroupId)) {
+			groups = append(groups, group)
+		}
+	}
+
+	start, _ := strconv.Atoi(aws.ToString(params.NextToken))
+	end := len(groups)
+
+	out := &ec2.DescribeSecurityGroupsOutput{}
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+
+	out.SecurityGroups = groups[start:end]
+
+	return out, nil
+}
+
+func (f *fakeEC2) DescribeSecurityGroupRules(_ context.Context, params *ec2.DescribeSecurityGroupRulesInput, _ ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeSecurityGroupRules"); err != nil {
+		return nil, err
+	}
+
+	var groupIDs []string
+	for _, filter := range params.Filters {
+		if aws.ToString(filter.Name) == "group-id" {
+			groupIDs = filter.Values
+		}
+	}
+
+	out := &ec2.DescribeSecurityGroupRulesOutput{}
+	for _, rule := range f.rules {
+		if groupIDs == nil || slices.Contains(groupIDs, aws.ToString(rule.GroupId)) {
+			out.SecurityGroupRules = append(out.SecurityGroupRules, rule)
+		}
+	}
+
+	return out, nil
+}
+
+// authorize adds a rule per range of perms and returns them as EC2 would.
+func (f *fakeEC2) authorize(groupID *string, egress bool, perms []types.IpPermission) []types.SecurityGroupRule {
+	var created []types.SecurityGroupRule
+
+	for _, perm := range perms {
+		rule := types.SecurityGroupRule{GroupId: groupID, IsEgress: aws.Bool(egress), IpProtocol: perm.IpProtocol, FromPort: perm.FromPort, ToPort: perm.ToPort}
+
+		for _, ipRange := range perm.IpRanges {
+			f.nextID++
+			rule.SecurityGroupRuleId = aws.String("sgr-new" + strconv.Itoa(f.nextID))
+			rule.CidrIpv4, rule.Description = ipRange.CidrIp, ipRange.Description
+			created = append(created, rule)
+		}
+
+		for _, ipRange := range perm.Ipv6Ranges {
+			f.nextID++
+			rule.SecurityGroupRuleId = aws.String("sgr-new" + strconv.Itoa(f.nextID))
+			rule.CidrIpv4, rule.CidrIpv6, rule.Description = nil, ipRange.CidrIpv6, ipRange.Description
+			created = append(created, rule)
+		}
+	}
+
+	f.rules = append(f.rules, created...)
+
+	return created
+}
+
+func (f *fakeEC2) AuthorizeSecurityGroupIngress(_ context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, _ ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("AuthorizeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+
+	return &ec2.AuthorizeSecurityGroupIngressOutput{SecurityGroupRules: f.authorize(params.GroupId, false, params.IpPermissions)}, nil
+}
+
+func (f *fakeEC2) AuthorizeSecurityGroupEgress(_ context.Context, params *ec2.AuthorizeSecurityGroupEgressInput, _ ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupEgressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("AuthorizeSecurityGroupEgress"); err != nil {
+		return nil, err
+	}
+
+	return &ec2.AuthorizeSecurityGroupEgressOutput{SecurityGroupRules: f.authorize(params.GroupId, true, params.IpPermissions)}, nil
+}
+
+// revoke drops the rules with these IDs.
+func (f *fakeEC2) revoke(ruleIDs []string) {
+	f.rules = slices.DeleteFunc(f.rules, func(rule types.SecurityGroupRule) bool {
+		return slices.Contains(ruleIDs, aws.ToString(rule.SecurityGroupRuleId))
+	})
+}
+
+func (f *fakeEC2) RevokeSecurityGroupIngress(_ context.Context, params *ec2.RevokeSecurityGroupIngressInput, _ ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("RevokeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+
+	f.revoke(params.SecurityGroupRuleIds)
+
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeEC2) RevokeSecurityGroupEgress(_ context.Context, params *ec2.RevokeSecurityGroupEgressInput, _ ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupEgressOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("RevokeSecurityGroupEgress"); err != nil {
+		return nil, err
+	}
+
+	f.revoke(params.SecurityGroupRuleIds)
+
+	return &ec2.RevokeSecurityGroupEgressOutput{}, nil
+}
+
+func (f *fakeEC2) ModifySecurityGroupRules(_ context.Context, params *ec2.ModifySecurityGroupRulesInput, _ ...func(*ec2.Options)) (*ec2.ModifySecurityGroupRulesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ModifySecurityGroupRules"); err != nil {
+		return nil, err
+	}
+
+	for _, update := range params.SecurityGroupRules {
+		for i, rule := range f.rules {
+			if aws.ToString(rule.SecurityGroupRuleId) == aws.ToString(update.SecurityGroupRuleId) {
+				request := update.SecurityGroupRule
+				f.rules[i].IpProtocol, f.rules[i].FromPort, f.rules[i].ToPort = request.IpProtocol, request.FromPort, request.ToPort
+				f.rules[i].CidrIpv4, f.rules[i].CidrIpv6, f.rules[i].Description = request.CidrIpv4, request.CidrIpv6, request.Description
+			}
+		}
+	}
+
+	return &ec2.ModifySecurityGroupRulesOutput{Return: aws.Bool(true)}, nil
+}
+
+// cidrs lists the CIDRs of the fake's rules, in order.
+func (f *fakeEC2) cidrs() []string {
+	var cidrs []string
+
+	for _, rule := range f.rules {
+		cidrs = append(cidrs, aws.ToString(rule.CidrIpv4)+aws.ToString(rule.CidrIpv6))
+	}
+
+	return cidrs
+}
+
+// ruleSummaries lists the fake's rules as "id cidr", with " egress" for egress ones.
+func (f *fakeEC2) ruleSummaries() []string {
+	var summaries []string
+
+	for _, rule := range f.rules {
+		summary := aws.ToString(rule.SecurityGroupRuleId) + " " + aws.ToString(rule.CidrIpv4)
+		if aws.ToBool(rule.IsEgress) {
+			summary += " egress"
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries
+}
+
+func apiError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: code}
+}
+
+// ingressRule is a tcp rule of sg-1 as DescribeSecurityGroupRules returns it.
+func ingressRule(id, cidr, description string, port int32) types.SecurityGroupRule {
+	return types.SecurityGroupRule{
+		SecurityGroupRuleId: aws.String(id),
+		GroupId:             aws.String("sg-1"),
+		IsEgress:            aws.Bool(false),
+		IpProtocol:          aws.String("tcp"),
+		FromPort:            aws.Int32(port),
+		ToPort:              aws.Int32(port),
+		CidrIpv4:            aws.String(cidr),
+		Description:         aws.String(description),
+	}
+}
+
+// egressRule is ingressRule as an egress rule.
+func egressRule(id, cidr, description string, port int32) types.SecurityGroupRule {
+	rule := ingressRule(id, cidr, description, port)
+	rule.IsEgress = aws.Bool(true)
+
+	return rule
+}
+
+func ownedRule(id, cidr string, port int32) OwnedRule {
+	return ownedRuleFromSecurityGroupRule(ingressRule(id, cidr, "laptop", port))
+}
+
+func ruleIDs(rules []OwnedRule) []string {
+	var ids []string
+
+	for _, rule := range rules {
+		ids = append(ids, rule.RuleID)
+	}
+
+	return ids
+}
+
+func ruleID(rule *OwnedRule) string {
+	if rule == nil {
+		return ""
+	}
+
+	return rule.RuleID
+}
+
+var ssh = portRule("tcp", 22)
+
+func TestSplitOwnedRules(t *testing.T) {
+	ipv6 := ownedRuleFromSecurityGroupRule(types.SecurityGroupRule{SecurityGroupRuleId: aws.String("sgr-v6"), IpProtocol: aws.String("tcp"), FromPort: aws.Int32(22), ToPort: aws.Int32(22), CidrIpv6: aws.String("2001:db8::1/128")})
+
+	tests := []struct {
+		name        string
+		rules       []OwnedRule
+		wantCurrent string
+		wantStale   []string
+	}{
+		{"no rules", nil, "", nil},
+		{"current rule", []OwnedRule{ownedRule("sgr-1", "203.0.113.1/32", 22)}, "sgr-1", nil},
+		{"outdated IP", []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22)}, "", []string{"sgr-1"}},
+		{"right IP, other port", []OwnedRule{ownedRule("sgr-1", "203.0.113.1/32", 443)}, "", []string{"sgr-1"}},
+		{"duplicate of the current rule", []OwnedRule{ownedRule("sgr-1", "203.0.113.1/32", 22), ownedRule("sgr-2", "203.0.113.1/32", 22)}, "sgr-1", []string{"sgr-2"}},
+		{"other family skipped", []OwnedRule{ipv6, ownedRule("sgr-1", "198.51.100.1/32", 22)}, "", []string{"sgr-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, stale := splitOwnedRules(tt.rules, false, ssh, "203.0.113.1/32")
+
+			if got := ruleID(current); got != tt.wantCurrent {
+				t.Errorf("current = %q, want %q", got, tt.wantCurrent)
+			}
+
+			if got := ruleIDs(stale); !slices.Equal(got, tt.wantStale) {
+				t.Errorf("stale = %v, want %v", got, tt.wantStale)
+			}
+		})
+	}
+}
+
+func TestClaimRules(t *testing.T) {
+	https := portRule("tcp", 443)
+	dns := portRule("udp", 53)
+
+	tests := []struct {
+		name  string
+		rules []OwnedRule
+		rule  RuleSpec
+		specs []RuleSpec
+		want  []string
+	}{
+		{
+			name:  "single spec keeps every rule",
+			rules: []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22), ownedRule("sgr-2", "198.51.100.1/32", 80)},
+			rule:  ssh,
+			specs: []RuleSpec{ssh},
+			want:  []string{"sgr-1", "sgr-2"},
+		},
+		{
+			name:  "each spec claims its own rule",
+			rules: []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22), ownedRule("sgr-2", "198.51.100.1/32", 443)},
+			rule:  https,
+			specs: []RuleSpec{ssh, https},
+			want:  []string{"sgr-2"},
+		},
+		{
+			name:  "orphan goes to the first spec without a rule",
+			rules: []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22), ownedRule("sgr-2", "198.51.100.1/32", 80)},
+			rule:  https,
+			specs: []RuleSpec{ssh, https, dns},
+			want:  []string{"sgr-2"},
+		},
+		{
+			name:  "orphans left over go to the last spec",
+			rules: []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22), ownedRule("sgr-2", "198.51.100.1/32", 443), ownedRule("sgr-3", "198.51.100.1/32", 80)},
+			rule:  https,
+			specs: []RuleSpec{ssh, https},
+			want:  []string{"sgr-2", "sgr-3"},
+		},
+		{
+			name:  "spec with no rule and no orphan claims nothing",
+			rules: []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22)},
+			rule:  https,
+			specs: []RuleSpec{ssh, https},
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ruleIDs(claimRules(tt.rules, false, tt.rule, tt.specs)); !slices.Equal(got, tt.want) {
+				t.Errorf("claimRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateOwnedRules(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	waiting := ownedRule("sgr-3", "198.51.100.3/32", 22)
+	waiting.Description = withMarker("laptop", revokeAfterMarker, now.Add(time.Hour))
+	expired := ownedRule("sgr-4", "198.51.100.4/32", 22)
+	expired.Description = withMarker("laptop", revokeAfterMarker, now.Add(-time.Hour))
+
+	tests := []struct {
+		name        string
+		rules       []OwnedRule
+		grace       time.Duration
+		wantCurrent string
+		wantModify  string
+		wantRevoke  []string
+		wantDefer   []string
+		wantAdd     bool
+		wantDiff    []string
+	}{
+		{
+			name:     "no matching permission",
+			wantAdd:  true,
+			wantDiff: []string{"+ tcp 22 from 203.0.113.1/32"},
+		},
+		{
+			name:        "already current",
+			rules:       []OwnedRule{ownedRule("sgr-1", "203.0.113.1/32", 22)},
+			wantCurrent: "sgr-1",
+			wantDiff:    []string{"  tcp 22 from 203.0.113.1/32"},
+		},
+		{
+			name:       "outdated IP is replaced in place",
+			rules:      []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22)},
+			wantModify: "sgr-1",
+			wantDiff:   []string{"- tcp 22 from 198.51.100.1/32", "+ tcp 22 from 203.0.113.1/32"},
+		},
+		{
+			name:       "rule with the configured ports is the one modified",
+			rules:      []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 80), ownedRule("sgr-2", "198.51.100.2/32", 22)},
+			wantModify: "sgr-2",
+			wantRevoke: []string{"sgr-1"},
+			wantDiff:   []string{"- tcp 22 from 198.51.100.2/32", "+ tcp 22 from 203.0.113.1/32", "- tcp 80 from 198.51.100.1/32"},
+		},
+		{
+			name:        "stale rules revoked next to the current one",
+			rules:       []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22), ownedRule("sgr-2", "203.0.113.1/32", 22)},
+			wantCurrent: "sgr-2",
+			wantRevoke:  []string{"sgr-1"},
+			wantDiff:    []string{"  tcp 22 from 203.0.113.1/32", "- tcp 22 from 198.51.100.1/32"},
+		},
+		{
+			name:       "grace period defers instead of modifying",
+			rules:      []OwnedRule{ownedRule("sgr-1", "198.51.100.1/32", 22), waiting, expired},
+			grace:      time.Hour,
+			wantAdd:    true,
+			wantDefer:  []string{"sgr-1"},
+			wantRevoke: []string{"sgr-4"},
+			wantDiff: []string{
+				"  tcp 22 from 198.51.100.3/32 (revoked after 2024-06-01T13:00Z)",
+				"  tcp 22 from 198.51.100.1/32 (kept until 2024-06-01T13:00Z)",
+				"- tcp 22 from 198.51.100.4/32",
+				"+ tcp 22 from 203.0.113.1/32",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eval := evaluateOwnedRules(tt.rules, false, ssh, "203.0.113.1/32", tt.grace, now)
+
+			if got := ruleID(eval.Current); got != tt.wantCurrent {
+				t.Errorf("Current = %q, want %q", got, tt.wantCurrent)
+			}
+
+			if got := ruleID(eval.Modify); got != tt.wantModify {
+				t.Errorf("Modify = %q, want %q", got, tt.wantModify)
+			}
+
+			if got := ruleIDs(eval.Revoke); !slices.Equal(got, tt.wantRevoke) {
+				t.Errorf("Revoke = %v, want %v", got, tt.wantRevoke)
+			}
+
+			if got := ruleIDs(eval.Defer); !slices.Equal(got, tt.wantDefer) {
+				t.Errorf("Defer = %v, want %v", got, tt.wantDefer)
+			}
+
+			if eval.NeedsAdd != tt.wantAdd {
+				t.Errorf("NeedsAdd = %v, want %v", eval.NeedsAdd, tt.wantAdd)
+			}
+
+			var diff []string
+			for _, change := range eval.Diff {
+				diff = append(diff, change.String())
+			}
+
+			if !slices.Equal(diff, tt.wantDiff) {
+				t.Errorf("Diff = %q, want %q", diff, tt.wantDiff)
+			}
+		})
+	}
+}
+
+func TestSyncSecurityGroupRule(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []types.SecurityGroupRule
+		errs       map[string]error
+		wantCalls  []string
+		wantAction Action
+		wantCidrs  []string
+	}{
+		{
+			name:       "outdated IP is replaced",
+			rules:      []types.SecurityGroupRule{ingressRule("sgr-1", "198.51.100.1/32", "laptop", 22)},
+			wantCalls:  []string{"DescribeSecurityGroupRules", "ModifySecurityGroupRules"},
+			wantAction: ActionUpdated,
+			wantCidrs:  []string{"203.0.113.1/32"},
+		},
+		{
+			name:       "duplicate on authorize is not a failure",
+			errs:       map[string]error{"AuthorizeSecurityGroupIngress": apiError("InvalidPermission.Duplicate")},
+			wantCalls:  []string{"DescribeSecurityGroupRules", "AuthorizeSecurityGroupIngress"},
+			wantAction: ActionAdded,
+		},
+		{
+			name: "rule already gone on revoke is not a failure",
+			rules: []types.SecurityGroupRule{
+				ingressRule("sgr-1", "198.51.100.1/32", "laptop", 22),
+				ingressRule("sgr-2", "198.51.100.2/32", "laptop", 22),
+			},
+			errs:       map[string]error{"RevokeSecurityGroupIngress": apiError("InvalidPermission.NotFound")},
+			wantCalls:  []string{"DescribeSecurityGroupRules", "ModifySecurityGroupRules", "RevokeSecurityGroupIngress"},
+			wantAction: ActionUpdated,
+			wantCidrs:  []string{"203.0.113.1/32", "198.51.100.2/32"},
+		},
+		{
+			name:       "group with no matching permission",
+			rules:      []types.SecurityGroupRule{ingressRule("sgr-1", "198.51.100.1/32", "someone-else", 22)},
+			wantCalls:  []string{"DescribeSecurityGroupRules", "AuthorizeSecurityGroupIngress"},
+			wantAction: ActionAdded,
+			wantCidrs:  []string{"198.51.100.1/32", "203.0.113.1/32"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeEC2{rules: tt.rules, errs: tt.errs}
+
+			result, err := syncSecurityGroupRule(context.Background(), client, "sg-1", nil, "203.0.113.1/32", "laptop", ssh, Ingress, Settings{})
+			if err != nil {
+				t.Fatalf("syncSecurityGroupRule() error = %v", err)
+			}
+
+			if len(result.Warnings) > 0 {
+				t.Errorf("Warnings = %q, want none", result.Warnings)
+			}
+
+			if !slices.Equal(client.calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", client.calls, tt.wantCalls)
+			}
+
+			if got := result.Action(); got != tt.wantAction {
+				t.Errorf("Action() = %q, want %q", got, tt.wantAction)
+			}
+
+			if got := client.cidrs(); !slices.Equal(got, tt.wantCidrs) {
+				t.Errorf("rules left = %v, want %v", got, tt.wantCidrs)
+			}
+		})
+	}
+}
+
+func TestSyncLeavesOtherDirection(t *testing.T) {
+	tests := []struct {
+		name      string
+		direction Direction
+		rules     []types.SecurityGroupRule
+		wantCalls []string
+		wantRules []string
+	}{
+		{
+			name:      "ingress authorized next to an egress rule",
+			direction: Ingress,
+			rules:     []types.SecurityGroupRule{egressRule("sgr-out", "198.51.100.1/32", "laptop", 22)},
+			wantCalls: []string{"DescribeSecurityGroupRules", "AuthorizeSecurityGroupIngress"},
+			wantRules: []string{"sgr-out 198.51.100.1/32 egress", "sgr-new1 203.0.113.1/32"},
+		},
+		{
+			name:      "egress authorized next to an ingress rule",
+			direction: Egress,
+			rules:     []types.SecurityGroupRule{ingressRule("sgr-in", "198.51.100.1/32", "laptop", 22)},
+			wantCalls: []string{"DescribeSecurityGroupRules", "AuthorizeSecurityGroupEgress"},
+			wantRules: []string{"sgr-in 198.51.100.1/32", "sgr-new1 203.0.113.1/32 egress"},
+		},
+		{
+			name:      "ingress duplicates revoked, egress kept",
+			direction: Ingress,
+			rules: []types.SecurityGroupRule{
+				ingressRule("sgr-in1", "198.51.100.1/32", "laptop", 22),
+				ingressRule("sgr-in2", "198.51.100.2/32", "laptop", 22),
+				egressRule("sgr-out", "198.51.100.3/32", "laptop", 22),
+			},
+			wantCalls: []string{"DescribeSecurityGroupRules", "ModifySecurityGroupRules", "RevokeSecurityGroupIngress"},
+			wantRules: []string{"sgr-in1 203.0.113.1/32", "sgr-out 198.51.100.3/32 egress"},
+		},
+		{
+			name:      "egress duplicates revoked, ingress kept",
+			direction: Egress,
+			rules: []types.SecurityGroupRule{
+				ingressRule("sgr-in", "198.51.100.3/32", "laptop", 22),
+				egressRule("sgr-out1", "198.51.100.1/32", "laptop", 22),
+				egressRule("sgr-out2", "198.51.100.2/32", "laptop", 22),
+			},
+			wantCalls: []string{"DescribeSecurityGroupRules", "ModifySecurityGroupRules", "RevokeSecurityGroupEgress"},
+			wantRules: []string{"sgr-in 198.51.100.3/32", "sgr-out1 203.0.113.1/32 egress"},
+		},
+		{
+			name:      "current ingress rule, egress left outdated",
+			direction: Ingress,
+			rules: []types.SecurityGroupRule{
+				ingressRule("sgr-in", "203.0.113.1/32", "laptop", 22),
+				egressRule("sgr-out", "198.51.100.1/32", "laptop", 22),
+			},
+			wantCalls: []string{"DescribeSecurityGroupRules"},
+			wantRules: []string{"sgr-in 203.0.113.1/32", "sgr-out 198.51.100.1/32 egress"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeEC2{rules: tt.rules}
+
+			if _, err := syncSecurityGroupRule(context.Background(), client, "sg-1", nil, "203.0.113.1/32", "laptop", ssh, tt.direction, Settings{}); err != nil {
+				t.Fatalf("syncSecurityGroupRule() error = %v", err)
+			}
+
+			if !slices.Equal(client.calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", client.calls, tt.wantCalls)
+			}
+
+			if got := client.ruleSummaries(); !slices.Equal(got, tt.wantRules) {
+				t.Errorf("rules left = %v, want %v", got, tt.wantRules)
+			}
+		})
+	}
+}
+
+func TestRevokeMatchingRulesLeavesOtherDirection(t *testing.T) {
+	rules := []types.SecurityGroupRule{
+		ingressRule("sgr-in", "198.51.100.1/32", "laptop", 22),
+		egressRule("sgr-out", "198.51.100.2/32", "laptop", 22),
+	}
+
+	tests := []struct {
+		name      string
+		egress    bool
+		wantCalls []string
+		wantRules []string
+	}{
+		{"ingress", false, []string{"DescribeSecurityGroupRules", "RevokeSecurityGroupIngress"}, []string{"sgr-out 198.51.100.2/32 egress"}},
+		{"egress", true, []string{"DescribeSecurityGroupRules", "RevokeSecurityGroupEgress"}, []string{"sgr-in 198.51.100.1/32"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeEC2{rules: slices.Clone(rules)}
+			result := GroupResult{SgID: "sg-1", Description: "laptop", Egress: tt.egress}
+
+			result, err := revokeMatchingRules(context.Background(), client, nil, result, MatchExact.Owns("laptop"))
+			if err != nil {
+				t.Fatalf("revokeMatchingRules() error = %v", err)
+			}
+
+			if !slices.Equal(client.calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", client.calls, tt.wantCalls)
+			}
+
+			if got := client.ruleSummaries(); !slices.Equal(got, tt.wantRules) {
+				t.Errorf("rules left = %v, want %v", got, tt.wantRules)
+			}
+
+			if len(result.RevokeCidrs) != 1 {
+				t.Errorf("RevokeCidrs = %v, want one", result.RevokeCidrs)
+			}
+		})
+	}
+}
+
+func TestSyncAllGroupDeleted(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      bool
+		wantDeleted []string
+		wantErrors  int
+		wantAction  Action
+	}{
+		{"skipped", false, []string{"sg-1"}, 0, ActionSkippedDeleted},
+		{"strict", true, nil, 1, ActionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The group is gone by the time its rule is authorized: its rules were
+			// described as none, as for a group deleted right after resolution.
+			client := &fakeEC2{errs: map[string]error{"AuthorizeSecurityGroupIngress": apiError("InvalidGroup.NotFound")}}
+
+			result := SyncAll(context.Background(), client, []string{"sg-1"}, nil, []string{"203.0.113.1/32"}, "laptop", ssh, Settings{Strict: tt.strict})
+
+			if want := []string{"DescribeSecurityGroupRules", "AuthorizeSecurityGroupIngress"}; !slices.Equal(client.calls, want) {
+				t.Errorf("calls = %v, want %v", client.calls, want)
+			}
+
+			if !slices.Equal(result.Deleted, tt.wantDeleted) {
+				t.Errorf("Deleted = %v, want %v", result.Deleted, tt.wantDeleted)
+			}
+
+			if len(result.Errors) != tt.wantErrors {
+				t.Errorf("Errors = %v, want %d", result.Errors, tt.wantErrors)
+			}
+
+			if result.SuccessCount != 0 {
+				t.Errorf("SuccessCount = %d, want 0", result.SuccessCount)
+			}
+
+			if len(result.Results) != 1 {
+				t.Fatalf("Results = %v, want one", result.Results)
+			}
+
+			if got := result.Results[0].Action(); got != tt.wantAction {
+				t.Errorf("Action() = %q, want %q", got, tt.wantAction)
+			}
+
+			if got := result.Results[0].Deleted; got != !tt.strict {
+				t.Errorf("GroupResult.Deleted = %v, want %v", got, !tt.strict)
+			}
+		})
+	}
+}
+
+func TestDescribeSecurityGroupsWithFiltersPages(t *testing.T) {
+	client := &fakeEC2{pageSize: 2}
+	for i := range 5 {
+		client.groups = append(client.groups, types.SecurityGroup{GroupId: aws.String(fmt.Sprintf("sg-%d", i))})
+	}
+
+	groups, pages, err := describeSecurityGroupsWithFilters(context.Background(), client, tagFilters([]string{"web"}, nil))
+	if err != nil {
+		t.Fatalf("describeSecurityGroupsWithFilters() error = %v", err)
+	}
+
+	if pages != 3 {
+		t.Errorf("pages = %d, want 3", pages)
+	}
+
+	if got := slices.Sorted(maps.Keys(groups)); !slices.Equal(got, []string{"sg-0", "sg-1", "sg-2", "sg-3", "sg-4"}) {
+		t.Errorf("groups = %v, want all five", got)
+	}
+}
+
+func TestGuardrailsApply(t *testing.T) {
+	group := func(id string, tags ...string) types.SecurityGroup {
+		sg := types.SecurityGroup{GroupId: aws.String(id)}
+		for i := 0; i < len(tags); i += 2 {
+			sg.Tags = append(sg.Tags, types.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+		}
+
+		return sg
+	}
+
+	groups := []types.SecurityGroup{
+		group("sg-tagged", "env", "dev"),
+		group("sg-untagged"),
+		group("sg-other-value", "env", "prod"),
+		group("sg-opted-out", "env", "dev", OptOutTagKey, OptOutTagValue),
+	}
+	requireDev := &TagFilter{Key: "env", Value: "dev"}
+
+	tests := []struct {
+		name           string
+		guards         Guardrails
+		wantKept       []string
+		wantSkipped    []string
+		wantViolations int
+	}{
+		{
+			name:        "no required tag",
+			wantKept:    []string{"sg-tagged", "sg-untagged", "sg-other-value"},
+			wantSkipped: []string{"sg-opted-out"},
+		},
+		{
+			name:        "required tag",
+			guards:      Guardrails{RequireTag: requireDev},
+			wantKept:    []string{"sg-tagged"},
+			wantSkipped: []string{"sg-untagged", "sg-other-value", "sg-opted-out"},
+		},
+		{
+			name:           "required tag, strict",
+			guards:         Guardrails{RequireTag: requireDev, Strict: true},
+			wantKept:       []string{"sg-tagged"},
+			wantSkipped:    []string{"sg-untagged", "sg-other-value", "sg-opted-out"},
+			wantViolations: 2,
+		},
+		{
+			name:        "required tag, opt-out ignored",
+			guards:      Guardrails{RequireTag: requireDev, IgnoreOptOut: true},
+			wantKept:    []string{"sg-tagged", "sg-opted-out"},
+			wantSkipped: []string{"sg-untagged", "sg-other-value"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, skipped, violations := tt.guards.Apply(context.Background(), "us-east-1", groups)
+
+			var keptIDs []string
+			for _, sg := range kept {
+				keptIDs = append(keptIDs, aws.ToString(sg.GroupId))
+			}
+
+			if !slices.Equal(keptIDs, tt.wantKept) {
+				t.Errorf("kept = %v, want %v", keptIDs, tt.wantKept)
+			}
+
+			if !slices.Equal(skipped, tt.wantSkipped) {
+				t.Errorf("skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+
+			if len(violations) != tt.wantViolations {
+				t.Errorf("violations = %v, want %d", violations, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestMergeLightsailPorts(t *testing.T) {
+	const tcp, udp = lightsailtypes.NetworkProtocolTcp, lightsailtypes.NetworkProtocolUdp
+
+	https := lightsailtypes.InstancePortState{Protocol: tcp, FromPort: 443, ToPort: 443, Cidrs: []string{"0.0.0.0/0"}, Ipv6Cidrs: []string{"::/0"}}
+	wireguard := lightsailtypes.InstancePortState{Protocol: udp, FromPort: 51820, ToPort: 51820, Cidrs: []string{"198.51.100.0/24"}, CidrListAliases: []string{"lightsail-connect"}}
+	sshState := lightsailtypes.InstancePortState{Protocol: tcp, FromPort: 22, ToPort: 22, Cidrs: []string{"203.0.113.1/32", "192.0.2.7/32"}, Ipv6Cidrs: []string{"2001:db8::1/128"}}
+
+	// info is the PortInfo a port state is written back as when it is left alone.
+	info := func(state lightsailtypes.InstancePortState) lightsailtypes.PortInfo {
+		return lightsailtypes.PortInfo{
+			Protocol:        state.Protocol,
+			FromPort:        state.FromPort,
+			ToPort:          state.ToPort,
+			Cidrs:           append([]string{}, state.Cidrs...),
+			Ipv6Cidrs:       append([]string{}, state.Ipv6Cidrs...),
+			CidrListAliases: append([]string{}, state.CidrListAliases...),
+		}
+	}
+
+	tests := []struct {
+		name        string
+		states      []lightsailtypes.InstancePortState
+		targetCidrs []string
+		stale       []string
+		want        []lightsailtypes.PortInfo
+	}{
+		{
+			name:        "unrelated port states unchanged",
+			states:      []lightsailtypes.InstancePortState{https, sshState, wireguard},
+			targetCidrs: []string{"203.0.113.1/32"},
+			want:        []lightsailtypes.PortInfo{info(https), info(sshState), info(wireguard)},
+		},
+		{
+			name:        "stale CIDRs dropped from the matching state only",
+			states:      []lightsailtypes.InstancePortState{https, sshState},
+			targetCidrs: []string{"203.0.113.9/32", "2001:db8::9/128"},
+			stale:       []string{"203.0.113.1/32", "2001:db8::1/128", "0.0.0.0/0"},
+			want: []lightsailtypes.PortInfo{
+				info(https),
+				{Protocol: tcp, FromPort: 22, ToPort: 22, Cidrs: []string{"192.0.2.7/32", "203.0.113.9/32"}, Ipv6Cidrs: []string{"2001:db8::9/128"}, CidrListAliases: []string{}},
+			},
+		},
+		{
+			name:   "empty CIDR lists stay non-nil",
+			states: []lightsailtypes.InstancePortState{sshState},
+			stale:  []string{"203.0.113.1/32", "192.0.2.7/32", "2001:db8::1/128"},
+			want:   []lightsailtypes.PortInfo{{Protocol: tcp, FromPort: 22, ToPort: 22, Cidrs: []string{}, Ipv6Cidrs: []string{}, CidrListAliases: []string{}}},
+		},
+		{
+			name:        "state appended when nothing matches",
+			states:      []lightsailtypes.InstancePortState{https},
+			targetCidrs: []string{"203.0.113.9/32"},
+			want: []lightsailtypes.PortInfo{
+				info(https),
+				{Protocol: tcp, FromPort: 22, ToPort: 22, Cidrs: []string{"203.0.113.9/32"}, Ipv6Cidrs: []string{}, CidrListAliases: []string{}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeLightsailPorts(tt.states, tcp, 22, 22, tt.targetCidrs, tt.stale)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeLightsailPorts() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokeRuleIDs(t *testing.T) {
+	client := &fakeEC2{rules: []types.SecurityGroupRule{
+		// A rule with our description that was there before the run.
+		ingressRule("sgr-1", "198.51.100.1/32", "laptop", 22),
+		// The rule the run authorized.
+		ingressRule("sgr-2", "203.0.113.1/32", "laptop", 22),
+		ingressRule("sgr-3", "192.0.2.1/32", "someone-else", 22),
+	}}
+
+	// sgr-9 was revoked since it was recorded.
+	result, err := RevokeRuleIDs(context.Background(), client, "sg-1", "laptop", false, []string{"sgr-2", "sgr-9"})
+	if err != nil {
+		t.Fatalf("RevokeRuleIDs() error = %v", err)
+	}
+
+	if !slices.Equal(result.RevokeCidrs, []string{"203.0.113.1/32"}) {
+		t.Errorf("RevokeCidrs = %v, want [203.0.113.1/32]", result.RevokeCidrs)
+	}
+
+	if want := []string{"DescribeSecurityGroupRules", "RevokeSecurityGroupIngress"}; !slices.Equal(client.calls, want) {
+		t.Errorf("calls = %v, want %v", client.calls, want)
+	}
+
+	if got, want := client.cidrs(), []string{"198.51.100.1/32", "192.0.2.1/32"}; !slices.Equal(got, want) {
+		t.Errorf("rules left = %v, want %v", got, want)
+	}
+
+	// Nothing is revoked once every recorded rule is gone.
+	client.calls = nil
+
+	if _, err := RevokeRuleIDs(context.Background(), client, "sg-1", "laptop", false, []string{"sgr-2"}); err != nil {
+		t.Fatalf("RevokeRuleIDs() error = %v", err)
+	}
+
+	if want := []string{"DescribeSecurityGroupRules"}; !slices.Equal(client.calls, want) {
+		t.Errorf("calls = %v, want %v", client.calls, want)
+	}
+}
+
+func TestPlanAllowlist(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []OwnedRule
+		cidrs []string
+		want  []string
+	}{
+		{
+			name:  "empty group",
+			cidrs: []string{"10.0.0.0/8", "192.0.2.0/24"},
+			want:  []string{"+ tcp 22 from 10.0.0.0/8", "+ tcp 22 from 192.0.2.0/24"},
+		},
+		{
+			name:  "unchanged",
+			rules: []OwnedRule{ownedRule("sgr-1", "10.0.0.0/8", 22), ownedRule("sgr-2", "192.0.2.0/24", 22)},
+			cidrs: []string{"192.0.2.0/24", "10.0.0.0/8"},
+			want:  []string{"  tcp 22 from 10.0.0.0/8", "  tcp 22 from 192.0.2.0/24"},
+		},
+		{
+			name:  "removed from the list",
+			rules: []OwnedRule{ownedRule("sgr-1", "10.0.0.0/8", 22), ownedRule("sgr-2", "192.0.2.0/24", 22)},
+			cidrs: []string{"10.0.0.0/8"},
+			want:  []string{"  tcp 22 from 10.0.0.0/8", "- tcp 22 from 192.0.2.0/24"},
+		},
+		{
+			name:  "added, removed and unchanged",
+			rules: []OwnedRule{ownedRule("sgr-1", "10.0.0.0/8", 22), ownedRule("sgr-2", "192.0.2.0/24", 22)},
+			cidrs: []string{"10.0.0.0/8", "198.51.100.0/24"},
+			want:  []string{"  tcp 22 from 10.0.0.0/8", "- tcp 22 from 192.0.2.0/24", "+ tcp 22 from 198.51.100.0/24"},
+		},
+		{
+			name:  "emptied list",
+			rules: []OwnedRule{ownedRule("sgr-1", "10.0.0.0/8", 22)},
+			want:  []string{"- tcp 22 from 10.0.0.0/8"},
+		},
+		{
+			name:  "listed CIDR on another port is replaced",
+			rules: []OwnedRule{ownedRule("sgr-1", "10.0.0.0/8", 443)},
+			cidrs: []string{"10.0.0.0/8"},
+			want:  []string{"- tcp 443 from 10.0.0.0/8", "+ tcp 22 from 10.0.0.0/8"},
+		},
+		{
+			name:  "duplicate rule and duplicate CIDR",
+			rules: []OwnedRule{ownedRule("sgr-1", "10.0.0.0/8", 22), ownedRule("sgr-2", "10.0.0.0/8", 22)},
+			cidrs: []string{"10.0.0.0/8", "10.0.0.0/8", "192.0.2.0/24", "192.0.2.0/24"},
+			want:  []string{"  tcp 22 from 10.0.0.0/8", "- tcp 22 from 10.0.0.0/8", "+ tcp 22 from 192.0.2.0/24"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, change := range planAllowlist(tt.rules, ssh, tt.cidrs).diff(ssh) {
+				got = append(got, change.String())
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("diff =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}